@@ -277,10 +277,20 @@ func (buf *Buffer) GetPosition() int {
 	return buf.currentPosition
 }
 
+func (buf *Buffer) GetWidth() int {
+	return buf.width
+}
+
 func (buf *Buffer) GetSize() int {
 	return buf.numberOfChars
 }
 
+// ScreenPosition returns the column and line, counted from the first line, pos is displayed at
+func (buf *Buffer) ScreenPosition(pos int) (int, int) {
+	_, x, y, line := buf.findPos(pos)
+	return sliceLength(line.Bytes[:x]), y
+}
+
 func (buf *Buffer) GetDisplayInformation(screenY, height int) (int, int, int, *Line) {
 	if buf.currentY < screenY {
 		screenY = buf.currentY
@@ -43,3 +43,13 @@ func TestStringToBuffer(t *testing.T) {
 	assertEqual(t, len("abcabcabcabcabcabcabcabcabcabcabcdef"), buf.numberOfChars)
 	assertEqual(t, 4, buf.numberOfLines)
 }
+
+func TestScreenPosition(t *testing.T) {
+	buf := StringToBuffer("abc abc\n\tdef def", 10)
+	x, y := buf.ScreenPosition(2)
+	assertEqual(t, 2, x)
+	assertEqual(t, 0, y)
+	x, y = buf.ScreenPosition(9)
+	assertEqual(t, 4, x)
+	assertEqual(t, 1, y)
+}
@@ -5,6 +5,10 @@ import (
 	"github.com/satori/go.uuid"
 )
 
+// first byte of payloads in the binary wire format. It's never the first byte of json
+// and is unused in msgpack so decoders can tell the formats apart
+const BINARY_PAYLOAD_MAGIC = byte(0xc1)
+
 type SiteId [16]byte
 type OperationId [20]byte
 
@@ -37,3 +41,19 @@ func UuidToBytes(id string) []byte {
 	bytesUUID := givenUUID.Bytes()
 	return bytesUUID
 }
+
+// roles of the sites in a network, an empty role means ROLE_EDITOR
+const (
+	ROLE_OWNER  = "owner"  // edits and assigns roles to the others
+	ROLE_EDITOR = "editor" // edits
+	ROLE_VIEWER = "viewer" // only reads, its operations are rejected
+)
+
+// RoleGrant is the role of a site with the signature of the owner that assigned it,
+// see network/roles.go. Keys and signatures are base64 encoded
+type RoleGrant struct {
+	Role      string
+	Version   uint32
+	Signer    string // public key of the site that assigned the role
+	Signature string
+}
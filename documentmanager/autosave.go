@@ -0,0 +1,259 @@
+package documentmanager
+
+import (
+	"../buffer"
+	. "../common"
+	"../treedoc"
+	"../version"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// RecoveryState is the content of a recovery file. Besides the text it keeps
+// the site id and the operation log so the document can rejoin a network
+// as the same site and exchange whatever was missed through anti-entropy
+type RecoveryState struct {
+	DocId       string
+	Name        string `json:",omitempty"`
+	OwnerId     SiteId
+	OpVersion   uint32
+	NodeIdClock uint32
+	Vector      version.VersionVectorJson
+	Text        string
+	Log         []LogEntry
+	Tags        []TagJson
+	// private key of the site, the file must stay private
+	SigningKey []byte `json:",omitempty"`
+	// the role of the site in the network, empty in older files
+	RoleGrant RoleGrant
+	// set on branches, see fork.go
+	ParentDocId string                    `json:",omitempty"`
+	ForkVector  version.VersionVectorJson `json:",omitempty"`
+	// the branch edited instead of the document, if any
+	Branch *RecoveryState `json:",omitempty"`
+}
+
+var ErrCorruptedRecovery = errors.New("recovery: replayed document does not match saved text")
+
+// caller must hold at least the read lock of the model
+func (model *DocumentModel) recoveryState() RecoveryState {
+	log := make([]LogEntry, len(model.Log.Log))
+	copy(log, model.Log.Log)
+	tags := make([]TagJson, 0, len(model.Tags))
+	for _, tag := range model.Tags {
+		tags = append(tags, tag.toJsonable())
+	}
+	var branch *RecoveryState
+	if model.Branch != nil {
+		model.Branch.RLock()
+		state := model.Branch.recoveryState()
+		model.Branch.RUnlock()
+		branch = &state
+	}
+	return RecoveryState{
+		DocId:       model.DocId,
+		Name:        model.Name,
+		OwnerId:     model.OwnerId,
+		OpVersion:   model.OpVersion,
+		NodeIdClock: model.NodeIdClock,
+		Vector:      model.Log.Vector.ToJsonable(),
+		Text:        model.Buffer.ToString(),
+		Log:         log,
+		Tags:        tags,
+		SigningKey:  model.SigningKey,
+		RoleGrant:   model.RoleGrant,
+		ParentDocId: model.ParentDocId,
+		ForkVector:  model.ForkVector.ToJsonable(),
+		Branch:      branch,
+	}
+}
+
+// write to a temporary file first so a crash while saving doesn't
+// destroy the previous recovery file
+func SaveRecoveryFile(path string, state RecoveryState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func LoadRecoveryFile(path string) (RecoveryState, error) {
+	var state RecoveryState
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(b, &state)
+	return state, err
+}
+
+func HasRecoveryFile(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func RemoveRecoveryFile(path string) {
+	os.Remove(path)
+}
+
+// NewDocumentModelFromRecovery rebuilds the document by replaying the saved log,
+// the model continues as the same site
+func NewDocumentModelFromRecovery(state RecoveryState, width int, updateGUI func(), broadcastRemote func(RemoteOperation)) (*DocumentModel, error) {
+	model := NewDocumentModel(state.OwnerId, width, updateGUI, broadcastRemote)
+	model.DocId = state.DocId
+	model.Name = state.Name
+	model.RoleGrant = state.RoleGrant
+	if len(state.SigningKey) == ed25519.PrivateKeySize {
+		model.SigningKey = state.SigningKey
+		model.RequireSignatures = true
+	}
+	for _, entry := range state.Log {
+		if entry.editsText() {
+			model.Treedoc.ApplyOperation(entry.Operation)
+		}
+		model.Log.WriteEntry(entry)
+	}
+	if treedoc.DocToString(model.Treedoc) != state.Text {
+		return nil, ErrCorruptedRecovery
+	}
+	model.Buffer = buffer.StringToBuffer(state.Text, width)
+	model.OpVersion = state.OpVersion
+	model.NodeIdClock = state.NodeIdClock
+	for _, tag := range state.Tags {
+		model.Tags[tag.Name] = tagFromJson(tag)
+	}
+	model.ParentDocId = state.ParentDocId
+	if state.ForkVector != nil {
+		model.ForkVector = version.FromVersionVectorJson(state.ForkVector)
+	}
+	if state.Branch != nil {
+		// the branch isn't attached to the network
+		branch, err := NewDocumentModelFromRecovery(*state.Branch, width, updateGUI, nil)
+		if err != nil {
+			return nil, err
+		}
+		model.Branch = branch
+	}
+	return model, nil
+}
+
+// NewDocumentModelFromText starts a fresh document (new site with key, no history) containing text
+func NewDocumentModelFromText(key ed25519.PrivateKey, text string, width int, updateGUI func(), broadcastRemote func(RemoteOperation)) *DocumentModel {
+	model := NewDocumentModel(SiteId{}, width, updateGUI, nil)
+	model.SetSigningKey(key)
+	for i := 0; i < len(text); i++ {
+		model.LocalInsert(text[i])
+	}
+	model.Buffer.SetPosition(0)
+	model.BroadcastRemote = broadcastRemote
+	return model
+}
+
+// Autosaver writes the recovery file of a document whenever it changes,
+// but no more than once every interval
+type Autosaver struct {
+	Path     string
+	interval time.Duration
+	changed  chan struct{}
+	done     chan struct{}
+	// serializes saving with removal of the file
+	mutex   sync.Mutex
+	stopped bool
+}
+
+func NewAutosaver(path string, interval time.Duration) *Autosaver {
+	return &Autosaver{
+		Path:     path,
+		interval: interval,
+		changed:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+func (saver *Autosaver) Start(model *DocumentModel) {
+	model.setAutosaver(saver)
+	go saver.run(model)
+}
+
+func (saver *Autosaver) run(model *DocumentModel) {
+	for {
+		select {
+		case <-saver.changed:
+		case <-saver.done:
+			return
+		}
+		saver.save(model)
+		// throttle, any changes in the meantime are picked up by the next save
+		select {
+		case <-time.After(saver.interval):
+		case <-saver.done:
+			return
+		}
+	}
+}
+
+func (saver *Autosaver) save(model *DocumentModel) error {
+	saver.mutex.Lock()
+	defer saver.mutex.Unlock()
+	if saver.stopped {
+		return nil
+	}
+	model.RLock()
+	state := model.recoveryState()
+	model.RUnlock()
+	return SaveRecoveryFile(saver.Path, state)
+}
+
+// Notify never blocks, multiple notifications before a save collapse into one
+func (saver *Autosaver) Notify() {
+	select {
+	case saver.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Stop stops autosaving after writing the latest state one last time
+func (saver *Autosaver) Stop(model *DocumentModel) error {
+	err := saver.save(model)
+	saver.detach(model)
+	return err
+}
+
+// Discard stops autosaving and removes the recovery file
+func (saver *Autosaver) Discard(model *DocumentModel) {
+	saver.detach(model)
+	RemoveRecoveryFile(saver.Path)
+}
+
+func (saver *Autosaver) detach(model *DocumentModel) {
+	saver.mutex.Lock()
+	if !saver.stopped {
+		saver.stopped = true
+		close(saver.done)
+	}
+	saver.mutex.Unlock()
+	model.setAutosaver(nil)
+}
+
+// the branch is saved by the autosaver of the document
+func (model *DocumentModel) setAutosaver(saver *Autosaver) {
+	model.Lock()
+	defer model.Unlock()
+	model.Autosaver = saver
+	if model.Branch != nil {
+		model.Branch.Lock()
+		model.Branch.Autosaver = saver
+		model.Branch.Unlock()
+	}
+}
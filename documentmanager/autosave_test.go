@@ -0,0 +1,79 @@
+package documentmanager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestModel(id [16]byte) *DocumentModel {
+	return NewDocumentModel(id, 80, func() {}, nil)
+}
+
+func insertString(model *DocumentModel, str string) {
+	for i := 0; i < len(str); i++ {
+		model.LocalInsert(str[i])
+	}
+}
+
+func TestRecoveryRoundTrip(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "recovery")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "recovery.json")
+
+	model := newTestModel(A_ID)
+	insertString(model, "hello world")
+	model.LocalBackspace()
+	model.Buffer.SetPosition(0)
+	model.LocalDelete()
+	other := newTestModel(B_ID)
+	insertString(other, "x")
+	model.ApplyRemoteOperation(RemoteOperation{Vector: NewTestVector(0, 0, 0), Id: B_ID, Version: 1, Op: other.Log.Log[0].Operation})
+
+	err := SaveRecoveryFile(path, model.recoveryState())
+	assertEqual(t, nil, err)
+	state, err := LoadRecoveryFile(path)
+	assertEqual(t, nil, err)
+
+	recovered, err := NewDocumentModelFromRecovery(state, 80, func() {}, nil)
+	assertEqual(t, nil, err)
+	assertEqual(t, model.Buffer.ToString(), recovered.Buffer.ToString())
+	assertEqual(t, model.Log.Vector, recovered.Log.Vector)
+	assertEqual(t, model.OpVersion, recovered.OpVersion)
+	assertEqual(t, model.NodeIdClock, recovered.NodeIdClock)
+
+	// the recovered site keeps editing where it left off
+	insertString(recovered, "!")
+	assertEqual(t, model.OpVersion+1, recovered.OpVersion)
+}
+
+func TestRecoveryFromText(t *testing.T) {
+	model := NewDocumentModelFromText(NewSiteKey(), "abc\ndef", 80, func() {}, nil)
+	assertEqual(t, "abc\ndef", model.Buffer.ToString())
+	assertEqual(t, 0, model.Buffer.GetPosition())
+}
+
+func TestAutosaver(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "autosave")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "recovery.json")
+
+	model := newTestModel(A_ID)
+	saver := NewAutosaver(path, 10*time.Millisecond)
+	saver.Start(model)
+	insertString(model, "abc")
+	for i := 0; i < 100 && !HasRecoveryFile(path); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	insertString(model, "def")
+	saver.Stop(model)
+
+	state, err := LoadRecoveryFile(path)
+	assertEqual(t, nil, err)
+	assertEqual(t, "abcdef", state.Text)
+
+	saver.Discard(model)
+	assertEqual(t, false, HasRecoveryFile(path))
+}
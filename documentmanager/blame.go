@@ -0,0 +1,65 @@
+package documentmanager
+
+import (
+	. "../common"
+	"../treedoc"
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// BlameLine is a line of the document with the sites that wrote what's left of it
+type BlameLine struct {
+	Text  string
+	Sites []SiteId // the sites that inserted its characters, most characters first
+}
+
+type atomRef struct {
+	id treedoc.NodeId
+	n  uint16
+}
+
+// Blame attributes every line of the document to the sites that inserted its characters
+func (model *DocumentModel) Blame() []BlameLine {
+	model.RLock()
+	defer model.RUnlock()
+	text := model.Buffer.ToString()
+	lineStarts := lineStartPositions(text)
+	deleted := make(map[atomRef]bool)
+	for _, entry := range model.Log.Log {
+		if entry.editsText() && entry.Operation.Type == treedoc.DELETE {
+			deleted[atomRef{entry.Operation.Id, entry.Operation.N}] = true
+		}
+	}
+	counts := make([]map[SiteId]int, len(lineStarts))
+	for _, entry := range model.Log.Log {
+		if !entry.editsText() || entry.Operation.Type == treedoc.DELETE || deleted[atomRef{entry.Operation.Id, entry.Operation.N}] {
+			continue
+		}
+		pos, ok := model.Treedoc.AtomPosition(entry.Operation.Id, entry.Operation.N)
+		if !ok || pos >= len(text) {
+			continue
+		}
+		line := sort.SearchInts(lineStarts, pos+1) - 1
+		if counts[line] == nil {
+			counts[line] = make(map[SiteId]int)
+		}
+		counts[line][entry.Id]++
+	}
+	blame := make([]BlameLine, 0, len(lineStarts))
+	for i, line := range strings.Split(text, "\n") {
+		sites := make([]SiteId, 0, len(counts[i]))
+		for site := range counts[i] {
+			sites = append(sites, site)
+		}
+		lineCounts := counts[i]
+		sort.Slice(sites, func(a, b int) bool {
+			if lineCounts[sites[a]] != lineCounts[sites[b]] {
+				return lineCounts[sites[a]] > lineCounts[sites[b]]
+			}
+			return bytes.Compare(sites[a][:], sites[b][:]) < 0
+		})
+		blame = append(blame, BlameLine{Text: line, Sites: sites})
+	}
+	return blame
+}
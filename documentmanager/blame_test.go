@@ -0,0 +1,30 @@
+package documentmanager
+
+import (
+	. "../common"
+	"testing"
+)
+
+func TestBlame(t *testing.T) {
+	a := newTestModel(A_ID)
+	b := newTestModel(B_ID)
+	insertString(a, "one\ntwo\n")
+	exchangeOperations(a, b)
+	// b rewrites the second line and adds a third
+	b.Buffer.SetPosition(7)
+	b.LocalBackspace()
+	b.LocalBackspace()
+	insertString(b, "wenty\nthree")
+	exchangeOperations(b, a)
+	assertEqual(t, "one\ntwenty\nthree\n", a.Buffer.ToString())
+
+	// the line breaks count for the lines they end
+	blame := a.Blame()
+	assertEqual(t, []BlameLine{
+		{"one", []SiteId{A_ID}},
+		{"twenty", []SiteId{B_ID, A_ID}},
+		{"three", []SiteId{B_ID, A_ID}},
+		{"", []SiteId{}},
+	}, blame)
+	assertEqual(t, blame, b.Blame())
+}
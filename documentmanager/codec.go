@@ -0,0 +1,200 @@
+package documentmanager
+
+import (
+	. "../common"
+	"../treedoc"
+	"../version"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+)
+
+// Binary wire format of a list of remote operations:
+//
+//   magic byte, number of operations
+//   for every operation: vector, site id (16 bytes), version, op type, flags, then depending on the type
+//     INSERT_NEW:  parent node id, parent n, node id, n, atom
+//     INSERT_ROOT: node id, n, atom
+//     INSERT:      node id, n, atom
+//     DELETE:      node id, n
+//     ROLE:        node id, n, atom, see roles.go
+//   and if the operation is signed, the public key (32 bytes) and signature (64 bytes)
+//
+// Numbers are uvarints. Node ids start with the site id that created them, which most of the
+// time is the author of the operation, so a flag bit tells whether the 16 bytes are omitted
+// and only the clock part of the id is written.
+
+const (
+	flagIdByAuthor       = byte(1)
+	flagParentIdByAuthor = byte(2)
+	flagSigned           = byte(4)
+)
+
+var ErrMalformedOperations = errors.New("documentmanager: malformed binary operations")
+
+func RemoteOperationsToBinary(ops []RemoteOperation) []byte {
+	buf := make([]byte, 0, 64*len(ops)+8)
+	buf = append(buf, BINARY_PAYLOAD_MAGIC)
+	buf = appendUvarint(buf, uint64(len(ops)))
+	for _, op := range ops {
+		buf = op.Vector.AppendBinary(buf)
+		buf = append(buf, op.Id[:]...)
+		buf = appendUvarint(buf, uint64(op.Version))
+		buf = append(buf, op.Op.Type)
+		flags := byte(0)
+		if nodeIdByAuthor(op.Op.Id, op.Id) {
+			flags |= flagIdByAuthor
+		}
+		if nodeIdByAuthor(op.Op.ParentId, op.Id) {
+			flags |= flagParentIdByAuthor
+		}
+		signed := len(op.PubKey) == ed25519.PublicKeySize && len(op.Signature) == ed25519.SignatureSize
+		if signed {
+			flags |= flagSigned
+		}
+		buf = append(buf, flags)
+		if op.Op.Type == treedoc.INSERT_NEW {
+			buf = appendNodeId(buf, op.Op.ParentId, flags&flagParentIdByAuthor != 0)
+			buf = appendUvarint(buf, uint64(op.Op.ParentN))
+		}
+		buf = appendNodeId(buf, op.Op.Id, flags&flagIdByAuthor != 0)
+		buf = appendUvarint(buf, uint64(op.Op.N))
+		if op.Op.Type != treedoc.DELETE {
+			buf = append(buf, op.Op.Atom)
+		}
+		if signed {
+			buf = append(buf, op.PubKey...)
+			buf = append(buf, op.Signature...)
+		}
+	}
+	return buf
+}
+
+func RemoteOperationsFromBinary(slice []byte) ([]RemoteOperation, error) {
+	if !version.IsBinary(slice) {
+		return nil, ErrMalformedOperations
+	}
+	reader := binaryReader{data: slice, i: 1}
+	count := reader.uvarint()
+	if reader.err != nil || count > uint64(len(slice)) {
+		return nil, ErrMalformedOperations
+	}
+	ops := make([]RemoteOperation, 0, count)
+	for ; count > 0 && reader.err == nil; count-- {
+		var op RemoteOperation
+		op.Vector = reader.vector()
+		op.Id = reader.siteId()
+		op.Version = uint32(reader.uvarint())
+		op.Op.Type = reader.byte()
+		flags := reader.byte()
+		if op.Op.Type == treedoc.INSERT_NEW {
+			op.Op.ParentId = reader.nodeId(op.Id, flags&flagParentIdByAuthor != 0)
+			op.Op.ParentN = uint16(reader.uvarint())
+		}
+		op.Op.Id = reader.nodeId(op.Id, flags&flagIdByAuthor != 0)
+		op.Op.N = uint16(reader.uvarint())
+		if op.Op.Type != treedoc.DELETE {
+			op.Op.Atom = reader.byte()
+		}
+		if flags&flagSigned != 0 {
+			op.PubKey = reader.bytes(ed25519.PublicKeySize)
+			op.Signature = reader.bytes(ed25519.SignatureSize)
+		}
+		ops = append(ops, op)
+	}
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	return ops, nil
+}
+
+func nodeIdByAuthor(id treedoc.NodeId, author SiteId) bool {
+	site, _ := treedoc.SeparateNodeID(id)
+	return site == author
+}
+
+func appendNodeId(buf []byte, id treedoc.NodeId, byAuthor bool) []byte {
+	site, clock := treedoc.SeparateNodeID(id)
+	if !byAuthor {
+		buf = append(buf, site[:]...)
+	}
+	return appendUvarint(buf, uint64(clock))
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+// reads from data sequentially, once an error occurs all further reads return zero values
+type binaryReader struct {
+	data []byte
+	i    int
+	err  error
+}
+
+func (reader *binaryReader) uvarint() uint64 {
+	if reader.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(reader.data[reader.i:])
+	if n <= 0 {
+		reader.err = ErrMalformedOperations
+		return 0
+	}
+	reader.i += n
+	return x
+}
+
+func (reader *binaryReader) byte() byte {
+	if reader.err != nil || reader.i >= len(reader.data) {
+		reader.err = ErrMalformedOperations
+		return 0
+	}
+	reader.i++
+	return reader.data[reader.i-1]
+}
+
+func (reader *binaryReader) bytes(n int) []byte {
+	if reader.err != nil || reader.i+n > len(reader.data) {
+		reader.err = ErrMalformedOperations
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, reader.data[reader.i:reader.i+n])
+	reader.i += n
+	return b
+}
+
+func (reader *binaryReader) siteId() SiteId {
+	var id SiteId
+	if reader.err != nil || reader.i+16 > len(reader.data) {
+		reader.err = ErrMalformedOperations
+		return id
+	}
+	copy(id[:], reader.data[reader.i:reader.i+16])
+	reader.i += 16
+	return id
+}
+
+func (reader *binaryReader) nodeId(author SiteId, byAuthor bool) treedoc.NodeId {
+	site := author
+	if !byAuthor {
+		site = reader.siteId()
+	}
+	return treedoc.NewNodeId(site, uint32(reader.uvarint()))
+}
+
+func (reader *binaryReader) vector() version.VersionVector {
+	if reader.err != nil {
+		return nil
+	}
+	vector, n, err := version.ReadBinary(reader.data[reader.i:])
+	if err != nil {
+		reader.err = ErrMalformedOperations
+		return nil
+	}
+	reader.i += n
+	return vector
+}
@@ -0,0 +1,37 @@
+package documentmanager
+
+import (
+	"../treedoc"
+	"testing"
+)
+
+func TestBinaryOperations(t *testing.T) {
+	a := newTestModel(A_ID)
+	b := newTestModel(B_ID)
+	insertString(a, "abc")
+	exchangeOperations(a, b)
+	b.Buffer.SetPosition(1)
+	insertString(b, "xy")
+	b.LocalDelete()
+
+	ops := b.Log.GetMissingOperations(NewTestVector(0, 0, 0))
+	ops[4].Vector = NewTestVector(3, 2, 0)
+	assertEqual(t, treedoc.INSERT_NEW, ops[3].Op.Type)
+	assertEqual(t, treedoc.DELETE, ops[5].Op.Type)
+
+	slice := RemoteOperationsToBinary(ops)
+	decoded, err := RemoteOperationsFromBinary(slice)
+	assertEqual(t, nil, err)
+	assertEqual(t, ops, decoded)
+	assertEqual(t, ops, RemoteOperationsFromSlice(slice))
+	assertEqual(t, ops, RemoteOperationsFromSlice(RemoteOperationsToSlice(ops)))
+
+	// a single insert should be a small fraction of the json encoding
+	single := RemoteOperationsToBinary(ops[:1])
+	if len(single)*5 > len(RemoteOperationsToSlice(ops[:1])) {
+		t.Fatalf("binary encoding is %d bytes, json is %d bytes", len(single), len(RemoteOperationsToSlice(ops[:1])))
+	}
+
+	_, err = RemoteOperationsFromBinary(slice[:len(slice)-1])
+	assertEqual(t, ErrMalformedOperations, err)
+}
@@ -0,0 +1,60 @@
+package documentmanager
+
+import (
+	"strings"
+)
+
+// DiffLine is a line of the difference between two versions of the document, Kind is
+// ' ' for a line in both, '-' for a line only in the older and '+' only in the newer
+type DiffLine struct {
+	Kind byte
+	Text string
+}
+
+// DiffSinceTag returns the changes of the document since the tag was created
+func (model *DocumentModel) DiffSinceTag(name string) ([]DiffLine, error) {
+	old, err := model.TextAtTag(name)
+	if err != nil {
+		return nil, err
+	}
+	model.RLock()
+	current := model.Buffer.ToString()
+	model.RUnlock()
+	return diffLines(strings.Split(old, "\n"), strings.Split(current, "\n")), nil
+}
+
+// the longest common subsequence of lines, the rest is removed or added
+func diffLines(a, b []string) []DiffLine {
+	// common[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+	diff := make([]DiffLine, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			diff = append(diff, DiffLine{' ', a[i]})
+			i, j = i+1, j+1
+		case j == len(b) || (i < len(a) && common[i+1][j] >= common[i][j+1]):
+			diff = append(diff, DiffLine{'-', a[i]})
+			i++
+		default:
+			diff = append(diff, DiffLine{'+', b[j]})
+			j++
+		}
+	}
+	return diff
+}
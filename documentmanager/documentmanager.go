@@ -5,6 +5,7 @@ import (
 	. "../common"
 	"../treedoc"
 	"../version"
+	"crypto/ed25519"
 	"fmt"
 	"github.com/nsf/termbox-go"
 	"sync"
@@ -12,6 +13,8 @@ import (
 
 type DocumentModel struct {
 	sync.RWMutex
+	DocId           string
+	Name            string // given by the user, announced on the local network
 	OwnerId         SiteId
 	OpVersion       uint32
 	NodeIdClock     uint32
@@ -21,6 +24,25 @@ type DocumentModel struct {
 	Queue           *OperationQueue
 	UpdateGUI       func()
 	BroadcastRemote func(RemoteOperation)
+	BroadcastTags   func([]Tag)
+	Autosaver       *Autosaver
+	Tags            map[string]Tag
+	// set while the document is partitioned from the network
+	Offline bool
+	// the received operations at the time the document last went offline
+	OfflineVector version.VersionVector
+	// set on branches, the document it was forked from and the version at the fork
+	ParentDocId string
+	ForkVector  version.VersionVector
+	// the branch edited instead of the document, saved along with it, see SetBranch
+	Branch *DocumentModel
+	// local operations are signed with SigningKey, see SetSigningKey
+	SigningKey        ed25519.PrivateKey
+	RequireSignatures bool
+	// the role of the local site as assigned in the network, kept in the recovery file
+	RoleGrant RoleGrant
+	// the other end of the selection of the local user, see presence.go
+	Mark *Anchor
 }
 
 func NewDocumentModel(id SiteId, width int, updateGUI func(), broadcastRemote func(RemoteOperation)) *DocumentModel {
@@ -30,6 +52,7 @@ func NewDocumentModel(id SiteId, width int, updateGUI func(), broadcastRemote fu
 		Buffer:          buffer.StringToBuffer("", width),
 		Queue:           NewQueue(),
 		Log:             NewLog(),
+		Tags:            make(map[string]Tag),
 		UpdateGUI:       updateGUI,
 		BroadcastRemote: broadcastRemote,
 	}
@@ -38,6 +61,9 @@ func NewDocumentModel(id SiteId, width int, updateGUI func(), broadcastRemote fu
 func (model *DocumentModel) LocalInsert(atom byte) {
 	model.Lock()
 	defer model.Unlock()
+	if model.readOnly() {
+		return
+	}
 	pos := model.Buffer.GetPosition()
 	model.Buffer.InsertAtCurrent(atom)
 	id := treedoc.NewNodeId(model.OwnerId, model.NodeIdClock)
@@ -45,66 +71,91 @@ func (model *DocumentModel) LocalInsert(atom byte) {
 	if operation.Type == treedoc.INSERT_NEW || operation.Type == treedoc.INSERT_ROOT {
 		model.NodeIdClock++
 	}
-	model.OpVersion++
-	vector := model.Log.Vector.Copy()
-	model.Log.Write(model.OwnerId, model.OpVersion, operation)
-	model.AssertEqual()
-	//model.Debug()
-	if model.BroadcastRemote != nil {
-		go model.BroadcastRemote(RemoteOperation{Vector: vector, Id: model.OwnerId, Version: model.OpVersion, Op: operation})
-	}
+	model.writeLocalOperation(operation)
 }
 
 func (model *DocumentModel) LocalBackspace() {
 	model.Lock()
 	defer model.Unlock()
+	if model.readOnly() {
+		return
+	}
 	pos := model.Buffer.GetPosition() - 1
 	if pos < 0 {
 		return
 	}
 	model.Buffer.BackspaceAtCurrent()
 	operation := treedoc.DeletePos(model.Treedoc, pos)
-	model.OpVersion++
-	vector := model.Log.Vector.Copy()
-	model.Log.Write(model.OwnerId, model.OpVersion, operation)
-	model.AssertEqual()
-	//model.Debug()
-	if model.BroadcastRemote != nil {
-		go model.BroadcastRemote(RemoteOperation{Vector: vector, Id: model.OwnerId, Version: model.OpVersion, Op: operation})
-	}
+	model.writeLocalOperation(operation)
 }
 
 func (model *DocumentModel) LocalDelete() {
 	model.Lock()
 	defer model.Unlock()
+	if model.readOnly() {
+		return
+	}
 	pos := model.Buffer.GetPosition()
 	if pos >= model.Buffer.GetSize() {
 		return
 	}
 	model.Buffer.DeleteAtCurrent()
 	operation := treedoc.DeletePos(model.Treedoc, pos)
+	model.writeLocalOperation(operation)
+}
+
+// caller must hold the lock of the model
+func (model *DocumentModel) writeLocalOperation(operation treedoc.Operation) {
 	model.OpVersion++
-	vector := model.Log.Vector.Copy()
-	model.Log.Write(model.OwnerId, model.OpVersion, operation)
+	entry := LogEntry{Operation: operation, Id: model.OwnerId, Version: model.OpVersion, Vector: model.Log.Vector.Copy()}
+	entry.PubKey, entry.Signature = model.sign(model.OpVersion, entry.Vector, operation)
+	model.Log.WriteEntry(entry)
 	model.AssertEqual()
+	model.notifyChanged()
 	//model.Debug()
 	if model.BroadcastRemote != nil {
-		go model.BroadcastRemote(RemoteOperation{Vector: vector, Id: model.OwnerId, Version: model.OpVersion, Op: operation})
+		go model.BroadcastRemote(entry.remoteOperation())
 	}
 }
 
 func (model *DocumentModel) ApplyRemoteOperation(op RemoteOperation) {
 	model.Lock()
 	defer model.Unlock()
+	model.applyRemoteOperation(op)
+	//model.Debug()
+	model.UpdateGUI()
+}
+
+// returns the operations written to the log, op and any queued operations it
+// made ready, including the rejected ones. Caller must hold the lock of the model
+func (model *DocumentModel) applyRemoteOperation(op RemoteOperation) []RemoteOperation {
+	if model.RequireSignatures && op.VerifySignature() != nil {
+		// forged or corrupted, drop it. The real operation with the same version
+		// can still be received later
+		return nil
+	}
 	queueOps := model.Queue.Enqueue(op, model.Log.Vector.Copy())
 	for _, queueOp := range queueOps {
-		bufOp := model.Treedoc.ApplyOperation(queueOp.Op)
-		model.Buffer.ApplyOperation(bufOp)
-		model.Log.Write(queueOp.Id, queueOp.Version, queueOp.Op)
+		entry := queueOp.logEntry()
+		// decided by the roles at the point the operation was made, as on every other site
+		entry.Rejected = !model.permits(queueOp.Id, queueOp.Op, queueOp.Vector)
+		if entry.editsText() {
+			bufOp := model.Treedoc.ApplyOperation(queueOp.Op)
+			model.Buffer.ApplyOperation(bufOp)
+		}
+		model.Log.WriteEntry(entry)
 		model.AssertEqual()
 	}
-	//model.Debug()
-	model.UpdateGUI()
+	if len(queueOps) > 0 {
+		model.notifyChanged()
+	}
+	return queueOps
+}
+
+func (model *DocumentModel) notifyChanged() {
+	if model.Autosaver != nil {
+		model.Autosaver.Notify()
+	}
 }
 
 func (model *DocumentModel) AssertEqual() {
@@ -126,13 +177,22 @@ func (model *DocumentModel) Debug() {
 }
 
 func (model *DocumentModel) GetVersionVectorReceived() version.VersionVector {
+	model.RLock()
+	defer model.RUnlock()
+	return model.versionVectorReceived()
+}
+
+// caller must hold the lock
+func (model *DocumentModel) versionVectorReceived() version.VersionVector {
 	v := model.Log.Vector.Copy()
 	v.Merge(model.Queue.vector)
 	return v
 }
 
 func (model *DocumentModel) GetMissingOperations(vector version.VersionVector) ([]RemoteOperation, []RemoteOperation) {
-	myVec := model.GetVersionVectorReceived()
+	model.RLock()
+	defer model.RUnlock()
+	myVec := model.versionVectorReceived()
 	compare := myVec.Compare(vector)
 	if compare == version.GREATER_THAN || compare == version.CONFLICT {
 		ops := model.Log.GetMissingOperations(vector)
@@ -141,3 +201,12 @@ func (model *DocumentModel) GetMissingOperations(vector version.VersionVector) (
 	}
 	return nil, nil
 }
+
+// GetOperationsInRanges returns the received operations in ranges, the ones still
+// waiting in the queue come last
+func (model *DocumentModel) GetOperationsInRanges(ranges []version.Range) []RemoteOperation {
+	model.RLock()
+	defer model.RUnlock()
+	ops := model.Log.GetOperationsInRanges(ranges)
+	return append(ops, model.Queue.GetOperationsInRanges(ranges)...)
+}
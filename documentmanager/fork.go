@@ -0,0 +1,86 @@
+package documentmanager
+
+import (
+	"../buffer"
+	. "../common"
+	"../treedoc"
+	"errors"
+)
+
+var ErrReadOnly = errors.New("documentmanager: the document is read only, the branch can't be merged")
+
+// Fork copies the document into a branch with document id docId. The branch shares
+// the history of the document up to now but edits as a different site, so the operations
+// of both documents stay unique and can later be merged back with MergeBranch.
+// The branch site is let edit first, so its operations are allowed once merged.
+// The branch is not attached to the network, the peers only learn its id from the
+// presence of the user, see LocalPresence
+func (model *DocumentModel) Fork(docId string, branchSite SiteId) *DocumentModel {
+	model.Lock()
+	defer model.Unlock()
+	// a read only document can't merge the branch anyway
+	model.assignRole(branchSite, ROLE_EDITOR)
+	branch := NewDocumentModel(branchSite, model.Buffer.GetWidth(), model.UpdateGUI, nil)
+	branch.DocId = docId
+	branch.ParentDocId = model.DocId
+	for _, entry := range model.Log.Log {
+		if entry.editsText() {
+			branch.Treedoc.ApplyOperation(entry.Operation)
+		}
+		branch.Log.WriteEntry(entry)
+	}
+	branch.Buffer = buffer.StringToBuffer(treedoc.DocToString(branch.Treedoc), model.Buffer.GetWidth())
+	branch.Buffer.SetPosition(model.Buffer.GetPosition())
+	branch.ForkVector = model.Log.Vector.Copy()
+	for name, tag := range model.Tags {
+		branch.Tags[name] = tag
+	}
+	return branch
+}
+
+// SetBranch sets the branch edited instead of the document, or none if branch is nil.
+// The branch is autosaved in the recovery file of the document
+func (model *DocumentModel) SetBranch(branch *DocumentModel) {
+	model.Lock()
+	defer model.Unlock()
+	model.Branch = branch
+	if branch != nil {
+		branch.Lock()
+		branch.Autosaver = model.Autosaver
+		branch.Unlock()
+	}
+	model.notifyChanged()
+}
+
+// BranchOperations returns the operations made on a branch since it was forked
+// each with the vector of the operations it depends on
+func (branch *DocumentModel) BranchOperations() []RemoteOperation {
+	branch.RLock()
+	defer branch.RUnlock()
+	ops := make([]RemoteOperation, 0)
+	for _, entry := range branch.Log.Log {
+		if entry.Version > branch.ForkVector.Get(entry.Id) {
+			ops = append(ops, entry.remoteOperation())
+		}
+	}
+	return ops
+}
+
+// MergeBranch applies the operations made on branch to the document and broadcasts
+// them to the network. Returns the number of operations merged, or ErrReadOnly if the
+// local site may not edit the document
+func (model *DocumentModel) MergeBranch(branch *DocumentModel) (int, error) {
+	if model.IsReadOnly() {
+		return 0, ErrReadOnly
+	}
+	ops := branch.BranchOperations()
+	for _, op := range ops {
+		model.ApplyRemoteOperation(op)
+	}
+	if model.BroadcastRemote != nil {
+		for _, op := range ops {
+			model.BroadcastRemote(op)
+		}
+	}
+	return len(ops), nil
+}
@@ -0,0 +1,119 @@
+package documentmanager
+
+import (
+	. "../common"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestForkAndMerge(t *testing.T) {
+	a := newTestModel(A_ID)
+	a.DocId = "main"
+	b := newTestModel(B_ID)
+	insertString(a, "hello world")
+	exchangeOperations(a, b)
+
+	// local edits are broadcast from goroutines
+	var mutex sync.Mutex
+	broadcasted := make([]RemoteOperation, 0)
+	a.BroadcastRemote = func(op RemoteOperation) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		broadcasted = append(broadcasted, op)
+	}
+	branch := a.Fork("branch", C_ID)
+	assertEqual(t, "branch", branch.DocId)
+	assertEqual(t, "main", branch.ParentDocId)
+	assertEqual(t, "hello world", branch.Buffer.ToString())
+
+	// rewrite on the branch while the original keeps changing
+	branch.Buffer.SetPosition(5)
+	insertString(branch, ",")
+	branch.Buffer.SetPosition(12)
+	insertString(branch, "!")
+	a.Buffer.SetPosition(0)
+	a.LocalDelete()
+	insertString(a, "H")
+	assertEqual(t, "hello, world!", branch.Buffer.ToString())
+	assertEqual(t, 2, len(branch.BranchOperations()))
+
+	// wait for the broadcasts of the local edits before counting the merged ones
+	for i := 0; i < 100; i++ {
+		mutex.Lock()
+		done := len(broadcasted) == 2
+		mutex.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mutex.Lock()
+	broadcasted = broadcasted[:0]
+	mutex.Unlock()
+	count, err := a.MergeBranch(branch)
+	assertEqual(t, nil, err)
+	assertEqual(t, 2, count)
+	assertEqual(t, "Hello, world!", a.Buffer.ToString())
+
+	// peers receive the merged operations through the normal broadcast
+	mutex.Lock()
+	merged := broadcasted
+	mutex.Unlock()
+	assertEqual(t, 2, len(merged))
+	for _, op := range merged {
+		b.ApplyRemoteOperation(op)
+	}
+	assertEqual(t, "hello, world!", b.Buffer.ToString())
+	exchangeOperations(a, b)
+	assertEqual(t, a.Buffer.ToString(), b.Buffer.ToString())
+}
+
+func TestBranchAutosaved(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "autosave")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "recovery.json")
+
+	a := newTestModel(A_ID)
+	a.DocId = "main"
+	insertString(a, "hello")
+	saver := NewAutosaver(path, 10*time.Millisecond)
+	saver.Start(a)
+	branch := a.Fork("branch", C_ID)
+	a.SetBranch(branch)
+	assertEqual(t, "branch", a.LocalPresence().Branch)
+	insertString(branch, " world")
+	saver.Stop(a)
+
+	state, err := LoadRecoveryFile(path)
+	assertEqual(t, nil, err)
+	model, err := NewDocumentModelFromRecovery(state, 80, func() {}, nil)
+	assertEqual(t, nil, err)
+	assertEqual(t, "hello", model.Buffer.ToString())
+	assertEqual(t, "hello world", model.Branch.Buffer.ToString())
+	assertEqual(t, "main", model.Branch.ParentDocId)
+	assertEqual(t, len(" world"), len(model.Branch.BranchOperations()))
+
+	a.SetBranch(nil)
+	assertEqual(t, "", a.LocalPresence().Branch)
+}
+
+func TestMergeRefusedWhenReadOnly(t *testing.T) {
+	models := newTestModels(A_ID, B_ID)
+	a, b := models[0], models[1]
+	assertEqual(t, nil, a.AssignRole(B_ID, ROLE_EDITOR))
+	exchangeOperations(a, b)
+	branch := b.Fork("branch", C_ID)
+	insertString(branch, "c")
+
+	assertEqual(t, nil, a.AssignRole(B_ID, ROLE_VIEWER))
+	exchangeOperations(a, b)
+	merged, err := b.MergeBranch(branch)
+	assertEqual(t, ErrReadOnly, err)
+	assertEqual(t, 0, merged)
+	assertEqual(t, "", b.Buffer.ToString())
+	assertEqual(t, 1, len(branch.BranchOperations()))
+}
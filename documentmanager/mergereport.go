@@ -0,0 +1,148 @@
+package documentmanager
+
+import (
+	. "../common"
+	"../treedoc"
+	"sort"
+)
+
+// MergeRegion is a range of lines changed by one site while the
+// document was partitioned from the network
+type MergeRegion struct {
+	Site      SiteId
+	Local     bool
+	StartLine int // lines start from 1 and are the lines in the current document
+	EndLine   int
+	Inserted  int
+	Deleted   int
+}
+
+// GoOffline marks the point where the document got partitioned from the network,
+// local edits made from now on are kept in the log until they can be exchanged.
+// Does nothing while the document is offline already
+func (model *DocumentModel) GoOffline() {
+	model.Lock()
+	defer model.Unlock()
+	if model.Offline {
+		return
+	}
+	model.Offline = true
+	model.OfflineVector = model.Log.Vector.Copy()
+}
+
+// GoOnline marks that the document is attached to a network again. The merge report
+// keeps growing as the operations made during the partition arrive
+func (model *DocumentModel) GoOnline() {
+	model.Lock()
+	defer model.Unlock()
+	model.Offline = false
+}
+
+func (model *DocumentModel) IsOffline() bool {
+	model.RLock()
+	defer model.RUnlock()
+	return model.Offline
+}
+
+// HasMergeReport returns whether the document has been reconnected after going offline
+func (model *DocumentModel) HasMergeReport() bool {
+	model.RLock()
+	defer model.RUnlock()
+	return model.OfflineVector != nil && !model.Offline
+}
+
+// MergeReport returns the regions changed by every site since the document went offline,
+// ordered by site (local site first) then by line
+func (model *DocumentModel) MergeReport() []MergeRegion {
+	model.RLock()
+	defer model.RUnlock()
+	if model.OfflineVector == nil {
+		return nil
+	}
+	lineStarts := lineStartPositions(model.Buffer.ToString())
+	bySite := make(map[SiteId]map[int]*MergeRegion)
+	for _, entry := range model.Log.Log {
+		if entry.Version <= model.OfflineVector.Get(entry.Id) || !entry.editsText() {
+			continue
+		}
+		pos, ok := model.Treedoc.AtomPosition(entry.Operation.Id, entry.Operation.N)
+		if !ok {
+			continue
+		}
+		line := sort.SearchInts(lineStarts, pos+1)
+		lines, ok := bySite[entry.Id]
+		if !ok {
+			lines = make(map[int]*MergeRegion)
+			bySite[entry.Id] = lines
+		}
+		region, ok := lines[line]
+		if !ok {
+			region = &MergeRegion{Site: entry.Id, Local: entry.Id == model.OwnerId, StartLine: line, EndLine: line}
+			lines[line] = region
+		}
+		if entry.Operation.Type == treedoc.DELETE {
+			region.Deleted++
+		} else {
+			region.Inserted++
+		}
+	}
+
+	report := make([]MergeRegion, 0)
+	for _, lines := range bySite {
+		report = append(report, joinAdjacentLines(lines)...)
+	}
+	sort.Sort(mergeRegionList(report))
+	return report
+}
+
+// positions where each line starts, the first line starts at 0
+func lineStartPositions(text string) []int {
+	starts := []int{0}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			starts = append(starts, i+1)
+		}
+	}
+	return starts
+}
+
+func joinAdjacentLines(lines map[int]*MergeRegion) []MergeRegion {
+	keys := make([]int, 0, len(lines))
+	for line := range lines {
+		keys = append(keys, line)
+	}
+	sort.Ints(keys)
+	result := make([]MergeRegion, 0)
+	for _, line := range keys {
+		region := *lines[line]
+		last := len(result) - 1
+		if last >= 0 && result[last].EndLine+1 >= line {
+			result[last].EndLine = line
+			result[last].Inserted += region.Inserted
+			result[last].Deleted += region.Deleted
+		} else {
+			result = append(result, region)
+		}
+	}
+	return result
+}
+
+type mergeRegionList []MergeRegion
+
+func (list mergeRegionList) Len() int {
+	return len(list)
+}
+
+func (list mergeRegionList) Less(i, j int) bool {
+	if list[i].Local != list[j].Local {
+		return list[i].Local
+	}
+	if list[i].Site != list[j].Site {
+		return list[i].Site.ToString() < list[j].Site.ToString()
+	}
+	return list[i].StartLine < list[j].StartLine
+}
+
+func (list mergeRegionList) Swap(i, j int) {
+	list[i], list[j] = list[j], list[i]
+}
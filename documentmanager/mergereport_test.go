@@ -0,0 +1,40 @@
+package documentmanager
+
+import (
+	"testing"
+)
+
+func exchangeOperations(from, to *DocumentModel) {
+	for _, op := range from.Log.GetMissingOperations(to.Log.Vector) {
+		to.ApplyRemoteOperation(op)
+	}
+}
+
+func TestMergeReport(t *testing.T) {
+	a := newTestModel(A_ID)
+	b := newTestModel(B_ID)
+	insertString(a, "one\ntwo\nthree\nfour\n")
+	exchangeOperations(a, b)
+	assertEqual(t, "one\ntwo\nthree\nfour\n", b.Buffer.ToString())
+
+	a.GoOffline()
+	assertEqual(t, false, a.HasMergeReport())
+	// a appends to the first line, b rewrites the end of the third and the fourth line
+	a.Buffer.SetPosition(3)
+	insertString(a, "!!")
+	b.Buffer.SetPosition(13)
+	b.LocalBackspace()
+	b.Buffer.SetPosition(17)
+	insertString(b, "fourth")
+	a.GoOnline()
+	exchangeOperations(b, a)
+	exchangeOperations(a, b)
+	assertEqual(t, "one!!\ntwo\nthre\nfourfourth\n", a.Buffer.ToString())
+	assertEqual(t, a.Buffer.ToString(), b.Buffer.ToString())
+
+	assertEqual(t, true, a.HasMergeReport())
+	report := a.MergeReport()
+	assertEqual(t, 2, len(report))
+	assertEqual(t, MergeRegion{Site: A_ID, Local: true, StartLine: 1, EndLine: 1, Inserted: 2}, report[0])
+	assertEqual(t, MergeRegion{Site: B_ID, Local: false, StartLine: 3, EndLine: 4, Inserted: 6, Deleted: 1}, report[1])
+}
@@ -4,46 +4,118 @@ import (
 	. "../common"
 	"../treedoc"
 	"../version"
+	"encoding/json"
 )
 
 type LogEntry struct {
 	Operation treedoc.Operation
 	Id        SiteId
 	Version   uint32
+	// kept so the operation can be forwarded to other sites, empty in older recovery files
+	Vector    version.VersionVector
+	PubKey    []byte
+	Signature []byte
+	// the site wasn't allowed to make the operation, it's kept but not applied, see roles.go
+	Rejected bool
+}
+
+// the vector is written in binary since site ids aren't valid json keys
+type logEntryJson struct {
+	Operation treedoc.Operation
+	Id        SiteId
+	Version   uint32
+	Vector    []byte `json:",omitempty"`
+	PubKey    []byte `json:",omitempty"`
+	Signature []byte `json:",omitempty"`
+	Rejected  bool   `json:",omitempty"`
+}
+
+func (entry LogEntry) MarshalJSON() ([]byte, error) {
+	entryJson := logEntryJson{entry.Operation, entry.Id, entry.Version, nil, entry.PubKey, entry.Signature, entry.Rejected}
+	if entry.Vector != nil {
+		entryJson.Vector = entry.Vector.ToBinary()
+	}
+	return json.Marshal(entryJson)
+}
+
+func (entry *LogEntry) UnmarshalJSON(data []byte) error {
+	var entryJson logEntryJson
+	if err := json.Unmarshal(data, &entryJson); err != nil {
+		return err
+	}
+	*entry = LogEntry{entryJson.Operation, entryJson.Id, entryJson.Version, nil, entryJson.PubKey, entryJson.Signature, entryJson.Rejected}
+	if entryJson.Vector != nil {
+		vector, err := version.FromSlice(entryJson.Vector)
+		if err != nil {
+			return err
+		}
+		entry.Vector = vector
+	}
+	return nil
+}
+
+// whether the entry changed the text, it's neither rejected nor a role operation
+func (entry LogEntry) editsText() bool {
+	return !entry.Rejected && entry.Operation.Type != ROLE_OPERATION
+}
+
+func (entry LogEntry) remoteOperation() RemoteOperation {
+	vector := entry.Vector
+	if vector == nil {
+		vector = version.NewVector()
+	}
+	return RemoteOperation{
+		Vector:    vector,
+		Id:        entry.Id,
+		Version:   entry.Version,
+		Op:        entry.Operation,
+		PubKey:    entry.PubKey,
+		Signature: entry.Signature,
+	}
+}
+
+func (op RemoteOperation) logEntry() LogEntry {
+	return LogEntry{
+		Operation: op.Op,
+		Id:        op.Id,
+		Version:   op.Version,
+		Vector:    op.Vector,
+		PubKey:    op.PubKey,
+		Signature: op.Signature,
+	}
 }
 
 type OperationLog struct {
 	Log    []LogEntry
 	Vector version.VersionVector
+	// the role operations that weren't rejected, see roles.go
+	roles []LogEntry
 }
 
 func NewLog() *OperationLog {
-	return &OperationLog{make([]LogEntry, 0, 100), version.NewVector()}
+	return &OperationLog{Log: make([]LogEntry, 0, 100), Vector: version.NewVector()}
 }
 
 func (log *OperationLog) Write(id SiteId, version uint32, operation treedoc.Operation) {
-	log.Vector.IncrementTo(id, version)
-	log.Log = append(log.Log, LogEntry{
-		Id:        id,
-		Version:   version,
-		Operation: operation,
-	})
+	log.WriteEntry(LogEntry{Id: id, Version: version, Operation: operation})
+}
+
+func (log *OperationLog) WriteEntry(entry LogEntry) {
+	log.Vector.IncrementTo(entry.Id, entry.Version)
+	log.Log = append(log.Log, entry)
+	if entry.Operation.Type == ROLE_OPERATION && !entry.Rejected {
+		log.roles = append(log.roles, entry)
+	}
 }
 
 func (log *OperationLog) GetMissingOperations(vector version.VersionVector) []RemoteOperation {
 	result := make([]RemoteOperation, 0, 10)
-	emptyVector := version.NewVector()
 	currentVector := vector.Copy()
 
 	for i := len(log.Log) - 1; i >= 0; i-- {
 		currentLog := log.Log[i]
 		if vector.Get(currentLog.Id) < currentLog.Version {
-			result = append(result, RemoteOperation{
-				Vector:  emptyVector,
-				Id:      currentLog.Id,
-				Version: currentLog.Version,
-				Op:      currentLog.Operation,
-			})
+			result = append(result, currentLog.remoteOperation())
 		}
 		currentVector.DecrementTo(currentLog.Id, currentLog.Version-1)
 
@@ -59,3 +131,13 @@ func (log *OperationLog) GetMissingOperations(vector version.VersionVector) []Re
 	}
 	return result
 }
+
+func (log *OperationLog) GetOperationsInRanges(ranges []version.Range) []RemoteOperation {
+	result := make([]RemoteOperation, 0, 10)
+	for _, entry := range log.Log {
+		if version.ContainsOperation(ranges, entry.Id, entry.Version) {
+			result = append(result, entry.remoteOperation())
+		}
+	}
+	return result
+}
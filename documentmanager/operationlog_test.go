@@ -56,3 +56,20 @@ func TestGetMissingOperations(t *testing.T) {
 	assertEqual(t, treedoc.NewNodeId(A_ID, 2), result[1].Op.Id)
 	assertEqual(t, treedoc.NewNodeId(B_ID, 1), result[2].Op.Id)
 }
+
+func TestGetOperationsInRanges(t *testing.T) {
+	log := NewLog()
+	log.Write(A_ID, 1, treedoc.Operation{Id: treedoc.NewNodeId(A_ID, 1)})
+	log.Write(A_ID, 2, treedoc.Operation{Id: treedoc.NewNodeId(A_ID, 2)})
+	log.Write(B_ID, 1, treedoc.Operation{Id: treedoc.NewNodeId(B_ID, 1)})
+	log.Write(A_ID, 3, treedoc.Operation{Id: treedoc.NewNodeId(A_ID, 3)})
+	log.Write(B_ID, 2, treedoc.Operation{Id: treedoc.NewNodeId(B_ID, 2)})
+
+	result := log.GetOperationsInRanges(NewTestVector(1, 1, 0).MissingRanges(NewTestVector(2, 2, 0)))
+	assertEqual(t, 2, len(result))
+	assertEqual(t, treedoc.NewNodeId(A_ID, 2), result[0].Op.Id)
+	assertEqual(t, treedoc.NewNodeId(B_ID, 2), result[1].Op.Id)
+
+	result = log.GetOperationsInRanges(NewTestVector(3, 2, 0).MissingRanges(NewTestVector(2, 2, 0)))
+	assertEqual(t, 0, len(result))
+}
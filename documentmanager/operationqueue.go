@@ -74,3 +74,13 @@ func (queue *OperationQueue) GetMissingOperations(vector VersionVector) []Remote
 	}
 	return result
 }
+
+func (queue *OperationQueue) GetOperationsInRanges(ranges []Range) []RemoteOperation {
+	result := make([]RemoteOperation, 0)
+	for _, elem := range queue.queue {
+		if ContainsOperation(ranges, elem.Id, elem.Version) {
+			result = append(result, elem)
+		}
+	}
+	return result
+}
@@ -0,0 +1,109 @@
+package documentmanager
+
+import (
+	"../treedoc"
+	"encoding/json"
+)
+
+// Presence is where a user is in the document, shown to the other users. It's sent to
+// them as it changes and never written to the log. Positions are anchored to atoms of the
+// treedoc, so they stay between the same characters while the others' edits come in
+type Presence struct {
+	Cursor    Anchor
+	Selection *Anchor `json:",omitempty"` // the other end of the selection, if any
+	// the id of the branch edited instead of the document, the cursor stays where the
+	// user left the document
+	Branch string `json:",omitempty"`
+}
+
+// Anchor is the position right after the atom Id/N, or the start of the document
+type Anchor struct {
+	Id    treedoc.NodeId
+	N     uint16
+	Start bool `json:",omitempty"`
+}
+
+func PresenceToSlice(presence Presence) []byte {
+	data, _ := json.Marshal(presence)
+	return data
+}
+
+func PresenceFromSlice(data []byte) (Presence, error) {
+	var presence Presence
+	err := json.Unmarshal(data, &presence)
+	return presence, err
+}
+
+// ToggleMark starts a selection at the cursor, or ends the current one
+func (model *DocumentModel) ToggleMark() {
+	model.Lock()
+	defer model.Unlock()
+	if model.Mark != nil {
+		model.Mark = nil
+		return
+	}
+	mark := model.anchorAt(model.Buffer.GetPosition())
+	model.Mark = &mark
+}
+
+// Selection returns the selected part of the document, from start up to end
+func (model *DocumentModel) Selection() (start, end int, ok bool) {
+	model.RLock()
+	defer model.RUnlock()
+	if model.Mark == nil {
+		return 0, 0, false
+	}
+	mark, ok := model.position(*model.Mark)
+	start, end = ordered(mark, model.Buffer.GetPosition())
+	return start, end, ok
+}
+
+// LocalPresence returns the presence of the local user
+func (model *DocumentModel) LocalPresence() Presence {
+	model.RLock()
+	defer model.RUnlock()
+	presence := Presence{Cursor: model.anchorAt(model.Buffer.GetPosition()), Selection: model.Mark}
+	if model.Branch != nil {
+		presence.Branch = model.Branch.DocId
+	}
+	return presence
+}
+
+// PresencePositions returns the cursor and selection of a remote user in this document.
+// ok is false if it refers to operations not received yet
+func (model *DocumentModel) PresencePositions(presence Presence) (cursor, start, end int, ok bool) {
+	model.RLock()
+	defer model.RUnlock()
+	cursor, ok = model.position(presence.Cursor)
+	start, end = cursor, cursor
+	if presence.Selection != nil {
+		if mark, markOk := model.position(*presence.Selection); markOk {
+			start, end = ordered(mark, cursor)
+		}
+	}
+	return cursor, start, end, ok
+}
+
+func ordered(a, b int) (int, int) {
+	if a > b {
+		return b, a
+	}
+	return a, b
+}
+
+// the anchor of pos, caller must hold the lock
+func (model *DocumentModel) anchorAt(pos int) Anchor {
+	id, n, ok := model.Treedoc.AtomBefore(pos)
+	if !ok {
+		return Anchor{Start: true}
+	}
+	return Anchor{Id: id, N: n}
+}
+
+// caller must hold the lock
+func (model *DocumentModel) position(anchor Anchor) (int, bool) {
+	if anchor.Start {
+		return 0, true
+	}
+	return model.Treedoc.PositionAfter(anchor.Id, anchor.N)
+}
@@ -0,0 +1,45 @@
+package documentmanager
+
+import (
+	"testing"
+)
+
+func TestPresence(t *testing.T) {
+	a := newTestModel(A_ID)
+	b := newTestModel(B_ID)
+	insertString(a, "hello world")
+	exchangeOperations(a, b)
+
+	// a selects "world"
+	a.Buffer.SetPosition(6)
+	a.ToggleMark()
+	a.Buffer.SetPosition(11)
+	start, end, ok := a.Selection()
+	assertEqual(t, true, ok)
+	assertEqual(t, 6, start)
+	assertEqual(t, 11, end)
+	presence, err := PresenceFromSlice(PresenceToSlice(a.LocalPresence()))
+	assertEqual(t, nil, err)
+
+	cursor, start, end, ok := b.PresencePositions(presence)
+	assertEqual(t, true, ok)
+	assertEqual(t, []int{11, 6, 11}, []int{cursor, start, end})
+
+	// the selection stays on "world" while b edits before it
+	b.Buffer.SetPosition(0)
+	insertString(b, ">> ")
+	b.Buffer.SetPosition(8)
+	b.LocalBackspace()
+	assertEqual(t, ">> hell world", b.Buffer.ToString())
+	cursor, start, end, _ = b.PresencePositions(presence)
+	assertEqual(t, []int{13, 8, 13}, []int{cursor, start, end})
+
+	// operations of a not received yet aren't shown
+	insertString(a, "!")
+	_, _, _, ok = b.PresencePositions(a.LocalPresence())
+	assertEqual(t, false, ok)
+
+	a.ToggleMark()
+	_, _, ok = a.Selection()
+	assertEqual(t, false, ok)
+}
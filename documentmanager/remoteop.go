@@ -13,21 +13,28 @@ type RemoteOperation struct {
 	Id      SiteId
 	Version uint32
 	Op      treedoc.Operation
+	// signature of the author, see VerifySignature
+	PubKey    []byte
+	Signature []byte
 }
 
 type RemoteOperationJson struct {
-	Vector  version.VersionVectorJson
-	Id      SiteId
-	Version uint32
-	Op      treedoc.Operation
+	Vector    version.VersionVectorJson
+	Id        SiteId
+	Version   uint32
+	Op        treedoc.Operation
+	PubKey    []byte `json:",omitempty"`
+	Signature []byte `json:",omitempty"`
 }
 
 func RemoteOperationToSlice(op RemoteOperation) []byte {
 	slice, err := json.Marshal(RemoteOperationJson{
-		Vector:  op.Vector.ToJsonable(),
-		Id:      op.Id,
-		Version: op.Version,
-		Op:      op.Op,
+		Vector:    op.Vector.ToJsonable(),
+		Id:        op.Id,
+		Version:   op.Version,
+		Op:        op.Op,
+		PubKey:    op.PubKey,
+		Signature: op.Signature,
 	})
 	if err != nil {
 		termbox.Close()
@@ -40,10 +47,12 @@ func RemoteOperationFromSlice(slice []byte) RemoteOperation {
 	var opJson RemoteOperationJson
 	json.Unmarshal(slice, &opJson)
 	return RemoteOperation{
-		Vector:  version.FromVersionVectorJson(opJson.Vector),
-		Id:      opJson.Id,
-		Version: opJson.Version,
-		Op:      opJson.Op,
+		Vector:    version.FromVersionVectorJson(opJson.Vector),
+		Id:        opJson.Id,
+		Version:   opJson.Version,
+		Op:        opJson.Op,
+		PubKey:    opJson.PubKey,
+		Signature: opJson.Signature,
 	}
 }
 
@@ -51,26 +60,35 @@ func RemoteOperationsToSlice(ops []RemoteOperation) []byte {
 	newOps := make([]RemoteOperationJson, len(ops), len(ops))
 	for i, op := range ops {
 		newOps[i] = RemoteOperationJson{
-			Vector:  op.Vector.ToJsonable(),
-			Id:      op.Id,
-			Version: op.Version,
-			Op:      op.Op,
+			Vector:    op.Vector.ToJsonable(),
+			Id:        op.Id,
+			Version:   op.Version,
+			Op:        op.Op,
+			PubKey:    op.PubKey,
+			Signature: op.Signature,
 		}
 	}
 	b, _ := json.Marshal(newOps)
 	return b
 }
 
+// RemoteOperationsFromSlice decodes operations in either json or binary format
 func RemoteOperationsFromSlice(slice []byte) []RemoteOperation {
+	if version.IsBinary(slice) {
+		ops, _ := RemoteOperationsFromBinary(slice)
+		return ops
+	}
 	var opsJson []RemoteOperationJson
 	json.Unmarshal(slice, &opsJson)
 	ops := make([]RemoteOperation, len(opsJson), len(opsJson))
 	for i, op := range opsJson {
 		ops[i] = RemoteOperation{
-			Vector:  version.FromVersionVectorJson(op.Vector),
-			Id:      op.Id,
-			Version: op.Version,
-			Op:      op.Op,
+			Vector:    version.FromVersionVectorJson(op.Vector),
+			Id:        op.Id,
+			Version:   op.Version,
+			Op:        op.Op,
+			PubKey:    op.PubKey,
+			Signature: op.Signature,
 		}
 	}
 	return ops
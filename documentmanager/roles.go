@@ -0,0 +1,193 @@
+package documentmanager
+
+import (
+	. "../common"
+	"../treedoc"
+	"../version"
+	"encoding/hex"
+	"errors"
+)
+
+// Roles are assigned by role operations, signed and delivered like the treedoc operations
+// and kept in the log. An operation is allowed by the roles assigned in its causal past,
+// given by its vector, so every site decides the same for it no matter when it learns of
+// later role changes. Of role operations assigned concurrently to a site the lower role
+// wins, so a concurrent demotion isn't lost. The site that created the document, named
+// by its id, is its owner. Owners assign any role to the others, editors only let sites
+// without a role edit, e.g. the ones joining the network. Sites without a role can't edit.
+// Disallowed operations are kept in the log as rejected so the vectors still agree.
+// Documents whose id doesn't name their creator, created by older versions or outside
+// the editor, don't check roles
+
+// ROLE_OPERATION assigns to the site of its node id the role whose first letter is its atom
+const ROLE_OPERATION byte = 16
+
+var (
+	ErrNotPermitted = errors.New("documentmanager: the site may not assign that role")
+	ErrInvalidRole  = errors.New("documentmanager: unknown role")
+)
+
+// DocIdOfSite returns the id of a new document created by site
+func DocIdOfSite(site SiteId) string {
+	return hex.EncodeToString(site[:])
+}
+
+// caller must hold the lock of the model. Branches are created by the creator of their document
+func (model *DocumentModel) creator() (SiteId, bool) {
+	docId := model.DocId
+	if model.ParentDocId != "" {
+		docId = model.ParentDocId
+	}
+	var site SiteId
+	b, err := hex.DecodeString(docId)
+	if err != nil || len(b) != len(site) {
+		return site, false
+	}
+	copy(site[:], b)
+	return site, true
+}
+
+func roleAtom(role string) byte {
+	switch role {
+	case ROLE_OWNER, ROLE_EDITOR, ROLE_VIEWER:
+		return role[0]
+	}
+	return 0
+}
+
+func atomRole(atom byte) string {
+	for _, role := range []string{ROLE_OWNER, ROLE_EDITOR, ROLE_VIEWER} {
+		if role[0] == atom {
+			return role
+		}
+	}
+	return ""
+}
+
+func roleRank(role string) int {
+	switch role {
+	case ROLE_VIEWER:
+		return 0
+	case ROLE_EDITOR:
+		return 1
+	case ROLE_OWNER:
+		return 2
+	}
+	return -1
+}
+
+func roleTarget(op treedoc.Operation) SiteId {
+	site, _ := treedoc.SeparateNodeID(op.Id)
+	return site
+}
+
+// whether entry a is in the causal past of entry b
+func precedes(a, b LogEntry) bool {
+	return b.Vector.Get(a.Id) >= a.Version
+}
+
+// caller must hold the lock of the model. The role of site as assigned by the role
+// operations seen at vector, empty if it has none
+func (model *DocumentModel) roleAt(site SiteId, vector version.VersionVector) string {
+	if creator, ok := model.creator(); ok && site == creator {
+		return ROLE_OWNER
+	}
+	// the log is in causal order, an entry never precedes the ones before it
+	latest := make([]LogEntry, 0, 1)
+	for _, entry := range model.Log.roles {
+		if roleTarget(entry.Operation) != site || vector.Get(entry.Id) < entry.Version {
+			continue
+		}
+		concurrent := latest[:0]
+		for _, other := range latest {
+			if !precedes(other, entry) {
+				concurrent = append(concurrent, other)
+			}
+		}
+		latest = append(concurrent, entry)
+	}
+	role := ""
+	for _, entry := range latest {
+		if r := atomRole(entry.Operation.Atom); role == "" || roleRank(r) < roleRank(role) {
+			role = r
+		}
+	}
+	return role
+}
+
+// caller must hold the lock of the model. Whether site may make op at vector
+func (model *DocumentModel) permits(site SiteId, op treedoc.Operation, vector version.VersionVector) bool {
+	creator, ok := model.creator()
+	if !ok {
+		return true
+	}
+	role := model.roleAt(site, vector)
+	if op.Type != ROLE_OPERATION {
+		return role == ROLE_OWNER || role == ROLE_EDITOR
+	}
+	target := roleTarget(op)
+	if atomRole(op.Atom) == "" || target == creator {
+		return false
+	}
+	if role == ROLE_OWNER {
+		return true
+	}
+	return role == ROLE_EDITOR && atomRole(op.Atom) == ROLE_EDITOR && model.roleAt(target, vector) == ""
+}
+
+// caller must hold the lock of the model
+func (model *DocumentModel) readOnly() bool {
+	return !model.permits(model.OwnerId, treedoc.Operation{}, model.Log.Vector)
+}
+
+// IsReadOnly returns whether the local site may not edit, as a viewer or a site no one let edit yet
+func (model *DocumentModel) IsReadOnly() bool {
+	model.RLock()
+	defer model.RUnlock()
+	return model.readOnly()
+}
+
+// SiteRole returns the role of site, empty if it has none or the document doesn't check roles
+func (model *DocumentModel) SiteRole(site SiteId) string {
+	model.RLock()
+	defer model.RUnlock()
+	if _, ok := model.creator(); !ok {
+		return ""
+	}
+	return model.roleAt(site, model.Log.Vector)
+}
+
+// AssignRole assigns role to site with a role operation made by the local site. Nothing
+// is done if site already has the role or the document doesn't check roles
+func (model *DocumentModel) AssignRole(site SiteId, role string) error {
+	model.Lock()
+	defer model.Unlock()
+	return model.assignRole(site, role)
+}
+
+// caller must hold the lock of the model
+func (model *DocumentModel) assignRole(site SiteId, role string) error {
+	atom := roleAtom(role)
+	if atom == 0 {
+		return ErrInvalidRole
+	}
+	if _, ok := model.creator(); !ok || model.roleAt(site, model.Log.Vector) == role {
+		return nil
+	}
+	operation := treedoc.Operation{Type: ROLE_OPERATION, Id: treedoc.NewNodeId(site, 0), Atom: atom}
+	if !model.permits(model.OwnerId, operation, model.Log.Vector) {
+		return ErrNotPermitted
+	}
+	model.writeLocalOperation(operation)
+	return nil
+}
+
+// SetRoleGrant keeps the role assigned to the local site so a recovered document rejoins with it
+func (model *DocumentModel) SetRoleGrant(grant RoleGrant) {
+	model.Lock()
+	defer model.Unlock()
+	if model.RoleGrant != grant {
+		model.RoleGrant = grant
+		model.notifyChanged()
+	}
+}
@@ -0,0 +1,138 @@
+package documentmanager
+
+import (
+	. "../common"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// models of the sites editing the document created by the first one
+func newTestModels(ids ...SiteId) []*DocumentModel {
+	models := make([]*DocumentModel, len(ids))
+	for i, id := range ids {
+		models[i] = newTestModel(id)
+		models[i].DocId = DocIdOfSite(ids[0])
+	}
+	return models
+}
+
+func TestViewerRole(t *testing.T) {
+	models := newTestModels(A_ID, B_ID)
+	a, b := models[0], models[1]
+	insertString(a, "abc")
+	exchangeOperations(a, b)
+
+	// b has no role yet
+	assertEqual(t, true, b.IsReadOnly())
+	assertEqual(t, nil, a.AssignRole(B_ID, ROLE_VIEWER))
+	exchangeOperations(a, b)
+	assertEqual(t, ROLE_VIEWER, b.SiteRole(B_ID))
+	assertEqual(t, true, b.IsReadOnly())
+	insertString(b, "x")
+	b.LocalBackspace()
+	b.Buffer.SetPosition(0)
+	b.LocalDelete()
+	assertEqual(t, "abc", b.Buffer.ToString())
+	assertEqual(t, uint32(0), b.OpVersion)
+	assertEqual(t, ErrNotPermitted, b.AssignRole(B_ID, ROLE_EDITOR))
+
+	// edits of the owner still arrive
+	insertString(a, "d")
+	exchangeOperations(a, b)
+	assertEqual(t, "abcd", b.Buffer.ToString())
+
+	assertEqual(t, nil, a.AssignRole(B_ID, ROLE_EDITOR))
+	exchangeOperations(a, b)
+	assertEqual(t, false, b.IsReadOnly())
+	b.Buffer.SetPosition(0)
+	insertString(b, "e")
+	exchangeOperations(b, a)
+	assertEqual(t, "eabcd", a.Buffer.ToString())
+}
+
+func TestRolesAtCausalPoint(t *testing.T) {
+	models := newTestModels(A_ID, B_ID, C_ID)
+	a, b, c := models[0], models[1], models[2]
+	assertEqual(t, nil, a.AssignRole(B_ID, ROLE_EDITOR))
+	assertEqual(t, nil, a.AssignRole(C_ID, ROLE_EDITOR))
+	exchangeOperations(a, b)
+	exchangeOperations(a, c)
+
+	// b edits while a concurrently demotes it, c learns of the demotion first
+	insertString(b, "b")
+	assertEqual(t, nil, a.AssignRole(B_ID, ROLE_VIEWER))
+	exchangeOperations(a, c)
+	exchangeOperations(b, c)
+	exchangeOperations(b, a)
+	exchangeOperations(a, b)
+	for _, model := range models {
+		assertEqual(t, "b", model.Buffer.ToString())
+		assertEqual(t, ROLE_VIEWER, model.SiteRole(B_ID))
+	}
+	assertEqual(t, true, b.IsReadOnly())
+
+	// a modified b ignoring the demotion, its edit is rejected everywhere but counts in the vector
+	b.DocId = ""
+	insertString(b, "x")
+	b.DocId = a.DocId
+	exchangeOperations(b, c)
+	exchangeOperations(b, a)
+	assertEqual(t, "b", a.Buffer.ToString())
+	assertEqual(t, "b", c.Buffer.ToString())
+	assertEqual(t, true, c.Log.Log[len(c.Log.Log)-1].Rejected)
+	// the next edit of a depends on the rejected one
+	insertString(a, "a")
+	exchangeOperations(a, c)
+	assertEqual(t, a.Buffer.ToString(), c.Buffer.ToString())
+	assertEqual(t, a.Log.Vector, c.Log.Vector)
+}
+
+func TestEditorLetsNewSitesEdit(t *testing.T) {
+	models := newTestModels(A_ID, B_ID, C_ID)
+	a, b, c := models[0], models[1], models[2]
+	assertEqual(t, ErrNotPermitted, b.AssignRole(C_ID, ROLE_EDITOR))
+	assertEqual(t, nil, a.AssignRole(B_ID, ROLE_EDITOR))
+	exchangeOperations(a, b)
+
+	// editors let sites without a role edit, but don't assign other roles
+	assertEqual(t, ErrNotPermitted, b.AssignRole(C_ID, ROLE_OWNER))
+	assertEqual(t, nil, b.AssignRole(C_ID, ROLE_EDITOR))
+	exchangeOperations(b, c)
+	insertString(c, "c")
+	exchangeOperations(c, a)
+	assertEqual(t, "c", a.Buffer.ToString())
+
+	// nor let viewers edit again, nor change the role of the creator
+	assertEqual(t, nil, a.AssignRole(C_ID, ROLE_VIEWER))
+	exchangeOperations(a, b)
+	assertEqual(t, ErrNotPermitted, b.AssignRole(C_ID, ROLE_EDITOR))
+	assertEqual(t, ErrNotPermitted, a.AssignRole(A_ID, ROLE_VIEWER))
+	assertEqual(t, ErrInvalidRole, a.AssignRole(C_ID, "admin"))
+}
+
+func TestRolesRecovered(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "recovery")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "recovery.json")
+
+	models := newTestModels(A_ID, B_ID)
+	a, b := models[0], models[1]
+	assertEqual(t, nil, a.AssignRole(B_ID, ROLE_EDITOR))
+	exchangeOperations(a, b)
+	insertString(b, "b")
+	assertEqual(t, nil, a.AssignRole(B_ID, ROLE_VIEWER))
+	exchangeOperations(b, a)
+
+	assertEqual(t, nil, SaveRecoveryFile(path, a.recoveryState()))
+	state, err := LoadRecoveryFile(path)
+	assertEqual(t, nil, err)
+	recovered, err := NewDocumentModelFromRecovery(state, 80, func() {}, nil)
+	assertEqual(t, nil, err)
+	assertEqual(t, "b", recovered.Buffer.ToString())
+	assertEqual(t, ROLE_VIEWER, recovered.SiteRole(B_ID))
+	for i, entry := range a.Log.Log {
+		assertEqual(t, entry.Vector, recovered.Log.Log[i].Vector)
+	}
+}
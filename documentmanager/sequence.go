@@ -0,0 +1,31 @@
+package documentmanager
+
+// The hub of a star network keeps the canonical operation log: clients send their
+// operations to the hub only, which applies them and forwards exactly the ones written
+// to its log, in log order. Operations with an invalid signature and duplicates are never
+// forwarded. Operations of viewers are, written to the log as rejected, since the later
+// operations depend on them and the clients reject them as well, see roles.go
+
+// SequenceRemoteOperations applies ops and returns the ones written to the log, in the
+// order they were written. Operations still waiting for others are returned by the call
+// that makes them ready
+func (model *DocumentModel) SequenceRemoteOperations(ops []RemoteOperation) []RemoteOperation {
+	model.Lock()
+	defer model.Unlock()
+	sequenced := make([]RemoteOperation, 0, len(ops))
+	for _, op := range ops {
+		sequenced = append(sequenced, model.applyRemoteOperation(op)...)
+	}
+	if len(sequenced) > 0 {
+		model.UpdateGUI()
+	}
+	return sequenced
+}
+
+// LogLength returns the number of operations in the log, which is the sequence
+// number of the next operation written to it
+func (model *DocumentModel) LogLength() int {
+	model.RLock()
+	defer model.RUnlock()
+	return len(model.Log.Log)
+}
@@ -0,0 +1,49 @@
+package documentmanager
+
+import (
+	. "../common"
+	"testing"
+)
+
+func TestSequenceRemoteOperations(t *testing.T) {
+	models := newTestModels(C_ID, A_ID, B_ID)
+	hub, a, b := models[0], models[1], models[2]
+	hub.AssignRole(A_ID, ROLE_EDITOR)
+	hub.AssignRole(B_ID, ROLE_EDITOR)
+	exchangeOperations(hub, a)
+	exchangeOperations(hub, b)
+	insertString(a, "ab")
+	insertString(b, "x")
+	aOps := a.Log.GetMissingOperations(hub.Log.Vector)
+	bOps := b.Log.GetMissingOperations(hub.Log.Vector)
+
+	// the second operation of a waits for the first
+	sequenced := hub.SequenceRemoteOperations([]RemoteOperation{aOps[1]})
+	assertEqual(t, 0, len(sequenced))
+	sequenced = hub.SequenceRemoteOperations([]RemoteOperation{aOps[0], bOps[0]})
+	assertEqual(t, 3, len(sequenced))
+	assertEqual(t, uint32(1), sequenced[0].Version)
+	assertEqual(t, uint32(2), sequenced[1].Version)
+	assertEqual(t, B_ID, sequenced[2].Id)
+	assertEqual(t, 5, hub.LogLength())
+
+	// duplicates aren't sequenced again
+	assertEqual(t, 0, len(hub.SequenceRemoteOperations(aOps)))
+	assertEqual(t, 5, hub.LogLength())
+
+	// operations of viewers are sequenced as rejected, by a modified client ignoring its role
+	hub.AssignRole(B_ID, ROLE_VIEWER)
+	exchangeOperations(hub, b)
+	b.DocId = ""
+	insertString(b, "y")
+	b.DocId = hub.DocId
+	assertEqual(t, 1, len(hub.SequenceRemoteOperations(b.Log.GetMissingOperations(hub.Log.Vector))))
+	assertEqual(t, 7, hub.LogLength())
+	assertEqual(t, "abx", hub.Buffer.ToString())
+
+	// a client applying the sequenced operations ends up with the document of the hub
+	client := newTestModels(C_ID, StringToSiteId("dddddddddddddddd"))[1]
+	client.SequenceRemoteOperations(hub.Log.GetMissingOperations(client.Log.Vector))
+	assertEqual(t, hub.Buffer.ToString(), client.Buffer.ToString())
+	assertEqual(t, hub.Log.Vector, client.Log.Vector)
+}
@@ -0,0 +1,121 @@
+package documentmanager
+
+import (
+	. "../common"
+	"../treedoc"
+	"../version"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// Every site has an Ed25519 keypair and its site id is derived from the public key, so
+// a site can only author operations with the key its id belongs to. Operations carry the
+// public key and a signature of their id, version, vector and treedoc operation. The
+// vector is signed since it decides the roles the operation is checked against, see
+// roles.go, and is kept in the log so resent operations carry the same one. Sites only
+// insert into nodes of their own, so no one can take over the node ids of another site.
+// Checkpoints are signed the same way by their author, see tags.go
+
+var (
+	ErrUnsigned          = errors.New("signature: operation or checkpoint is not signed")
+	ErrKeyDoesNotMatchId = errors.New("signature: public key does not belong to the site id")
+	ErrInvalidSignature  = errors.New("signature: invalid signature")
+	ErrForeignNodeId     = errors.New("signature: operation inserts into a node of another site")
+)
+
+// NewSiteKey generates the keypair of a new site
+func NewSiteKey() ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err.Error())
+	}
+	return key
+}
+
+func SiteIdFromPublicKey(pubKey ed25519.PublicKey) SiteId {
+	var id SiteId
+	sum := sha256.Sum256(pubKey)
+	copy(id[:], sum[:len(id)])
+	return id
+}
+
+// SetSigningKey makes the document edit as the site owning key: local operations are
+// signed and remote operations without a valid signature are dropped. It must be set
+// before the first local operation since it changes the site id of the document
+func (model *DocumentModel) SetSigningKey(key ed25519.PrivateKey) {
+	model.Lock()
+	defer model.Unlock()
+	model.SigningKey = key
+	model.OwnerId = SiteIdFromPublicKey(key.Public().(ed25519.PublicKey))
+	model.RequireSignatures = true
+}
+
+// caller must hold the lock of the model, returns nils if the document doesn't sign
+func (model *DocumentModel) sign(opVersion uint32, vector version.VersionVector, op treedoc.Operation) (pubKey, signature []byte) {
+	return model.signContent(signedContent(model.OwnerId, opVersion, vector, op))
+}
+
+// caller must hold the lock of the model, returns nils if the document doesn't sign
+func (model *DocumentModel) signContent(content []byte) (pubKey, signature []byte) {
+	if model.SigningKey == nil {
+		return nil, nil
+	}
+	pubKey = model.SigningKey.Public().(ed25519.PublicKey)
+	return pubKey, ed25519.Sign(model.SigningKey, content)
+}
+
+// VerifySignature checks that op was signed by the site it claims to come from and only
+// inserts into nodes of that site
+func (op RemoteOperation) VerifySignature() error {
+	err := verifySigned(op.Id, op.PubKey, op.Signature, signedContent(op.Id, op.Version, op.Vector, op.Op))
+	if err != nil {
+		return err
+	}
+	if !op.insertsIntoOwnNode() {
+		return ErrForeignNodeId
+	}
+	return nil
+}
+
+// checks that content was signed by site
+func verifySigned(site SiteId, pubKey, signature, content []byte) error {
+	if len(pubKey) != ed25519.PublicKeySize || len(signature) != ed25519.SignatureSize {
+		return ErrUnsigned
+	}
+	if SiteIdFromPublicKey(pubKey) != site {
+		return ErrKeyDoesNotMatchId
+	}
+	if !ed25519.Verify(pubKey, content, signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// deletes and role operations may name the nodes of any site
+func (op RemoteOperation) insertsIntoOwnNode() bool {
+	switch op.Op.Type {
+	case treedoc.INSERT_NEW, treedoc.INSERT_ROOT, treedoc.INSERT:
+		site, _ := treedoc.SeparateNodeID(op.Op.Id)
+		return site == op.Id
+	}
+	return true
+}
+
+func signedContent(id SiteId, opVersion uint32, vector version.VersionVector, op treedoc.Operation) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("treedoc operation")
+	buf.Write(id[:])
+	binary.Write(&buf, binary.BigEndian, opVersion)
+	buf.Write(vector.ToBinary())
+	buf.WriteByte(op.Type)
+	buf.Write(op.ParentId[:])
+	binary.Write(&buf, binary.BigEndian, op.ParentN)
+	buf.Write(op.Id[:])
+	binary.Write(&buf, binary.BigEndian, op.N)
+	buf.WriteByte(op.Atom)
+	return buf.Bytes()
+}
@@ -0,0 +1,100 @@
+package documentmanager
+
+import (
+	. "../common"
+	"crypto/ed25519"
+	"testing"
+)
+
+func newSignedTestModel() *DocumentModel {
+	model := NewDocumentModel(A_ID, 80, func() {}, nil)
+	model.SetSigningKey(NewSiteKey())
+	return model
+}
+
+func TestSignedOperations(t *testing.T) {
+	a := newSignedTestModel()
+	b := newSignedTestModel()
+	assertEqual(t, SiteIdFromPublicKey(a.SigningKey.Public().(ed25519.PublicKey)), a.OwnerId)
+	insertString(a, "abc")
+	exchangeOperations(a, b)
+	assertEqual(t, "abc", b.Buffer.ToString())
+
+	// forwarded operations keep the signature of the author
+	c := newSignedTestModel()
+	ops := b.Log.GetMissingOperations(c.Log.Vector)
+	for _, op := range ops {
+		assertEqual(t, nil, op.VerifySignature())
+	}
+	decoded, err := RemoteOperationsFromBinary(RemoteOperationsToBinary(ops))
+	assertEqual(t, nil, err)
+	assertEqual(t, ops, decoded)
+	assertEqual(t, ops, RemoteOperationsFromSlice(RemoteOperationsToSlice(ops)))
+
+	// tampered content
+	forged := ops[0]
+	forged.Op.Atom = 'x'
+	assertEqual(t, ErrInvalidSignature, forged.VerifySignature())
+	c.ApplyRemoteOperation(forged)
+	assertEqual(t, "", c.Buffer.ToString())
+
+	// tampered vector, which decides the roles the operation is checked against
+	forged = ops[1]
+	forged.Vector = forged.Vector.Copy()
+	forged.Vector.IncrementTo(b.OwnerId, 1)
+	assertEqual(t, ErrInvalidSignature, forged.VerifySignature())
+
+	// claiming to be another site
+	forged = ops[0]
+	forged.Id = b.OwnerId
+	assertEqual(t, ErrKeyDoesNotMatchId, forged.VerifySignature())
+
+	// unsigned
+	forged = ops[0]
+	forged.PubKey = nil
+	assertEqual(t, ErrUnsigned, forged.VerifySignature())
+	c.ApplyRemoteOperation(forged)
+	assertEqual(t, "", c.Buffer.ToString())
+
+	// signed with a key the site id doesn't belong to
+	mallory := NewSiteKey()
+	forged = ops[0]
+	forged.PubKey = mallory.Public().(ed25519.PublicKey)
+	forged.Signature = ed25519.Sign(mallory, signedContent(forged.Id, forged.Version, forged.Vector, forged.Op))
+	assertEqual(t, ErrKeyDoesNotMatchId, forged.VerifySignature())
+
+	// a site signing an insert into the nodes of another site
+	mallet := newSignedTestModel()
+	forged = ops[0]
+	forged.Id = mallet.OwnerId
+	mallet.Lock()
+	forged.PubKey, forged.Signature = mallet.sign(forged.Version, forged.Vector, forged.Op)
+	mallet.Unlock()
+	assertEqual(t, ErrForeignNodeId, forged.VerifySignature())
+	c.ApplyRemoteOperation(forged)
+	assertEqual(t, "", c.Buffer.ToString())
+
+	exchangeOperations(b, c)
+	assertEqual(t, "abc", c.Buffer.ToString())
+}
+
+func TestSignedRecovery(t *testing.T) {
+	a := newSignedTestModel()
+	insertString(a, "abc")
+	a.SetRoleGrant(RoleGrant{Role: ROLE_VIEWER, Version: 2, Signer: "key", Signature: "signature"})
+	a.RLock()
+	state := a.recoveryState()
+	a.RUnlock()
+	recovered, err := NewDocumentModelFromRecovery(state, 80, func() {}, nil)
+	assertEqual(t, nil, err)
+	assertEqual(t, a.OwnerId, recovered.OwnerId)
+	// rejoins with the role it had
+	assertEqual(t, a.RoleGrant, recovered.RoleGrant)
+	assertEqual(t, true, recovered.RequireSignatures)
+	recovered.Buffer.SetPosition(3)
+	insertString(recovered, "d")
+
+	b := newSignedTestModel()
+	exchangeOperations(recovered, b)
+	assertEqual(t, "abcd", b.Buffer.ToString())
+}
@@ -0,0 +1,175 @@
+package documentmanager
+
+import (
+	. "../common"
+	"../treedoc"
+	"../version"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+// Tag is a named checkpoint in the history of the document. Tags are
+// replicated as a grow-only set keyed by name and signed by their author
+// like operations, see signature.go
+type Tag struct {
+	Name      string
+	Author    SiteId
+	Vector    version.VersionVector
+	PubKey    []byte
+	Signature []byte
+}
+
+type TagJson struct {
+	Name      string
+	Author    SiteId
+	Vector    version.VersionVectorJson
+	PubKey    []byte `json:",omitempty"`
+	Signature []byte `json:",omitempty"`
+}
+
+var (
+	ErrEmptyTagName       = errors.New("checkpoint: name can't be empty")
+	ErrTagExists          = errors.New("checkpoint: a checkpoint with the same name already exists")
+	ErrTagNotFound        = errors.New("checkpoint: no checkpoint with that name")
+	ErrTagNotYetAvailable = errors.New("checkpoint: not all operations of the checkpoint have been received yet")
+)
+
+// CreateTag records the current version of the document under name and broadcasts it
+func (model *DocumentModel) CreateTag(name string) (Tag, error) {
+	model.Lock()
+	defer model.Unlock()
+	if name == "" {
+		return Tag{}, ErrEmptyTagName
+	}
+	if _, ok := model.Tags[name]; ok {
+		return Tag{}, ErrTagExists
+	}
+	tag := Tag{Name: name, Author: model.OwnerId, Vector: model.Log.Vector.Copy()}
+	tag.PubKey, tag.Signature = model.signContent(tag.signedContent())
+	model.Tags[name] = tag
+	model.notifyChanged()
+	if model.BroadcastTags != nil {
+		go model.BroadcastTags([]Tag{tag})
+	}
+	return tag, nil
+}
+
+// ApplyRemoteTags merges tags received from other sites. When two sites create a tag
+// with the same name concurrently, every site keeps the one from the smaller site id.
+// Tags without a valid signature of their author are dropped if the document requires them
+func (model *DocumentModel) ApplyRemoteTags(tags []Tag) {
+	model.Lock()
+	defer model.Unlock()
+	changed := false
+	for _, tag := range tags {
+		if model.RequireSignatures && tag.VerifySignature() != nil {
+			continue
+		}
+		existing, ok := model.Tags[tag.Name]
+		if !ok || tag.Author.ToString() < existing.Author.ToString() {
+			model.Tags[tag.Name] = tag
+			changed = true
+		}
+	}
+	if changed {
+		model.notifyChanged()
+	}
+}
+
+// GetTags returns all known tags ordered by name
+func (model *DocumentModel) GetTags() []Tag {
+	model.RLock()
+	defer model.RUnlock()
+	tags := make([]Tag, 0, len(model.Tags))
+	for _, tag := range model.Tags {
+		tags = append(tags, tag)
+	}
+	sort.Sort(tagList(tags))
+	return tags
+}
+
+// VerifySignature checks that tag was signed by its author
+func (tag Tag) VerifySignature() error {
+	return verifySigned(tag.Author, tag.PubKey, tag.Signature, tag.signedContent())
+}
+
+func (tag Tag) signedContent() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("checkpoint")
+	buf.Write(tag.Author[:])
+	buf.Write(tag.Vector.ToBinary())
+	buf.WriteString(tag.Name)
+	return buf.Bytes()
+}
+
+// TextAtTag returns the text of the document as it was when the tag was created
+func (model *DocumentModel) TextAtTag(name string) (string, error) {
+	model.RLock()
+	defer model.RUnlock()
+	tag, ok := model.Tags[name]
+	if !ok {
+		return "", ErrTagNotFound
+	}
+	compare := model.Log.Vector.Compare(tag.Vector)
+	if compare != version.GREATER_THAN && compare != version.EQUAL {
+		return "", ErrTagNotYetAvailable
+	}
+	return model.Log.TextAt(tag.Vector), nil
+}
+
+// TextAt rebuilds the text of the document containing only the operations in vector
+func (log *OperationLog) TextAt(vector version.VersionVector) string {
+	doc := treedoc.NewDocument()
+	for _, entry := range log.Log {
+		if entry.Version <= vector.Get(entry.Id) && entry.editsText() {
+			doc.ApplyOperation(entry.Operation)
+		}
+	}
+	return treedoc.DocToString(doc)
+}
+
+func TagsToSlice(tags []Tag) []byte {
+	tagsJson := make([]TagJson, len(tags))
+	for i, tag := range tags {
+		tagsJson[i] = tag.toJsonable()
+	}
+	b, _ := json.Marshal(tagsJson)
+	return b
+}
+
+func TagsFromSlice(slice []byte) ([]Tag, error) {
+	var tagsJson []TagJson
+	err := json.Unmarshal(slice, &tagsJson)
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]Tag, len(tagsJson))
+	for i, tag := range tagsJson {
+		tags[i] = tagFromJson(tag)
+	}
+	return tags, nil
+}
+
+func (tag Tag) toJsonable() TagJson {
+	return TagJson{Name: tag.Name, Author: tag.Author, Vector: tag.Vector.ToJsonable(), PubKey: tag.PubKey, Signature: tag.Signature}
+}
+
+func tagFromJson(tag TagJson) Tag {
+	return Tag{Name: tag.Name, Author: tag.Author, Vector: version.FromVersionVectorJson(tag.Vector), PubKey: tag.PubKey, Signature: tag.Signature}
+}
+
+type tagList []Tag
+
+func (list tagList) Len() int {
+	return len(list)
+}
+
+func (list tagList) Less(i, j int) bool {
+	return list[i].Name < list[j].Name
+}
+
+func (list tagList) Swap(i, j int) {
+	list[i], list[j] = list[j], list[i]
+}
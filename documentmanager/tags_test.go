@@ -0,0 +1,131 @@
+package documentmanager
+
+import (
+	"../version"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTagRoundTrip(t *testing.T) {
+	a := newTestModel(A_ID)
+	insertString(a, "abc")
+	_, err := a.CreateTag("draft")
+	assertEqual(t, nil, err)
+	_, err = a.CreateTag("draft")
+	assertEqual(t, ErrTagExists, err)
+	_, err = a.CreateTag("")
+	assertEqual(t, ErrEmptyTagName, err)
+
+	a.LocalBackspace()
+	insertString(a, "def")
+	assertEqual(t, "abdef", a.Buffer.ToString())
+	text, err := a.TextAtTag("draft")
+	assertEqual(t, nil, err)
+	assertEqual(t, "abc", text)
+	_, err = a.TextAtTag("final")
+	assertEqual(t, ErrTagNotFound, err)
+
+	tags, err := TagsFromSlice(TagsToSlice(a.GetTags()))
+	assertEqual(t, nil, err)
+	assertEqual(t, a.GetTags(), tags)
+}
+
+func TestRemoteTags(t *testing.T) {
+	a := newTestModel(A_ID)
+	b := newTestModel(B_ID)
+	insertString(a, "abc")
+	tag, _ := a.CreateTag("draft")
+
+	// tag arrives before the operations it refers to
+	b.ApplyRemoteTags([]Tag{tag})
+	_, err := b.TextAtTag("draft")
+	assertEqual(t, ErrTagNotYetAvailable, err)
+	exchangeOperations(a, b)
+	text, err := b.TextAtTag("draft")
+	assertEqual(t, nil, err)
+	assertEqual(t, "abc", text)
+
+	// concurrent tags with the same name converge
+	insertString(b, "x")
+	bTag, _ := b.CreateTag("final")
+	aTag, _ := a.CreateTag("final")
+	a.ApplyRemoteTags([]Tag{bTag})
+	b.ApplyRemoteTags([]Tag{aTag})
+	assertEqual(t, a.GetTags(), b.GetTags())
+	assertEqual(t, A_ID, a.GetTags()[1].Author)
+}
+
+func TestTagsAutosaved(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "autosave")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "recovery.json")
+
+	a := newTestModel(A_ID)
+	b := newTestModel(B_ID)
+	saver := NewAutosaver(path, 10*time.Millisecond)
+	saver.Start(a)
+	defer saver.Stop(a)
+	tagged := func(count int) bool {
+		state, err := LoadRecoveryFile(path)
+		return err == nil && len(state.Tags) == count
+	}
+	a.CreateTag("draft")
+	for i := 0; i < 100 && !tagged(1); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertEqual(t, true, tagged(1))
+
+	tag, _ := b.CreateTag("final")
+	a.ApplyRemoteTags([]Tag{tag})
+	for i := 0; i < 100 && !tagged(2); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertEqual(t, true, tagged(2))
+}
+
+func TestDiffSinceTag(t *testing.T) {
+	a := newTestModel(A_ID)
+	insertString(a, "one\ntwo\nthree")
+	a.CreateTag("draft")
+	for i := 0; i < len("three"); i++ {
+		a.LocalBackspace()
+	}
+	insertString(a, "four")
+	diff, err := a.DiffSinceTag("draft")
+	assertEqual(t, nil, err)
+	assertEqual(t, []DiffLine{{' ', "one"}, {' ', "two"}, {'-', "three"}, {'+', "four"}}, diff)
+	_, err = a.DiffSinceTag("final")
+	assertEqual(t, ErrTagNotFound, err)
+
+	assertEqual(t, []DiffLine{{'+', "a"}, {' ', "b"}, {'-', "c"}}, diffLines([]string{"b", "c"}, []string{"a", "b"}))
+}
+
+func TestSignedTags(t *testing.T) {
+	a := newSignedTestModel()
+	b := newSignedTestModel()
+	insertString(a, "abc")
+	tag, _ := a.CreateTag("draft")
+	assertEqual(t, nil, tag.VerifySignature())
+	tags, _ := TagsFromSlice(TagsToSlice([]Tag{tag}))
+	assertEqual(t, nil, tags[0].VerifySignature())
+
+	// moved to another version, claimed by another site or unsigned
+	forged := tag
+	forged.Name = "moved"
+	forged.Vector = version.NewVector()
+	unsigned := Tag{Name: "unsigned", Author: a.OwnerId, Vector: tag.Vector}
+	claimed := tag
+	claimed.Name = "claimed"
+	claimed.Author = b.OwnerId
+	b.ApplyRemoteTags([]Tag{forged, unsigned, claimed})
+	assertEqual(t, 0, len(b.GetTags()))
+	assertEqual(t, ErrInvalidSignature, forged.VerifySignature())
+	assertEqual(t, ErrUnsigned, unsigned.VerifySignature())
+	assertEqual(t, ErrKeyDoesNotMatchId, claimed.VerifySignature())
+
+	b.ApplyRemoteTags([]Tag{tag})
+	assertEqual(t, []Tag{tag}, b.GetTags())
+}
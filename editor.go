@@ -3,28 +3,146 @@ package main
 import (
 	"./gui"
 	"./network"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/user"
+	"strings"
+	"time"
 )
 
 func main() {
-	if len(os.Args) < 2 || len(os.Args) > 3 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <listening port> [public listening port]\n", os.Args[0])
+	autosaveInterval := flag.Duration("autosave", 5*time.Second, "minimum time between autosaves of the document, 0 disables autosave")
+	recoveryFile := flag.String("recovery", "", "path of the recovery file (default: recovery_<listening port>.json)")
+	identityFile := flag.String("identity", "", "file keeping the identity peers recognize this node by across restarts, created if it doesn't exist (default: identity_<listening port>.txt)")
+	name := flag.String("name", "", "name shown to the other users (default: your login name)")
+	color := flag.String("color", "", "color of your cursor and name, one of "+strings.Join(network.ProfileColors, ", ")+" (default: picked from the identity)")
+	contact := flag.String("contact", "", "contact info shown to the other users, e.g. an email address")
+	codec := flag.String("codec", network.CodecBinary, "preferred wire encoding of messages, binary or json (readable, for debugging)")
+	useTLS := flag.Bool("tls", false, "encrypt all connections with TLS, peers must use TLS as well")
+	tlsCert := flag.String("tls-cert", "", "certificate presented to peers, a self-signed one is created if it doesn't exist (default: tls_<listening port>.crt)")
+	tlsKey := flag.String("tls-key", "", "private key of the certificate (default: tls_<listening port>.key)")
+	tlsCA := flag.String("tls-ca", "", "accept peers with a certificate signed by a CA in this PEM file")
+	tlsTrust := flag.String("tls-trust", "", "accept peers whose certificate SHA-256 fingerprint is listed in this file")
+	secret := flag.String("secret", "", "shared secret required to join the network")
+	secretFile := flag.String("secret-file", "", "read the shared secret from this file instead")
+	heartbeat := flag.Duration("heartbeat", time.Second, "interval between heartbeats sent to every connected peer")
+	suspectTimeout := flag.Duration("suspect-timeout", 5*time.Second, "a peer silent for about this long is suspect, longer on a link whose delays vary")
+	unreachableTimeout := flag.Duration("unreachable-timeout", 15*time.Second, "a peer silent for this long is disconnected and reconnected")
+	reconnectMin := flag.Duration("reconnect-min", time.Second, "delay before the first attempt to reconnect to a peer, doubled after each failure")
+	reconnectMax := flag.Duration("reconnect-max", 30*time.Second, "maximum delay between attempts to reconnect to a peer")
+	topology := flag.String("topology", network.TopologyMesh, "mesh, star to only connect to the hub, or hub to be the authoritative hub of a star")
+	maxPeers := flag.Int("max-peers", 0, "connect to a random sample of at most this many peers instead of all of them, 0 is unlimited")
+	relayMode := flag.Bool("relay", false, "run as a relay that forwards connections to peers started with -via-relay, instead of editing")
+	viaRelay := flag.String("via-relay", "", "accept connections through the relay at this address, for peers that can't accept connections")
+	discover := flag.Bool("discover", false, "announce the open document on the local network and list the documents of others in Connect")
+	discoveryAddr := flag.String("discovery-addr", network.DefaultDiscoveryAddr, "UDP multicast group used by -discover")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <listening port> [public listening port]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 1 || len(args) > 2 {
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	localAddr := os.Args[1]
-	publicAddr := os.Args[1]
-	if len(os.Args) == 3 {
-		publicAddr = os.Args[2]
+	localAddr := args[0]
+	publicAddr := args[0]
+	if len(args) == 2 {
+		publicAddr = args[1]
+	}
+	if *relayMode {
+		fmt.Println("Relaying connections on " + localAddr)
+		err := network.RunRelay(localAddr)
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if *codec != network.CodecBinary && *codec != network.CodecJson {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *topology != network.TopologyMesh && *topology != network.TopologyStar && *topology != network.TopologyHub {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *color != "" && !network.IsProfileColor(*color) {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *name == "" {
+		if u, err := user.Current(); err == nil {
+			*name = u.Username
+		}
+	}
+	if *recoveryFile == "" {
+		*recoveryFile = "recovery_" + strings.Replace(localAddr, ":", "_", -1) + ".json"
+	}
+	if *identityFile == "" {
+		*identityFile = "identity_" + strings.Replace(localAddr, ":", "_", -1) + ".txt"
+	}
+	identity, err := network.LoadIdentity(*identityFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	config := network.Config{
+		Codec:              *codec,
+		Identity:           identity,
+		Profile:            network.Profile{Name: *name, Color: *color, Contact: *contact},
+		Secret:             *secret,
+		HeartbeatInterval:  *heartbeat,
+		SuspectTimeout:     *suspectTimeout,
+		UnreachableTimeout: *unreachableTimeout,
+		ReconnectMinDelay:  *reconnectMin,
+		ReconnectMaxDelay:  *reconnectMax,
+		Topology:           *topology,
+		MaxPeers:           *maxPeers,
+		Relay:              *viaRelay,
+		Discovery:          *discover,
+		DiscoveryAddr:      *discoveryAddr,
+	}
+	if *secretFile != "" {
+		data, err := ioutil.ReadFile(*secretFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		config.Secret = strings.TrimSpace(string(data))
+	}
+	if *useTLS {
+		portName := strings.Replace(localAddr, ":", "_", -1)
+		if *tlsCert == "" {
+			*tlsCert = "tls_" + portName + ".crt"
+		}
+		if *tlsKey == "" {
+			*tlsKey = "tls_" + portName + ".key"
+		}
+		tlsConfig, err := network.NewTLSConfig(network.TLSOptions{
+			CertFile:  *tlsCert,
+			KeyFile:   *tlsKey,
+			CAFile:    *tlsCA,
+			TrustFile: *tlsTrust,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		config.TLS = tlsConfig
 	}
 
-	networkManager, err := network.NewNetworkManager(localAddr, publicAddr)
+	networkManager, err := network.NewNetworkManager(localAddr, publicAddr, config)
 
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v", err)
 		os.Exit(1)
 	}
 
-	gui.StartMainLoop(networkManager)
+	gui.StartMainLoop(networkManager, gui.Config{
+		RecoveryFile:     *recoveryFile,
+		AutosaveInterval: *autosaveInterval,
+	})
 }
@@ -5,9 +5,31 @@ import (
 )
 
 func redrawEditor(screenY, height int) int {
-	screenY, cursorX, cursorY, lines := appState.DocModel.Buffer.GetDisplayInformation(screenY, height)
+	docModel := editedDocument()
+	cursors := make([]remoteCursor, 0)
+	// the others see where we left the shared document and which branch we edit
+	updatePresence(appState.DocModel)
+	if appState.Branch == nil {
+		// branches aren't shared with the network
+		cursors = remoteCursors(docModel)
+	}
+	textHeight := height
+	if len(cursors) > 0 {
+		// the last line names the other users
+		textHeight--
+	}
+	screenY, cursorX, cursorY, lines := docModel.Buffer.GetDisplayInformation(screenY, textHeight)
 	termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
-	drawLines(lines, height)
+	drawLines(lines, textHeight)
+	if start, end, ok := docModel.Selection(); ok {
+		highlight(docModel.Buffer, lines, screenY, textHeight, start, end, func(cell *termbox.Cell) {
+			cell.Fg |= termbox.AttrReverse
+		})
+	}
+	for _, c := range cursors {
+		drawRemoteCursor(docModel.Buffer, lines, screenY, textHeight, c)
+	}
+	drawLegend(cursors, height-1)
 	termbox.SetCursor(cursorX, cursorY)
 	termbox.Flush()
 	return screenY
@@ -17,7 +39,7 @@ func DrawEditor() {
 	width, height := termbox.Size()
 	termbox.SetInputMode(termbox.InputEsc)
 	termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
-	docModel := appState.DocModel
+	docModel := editedDocument()
 	docModel.Buffer.Resize(width - 1)
 	appState.ScreenY = redrawEditor(appState.ScreenY, height)
 
@@ -65,7 +87,11 @@ func DrawEditor() {
 				docModel.LocalInsert('\n')
 				appState.ScreenY = redrawEditor(appState.ScreenY, height)
 			default:
-				if ev.Key == 0 && ev.Ch <= 256 {
+				if ev.Key == termbox.KeyCtrlSpace && ev.Ch == 0 {
+					// starts or ends a selection
+					docModel.ToggleMark()
+					appState.ScreenY = redrawEditor(appState.ScreenY, height)
+				} else if ev.Key == 0 && ev.Ch <= 256 {
 					docModel.LocalInsert(byte(ev.Ch))
 					appState.ScreenY = redrawEditor(appState.ScreenY, height)
 				}
@@ -79,7 +105,7 @@ func DrawEditor() {
 			termbox.HideCursor()
 			appState.ScreenY = redrawEditor(appState.ScreenY, height)
 		case termbox.EventInterrupt:
-			// remote operations
+			// remote operations and presence
 			appState.ScreenY = redrawEditor(appState.ScreenY, height)
 		case termbox.EventError:
 			termbox.Close()
@@ -8,9 +8,11 @@ import (
 	"../version"
 	"fmt"
 	"github.com/nsf/termbox-go"
-	"github.com/satori/go.uuid"
+	"io/ioutil"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // States
@@ -20,21 +22,57 @@ const STATE_EXIT = 10
 const STATE_DOCUMENT = 20
 const STATE_CONNECT = 30
 const STATE_ERROR = 40
+const STATE_RECOVER = 50
+const STATE_MERGE_REPORT = 60
+const STATE_CREATE_TAG = 70
+const STATE_TAGS = 80
+const STATE_TAG_VIEW = 90
+const STATE_ROLES = 100
+const STATE_NEW_DOCUMENT = 110
+const STATE_BLAME = 120
+const STATE_TAG_DIFF = 130
+
+// typed in the checkpoint view to compare the checkpoint with the current document
+const TAG_VIEW_DIFF = "diff"
 
 // Menu Options
 const OPTION_EXIT = "Exit"
 const OPTION_CONNECT = "Connect"
 const OPTION_DISCONNECT = "Disconnect"
+const OPTION_RECONNECT = "Reconnect"
+const OPTION_RECONNECT_NOW = "Reconnect To Peers Now"
+const OPTION_MERGE_REPORT = "Merge Report"
+const OPTION_CREATE_TAG = "Create Checkpoint"
+const OPTION_TAGS = "Checkpoints"
+const OPTION_BLAME = "Blame"
+const OPTION_FORK = "Fork Document"
+const OPTION_MERGE_BRANCH = "Merge Branch Back"
+const OPTION_DISCARD_BRANCH = "Discard Branch"
+const OPTION_ROLES = "Manage Roles"
 const OPTION_NEW_DOCUMENT = "New Document"
 const OPTION_CLOSE_DOCUMENT = "Close Document"
+const OPTION_RECOVER_NEW = "Recover As New Document"
+const OPTION_RECOVER_REJOIN = "Recover And Rejoin Network"
+const OPTION_RECOVER_DISCARD = "Discard Recovery File"
+
+// Config holds the startup options of the editor
+type Config struct {
+	RecoveryFile     string
+	AutosaveInterval time.Duration // 0 disables autosave
+}
 
 var appState struct {
-	State       int
-	DocModel    *documentmanager.DocumentModel
+	State    int
+	DocModel *documentmanager.DocumentModel
+	// a fork of DocModel being edited instead of it, DocModel stays attached to the network
+	Branch      *documentmanager.DocumentModel
 	ScreenY     int
 	MenuOptions []string
 	Manager     *network.NetworkManager
 	TempData    interface{}
+	Config      Config
+	// sessions listed on the connect screen
+	Discovered []network.DiscoveredSession
 }
 
 func doAction(input string) {
@@ -49,30 +87,173 @@ func doAction(input string) {
 		} else if appState.MenuOptions[n-1] == OPTION_CONNECT {
 			appState.State = STATE_CONNECT
 		} else if appState.MenuOptions[n-1] == OPTION_DISCONNECT {
-			appState.Manager.Disconnect()
+			err = appState.Manager.Disconnect()
 			if err != nil {
 				appState.State = STATE_ERROR
 				appState.TempData = err
+			} else {
+				appState.DocModel.GoOffline()
 			}
-		} else if appState.MenuOptions[n-1] == OPTION_NEW_DOCUMENT {
-			appState.DocModel = newDocument(StringToSiteId(uuid.NewV1().String()))
-			appState.ScreenY = 0
+		} else if appState.MenuOptions[n-1] == OPTION_RECONNECT {
+			err = appState.Manager.Reconnect()
+			if err != nil {
+				appState.State = STATE_ERROR
+				appState.TempData = err
+			} else {
+				appState.DocModel.GoOnline()
+			}
+		} else if appState.MenuOptions[n-1] == OPTION_RECONNECT_NOW {
+			appState.Manager.ReconnectNow()
+		} else if appState.MenuOptions[n-1] == OPTION_MERGE_REPORT {
+			appState.State = STATE_MERGE_REPORT
+		} else if appState.MenuOptions[n-1] == OPTION_CREATE_TAG {
+			appState.State = STATE_CREATE_TAG
+		} else if appState.MenuOptions[n-1] == OPTION_ROLES {
+			appState.State = STATE_ROLES
+		} else if appState.MenuOptions[n-1] == OPTION_TAGS {
+			appState.State = STATE_TAGS
+		} else if appState.MenuOptions[n-1] == OPTION_BLAME {
+			appState.State = STATE_BLAME
+		} else if appState.MenuOptions[n-1] == OPTION_FORK {
+			appState.Branch = forkDocument(appState.DocModel)
+			appState.DocModel.SetBranch(appState.Branch)
 			appState.State = STATE_DOCUMENT
+		} else if appState.MenuOptions[n-1] == OPTION_MERGE_BRANCH {
+			// a refused merge keeps the branch, it can still be merged once allowed to edit
+			if _, err := appState.DocModel.MergeBranch(appState.Branch); err != nil {
+				appState.State = STATE_ERROR
+				appState.TempData = err
+			} else {
+				appState.DocModel.SetBranch(nil)
+				appState.Branch = nil
+			}
+		} else if appState.MenuOptions[n-1] == OPTION_DISCARD_BRANCH {
+			appState.DocModel.SetBranch(nil)
+			appState.Branch = nil
+		} else if appState.MenuOptions[n-1] == OPTION_NEW_DOCUMENT {
+			appState.State = STATE_NEW_DOCUMENT
 		} else if appState.MenuOptions[n-1] == OPTION_CLOSE_DOCUMENT {
 			appState.Manager.CompleteDisconnect()
-			appState.DocModel = nil
+			closeDocument(true)
 		} else {
 			appState.State = STATE_MENU_RETRY
 		}
+	} else if appState.State == STATE_NEW_DOCUMENT {
+		docModel := newDocument()
+		docModel.Name = strings.TrimSpace(input)
+		openDocument(docModel)
+		appState.State = STATE_DOCUMENT
+	} else if appState.State == STATE_CREATE_TAG {
+		_, err := appState.DocModel.CreateTag(input)
+		if err != nil {
+			appState.State = STATE_ERROR
+			appState.TempData = err
+		} else {
+			appState.State = STATE_MENU
+		}
+	} else if appState.State == STATE_ROLES {
+		fields := strings.Fields(input)
+		peers := rolePeers()
+		if len(fields) != 2 {
+			appState.State = STATE_MENU
+			return
+		}
+		n, err := strconv.Atoi(fields[0])
+		if err != nil || n < 1 || n > len(peers) {
+			appState.State = STATE_MENU
+			return
+		}
+		err = appState.Manager.SetRole(peers[n-1].Id, fields[1])
+		if err != nil {
+			appState.State = STATE_ERROR
+			appState.TempData = err
+		}
+	} else if appState.State == STATE_TAGS {
+		tags := appState.DocModel.GetTags()
+		n, err := strconv.Atoi(input)
+		if err != nil || n < 1 || n > len(tags) {
+			appState.State = STATE_MENU
+			return
+		}
+		appState.TempData = tags[n-1].Name
+		appState.State = STATE_TAG_VIEW
+	} else if appState.State == STATE_TAG_VIEW {
+		if input == "" {
+			appState.State = STATE_TAGS
+			return
+		}
+		if input == TAG_VIEW_DIFF {
+			appState.State = STATE_TAG_DIFF
+			return
+		}
+		text, err := appState.DocModel.TextAtTag(appState.TempData.(string))
+		if err == nil {
+			err = ioutil.WriteFile(input, []byte(text), 0644)
+		}
+		if err != nil {
+			appState.State = STATE_ERROR
+			appState.TempData = err
+		} else {
+			appState.State = STATE_MENU
+		}
+	} else if appState.State == STATE_RECOVER {
+		n, err := strconv.Atoi(input)
+		if err != nil || n < 1 || n > len(appState.MenuOptions) {
+			return
+		}
+		if appState.MenuOptions[n-1] == OPTION_RECOVER_DISCARD {
+			documentmanager.RemoveRecoveryFile(appState.Config.RecoveryFile)
+			appState.State = STATE_MENU
+			return
+		}
+		state, err := documentmanager.LoadRecoveryFile(appState.Config.RecoveryFile)
+		if err != nil {
+			appState.State = STATE_ERROR
+			appState.TempData = err
+			return
+		}
+		if appState.MenuOptions[n-1] == OPTION_RECOVER_NEW {
+			docModel := newDocumentFromText(state.Text)
+			docModel.Name = state.Name
+			openDocument(docModel)
+			appState.State = STATE_DOCUMENT
+		} else if appState.MenuOptions[n-1] == OPTION_RECOVER_REJOIN {
+			docModel, err := newDocumentFromRecovery(state)
+			if err != nil {
+				appState.State = STATE_ERROR
+				appState.TempData = err
+				return
+			}
+			openDocument(docModel)
+			appState.State = STATE_CONNECT
+		}
 	} else if appState.State == STATE_CONNECT {
+		var discovered *network.DiscoveredSession
+		if n, err := strconv.Atoi(input); err == nil && n >= 1 && n <= len(appState.Discovered) {
+			discovered = &appState.Discovered[n-1]
+			input = discovered.Addr
+		}
 		err := appState.Manager.ConnectTo(input)
+		if err == nil {
+			joinDocument()
+		}
+		if err == nil && discovered != nil && appState.DocModel.Name == "" {
+			// an unnamed document takes the name of the session joined
+			setDocumentName(discovered.Name)
+		}
+		if appState.Manager.IsConnected() {
+			// ConnectTo starts a new session if we were disconnected
+			appState.DocModel.GoOnline()
+		}
 		if err != nil {
 			appState.State = STATE_ERROR
 			appState.TempData = err
 		} else {
 			appState.State = STATE_MENU
 		}
-	} else if appState.State == STATE_ERROR {
+	} else if appState.State == STATE_TAG_DIFF {
+		appState.State = STATE_TAG_VIEW
+	} else if appState.State == STATE_ERROR || appState.State == STATE_MERGE_REPORT || appState.State == STATE_BLAME {
 		appState.State = STATE_MENU
 	}
 }
@@ -84,7 +265,29 @@ func getPrompt() *buffer.Prompt {
 			options = append(options, OPTION_NEW_DOCUMENT)
 		} else {
 			options = append(options, OPTION_CONNECT)
-			options = append(options, OPTION_DISCONNECT)
+			if appState.Manager.IsConnected() {
+				options = append(options, OPTION_DISCONNECT)
+				if hasDisconnectedPeers() {
+					options = append(options, OPTION_RECONNECT_NOW)
+				}
+			} else {
+				options = append(options, OPTION_RECONNECT)
+			}
+			if appState.DocModel.HasMergeReport() {
+				options = append(options, OPTION_MERGE_REPORT)
+			}
+			if appState.Manager.LocalRole() == ROLE_OWNER && appState.Manager.IsConnected() {
+				options = append(options, OPTION_ROLES)
+			}
+			options = append(options, OPTION_CREATE_TAG)
+			options = append(options, OPTION_TAGS)
+			options = append(options, OPTION_BLAME)
+			if appState.Branch == nil {
+				options = append(options, OPTION_FORK)
+			} else {
+				options = append(options, OPTION_MERGE_BRANCH)
+				options = append(options, OPTION_DISCARD_BRANCH)
+			}
 			options = append(options, OPTION_CLOSE_DOCUMENT)
 		}
 		options = append(options, OPTION_EXIT)
@@ -99,18 +302,126 @@ func getPrompt() *buffer.Prompt {
 		str += "\nPeers In Network:\n"
 		netMeta := appState.Manager.GetNetworkMetadata().ToList()
 		sort.Sort(netMeta)
+		incompatible := appState.Manager.GetIncompatiblePeers()
+		peerStatus := appState.Manager.GetPeerStatus()
+		branches := peerBranches()
 		for _, node := range netMeta {
-			str += node.Id + ": Addr = " + node.Addr + ", Left = " + strconv.FormatBool(node.Left) + "\n"
+			str += peerName(node) + ": Addr = " + node.Addr + ", Left = " + strconv.FormatBool(node.Left) + ", Role = " + roleName(node.Role)
+			if node.Color != "" {
+				str += ", Color = " + node.Color
+			}
+			if node.Contact != "" {
+				str += ", Contact = " + node.Contact
+			}
+			if node.Topology == network.TopologyHub {
+				str += ", Hub"
+			}
+			if branch, ok := branches[node.Id]; ok {
+				str += ", Editing branch " + branch
+			}
+			if status, ok := peerStatus[node.Id]; ok && !node.Left {
+				str += ", Status = " + peerStatusString(status)
+			}
+			if reason, ok := incompatible[node.Id]; ok {
+				str += ", Incompatible = " + reason
+			}
+			str += "\n"
 		}
 		str += "\n"
+		if appState.Branch != nil {
+			str += "Editing branch " + appState.Branch.DocId + " forked from " + appState.Branch.ParentDocId + "\n\n"
+		}
+		if fingerprint := appState.Manager.TLSFingerprint(); fingerprint != "" {
+			str += "TLS certificate fingerprint: " + fingerprint + "\n\n"
+		}
+		if appState.DocModel != nil && appState.Manager.Topology() == network.TopologyHub {
+			str += "Hub of the network: " + strconv.Itoa(appState.DocModel.LogLength()) + " operations in the canonical log\n\n"
+		}
+		if appState.DocModel != nil && appState.DocModel.IsReadOnly() {
+			str += "The document is read only: you are a viewer, or no one let you edit yet\n\n"
+		}
+		if appState.DocModel != nil && appState.DocModel.IsOffline() {
+			str += "Offline: edits are kept and exchanged once reconnected\n\n"
+		}
 		if appState.State == STATE_MENU_RETRY {
 			str += "Input is not a valid input, please try again: "
 		} else {
 			str += "Enter number to exectute option: "
 		}
 		return buffer.NewPrompt(str)
+	} else if appState.State == STATE_RECOVER {
+		options := []string{OPTION_RECOVER_NEW, OPTION_RECOVER_REJOIN, OPTION_RECOVER_DISCARD}
+		appState.MenuOptions = options
+		str := "A recovery file from a previous session was found at " + appState.Config.RecoveryFile + "\n\n"
+		for i, option := range options {
+			str += strconv.Itoa(i+1) + ". " + option + "\n"
+		}
+		str += "\nEnter number to exectute option: "
+		return buffer.NewPrompt(str)
 	} else if appState.State == STATE_CONNECT {
-		return buffer.NewPrompt("Enter ip to connect to: ")
+		appState.Discovered = appState.Manager.DiscoveredSessions()
+		str := ""
+		if len(appState.Discovered) > 0 {
+			str += "Documents on the local network:\n\n"
+			for i, session := range appState.Discovered {
+				str += strconv.Itoa(i+1) + ". " + session.Name + " (" + session.Addr
+				if session.Peers > 1 {
+					str += " and " + strconv.Itoa(session.Peers-1) + " more"
+				}
+				str += ")"
+				if session.Authenticate {
+					str += ", requires the shared secret"
+				}
+				str += "\n"
+			}
+			str += "\nEnter the number of a document or an ip to connect to: "
+		} else {
+			str += "Enter ip to connect to: "
+		}
+		return buffer.NewPrompt(str)
+	} else if appState.State == STATE_NEW_DOCUMENT {
+		return buffer.NewPrompt("Enter a name for the document: ")
+	} else if appState.State == STATE_CREATE_TAG {
+		return buffer.NewPrompt("Enter a name for the checkpoint: ")
+	} else if appState.State == STATE_ROLES {
+		str := "Peers:\n\n"
+		for i, node := range rolePeers() {
+			str += strconv.Itoa(i+1) + ". " + peerName(node) + " (" + node.Addr + "): " + roleName(node.Role) + "\n"
+		}
+		str += "\nEnter the number of a peer and its new role (" + ROLE_OWNER + ", " + ROLE_EDITOR + " or " + ROLE_VIEWER +
+			"), e.g. \"1 " + ROLE_VIEWER + "\", or leave empty to go back: "
+		return buffer.NewPrompt(str)
+	} else if appState.State == STATE_TAGS {
+		str := "Checkpoints:\n\n"
+		for i, tag := range appState.DocModel.GetTags() {
+			str += strconv.Itoa(i+1) + ". " + tag.Name + " (by " + siteName(tag.Author) + ")\n"
+		}
+		str += "\nEnter number of the checkpoint to view, or leave empty to go back: "
+		return buffer.NewPrompt(str)
+	} else if appState.State == STATE_TAG_VIEW {
+		name := appState.TempData.(string)
+		text, err := appState.DocModel.TextAtTag(name)
+		if err != nil {
+			text = err.Error()
+		}
+		str := "Document at checkpoint " + name + ":\n\n" + text + "\n\n"
+		str += "Enter a file path to export the checkpoint to, \"" + TAG_VIEW_DIFF +
+			"\" to see what changed since, or leave empty to go back: "
+		return buffer.NewPrompt(str)
+	} else if appState.State == STATE_TAG_DIFF {
+		name := appState.TempData.(string)
+		diff, err := appState.DocModel.DiffSinceTag(name)
+		str := "Changes since checkpoint " + name + ":\n\n"
+		if err != nil {
+			str += err.Error() + "\n"
+		} else {
+			str += diffToString(diff)
+		}
+		return buffer.NewPrompt(str + "\nPress Enter to continue")
+	} else if appState.State == STATE_MERGE_REPORT {
+		return buffer.NewPrompt(mergeReportToString(appState.DocModel.MergeReport()) + "\nPress Enter to continue")
+	} else if appState.State == STATE_BLAME {
+		return buffer.NewPrompt(blameToString(editedDocument().Blame()) + "\nPress Enter to continue")
 	} else if appState.State == STATE_ERROR {
 		err := appState.TempData.(error)
 		str := fmt.Sprintf("%v\n\nPress Enter to continue", err)
@@ -119,7 +430,7 @@ func getPrompt() *buffer.Prompt {
 	panic("UNKNOWN STATE " + strconv.Itoa(appState.State))
 }
 
-func StartMainLoop(manager *network.NetworkManager) {
+func StartMainLoop(manager *network.NetworkManager, config Config) {
 	err := termbox.Init()
 	if err != nil {
 		panic(err)
@@ -127,6 +438,10 @@ func StartMainLoop(manager *network.NetworkManager) {
 	defer termbox.Close()
 
 	appState.State = STATE_MENU
+	appState.Config = config
+	if config.RecoveryFile != "" && documentmanager.HasRecoveryFile(config.RecoveryFile) {
+		appState.State = STATE_RECOVER
+	}
 	appState.Manager = manager
 	appState.Manager.SetRemoteOpHandler(func(msg []byte) {
 		if appState.DocModel != nil {
@@ -138,25 +453,55 @@ func StartMainLoop(manager *network.NetworkManager) {
 	})
 	appState.Manager.SetGetOpsReceiveVersion(func() []byte {
 		if appState.DocModel != nil {
-			return appState.DocModel.GetVersionVectorReceived().MarshalJSON()
+			return appState.DocModel.GetVersionVectorReceived().ToBinary()
 		} else {
 			return nil
 		}
 	})
-	appState.Manager.SetVersionCheckHandler(func(data []byte) ([]byte, bool) {
-		err, vector := version.UnmarshalJSON(data)
+	appState.Manager.SetTagHandler(func(data []byte) {
+		tags, err := documentmanager.TagsFromSlice(data)
 		if appState.DocModel != nil && err == nil {
-			ops, queueOps := appState.DocModel.GetMissingOperations(vector)
-			ops = append(ops, queueOps...)
+			appState.DocModel.ApplyRemoteTags(tags)
+		}
+	})
+	appState.Manager.SetGetTags(func() []byte {
+		if appState.DocModel != nil {
+			return documentmanager.TagsToSlice(appState.DocModel.GetTags())
+		} else {
+			return nil
+		}
+	})
+	appState.Manager.SetSequenceHandler(func(data []byte) ([]byte, bool) {
+		if appState.DocModel != nil {
+			ops := appState.DocModel.SequenceRemoteOperations(documentmanager.RemoteOperationsFromSlice(data))
+			if len(ops) > 0 {
+				return documentmanager.RemoteOperationsToBinary(ops), true
+			}
+		}
+		return nil, false
+	})
+	appState.Manager.SetNetMetaHandler(handleNetMeta)
+	appState.Manager.SetPresenceHandler(updateGUI)
+	appState.Manager.SetPartitionHandler(handlePartition)
+	appState.Manager.SetRangeRequestHandler(func(data []byte) ([]byte, bool) {
+		ranges, err := version.RangesFromSlice(data)
+		if appState.DocModel != nil && err == nil {
+			ops := appState.DocModel.GetOperationsInRanges(ranges)
 			if len(ops) > 0 {
-				return documentmanager.RemoteOperationsToSlice(ops), true
+				return documentmanager.RemoteOperationsToBinary(ops), true
 			}
 		}
 		return nil, false
 	})
+	if manager.Topology() == network.TopologyHub {
+		openHubDocument()
+	}
 	for {
 		if appState.State == STATE_EXIT {
-			appState.Manager.Disconnect()
+			appState.Manager.Close()
+			if appState.DocModel != nil {
+				closeDocument(false)
+			}
 			break
 		}
 		if appState.State == STATE_DOCUMENT {
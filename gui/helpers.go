@@ -5,7 +5,14 @@ import (
 	. "../common"
 	"../documentmanager"
 	"../network"
+	"crypto/ed25519"
+	"fmt"
 	"github.com/nsf/termbox-go"
+	"github.com/satori/go.uuid"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 )
 
 func drawLines(lines *buffer.Line, height int) {
@@ -28,16 +35,338 @@ func drawLines(lines *buffer.Line, height int) {
 	}
 }
 
-func newDocument(siteId SiteId) *documentmanager.DocumentModel {
+func updateGUI() {
+	termbox.Interrupt()
+}
+
+func broadcastRemote(op documentmanager.RemoteOperation) {
+	ops := make([]documentmanager.RemoteOperation, 1, 1)
+	ops[0] = op
+	appState.Manager.Broadcast(network.NewBroadcastMessage(
+		appState.Manager.GetCurrentId(),
+		network.MSG_TYPE_REMOTE_OP,
+		documentmanager.RemoteOperationsToBinary(ops)))
+}
+
+func broadcastTags(tags []documentmanager.Tag) {
+	appState.Manager.Broadcast(network.NewBroadcastMessage(
+		appState.Manager.GetCurrentId(),
+		network.MSG_TYPE_TAG,
+		documentmanager.TagsToSlice(tags)))
+}
+
+// every new document edits as a new site with its own signing key
+func newDocument() *documentmanager.DocumentModel {
+	width, _ := termbox.Size()
+	docModel := documentmanager.NewDocumentModel(SiteId{}, width-1, updateGUI, broadcastRemote)
+	docModel.SetSigningKey(documentmanager.NewSiteKey())
+	return docModel
+}
+
+func newDocumentFromText(text string) *documentmanager.DocumentModel {
+	width, _ := termbox.Size()
+	return documentmanager.NewDocumentModelFromText(documentmanager.NewSiteKey(), text, width-1, updateGUI, broadcastRemote)
+}
+
+func forkDocument(docModel *documentmanager.DocumentModel) *documentmanager.DocumentModel {
+	key := documentmanager.NewSiteKey()
+	branch := docModel.Fork(uuid.NewV1().String(), documentmanager.SiteIdFromPublicKey(key.Public().(ed25519.PublicKey)))
+	branch.SetSigningKey(key)
+	return branch
+}
+
+// the recovered document keeps the role it had, an older recovery file without one rejoins as an editor
+func newDocumentFromRecovery(state documentmanager.RecoveryState) (*documentmanager.DocumentModel, error) {
 	width, _ := termbox.Size()
-	return documentmanager.NewDocumentModel(siteId, width-1, func() {
-		termbox.Interrupt()
-	}, func(op documentmanager.RemoteOperation) {
-		ops := make([]documentmanager.RemoteOperation, 1, 1)
-		ops[0] = op
-		appState.Manager.Broadcast(network.NewBroadcastMessage(
-			appState.Manager.GetCurrentId(),
-			network.MSG_TYPE_REMOTE_OP,
-			documentmanager.RemoteOperationsToSlice(ops)))
-	})
+	docModel, err := documentmanager.NewDocumentModelFromRecovery(state, width-1, updateGUI, broadcastRemote)
+	if err == nil && docModel.RoleGrant.Role == "" {
+		docModel.RoleGrant = network.NewRoleGrant(docModel.SigningKey, ROLE_EDITOR, 1)
+	}
+	return docModel, err
+}
+
+// the document shown in the editor
+func editedDocument() *documentmanager.DocumentModel {
+	if appState.Branch != nil {
+		return appState.Branch
+	}
+	return appState.DocModel
+}
+
+// makes docModel the current document and starts autosaving it if enabled
+func openDocument(docModel *documentmanager.DocumentModel) {
+	if docModel.DocId == "" {
+		docModel.DocId = documentmanager.DocIdOfSite(docModel.OwnerId)
+	}
+	docModel.BroadcastTags = broadcastTags
+	appState.DocModel = docModel
+	// a recovered document may come with the branch that was being edited
+	appState.Branch = docModel.Branch
+	// creating a document makes us its owner, joining a network makes us an editor
+	if docModel.RoleGrant.Role == "" {
+		docModel.RoleGrant = network.NewRoleGrant(docModel.SigningKey, ROLE_OWNER, 1)
+	}
+	appState.Manager.SetLocalSite(docModel.SigningKey, docModel.RoleGrant)
+	appState.Manager.SetDocument(docModel.DocId, documentName(docModel))
+	appState.ScreenY = 0
+	if appState.Config.AutosaveInterval > 0 && appState.Config.RecoveryFile != "" {
+		documentmanager.NewAutosaver(appState.Config.RecoveryFile, appState.Config.AutosaveInterval).Start(docModel)
+	}
+}
+
+// closes the current document, the recovery file is kept unless discard is set
+func closeDocument(discard bool) {
+	docModel := appState.DocModel
+	docModel.RLock()
+	saver := docModel.Autosaver
+	docModel.RUnlock()
+	if saver != nil {
+		if discard {
+			saver.Discard(docModel)
+		} else {
+			saver.Stop(docModel)
+		}
+	}
+	appState.DocModel = nil
+	appState.Branch = nil
+	appState.Manager.SetDocument("", "")
+}
+
+// the hub opens its document right away so clients can join at any time, continuing the
+// one in the recovery file if there is one
+func openHubDocument() {
+	appState.State = STATE_MENU
+	if !documentmanager.HasRecoveryFile(appState.Config.RecoveryFile) {
+		openDocument(newDocument())
+		return
+	}
+	state, err := documentmanager.LoadRecoveryFile(appState.Config.RecoveryFile)
+	var docModel *documentmanager.DocumentModel
+	if err == nil {
+		docModel, err = newDocumentFromRecovery(state)
+	}
+	if err != nil {
+		appState.State = STATE_ERROR
+		appState.TempData = err
+		return
+	}
+	openDocument(docModel)
+}
+
+func documentName(docModel *documentmanager.DocumentModel) string {
+	if docModel.Name == "" {
+		return "untitled"
+	}
+	return docModel.Name
+}
+
+func setDocumentName(name string) {
+	appState.DocModel.Lock()
+	appState.DocModel.Name = name
+	appState.DocModel.Unlock()
+	appState.Manager.SetDocument(appState.DocModel.DocId, documentName(appState.DocModel))
+}
+
+// the document takes the id of the network it joined, so the peers announce the same one
+func joinDocument() {
+	docId := appState.Manager.DocId()
+	appState.DocModel.Lock()
+	if docId != "" {
+		appState.DocModel.DocId = docId
+	}
+	appState.DocModel.Unlock()
+}
+
+// the profiles of the sites seen in the network, kept after their nodes left
+// so that what they did is still attributed to them
+var siteProfiles = struct {
+	sync.Mutex
+	bySite map[SiteId]network.Profile
+}{bySite: make(map[SiteId]network.Profile)}
+
+func handleNetMeta(netMeta network.NetMeta) {
+	updateRoles(netMeta)
+	updateProfiles(netMeta)
+}
+
+// losing every peer takes the document offline like Disconnect, so there's a merge
+// report once the partition heals
+func handlePartition(partitioned bool) {
+	docModel := appState.DocModel
+	if docModel == nil {
+		return
+	}
+	if partitioned {
+		docModel.GoOffline()
+	} else if appState.Manager.IsConnected() {
+		docModel.GoOnline()
+	}
+	updateGUI()
+}
+
+func updateProfiles(netMeta network.NetMeta) {
+	siteProfiles.Lock()
+	defer siteProfiles.Unlock()
+	for _, node := range netMeta {
+		if site, err := siteIdFromString(node.Site); err == nil && node.Name != "" {
+			siteProfiles.bySite[site] = node.Profile()
+		}
+	}
+}
+
+// the name of the user editing as site, or the site id if it's unknown
+func siteName(site SiteId) string {
+	siteProfiles.Lock()
+	defer siteProfiles.Unlock()
+	if profile, ok := siteProfiles.bySite[site]; ok {
+		return profile.Name
+	}
+	return siteIdToString(site)
+}
+
+// the name of a peer, or its id if it has none
+func peerName(node network.NodeMetaListElem) string {
+	if node.Name != "" {
+		return node.Name
+	}
+	return node.Id
+}
+
+// assigns the roles in the network to the sites in the document, as far as the local
+// site may: owners assign any role, editors let the sites joining as editors edit
+func updateRoles(netMeta network.NetMeta) {
+	docModel := appState.DocModel
+	if docModel == nil {
+		return
+	}
+	for site, role := range netMeta.SiteRoles() {
+		id, err := siteIdFromString(site)
+		if err != nil {
+			continue
+		}
+		// a site without a role in the network joined as an editor, or left long enough
+		// ago to be forgotten, keeping the role it has in the document
+		if role == "" {
+			if docModel.SiteRole(id) != "" {
+				continue
+			}
+			role = ROLE_EDITOR
+		}
+		docModel.AssignRole(id, role)
+	}
+	docModel.SetRoleGrant(appState.Manager.LocalRoleGrant())
+}
+
+func siteIdFromString(str string) (SiteId, error) {
+	u, err := uuid.FromString(str)
+	return SiteId(u), err
+}
+
+func siteIdToString(id SiteId) string {
+	u, err := uuid.FromBytes(id[:])
+	if err != nil {
+		return id.ToString()
+	}
+	return u.String()
+}
+
+func mergeReportToString(report []documentmanager.MergeRegion) string {
+	str := "Changes made while the document was offline:\n\n"
+	if len(report) == 0 {
+		str += "No changes were made on either side\n"
+	}
+	for _, region := range report {
+		if region.Local {
+			str += "You: "
+		} else {
+			str += "Peer " + siteName(region.Site) + ": "
+		}
+		if region.StartLine == region.EndLine {
+			str += "line " + strconv.Itoa(region.StartLine)
+		} else {
+			str += "lines " + strconv.Itoa(region.StartLine) + "-" + strconv.Itoa(region.EndLine)
+		}
+		str += " (" + strconv.Itoa(region.Inserted) + " inserted, " + strconv.Itoa(region.Deleted) + " deleted)\n"
+	}
+	return str
+}
+
+// longer names, e.g. the site ids of users without a profile, are cut in the blame view
+const maxBlameNameLength = 16
+
+// every line of the document after the name of the user who wrote most of it,
+// and how many others changed it
+func blameToString(blame []documentmanager.BlameLine) string {
+	names := make([]string, len(blame))
+	width := 0
+	for i, line := range blame {
+		if len(line.Sites) == 0 {
+			continue
+		}
+		names[i] = siteName(line.Sites[0])
+		if len(names[i]) > maxBlameNameLength {
+			names[i] = names[i][:maxBlameNameLength]
+		}
+		if len(line.Sites) > 1 {
+			names[i] += " +" + strconv.Itoa(len(line.Sites)-1)
+		}
+		if len(names[i]) > width {
+			width = len(names[i])
+		}
+	}
+	str := "Who wrote each line:\n\n"
+	for i, line := range blame {
+		str += fmt.Sprintf("%-*s | %s\n", width, names[i], line.Text)
+	}
+	return str
+}
+
+// the lines of diff prefixed with + if added and - if removed
+func diffToString(diff []documentmanager.DiffLine) string {
+	str := ""
+	for _, line := range diff {
+		str += string(line.Kind) + " " + line.Text + "\n"
+	}
+	return str
+}
+
+// the other nodes in the network whose role can be changed, ordered by id
+func rolePeers() network.NetMetaList {
+	peers := make(network.NetMetaList, 0)
+	for _, node := range appState.Manager.GetNetworkMetadata().ToList() {
+		if node.Id != appState.Manager.GetCurrentId() && !node.Left {
+			peers = append(peers, node)
+		}
+	}
+	sort.Sort(peers)
+	return peers
+}
+
+func roleName(role string) string {
+	if role == "" {
+		return ROLE_EDITOR
+	}
+	return role
+}
+
+func peerStatusString(status network.PeerStatus) string {
+	state := status.State
+	if status.State == "suspect" || status.State == "unreachable" {
+		if !status.LastHeard.IsZero() {
+			state += " (last heard " + time.Since(status.LastHeard).Truncate(time.Second).String() + " ago)"
+		}
+	}
+	if status.Dropped > 0 {
+		state += ", behind (" + strconv.FormatUint(status.Dropped, 10) + " messages dropped, catching up)"
+	}
+	return state
+}
+
+func hasDisconnectedPeers() bool {
+	for _, status := range appState.Manager.GetPeerStatus() {
+		if status.State == "disconnected" || status.State == "unreachable" {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,139 @@
+package gui
+
+import (
+	"../buffer"
+	"../documentmanager"
+	"github.com/nsf/termbox-go"
+	"sort"
+)
+
+var profileColors = map[string]termbox.Attribute{
+	"red":     termbox.ColorRed,
+	"green":   termbox.ColorGreen,
+	"yellow":  termbox.ColorYellow,
+	"blue":    termbox.ColorBlue,
+	"magenta": termbox.ColorMagenta,
+	"cyan":    termbox.ColorCyan,
+}
+
+// the cursor and selection of another user in the edited document
+type remoteCursor struct {
+	name       string
+	color      termbox.Attribute
+	cursor     int
+	start, end int // the selection, empty without one
+}
+
+// sends where we are in docModel to the other users
+func updatePresence(docModel *documentmanager.DocumentModel) {
+	appState.Manager.SetPresence(documentmanager.PresenceToSlice(docModel.LocalPresence()))
+}
+
+// the other users in docModel, ordered by name
+func remoteCursors(docModel *documentmanager.DocumentModel) []remoteCursor {
+	netMeta := appState.Manager.GetNetworkMetadata()
+	cursors := make([]remoteCursor, 0)
+	for id, data := range appState.Manager.GetPresence() {
+		presence, err := documentmanager.PresenceFromSlice(data)
+		if err != nil {
+			continue
+		}
+		cursor, start, end, ok := docModel.PresencePositions(presence)
+		if !ok {
+			continue
+		}
+		node := netMeta[id]
+		name := node.Name
+		if name == "" {
+			name = node.Addr
+		}
+		if presence.Branch != "" {
+			name += " (on a branch)"
+		}
+		color, ok := profileColors[node.Color]
+		if !ok {
+			color = termbox.ColorWhite
+		}
+		cursors = append(cursors, remoteCursor{name: name, color: color, cursor: cursor, start: start, end: end})
+	}
+	sort.Slice(cursors, func(i, j int) bool {
+		return cursors[i].name < cursors[j].name
+	})
+	return cursors
+}
+
+// the branches the other users edit instead of the document, by session id
+func peerBranches() map[string]string {
+	branches := make(map[string]string)
+	for id, data := range appState.Manager.GetPresence() {
+		presence, err := documentmanager.PresenceFromSlice(data)
+		if err == nil && presence.Branch != "" {
+			branches[id] = presence.Branch
+		}
+	}
+	return branches
+}
+
+// changes the cells showing the document from start up to end, lines are the lines
+// on the screen starting at line screenY of buf
+func highlight(buf *buffer.Buffer, lines *buffer.Line, screenY, height, start, end int, change func(*termbox.Cell)) {
+	width, _ := termbox.Size()
+	cells := termbox.CellBuffer()
+	startX, startY := buf.ScreenPosition(start)
+	endX, endY := buf.ScreenPosition(end)
+	for y := 0; lines != nil && y < height; y++ {
+		row := screenY + y
+		if row >= startY && row <= endY {
+			from, to := 0, lineWidth(lines)
+			if row == startY {
+				from = startX
+			}
+			if row == endY {
+				to = endX
+			}
+			for x := from; x < to && x < width; x++ {
+				change(&cells[y*width+x])
+			}
+		}
+		lines = lines.Next
+	}
+}
+
+func drawRemoteCursor(buf *buffer.Buffer, lines *buffer.Line, screenY, height int, c remoteCursor) {
+	highlight(buf, lines, screenY, height, c.start, c.end, func(cell *termbox.Cell) {
+		cell.Fg = c.color | termbox.AttrUnderline
+	})
+	width, _ := termbox.Size()
+	x, y := buf.ScreenPosition(c.cursor)
+	y -= screenY
+	if x < width && y >= 0 && y < height {
+		cell := &termbox.CellBuffer()[y*width+x]
+		cell.Fg = termbox.ColorBlack
+		cell.Bg = c.color
+	}
+}
+
+// names the other users in their colors on line y
+func drawLegend(cursors []remoteCursor, y int) {
+	x := 0
+	for _, c := range cursors {
+		for _, ch := range " " + c.name + " " {
+			termbox.SetCell(x, y, ch, termbox.ColorBlack, c.color)
+			x++
+		}
+		x++
+	}
+}
+
+// the number of cells line takes on the screen
+func lineWidth(line *buffer.Line) int {
+	width := 0
+	for _, ch := range line.Bytes {
+		if ch == '\t' {
+			width += 4
+		} else if ch != '\n' {
+			width++
+		}
+	}
+	return width
+}
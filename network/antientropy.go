@@ -0,0 +1,220 @@
+package network
+
+import (
+	"../version"
+	"encoding/json"
+	"hash/fnv"
+	"math/rand"
+	"time"
+)
+
+// Anti-entropy repairs whatever the broadcast tree missed. Peers that might
+// be out of sync compare compact digests of their state and pull only the
+// ranges of operations they miss:
+//
+//   A -> B  digest        hashes of the version vector, NetMeta and tags of A
+//   B -> A  summary       the parts of the state of B whose hash differs
+//   A -> B  summary       reply with the parts of the state of A that B misses
+//   A <-> B rangeRequest  ranges of operations missed, answered with remoteOps
+//
+// Every round a digest is sent to one random peer. The interval between rounds
+// is reset to minSyncInterval on any activity and doubles each quiet round up
+// to maxSyncInterval, so an idle session sends a digest every half a minute.
+// A digest that differs from ours only counts as activity once per local state:
+// if pulling from the peer brought nothing new, e.g. because it has operations
+// it can't serve, further mismatches don't keep the interval short
+
+const (
+	minSyncInterval = 500 * time.Millisecond
+	maxSyncInterval = 30 * time.Second
+)
+
+type digest struct {
+	Vector  uint64
+	NetMeta uint64
+	Tags    uint64
+}
+
+type syncSummary struct {
+	Digest  digest // of the sender
+	Vector  []byte // received version vector, only set if it differs
+	NetMeta NetMeta
+	Tags    []byte
+	Reply   bool // answers a summary, so it isn't answered again
+}
+
+// the state compared by anti-entropy
+type syncState struct {
+	vector  []byte
+	netMeta NetMeta
+	tags    []byte
+	digest  digest
+}
+
+func (s *session) localSyncState() syncState {
+	state := syncState{
+		vector:  s.manager.GetOpsReceiveVersion(),
+		netMeta: s.nodePool.getLatestNetMetaCopy(),
+		tags:    s.manager.GetTags(),
+	}
+	if vector, err := version.FromSlice(state.vector); state.vector != nil && err == nil {
+		state.digest.Vector = vector.Hash()
+	}
+	state.digest.NetMeta = hashBytes(state.netMeta.toJson())
+	if state.tags != nil {
+		state.digest.Tags = hashBytes(state.tags)
+	}
+	return state
+}
+
+func hashBytes(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+// the parts of state a peer with digest remote and version vector remoteVector
+// (nil if unknown) doesn't have, returns false if there are none
+func (state syncState) summary(remote digest, remoteVector version.VersionVector, reply bool) (syncSummary, bool) {
+	summary := syncSummary{Digest: state.digest, Reply: reply}
+	if state.digest.Vector != remote.Vector {
+		vector, _ := version.FromSlice(state.vector)
+		if remoteVector == nil || len(remoteVector.MissingRanges(vector)) > 0 {
+			summary.Vector = state.vector
+		}
+	}
+	if state.digest.NetMeta != remote.NetMeta {
+		summary.NetMeta = state.netMeta
+	}
+	if state.digest.Tags != remote.Tags {
+		summary.Tags = state.tags
+	}
+	return summary, summary.Vector != nil || summary.NetMeta != nil || summary.Tags != nil
+}
+
+// noteActivity shortens the interval until the next anti-entropy round
+func (s *session) noteActivity() {
+	select {
+	case s.syncActivity <- struct{}{}:
+	default:
+	}
+}
+
+func (s *session) periodicallySync() {
+	interval := minSyncInterval
+	deadline := time.Now().Add(interval)
+	timer := time.NewTimer(interval)
+	for {
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-s.syncActivity:
+			interval = minSyncInterval
+			if time.Until(deadline) > interval {
+				if !timer.Stop() {
+					<-timer.C
+				}
+				deadline = time.Now().Add(interval)
+				timer.Reset(interval)
+			}
+		case <-timer.C:
+			if nodes := s.nodePool.getConnectedNodes(); len(nodes) > 0 {
+				s.sendDigest(nodes[rand.Intn(len(nodes))])
+			}
+			interval *= 2
+			if interval > maxSyncInterval {
+				interval = maxSyncInterval
+			}
+			deadline = time.Now().Add(interval)
+			timer.Reset(interval)
+		}
+	}
+}
+
+func (s *session) sendDigest(n *node) {
+	content, _ := json.Marshal(s.localSyncState().digest)
+	putMsgOnSendingQueueOfNode(NewReplyMessage(MSG_TYPE_DIGEST, content), n)
+}
+
+func (s *session) handleIncomingDigest(msg Message) {
+	var remote digest
+	if decodePayload(msg.Msg, &remote) != nil {
+		return
+	}
+	state := s.localSyncState()
+	summary, differs := state.summary(remote, nil, false)
+	if !differs {
+		return
+	}
+	if state.digest != s.mismatchedDigest {
+		s.mismatchedDigest = state.digest
+		s.noteActivity()
+	}
+	s.nodePool.sendMessageToNodeWithId(NewReplyMessage(MSG_TYPE_SUMMARY, summary.toJson()), msg.from)
+}
+
+func (s *session) handleIncomingSummary(msg Message) {
+	remote, err := newSyncSummaryFromSlice(msg.Msg)
+	if err != nil {
+		return
+	}
+	state := s.localSyncState()
+	if remote.NetMeta != nil {
+		s.handleIncomingNetMeta(newNetMetaUpdateMsg(s.id, s.fromPeer(msg.from, remote.NetMeta)))
+	}
+	if remote.Tags != nil && s.manager.TagHandler != nil {
+		go s.manager.TagHandler(remote.Tags)
+	}
+	var remoteVector version.VersionVector
+	if remote.Vector != nil && state.vector != nil {
+		remoteVector, err = version.FromSlice(remote.Vector)
+		local, localErr := version.FromSlice(state.vector)
+		if err != nil || localErr != nil {
+			return
+		}
+		if ranges := local.MissingRanges(remoteVector); len(ranges) > 0 {
+			request := NewReplyMessage(MSG_TYPE_RANGE_REQUEST, version.RangesToBinary(ranges))
+			s.nodePool.sendMessageToNodeWithId(request, msg.from)
+		}
+	}
+	if remote.Reply {
+		return
+	}
+	if reply, differs := state.summary(remote.Digest, remoteVector, true); differs {
+		s.nodePool.sendMessageToNodeWithId(NewReplyMessage(MSG_TYPE_SUMMARY, reply.toJson()), msg.from)
+	}
+}
+
+func (s *session) handleIncomingRangeRequest(msg Message) {
+	ops, ok := s.manager.RangeRequestHandler(msg.Msg)
+	if ok {
+		s.nodePool.sendMessageToNodeWithId(NewReplyMessage(MSG_TYPE_REMOTE_OP, ops), msg.from)
+	}
+}
+
+func newSyncSummaryFromSlice(content []byte) (syncSummary, error) {
+	var summary syncSummary
+	err := decodePayload(content, &summary)
+	return summary, err
+}
+
+func (summary syncSummary) toJson() []byte {
+	summaryJson, _ := json.Marshal(summary)
+	return summaryJson
+}
+
+// the version vector inside is converted to the same format as the content
+func (summary syncSummary) encode(codecName string) []byte {
+	vector, err := version.FromSlice(summary.Vector)
+	if codecName == CodecBinary {
+		if err == nil && summary.Vector != nil {
+			summary.Vector = vector.ToBinary()
+		}
+		return msgpackEncode(summary)
+	}
+	if err == nil && summary.Vector != nil {
+		summary.Vector = vector.MarshalJSON()
+	}
+	return summary.toJson()
+}
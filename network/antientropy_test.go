@@ -0,0 +1,48 @@
+package network
+
+import (
+	. "../common"
+	"../version"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAntiEntropyRepairsMissedOperations(t *testing.T) {
+	c := newChaosCluster(t, 3, 1)
+	// none of the edits of peer 0 are broadcast, the others pull them in anti-entropy rounds
+	c.peers[0].setQuiet(true)
+	c.edit(0, 30)
+	c.waitConverged(5 * time.Second)
+	c.peers[0].setQuiet(false)
+	c.edit(1, 10)
+	c.waitConverged(5 * time.Second)
+}
+
+func TestDigestMismatchNotedOncePerState(t *testing.T) {
+	p := newMemPeer(t, NewMemNetwork(), "a")
+	vector := []byte(nil)
+	p.nm.SetGetOpsReceiveVersion(func() []byte { return vector })
+	s := &session{manager: p.nm, nodePool: p.nm.nodePool, syncActivity: make(chan struct{}, 1)}
+	noted := func() bool {
+		select {
+		case <-s.syncActivity:
+			return true
+		default:
+			return false
+		}
+	}
+	remote, _ := json.Marshal(digest{Vector: 1})
+	s.handleIncomingDigest(Message{Msg: remote, from: "b"})
+	assertEqual(t, true, noted())
+
+	// pulling brought nothing new
+	s.handleIncomingDigest(Message{Msg: remote, from: "b"})
+	assertEqual(t, false, noted())
+
+	v := version.NewVector()
+	v.IncrementTo(StringToSiteId("aaaaaaaaaaaaaaaa"), 1)
+	vector = v.ToBinary()
+	s.handleIncomingDigest(Message{Msg: remote, from: "b"})
+	assertEqual(t, true, noted())
+}
@@ -0,0 +1,173 @@
+package network
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"golang.org/x/crypto/scrypt"
+	"sync"
+)
+
+// Networks can be protected by a shared secret. After the hello handshake both sides prove
+// that they know the secret without sending it:
+//
+//   dialer   -> acceptor: challenge{Nonce: a}
+//   acceptor -> dialer:   challenge{Nonce: b}
+//   dialer   -> acceptor: challenge{Proof: HMAC(key, "dial" | b | a)}
+//   acceptor -> dialer:   authResult{Accepted, Proof: HMAC(key, "accept" | a | b)}
+//
+// where key is derived from the secret with scrypt and the salt the acceptor announced in
+// its hello. The dialer proves first and the acceptor only proves to a dialer that did, so
+// connecting to a node yields nothing to check guesses of the secret against offline. A
+// node being dialed, or an eavesdropper without TLS, gets the proof of the dialer, so every
+// node salts the secret with a random salt of its own: guesses can't be precomputed and
+// every one is slow. Neither side sends metadata or operations to a peer that failed
+
+const (
+	nonceSize = 32
+	saltSize  = 16
+	// about 100ms per key on a laptop, derived once per salt
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var errInvalidSalt = errors.New("network: the peer announced no valid salt for the shared secret")
+
+const authFailedReason = "authentication failed, the shared secret doesn't match"
+
+type challenge struct {
+	Nonce []byte
+	Proof []byte
+}
+
+type authResult struct {
+	Accepted bool
+	Proof    []byte // of the acceptor, only if accepted
+}
+
+// authKeys derives the keys of the shared secret, of this node and of the peers it dials
+type authKeys struct {
+	secret string
+	salt   []byte
+	mutex  sync.Mutex
+	keys   map[string][]byte // by salt
+}
+
+// newAuthKeys salts secret for this node, returns nil if the network is open
+func newAuthKeys(secret string) (*authKeys, error) {
+	if secret == "" {
+		return nil, nil
+	}
+	salt := make([]byte, saltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	keys := &authKeys{secret: secret, salt: salt, keys: make(map[string][]byte)}
+	_, err = keys.forSalt(salt)
+	return keys, err
+}
+
+// the salt this node announces, nil if the network is open
+func (keys *authKeys) localSalt() []byte {
+	if keys == nil {
+		return nil
+	}
+	return keys.salt
+}
+
+// forSalt returns the key of the secret salted with salt
+func (keys *authKeys) forSalt(salt []byte) ([]byte, error) {
+	if len(salt) != saltSize {
+		return nil, errInvalidSalt
+	}
+	keys.mutex.Lock()
+	defer keys.mutex.Unlock()
+	if key, ok := keys.keys[string(salt)]; ok {
+		return key, nil
+	}
+	key, err := scrypt.Key([]byte(keys.secret), salt, scryptN, scryptR, scryptP, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	keys.keys[string(salt)] = key
+	return key, nil
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+func authProof(key []byte, role string, first, second []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(role))
+	mac.Write(first)
+	mac.Write(second)
+	return mac.Sum(nil)
+}
+
+// dialAuth proves to the acceptor that we know the secret and checks that the acceptor does.
+// Returns an *IncompatiblePeerError if either side failed
+func dialAuth(n *node, addr string, key []byte) error {
+	ours, err := newNonce()
+	if err != nil {
+		return err
+	}
+	err = n.writeLog(challenge{Nonce: ours}, "dialAuth challenge")
+	if err != nil {
+		return err
+	}
+	theirs := new(challenge)
+	err = n.readLog(theirs, "dialAuth response")
+	if err != nil {
+		return err
+	}
+	if len(theirs.Nonce) != nonceSize {
+		return &IncompatiblePeerError{addr, authFailedReason}
+	}
+	err = n.writeLog(challenge{Proof: authProof(key, "dial", theirs.Nonce, ours)}, "dialAuth proof")
+	if err != nil {
+		return err
+	}
+	result := new(authResult)
+	err = n.readLog(result, "dialAuth result")
+	if err != nil {
+		return err
+	}
+	if !result.Accepted || !hmac.Equal(result.Proof, authProof(key, "accept", ours, theirs.Nonce)) {
+		return &IncompatiblePeerError{addr, authFailedReason}
+	}
+	return nil
+}
+
+// acceptAuth checks that the dialing peer knows the secret, returns whether it does
+func acceptAuth(n *node, key []byte) bool {
+	theirs := new(challenge)
+	err := n.readLog(theirs, "acceptAuth challenge")
+	if err != nil || len(theirs.Nonce) != nonceSize {
+		return false
+	}
+	ours, err := newNonce()
+	if err != nil {
+		return false
+	}
+	err = n.writeLog(challenge{Nonce: ours}, "acceptAuth response")
+	if err != nil {
+		return false
+	}
+	proof := new(challenge)
+	err = n.readLog(proof, "acceptAuth proof")
+	if err != nil {
+		return false
+	}
+	result := authResult{Accepted: hmac.Equal(proof.Proof, authProof(key, "dial", ours, theirs.Nonce))}
+	if result.Accepted {
+		result.Proof = authProof(key, "accept", theirs.Nonce, ours)
+	}
+	err = n.writeLog(result, "acceptAuth result")
+	return err == nil && result.Accepted
+}
@@ -0,0 +1,133 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAuthKeys(t *testing.T) {
+	keys, err := newAuthKeys("")
+	assertEqual(t, nil, err)
+	assertEqual(t, true, keys == nil)
+	assertEqual(t, 0, len(keys.localSalt()))
+
+	a, _ := newAuthKeys("secret")
+	b, _ := newAuthKeys("secret")
+	assertEqual(t, false, bytes.Equal(a.localSalt(), b.localSalt()))
+	own, _ := a.forSalt(a.localSalt())
+	theirs, _ := a.forSalt(b.localSalt())
+	assertEqual(t, false, bytes.Equal(own, theirs))
+	// both sides derive the same key from the salt of the acceptor
+	same, _ := b.forSalt(b.localSalt())
+	assertEqual(t, theirs, same)
+	_, err = a.forSalt(nil)
+	assertEqual(t, errInvalidSalt, err)
+}
+
+func secretHello(keys *authKeys) hello {
+	return hello{ProtocolVersion: ProtocolVersion, MinProtocolVersion: minProtocolVersion,
+		Authenticate: keys != nil, AuthSalt: keys.localSalt()}
+}
+
+// runs the handshake of a dialing peer with secret dialer and a listening peer with secret listener
+func handshakeWithSecrets(dialer, listener string) (error, bool) {
+	dialerKeys, _ := newAuthKeys(dialer)
+	listenerKeys, _ := newAuthKeys(listener)
+	client, server := newMemConnPair(NewMemNetwork(), "dialer", "listener")
+	accepted := make(chan bool)
+	go func() {
+		_, ok := acceptHandshake(newConnWrapper(server), secretHello(listenerKeys), listenerKeys)
+		server.Close()
+		accepted <- ok
+	}()
+	_, err := dialHandshake(newConnWrapper(client), "listener", secretHello(dialerKeys), dialerKeys)
+	client.Close()
+	return err, <-accepted
+}
+
+func TestAuthenticate(t *testing.T) {
+	err, ok := handshakeWithSecrets("secret", "secret")
+	assertEqual(t, nil, err)
+	assertEqual(t, true, ok)
+
+	err, ok = handshakeWithSecrets("secret", "wrong")
+	assertEqual(t, &IncompatiblePeerError{"listener", authFailedReason}, err)
+	assertEqual(t, false, ok)
+
+	// the secret is missing on one side
+	err, ok = handshakeWithSecrets("secret", "")
+	assertEqual(t, &IncompatiblePeerError{"listener", "peer does not use a shared secret"}, err)
+	assertEqual(t, false, ok)
+	err, ok = handshakeWithSecrets("", "secret")
+	assertEqual(t, &IncompatiblePeerError{"listener", "peer requires a shared secret"}, err)
+	assertEqual(t, false, ok)
+
+	// a peer of an older version that doesn't salt the secret
+	keys, _ := newAuthKeys("secret")
+	unsalted := secretHello(keys)
+	unsalted.AuthSalt = nil
+	assertEqual(t, "peer does not salt the shared secret, it has to be updated", checkCompatible(secretHello(keys), unsalted))
+}
+
+// an acceptor proves nothing to a dialer that doesn't know the secret
+func TestAuthDialerProvesFirst(t *testing.T) {
+	keys, _ := newAuthKeys("secret")
+	key, _ := keys.forSalt(keys.localSalt())
+	client, server := newMemConnPair(NewMemNetwork(), "dialer", "listener")
+	accepted := make(chan bool)
+	go func() {
+		accepted <- acceptAuth(newConnWrapper(server), key)
+	}()
+	guessing := newConnWrapper(client)
+	guessing.writeLog(challenge{Nonce: bytes.Repeat([]byte{1}, nonceSize)}, "challenge")
+	response := new(challenge)
+	assertEqual(t, nil, guessing.readLog(response, "response"))
+	assertEqual(t, 0, len(response.Proof))
+	guessing.writeLog(challenge{Proof: bytes.Repeat([]byte{2}, nonceSize)}, "proof")
+	result := new(authResult)
+	assertEqual(t, nil, guessing.readLog(result, "result"))
+	assertEqual(t, authResult{}, *result)
+	assertEqual(t, false, <-accepted)
+}
+
+// records a handshake and replays it
+func TestAuthReplay(t *testing.T) {
+	keys, _ := newAuthKeys("secret")
+	key, _ := keys.forSalt(keys.localSalt())
+	client, server := newMemConnPair(NewMemNetwork(), "dialer", "listener")
+	go acceptAuth(newConnWrapper(server), key)
+	eavesdropped := newConnWrapper(client)
+	dialerNonce := bytes.Repeat([]byte{1}, nonceSize)
+	eavesdropped.writeLog(challenge{Nonce: dialerNonce}, "challenge")
+	response := new(challenge)
+	assertEqual(t, nil, eavesdropped.readLog(response, "response"))
+	eavesdropped.writeLog(challenge{Proof: authProof(key, "dial", response.Nonce, dialerNonce)}, "proof")
+	result := new(authResult)
+	assertEqual(t, nil, eavesdropped.readLog(result, "result"))
+	assertEqual(t, true, result.Accepted)
+	client.Close()
+
+	// a dialer doesn't take the replayed result of the acceptor for proof
+	client, server = newMemConnPair(NewMemNetwork(), "dialer", "listener")
+	go func() {
+		replaying := newConnWrapper(server)
+		replaying.readLog(new(challenge), "challenge")
+		replaying.writeLog(*response, "response")
+		replaying.readLog(new(challenge), "proof")
+		replaying.writeLog(*result, "result")
+		server.Close()
+	}()
+	assertEqual(t, &IncompatiblePeerError{"listener", authFailedReason}, dialAuth(newConnWrapper(client), "listener", key))
+
+	// nor does an acceptor take a replayed proof of a dialer
+	client, server = newMemConnPair(NewMemNetwork(), "dialer", "listener")
+	accepted := make(chan bool)
+	go func() {
+		accepted <- acceptAuth(newConnWrapper(server), key)
+	}()
+	replaying := newConnWrapper(client)
+	replaying.writeLog(challenge{Nonce: dialerNonce}, "challenge")
+	replaying.readLog(new(challenge), "response")
+	replaying.writeLog(challenge{Proof: authProof(key, "dial", response.Nonce, dialerNonce)}, "proof")
+	assertEqual(t, false, <-accepted)
+}
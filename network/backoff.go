@@ -0,0 +1,88 @@
+package network
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Failed attempts to connect to a node are retried after a delay that doubles from
+// ReconnectMinDelay up to ReconnectMaxDelay. The actual delay is picked at random
+// from the upper half of it so nodes that lost the same peer don't retry in lockstep.
+// Hearing of the node, directly or through a broadcast it sent, retries right away
+
+const (
+	defaultReconnectMinDelay = time.Second
+	defaultReconnectMaxDelay = 30 * time.Second
+)
+
+var ErrInvalidReconnectDelays = errors.New("network: the reconnect delays must be positive and the minimum at most the maximum")
+
+// returns the next backoff interval after interval and the delay to wait
+func nextBackoff(interval time.Duration, config Config) (time.Duration, time.Duration) {
+	interval *= 2
+	if interval < config.ReconnectMinDelay {
+		interval = config.ReconnectMinDelay
+	}
+	if interval > config.ReconnectMaxDelay {
+		interval = config.ReconnectMaxDelay
+	}
+	delay := interval/2 + time.Duration(rand.Int63n(int64(interval/2)+1))
+	return interval, delay
+}
+
+// waits before the next attempt to connect to n
+func (s *session) backoff(n *node) {
+	n.stateMutex.Lock()
+	var delay time.Duration
+	n.interval, delay = nextBackoff(n.interval, s.manager.config)
+	n.stateMutex.Unlock()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-n.retry:
+		n.resetBackoff()
+	case <-s.done:
+	}
+}
+
+// the next attempt to connect to n waits ReconnectMinDelay again
+func (n *node) resetBackoff() {
+	n.stateMutex.Lock()
+	n.interval = 0
+	n.stateMutex.Unlock()
+}
+
+// retryNow cuts the backoff of a disconnected node short
+func (n *node) retryNow() {
+	select {
+	case n.retry <- struct{}{}:
+	default:
+	}
+}
+
+// heardOf is called when a sign of life of node id arrives through another node
+func (np *nodePool) heardOf(id string) {
+	if n, ok := np.getNodeWithId(id); ok && n.isDisconnected() {
+		n.retryNow()
+	}
+}
+
+// returns the id of the node that created the broadcast message with msgId
+func broadcastOrigin(msgId string) string {
+	if i := strings.LastIndex(msgId, "/"); i >= 0 {
+		return msgId[:i]
+	}
+	return msgId
+}
+
+// ReconnectNow retries connecting to every disconnected peer without waiting for the backoff
+func (nm *NetworkManager) ReconnectNow() {
+	for _, n := range nm.nodePool.getAllNodes() {
+		if n.isDisconnected() {
+			n.retryNow()
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextBackoff(t *testing.T) {
+	config := Config{ReconnectMinDelay: time.Second, ReconnectMaxDelay: 10 * time.Second}
+	tests := []struct {
+		interval, next time.Duration
+	}{
+		{0, time.Second},               // starts at the minimum
+		{time.Second, 2 * time.Second}, // doubles
+		{4 * time.Second, 8 * time.Second},
+		{8 * time.Second, 10 * time.Second}, // capped
+		{10 * time.Second, 10 * time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			next, delay := nextBackoff(test.interval, config)
+			assertEqual(t, test.next, next)
+			// picked from the upper half
+			if delay < next/2 || delay > next {
+				t.Fatalf("delay %v out of [%v, %v]", delay, next/2, next)
+			}
+		}
+	}
+}
+
+func TestInvalidReconnectDelays(t *testing.T) {
+	mn := NewMemNetwork()
+	for _, config := range []Config{
+		{ReconnectMinDelay: -time.Second},
+		{ReconnectMinDelay: time.Minute, ReconnectMaxDelay: time.Second},
+		{ReconnectMaxDelay: -time.Second},
+	} {
+		config.Transport = mn.Transport("a")
+		_, err := NewNetworkManager("a", "a", config)
+		assertEqual(t, ErrInvalidReconnectDelays, err)
+	}
+}
@@ -0,0 +1,318 @@
+package network
+
+import (
+	. "../common"
+	"../documentmanager"
+	"../version"
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a peer of a chaosCluster editing its own document
+type chaosPeer struct {
+	addr     string
+	identity *Identity
+	doc      *documentmanager.DocumentModel
+	mutex    sync.Mutex
+	nm       *NetworkManager // replaced when the peer restarts
+	quiet    bool            // edits aren't broadcast, only anti-entropy spreads them
+}
+
+// chaosCluster runs peers on a MemNetwork, so that a test can script partitions, delays,
+// drops and restarts between edits and then check that the peers agree again
+type chaosCluster struct {
+	t     *testing.T
+	mn    *MemNetwork
+	peers []*chaosPeer
+	rand  *rand.Rand
+}
+
+func newChaosCluster(t *testing.T, n int, seed int64) *chaosCluster {
+	t.Logf("seed %d", seed)
+	c := &chaosCluster{t: t, mn: NewMemNetwork(), rand: rand.New(rand.NewSource(seed))}
+	for i := 0; i < n; i++ {
+		p := &chaosPeer{addr: fmt.Sprintf("peer%02d", i), identity: NewIdentity()}
+		p.doc = documentmanager.NewDocumentModel(SiteId{byte(i + 1)}, 80, func() {}, func(op documentmanager.RemoteOperation) {
+			nm, quiet := p.managerAndQuiet()
+			if quiet {
+				return
+			}
+			nm.Broadcast(NewBroadcastMessage(nm.GetCurrentId(), MSG_TYPE_REMOTE_OP, documentmanager.RemoteOperationsToBinary([]documentmanager.RemoteOperation{op})))
+		})
+		p.doc.SetSigningKey(documentmanager.NewSiteKey())
+		c.peers = append(c.peers, p)
+		c.start(i)
+	}
+	for i := 1; i < n; i++ {
+		// every peer joins through the previous one
+		if err := c.peers[i].manager().ConnectTo(c.peers[i-1].addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// every peer knows all others before any fault, a peer whose only known
+	// peers restart would be on its own as much as a user would be
+	c.waitConverged(5 * time.Second)
+	return c
+}
+
+func (p *chaosPeer) manager() *NetworkManager {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.nm
+}
+
+func (p *chaosPeer) managerAndQuiet() (*NetworkManager, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.nm, p.quiet
+}
+
+func (p *chaosPeer) setQuiet(quiet bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.quiet = quiet
+}
+
+func (p *chaosPeer) text() string {
+	p.doc.RLock()
+	defer p.doc.RUnlock()
+	return p.doc.Buffer.ToString()
+}
+
+// starts a network manager for peer i with the document it already has
+func (c *chaosCluster) start(i int) {
+	p := c.peers[i]
+	nm, err := NewNetworkManager(p.addr, p.addr, Config{
+		Transport:          c.mn.Transport(p.addr),
+		Identity:           p.identity,
+		HeartbeatInterval:  50 * time.Millisecond,
+		SuspectTimeout:     200 * time.Millisecond,
+		UnreachableTimeout: 500 * time.Millisecond,
+		ReconnectMinDelay:  50 * time.Millisecond,
+		ReconnectMaxDelay:  500 * time.Millisecond,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	nm.SetRemoteOpHandler(func(msg []byte) {
+		for _, op := range documentmanager.RemoteOperationsFromSlice(msg) {
+			p.doc.ApplyRemoteOperation(op)
+		}
+	})
+	nm.SetGetOpsReceiveVersion(func() []byte {
+		return p.doc.GetVersionVectorReceived().ToBinary()
+	})
+	nm.SetRangeRequestHandler(func(data []byte) ([]byte, bool) {
+		ranges, err := version.RangesFromSlice(data)
+		if err != nil {
+			return nil, false
+		}
+		ops := p.doc.GetOperationsInRanges(ranges)
+		if len(ops) == 0 {
+			return nil, false
+		}
+		return documentmanager.RemoteOperationsToBinary(ops), true
+	})
+	p.mutex.Lock()
+	p.nm = nm
+	p.mutex.Unlock()
+}
+
+// edit makes n random edits on peer i
+func (c *chaosCluster) edit(i, n int) {
+	doc := c.peers[i].doc
+	for j := 0; j < n; j++ {
+		doc.Lock()
+		length := len(doc.Buffer.ToString())
+		doc.Buffer.SetPosition(c.rand.Intn(length + 1))
+		doc.Unlock()
+		if length > 0 && c.rand.Intn(4) == 0 {
+			doc.LocalBackspace()
+		} else {
+			doc.LocalInsert(byte('a' + c.rand.Intn(26)))
+		}
+	}
+}
+
+// partition cuts every peer in side from every other peer
+func (c *chaosCluster) partition(side ...int) {
+	inSide := make(map[int]bool)
+	for _, i := range side {
+		inSide[i] = true
+	}
+	for i := range c.peers {
+		for j := range c.peers {
+			if inSide[i] && !inSide[j] {
+				c.mn.Partition(c.peers[i].addr, c.peers[j].addr)
+			}
+		}
+	}
+}
+
+func (c *chaosCluster) healAll() {
+	for i := range c.peers {
+		for j := range c.peers {
+			c.mn.Heal(c.peers[i].addr, c.peers[j].addr)
+		}
+	}
+}
+
+// crash stops peer i without telling anyone
+func (c *chaosCluster) crash(i int) {
+	c.mn.Cut(c.peers[i].addr)
+	c.peers[i].manager().Disconnect()
+}
+
+// restart starts peer i again under a new id, with the document and identity it had, and joins
+// through peer via as a user would. It stays down if via can't be reached
+func (c *chaosCluster) restart(i, via int) bool {
+	c.start(i)
+	if c.peers[i].manager().ConnectTo(c.peers[via].addr) != nil {
+		c.peers[i].manager().Disconnect()
+		return false
+	}
+	return true
+}
+
+// waitConverged waits until all peers have the same document and the same NetMeta
+func (c *chaosCluster) waitConverged(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if c.converged() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, p := range c.peers {
+		c.t.Logf("%s %s %q\n%v", p.addr, p.manager().GetCurrentId(), p.text(), p.manager().GetNetworkMetadata())
+	}
+	c.t.Fatal("peers did not converge")
+}
+
+func (c *chaosCluster) converged() bool {
+	text := c.peers[0].text()
+	netMeta := c.peers[0].manager().GetNetworkMetadata()
+	for _, p := range c.peers[1:] {
+		if p.text() != text || !reflect.DeepEqual(netMeta, p.manager().GetNetworkMetadata()) {
+			return false
+		}
+	}
+	// every current session is known and live, the ones before restarts are gone
+	for _, p := range c.peers {
+		if meta, ok := netMeta[p.manager().GetCurrentId()]; !ok || meta.Left {
+			return false
+		}
+	}
+	return len(netMeta) == len(c.peers)
+}
+
+func TestChaosPartitionHeal(t *testing.T) {
+	c := newChaosCluster(t, 5, 1)
+	c.edit(0, 20)
+	c.waitConverged(5 * time.Second)
+
+	// both sides keep editing while split
+	c.partition(0, 1)
+	c.edit(0, 10)
+	c.edit(3, 10)
+	c.edit(4, 10)
+	time.Sleep(time.Second)
+	assertEqual(t, c.peers[0].text(), c.peers[1].text())
+	assertEqual(t, c.peers[3].text(), c.peers[2].text())
+	assertEqual(t, false, c.peers[0].text() == c.peers[2].text())
+
+	c.healAll()
+	c.waitConverged(10 * time.Second)
+}
+
+func TestChaosDelayAndDrops(t *testing.T) {
+	c := newChaosCluster(t, 4, 2)
+	c.mn.SetLatency(20 * time.Millisecond)
+	c.mn.SetDropRate(0.02)
+	for round := 0; round < 10; round++ {
+		c.edit(c.rand.Intn(len(c.peers)), 5)
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.mn.SetDropRate(0)
+	c.waitConverged(10 * time.Second)
+}
+
+func TestChaosRestart(t *testing.T) {
+	c := newChaosCluster(t, 4, 3)
+	c.edit(2, 10)
+	c.waitConverged(5 * time.Second)
+
+	// edits made while peer 2 is down reach it after the restart, and its old
+	// session is dropped even though it never said it left
+	c.crash(2)
+	c.edit(0, 10)
+	c.edit(2, 5)
+	assertEqual(t, true, c.restart(2, 3))
+	c.waitConverged(10 * time.Second)
+
+	// a peer leaving voluntarily and coming back
+	c.peers[1].manager().Disconnect()
+	c.edit(3, 5)
+	assertEqual(t, nil, c.peers[1].manager().Reconnect())
+	c.waitConverged(10 * time.Second)
+}
+
+// the seed of TestChaosRandom, set CHAOS_SEED to replay another run
+func chaosSeed(t *testing.T) int64 {
+	seed := int64(1)
+	if s := os.Getenv("CHAOS_SEED"); s != "" {
+		var err error
+		if seed, err = strconv.ParseInt(s, 10, 64); err != nil {
+			t.Fatalf("invalid CHAOS_SEED: %v", err)
+		}
+	}
+	return seed
+}
+
+// random faults between random edits
+func TestChaosRandom(t *testing.T) {
+	c := newChaosCluster(t, 6, chaosSeed(t))
+	down := make(map[int]bool)
+	for step := 0; step < 30; step++ {
+		i := c.rand.Intn(len(c.peers))
+		switch c.rand.Intn(8) {
+		case 0:
+			c.partition(i, (i+1)%len(c.peers))
+		case 1:
+			c.healAll()
+		case 2:
+			c.mn.SetLatency(time.Duration(c.rand.Intn(30)) * time.Millisecond)
+		case 3:
+			c.mn.SetDropRate(c.rand.Float64() * 0.03)
+		case 4:
+			if i == 0 {
+				// the others rejoin through peer 0
+				continue
+			}
+			if !down[i] {
+				c.crash(i)
+				down[i] = true
+			} else if c.restart(i, 0) {
+				down[i] = false
+			}
+		default:
+			c.edit(i, 1+c.rand.Intn(5))
+		}
+		time.Sleep(time.Duration(c.rand.Intn(100)) * time.Millisecond)
+	}
+	c.healAll()
+	c.mn.SetLatency(0)
+	c.mn.SetDropRate(0)
+	for i := range c.peers {
+		if down[i] && !c.restart(i, 0) {
+			t.Fatal("can't rejoin through peer 0")
+		}
+	}
+	c.waitConverged(20 * time.Second)
+}
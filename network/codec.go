@@ -0,0 +1,110 @@
+package network
+
+import (
+	. "../common"
+	"../documentmanager"
+	"../version"
+	"bytes"
+	"encoding/json"
+	"github.com/hashicorp/go-msgpack/codec"
+	"sync"
+)
+
+// payload encodings, the codec of a connection is agreed on in the connect handshake
+const (
+	CodecJson   = "json"
+	CodecBinary = "binary"
+)
+
+// binary is only used if both sides prefer it, so either side can ask
+// for json to make the traffic readable when debugging
+func negotiateCodec(local, remote string) string {
+	if local == CodecBinary && remote == CodecBinary {
+		return CodecBinary
+	}
+	return CodecJson
+}
+
+// encodeForCodec returns msg with its payload converted to the format of the codec.
+// Receivers can decode either format so this is only needed on the sending side
+func encodeForCodec(msg Message, codecName string) Message {
+	if version.IsBinary(msg.Msg) == (codecName == CodecBinary) {
+		return msg
+	}
+	if msg.encodings == nil {
+		msg.Msg = convertPayload(msg, codecName)
+	} else {
+		msg.Msg = msg.encodings.get(codecName, func() []byte { return convertPayload(msg, codecName) })
+	}
+	return msg
+}
+
+// the payload of msg in the format of the codec, unchanged if it can't be converted
+func convertPayload(msg Message, codecName string) []byte {
+	switch msg.Type {
+	case MSG_TYPE_REMOTE_OP:
+		ops := documentmanager.RemoteOperationsFromSlice(msg.Msg)
+		if codecName == CodecBinary {
+			return documentmanager.RemoteOperationsToBinary(ops)
+		}
+		return documentmanager.RemoteOperationsToSlice(ops)
+	case MSG_TYPE_SUMMARY:
+		summary, err := newSyncSummaryFromSlice(msg.Msg)
+		if err == nil {
+			return summary.encode(codecName)
+		}
+	case MSG_TYPE_DIGEST:
+		var d digest
+		if decodePayload(msg.Msg, &d) == nil && codecName == CodecBinary {
+			return msgpackEncode(d)
+		}
+	case MSG_TYPE_NET_META_UPDATE:
+		netMeta, err := newNetMetaFromSlice(msg.Msg)
+		if err == nil {
+			return netMeta.encode(codecName)
+		}
+	}
+	return msg.Msg
+}
+
+// the payloads of a message by codec, so a message sent to many peers
+// is converted once per codec instead of once per peer
+type encodings struct {
+	mutex   sync.Mutex
+	byCodec map[string][]byte
+}
+
+// withEncodings returns msg with a cache for its converted payloads, set
+// before the message is copied for every peer it's sent to
+func (msg Message) withEncodings() Message {
+	if msg.encodings == nil {
+		msg.encodings = &encodings{byCodec: make(map[string][]byte)}
+	}
+	return msg
+}
+
+func (e *encodings) get(codecName string, convert func() []byte) []byte {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	payload, ok := e.byCodec[codecName]
+	if !ok {
+		payload = convert()
+		e.byCodec[codecName] = payload
+	}
+	return payload
+}
+
+func msgpackEncode(v interface{}) []byte {
+	buf := []byte{BINARY_PAYLOAD_MAGIC}
+	var b []byte
+	codec.NewEncoderBytes(&b, &codec.MsgpackHandle{}).Encode(v)
+	return append(buf, b...)
+}
+
+// decodes a payload in either json or msgpack (binary) format
+func decodePayload(data []byte, v interface{}) error {
+	if version.IsBinary(data) {
+		return codec.NewDecoder(bytes.NewReader(data[1:]), &codec.MsgpackHandle{}).Decode(v)
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,24 @@
+package network
+
+import (
+	"../version"
+	"testing"
+)
+
+func TestEncodeOncePerCodec(t *testing.T) {
+	netMeta := newNetMeta()
+	netMeta["a"] = NodeMeta{Addr: "a"}
+	netMeta["b"] = NodeMeta{Addr: "b"}
+	msg := newNetMetaUpdateMsg("a", netMeta).withEncodings()
+
+	// the copies sent to every peer share the converted payload
+	first, second := encodeForCodec(msg, CodecBinary), encodeForCodec(msg, CodecBinary)
+	assertEqual(t, true, version.IsBinary(first.Msg))
+	assertEqual(t, &first.Msg[0], &second.Msg[0])
+	decoded, err := newNetMetaFromSlice(first.Msg)
+	assertEqual(t, nil, err)
+	assertEqual(t, netMeta, decoded)
+
+	// the json peers keep the payload as it is
+	assertEqual(t, &msg.Msg[0], &encodeForCodec(msg, CodecJson).Msg[0])
+}
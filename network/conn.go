@@ -3,6 +3,7 @@ package network
 import (
 	"../documentmanager"
 	"../util"
+	"../version"
 	"bufio"
 	"fmt"
 	"net"
@@ -12,16 +13,6 @@ import (
 // Structural wise, this is probably a misuse
 // TODO fix the structure if possible
 
-func getSendWrapperFromNode(n *node) *node {
-	return &node{
-		conn:    n.conn,
-		reader:  n.reader,
-		writer:  n.writer,
-		outChan: n.outChan,
-		logger:  n.logger,
-	}
-}
-
 func newConnWrapper(conn net.Conn) *node {
 	var n node
 	n.setConn(conn)
@@ -34,8 +25,14 @@ func (n *node) setConn(conn net.Conn) {
 	n.writer = &util.MessageWriter{bufio.NewWriter(conn)}
 }
 
+// closes the connection, the one of a node in the pool is replaced on reconnecting
+// so it's only accessed with the stateMutex held
 func (n *node) close() {
-	n.conn.Close()
+	n.stateMutex.Lock()
+	defer n.stateMutex.Unlock()
+	if n.conn != nil {
+		n.conn.Close()
+	}
 }
 
 func (n *node) writeLog(buf interface{}, msgNote string) error {
@@ -74,15 +71,36 @@ func (n *node) readMessage(msgNote string) (string, error) {
 }
 
 func parseMessageHelper(msg Message) string {
-	msgPrint := msg.Type + fmt.Sprintln(msg.Visited)
+	msgPrint := msg.Type + " " + msg.Id + "\n"
 	switch msg.Type {
 	case MSG_TYPE_NET_META_UPDATE:
-		nm, _ := newNetMetaFromJson(msg.Msg)
+		nm, _ := newNetMetaFromSlice(msg.Msg)
 		msgPrint = msgPrint + "Content: " + fmt.Sprint(nm)
 		break
-	case MSG_TYPE_VERSION_CHECK:
-		vcm, _ := newVersionCheckMsgContentFromJson(msg.Msg)
-		msgPrint = msgPrint + "Content: " + fmt.Sprint(vcm)
+	case MSG_TYPE_SUMMARY:
+		summary, _ := newSyncSummaryFromSlice(msg.Msg)
+		msgPrint = msgPrint + "Content: " + fmt.Sprint(summary)
+		break
+	case MSG_TYPE_DIGEST:
+		var d digest
+		decodePayload(msg.Msg, &d)
+		msgPrint = msgPrint + "Content: " + fmt.Sprint(d)
+		break
+	case MSG_TYPE_RANGE_REQUEST:
+		ranges, _ := version.RangesFromSlice(msg.Msg)
+		msgPrint = msgPrint + "Content: " + fmt.Sprint(ranges)
+		break
+	case MSG_TYPE_ACK:
+		msgPrint = msgPrint + "Seq: " + fmt.Sprint(msg.Seq)
+		break
+	case MSG_TYPE_HEARTBEAT:
+		break
+	case MSG_TYPE_TAG:
+		tags, _ := documentmanager.TagsFromSlice(msg.Msg)
+		msgPrint = msgPrint + "Content: " + fmt.Sprint(tags)
+		break
+	case MSG_TYPE_PRESENCE:
+		msgPrint = msgPrint + "Content: " + string(msg.Msg)
 		break
 	default: //remote op
 		msgPrint = msgPrint + "Content: " + fmt.Sprint(documentmanager.RemoteOperationsFromSlice(msg.Msg))
@@ -91,6 +109,7 @@ func parseMessageHelper(msg Message) string {
 }
 
 func (n *node) sendMessage(msg Message, msgNote string) error {
+	msg = encodeForCodec(msg, n.codec)
 	msgPrint := parseMessageHelper(msg)
 	msgByte := n.logger.PrepareSend("send byte "+msgNote+" "+msgPrint, msg)
 	err := n.writer.WriteMessageSlice(msgByte)
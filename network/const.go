@@ -29,6 +29,10 @@ package network
 // costly and leads to other problems associated with handling more
 // connections
 
+// Every dial starts with the purpose below followed by the hello handshake
+// in hello.go, which rejects peers speaking an incompatible protocol version
+// before anything else is exchanged
+
 // the purpose of dialing to a node
 const (
 	// client-initiated poke to a remote node
@@ -0,0 +1,255 @@
+package network
+
+import (
+	"../version"
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LAN discovery: with Config.Discovery set, a node with an open document announces the
+// id and name of the document and its public address to a UDP multicast group and lists
+// the documents announced by others. A node joining a network takes over the id of the
+// document of the peer it connects to, so every node editing the same document announces
+// the same id and the document is listed once, however many peers edit it and however
+// often they reconnect. Only a document that wasn't edited yet takes over the id of
+// another, joining the network of another document with an edited one is refused.
+// Announcements are only hints, anyone on the network can send them and joining a
+// document still goes through the usual handshake
+
+const (
+	DefaultDiscoveryAddr = "239.255.43.21:24321"
+	announceInterval     = 2 * time.Second
+	// a peer that hasn't been announced for this long is dropped from the list
+	discoveryTimeout    = 3 * announceInterval
+	maxAnnouncementSize = 1024
+)
+
+var (
+	ErrNotMulticast  = errors.New("network: the discovery address must be a multicast group")
+	ErrOtherDocument = errors.New("network: the peer edits another document, only a new document can join it")
+)
+
+// DiscoveredSession is a document edited on the local network
+type DiscoveredSession struct {
+	DocId        string
+	Name         string // of the document
+	Addr         string // public address of the peer announced last, to connect to
+	Peers        int    // announcing the document
+	Authenticate bool   // joining requires the shared secret
+	LastSeen     time.Time
+}
+
+type announcement struct {
+	DocId        string
+	Name         string
+	Addr         string
+	Authenticate bool
+}
+
+type discovery struct {
+	conn     *net.UDPConn // sends announcements
+	listener *net.UDPConn
+	done     chan struct{}
+	stopOnce sync.Once
+	mutex    sync.Mutex
+	// by document id, then by address
+	peers map[string]map[string]discoveredPeer
+}
+
+type discoveredPeer struct {
+	announcement
+	lastSeen time.Time
+}
+
+func newDiscovery(conn, listener *net.UDPConn) *discovery {
+	return &discovery{
+		conn:     conn,
+		listener: listener,
+		done:     make(chan struct{}),
+		peers:    make(map[string]map[string]discoveredPeer),
+	}
+}
+
+func (nm *NetworkManager) startDiscovery() error {
+	groupAddr, err := net.ResolveUDPAddr("udp4", nm.config.DiscoveryAddr)
+	if err != nil {
+		return err
+	}
+	if !groupAddr.IP.IsMulticast() {
+		return ErrNotMulticast
+	}
+	listener, err := net.ListenMulticastUDP("udp4", nil, groupAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp4", nil, groupAddr)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	nm.discovery = newDiscovery(conn, listener)
+	go nm.announce()
+	go nm.listenForAnnouncements()
+	return nil
+}
+
+// closes the sockets, which ends listenForAnnouncements, and ends announce
+func (d *discovery) stop() {
+	d.stopOnce.Do(func() {
+		close(d.done)
+		d.conn.Close()
+		d.listener.Close()
+	})
+}
+
+func (nm *NetworkManager) announce() {
+	d := nm.discovery
+	for {
+		docId, name := nm.localDocument()
+		if docId != "" && nm.IsConnected() {
+			data, _ := json.Marshal(announcement{docId, name, nm.publicAddr, nm.auth != nil})
+			d.conn.Write(data)
+		}
+		select {
+		case <-d.done:
+			return
+		case <-time.After(announceInterval):
+		}
+	}
+}
+
+func (nm *NetworkManager) listenForAnnouncements() {
+	d := nm.discovery
+	buf := make([]byte, maxAnnouncementSize)
+	for {
+		n, _, err := d.listener.ReadFromUDP(buf)
+		if err != nil {
+			// closed by stop, or broken for good
+			return
+		}
+		var a announcement
+		if json.Unmarshal(buf[:n], &a) != nil {
+			continue
+		}
+		docId, _ := nm.localDocument()
+		if a.DocId == docId || a.Addr == nm.publicAddr {
+			continue
+		}
+		d.receive(a, time.Now())
+	}
+}
+
+func (d *discovery) receive(a announcement, now time.Time) {
+	if a.DocId == "" || a.Addr == "" {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	peers, ok := d.peers[a.DocId]
+	if !ok {
+		peers = make(map[string]discoveredPeer)
+		d.peers[a.DocId] = peers
+	}
+	peers[a.Addr] = discoveredPeer{a, now}
+}
+
+// the documents announced until now, dropping the peers that haven't been heard from
+func (d *discovery) sessions(now time.Time) []DiscoveredSession {
+	result := make([]DiscoveredSession, 0)
+	d.mutex.Lock()
+	for docId, peers := range d.peers {
+		var session DiscoveredSession
+		for addr, peer := range peers {
+			if now.Sub(peer.lastSeen) > discoveryTimeout {
+				delete(peers, addr)
+				continue
+			}
+			session.Peers++
+			if peer.lastSeen.After(session.LastSeen) || (peer.lastSeen.Equal(session.LastSeen) && addr < session.Addr) {
+				session.DocId = docId
+				session.Name = peer.Name
+				session.Addr = addr
+				session.Authenticate = peer.Authenticate
+				session.LastSeen = peer.lastSeen
+			}
+		}
+		if len(peers) == 0 {
+			delete(d.peers, docId)
+		} else {
+			result = append(result, session)
+		}
+	}
+	d.mutex.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].DocId < result[j].DocId
+	})
+	return result
+}
+
+// SetDocument sets the id and name of the document edited on this node, announced on the
+// local network if discovery is enabled. An empty id stops announcing
+func (nm *NetworkManager) SetDocument(docId, name string) {
+	nm.localMutex.Lock()
+	nm.docId = docId
+	nm.docName = name
+	nm.localMutex.Unlock()
+}
+
+// DocId returns the id of the document edited on this node, which is the one of the
+// network after joining it with ConnectTo
+func (nm *NetworkManager) DocId() string {
+	docId, _ := nm.localDocument()
+	return docId
+}
+
+func (nm *NetworkManager) localDocument() (string, string) {
+	nm.localMutex.Lock()
+	defer nm.localMutex.Unlock()
+	return nm.docId, nm.docName
+}
+
+// takes over the id of the document of a network being joined, if the peer joined has one.
+// Returns ErrOtherDocument if the local document has another id and was edited already
+func (nm *NetworkManager) joinDocument(docId string) error {
+	if docId == "" {
+		return nil
+	}
+	edited := nm.documentEdited()
+	nm.localMutex.Lock()
+	defer nm.localMutex.Unlock()
+	if nm.docId != "" && nm.docId != docId && edited {
+		return ErrOtherDocument
+	}
+	nm.docId = docId
+	return nil
+}
+
+// whether any operation was made or received on the local document
+func (nm *NetworkManager) documentEdited() bool {
+	vector, err := version.FromSlice(nm.GetOpsReceiveVersion())
+	return err == nil && len(vector) > 0
+}
+
+// DiscoveredSessions returns the documents recently announced on the local network
+// ordered by name
+func (nm *NetworkManager) DiscoveredSessions() []DiscoveredSession {
+	if nm.discovery == nil {
+		return make([]DiscoveredSession, 0)
+	}
+	return nm.discovery.sessions(time.Now())
+}
+
+// Close disconnects and stops discovery, the manager can't be used afterwards
+func (nm *NetworkManager) Close() {
+	nm.Disconnect()
+	if nm.discovery != nil {
+		nm.discovery.stop()
+	}
+}
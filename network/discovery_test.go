@@ -0,0 +1,84 @@
+package network
+
+import (
+	. "../common"
+	"../version"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDiscoveredSessions(t *testing.T) {
+	d := newDiscovery(nil, nil)
+	now := time.Now()
+	d.receive(announcement{"doc", "notes", "a", false}, now)
+	d.receive(announcement{"doc", "notes", "b", false}, now.Add(time.Second))
+	d.receive(announcement{"other", "agenda", "c", true}, now)
+	d.receive(announcement{"", "fake", "d", false}, now)
+
+	// the peers editing the same document are listed once
+	sessions := d.sessions(now.Add(time.Second))
+	assertEqual(t, 2, len(sessions))
+	assertEqual(t, DiscoveredSession{"other", "agenda", "c", 1, true, now}, sessions[0])
+	assertEqual(t, DiscoveredSession{"doc", "notes", "b", 2, false, now.Add(time.Second)}, sessions[1])
+
+	// until they stop announcing it
+	sessions = d.sessions(now.Add(discoveryTimeout + time.Millisecond))
+	assertEqual(t, 1, len(sessions))
+	assertEqual(t, "b", sessions[0].Addr)
+	assertEqual(t, 1, sessions[0].Peers)
+	assertEqual(t, 0, len(d.sessions(now.Add(discoveryTimeout+2*time.Second))))
+}
+
+func TestJoinDocument(t *testing.T) {
+	mn := NewMemNetwork()
+	a, b := newMemPeer(t, mn, "a"), newMemPeer(t, mn, "b")
+	a.nm.SetDocument("doc", "notes")
+	b.nm.SetDocument("mine", "notes")
+	assertEqual(t, nil, b.nm.ConnectTo("a"))
+	assertEqual(t, "doc", b.nm.DocId())
+	// a node joining through b gets the same one
+	c := newMemPeer(t, mn, "c")
+	assertEqual(t, nil, c.nm.ConnectTo("b"))
+	assertEqual(t, "doc", c.nm.DocId())
+
+	// an edited document doesn't join the network of another one
+	d := newMemPeer(t, mn, "d")
+	d.nm.SetDocument("edited", "notes")
+	vector := version.NewVector()
+	vector.IncrementTo(StringToSiteId("dddddddddddddddd"), 1)
+	d.nm.SetGetOpsReceiveVersion(func() []byte { return vector.ToBinary() })
+	assertEqual(t, ErrOtherDocument, d.nm.ConnectTo("a"))
+	assertEqual(t, "edited", d.nm.DocId())
+	assertEqual(t, "", d.connectedIds())
+}
+
+func TestDiscoveryStop(t *testing.T) {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip(err)
+	}
+	conn, err := net.DialUDP("udp4", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nm := &NetworkManager{discovery: newDiscovery(conn, listener)}
+	nm.SetDocument("doc", "notes")
+	listened, announced := make(chan struct{}), make(chan struct{})
+	go func() {
+		nm.listenForAnnouncements()
+		close(listened)
+	}()
+	go func() {
+		nm.announce()
+		close(announced)
+	}()
+	nm.Close()
+	for _, done := range []chan struct{}{listened, announced} {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("discovery did not stop")
+		}
+	}
+}
@@ -1,10 +1,17 @@
 package network
 
 import (
+	"crypto/tls"
 	"net"
+	"time"
 )
 
 func (s *session) handleNewConn(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok && handshakeTLS(tlsConn, s.manager.config.UnreachableTimeout) != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Now().Add(s.manager.config.UnreachableTimeout))
 	n := newConnWrapper(conn)
 	n.logger = s.manager.logger
 	// distinguish purpose of this connection
@@ -15,21 +22,36 @@ func (s *session) handleNewConn(conn net.Conn) {
 		return
 	}
 	switch purpose {
+	case dialingTypeRegister, dialingTypePoke, dialingTypeConnect:
+	default:
+		// invalid purpose; ignore
+		conn.Close()
+		return
+	}
+	remote, ok := acceptHandshake(n, s.localHello(), s.manager.auth)
+	if !ok {
+		conn.Close()
+		return
+	}
+	switch purpose {
 	case dialingTypeRegister:
 		s.handleRegister(n)
 	case dialingTypePoke:
 		s.handlePoke(n)
 	case dialingTypeConnect:
-		s.handleConnect(n)
-	default:
-		// invalid purpose; ignore
+		s.handleConnect(n, remote)
 	}
 }
 
 func (s *session) handleRegister(connWrapper *node) {
 	defer connWrapper.close()
-	latestNetMeta := s.nodePool.getLatestNetMeta()
-	err := connWrapper.writeLog(latestNetMeta, "handleRegister lastestNetMeta")
+	// sent once authenticated, so only members of the network learn the document
+	err := connWrapper.writeMessage(s.manager.DocId(), "handleRegister docId")
+	if err != nil {
+		return
+	}
+	latestNetMeta := s.nodePool.getLatestNetMetaCopy()
+	err = connWrapper.writeLog(latestNetMeta, "handleRegister lastestNetMeta")
 	if err != nil {
 		return
 	}
@@ -68,13 +90,32 @@ func (s *session) handlePoke(connWrapper *node) {
 	if err != nil {
 		return
 	}
-	s.manager.msgChan <- newNetMetaUpdateMsg(s.id, newJoinNetMeta(id, addr))
+	meta := NodeMeta{}
+	err = connWrapper.readLog(&meta, "handlePoke meta")
+	if err != nil {
+		return
+	}
+	meta.Addr = addr
+	meta.Left = false
+	joinNetMeta := newNetMeta()
+	joinNetMeta[id] = meta
+	s.manager.msgChan <- newNetMetaUpdateMsg(s.id, joinNetMeta)
+	// the poking node wants a connection, refused if we have enough peers
+	reply := "done"
+	if linked(s.manager.config.Topology, meta.Topology) {
+		n := s.nodePool.addOrGetNodeFromPool(id, meta, s.manager.logger)
+		if !s.nodePool.admit(n, s.manager.config) {
+			reply = "busy"
+		} else if n.isDisconnected() {
+			s.startDialing(n)
+		}
+	}
 	// TODO: not sure if the following is necessary when using tcp
 	// but it gives more guarantees
-	connWrapper.writeMessage("done", "handlePoke done") // best we can do
+	connWrapper.writeMessage(reply, "handlePoke reply") // best we can do
 }
 
-func (s *session) handleConnect(connWrapper *node) {
+func (s *session) handleConnect(connWrapper *node, remote hello) {
 	expectedId, err := connWrapper.readMessage("handleConnect expectedId")
 	defer func(err error, connWrapper *node) {
 		if err != nil {
@@ -88,6 +129,11 @@ func (s *session) handleConnect(connWrapper *node) {
 		connWrapper.writeMessage("false", "handleConnect false")
 		return
 	}
+	if !linked(s.manager.config.Topology, remote.Topology) {
+		// not a link of the star, the dialer only hasn't learned our topology yet
+		connWrapper.close()
+		return
+	}
 	err = connWrapper.writeMessage("true", "handleConnect true")
 	if err != nil {
 		return
@@ -100,19 +146,24 @@ func (s *session) handleConnect(connWrapper *node) {
 	if err != nil {
 		return
 	}
-	hasMsg, msg := s.getLatestVersionCheckMsg()
-	if hasMsg {
-		err = connWrapper.sendMessage(msg, "handleConnect versionCheckMsg")
-	}
-	if err != nil {
+	n := s.nodePool.addOrGetNodeFromPool(id, NodeMeta{Addr: addr}, s.manager.logger)
+	if !s.nodePool.admit(n, s.manager.config) {
+		// a peer that doesn't understand busy only sees the connection fail
+		if remote.Busy {
+			connWrapper.writeMessage("busy", "handleConnect busy")
+		}
+		connWrapper.close()
 		return
 	}
-	n := s.nodePool.addOrGetNodeFromPool(id, NodeMeta{addr, false}, s.manager.logger)
-	n.conn = connWrapper.conn
-	n.reader = connWrapper.reader
-	n.writer = connWrapper.writer
-	if n.setState(nodeStateConnected) {
-		go s.sendThread(getSendWrapperFromNode(n))
-		go s.receiveThread(n)
+	if remote.Busy {
+		err = connWrapper.writeMessage("true", "handleConnect accepted")
+		if err != nil {
+			return
+		}
 	}
+	connWrapper.codec = negotiateCodec(s.manager.config.Codec, remote.Codec)
+	connWrapper.peer = remote
+	connWrapper.queue = n.queue
+	connWrapper.conn.SetDeadline(time.Time{})
+	s.startConnection(n, connWrapper)
 }
@@ -0,0 +1,154 @@
+package network
+
+import (
+	"strconv"
+)
+
+// ProtocolVersion is the version of the peer protocol. It has to be increased on
+// any incompatible change to the handshakes, Message or the payloads it carries
+const ProtocolVersion = 11
+
+// the oldest protocol version this node can still talk to, which signs operations with
+// their vector, keeps in sync through the digests of antientropy.go and has the dialer
+// prove the shared secret first. Behaviour added since then is announced as a capability
+// in the hello, so peers without it can still connect
+const minProtocolVersion = 11
+
+// hello is the first thing sent by the dialing side after the purpose of the
+// connection and answered by the listening side with a helloReply
+type hello struct {
+	ProtocolVersion    int
+	MinProtocolVersion int
+	// capabilities, left out by peers of older versions
+	Codec        string // preferred payload encoding
+	Authenticate bool   // the network is protected by a shared secret
+	AuthSalt     []byte // the salt of the shared secret of the node, see auth.go
+	Topology     string // see star.go, empty if the peer only forms a mesh
+	Heartbeats   bool   // sends heartbeats, see liveness.go
+	Busy         bool   // understands that a connection is refused as busy, see sampling.go
+	LeftExpiry   bool   // removes the nodes that left once LeftAt expired, see leftgc.go
+	Incarnation  int64  // of the session of the node, see sendQueue.resume
+}
+
+type helloReply struct {
+	Accepted bool
+	Reason   string // why the peer is incompatible
+	Hello    hello
+}
+
+// IncompatiblePeerError is returned when a peer rejects the handshake
+type IncompatiblePeerError struct {
+	Addr   string
+	Reason string
+}
+
+func (err *IncompatiblePeerError) Error() string {
+	return "network: peer at " + err.Addr + " is incompatible: " + err.Reason
+}
+
+func (nm *NetworkManager) localHello() hello {
+	return hello{
+		ProtocolVersion:    ProtocolVersion,
+		MinProtocolVersion: minProtocolVersion,
+		Codec:              nm.config.Codec,
+		Authenticate:       nm.auth != nil,
+		AuthSalt:           nm.auth.localSalt(),
+		Topology:           nm.config.Topology,
+		Heartbeats:         true,
+		Busy:               true,
+		LeftExpiry:         true,
+	}
+}
+
+// the hello of the connections of s
+func (s *session) localHello() hello {
+	local := s.manager.localHello()
+	local.Incarnation = s.incarnation
+	return local
+}
+
+// returns the reason why a node with hello local can't talk to a node with hello remote
+// or "" if they are compatible
+func checkCompatible(local, remote hello) string {
+	if remote.ProtocolVersion < local.MinProtocolVersion {
+		return "peer uses protocol version " + strconv.Itoa(remote.ProtocolVersion) +
+			", at least version " + strconv.Itoa(local.MinProtocolVersion) + " is required"
+	}
+	if remote.MinProtocolVersion > local.ProtocolVersion {
+		return "peer requires protocol version " + strconv.Itoa(remote.MinProtocolVersion) +
+			" or newer, this node uses version " + strconv.Itoa(local.ProtocolVersion)
+	}
+	if remote.Authenticate && !local.Authenticate {
+		return "peer requires a shared secret"
+	}
+	if !remote.Authenticate && local.Authenticate {
+		return "peer does not use a shared secret"
+	}
+	if remote.Authenticate && len(remote.AuthSalt) == 0 {
+		// it would use the unsalted key of older versions
+		return "peer does not salt the shared secret, it has to be updated"
+	}
+	return ""
+}
+
+// dialHandshake sends our hello and waits for the peer to accept it, then authenticates
+// with the key of the salt of the peer if the network has a shared secret. Returns the
+// hello of the peer or an *IncompatiblePeerError if the peer rejected us
+func dialHandshake(n *node, addr string, local hello, keys *authKeys) (hello, error) {
+	err := n.writeLog(local, "dialHandshake hello")
+	if err != nil {
+		return hello{}, err
+	}
+	reply := new(helloReply)
+	err = n.readLog(reply, "dialHandshake helloReply")
+	if err != nil {
+		return hello{}, err
+	}
+	if !reply.Accepted {
+		// the reason of the peer is worded from its side, prefer ours
+		reason := checkCompatible(local, reply.Hello)
+		if reason == "" {
+			reason = reply.Reason
+		}
+		if reason == "" {
+			reason = "handshake rejected"
+		}
+		return hello{}, &IncompatiblePeerError{addr, reason}
+	}
+	if reason := checkCompatible(local, reply.Hello); reason != "" {
+		return hello{}, &IncompatiblePeerError{addr, reason}
+	}
+	if local.Authenticate {
+		key, err := keys.forSalt(reply.Hello.AuthSalt)
+		if err != nil {
+			return hello{}, &IncompatiblePeerError{addr, err.Error()}
+		}
+		err = dialAuth(n, addr, key)
+		if err != nil {
+			return hello{}, err
+		}
+	}
+	return reply.Hello, nil
+}
+
+// acceptHandshake reads the hello of a dialing peer and accepts or rejects it,
+// peers that fail to authenticate with the key of our salt are rejected as well
+func acceptHandshake(n *node, local hello, keys *authKeys) (hello, bool) {
+	remote := new(hello)
+	err := n.readLog(remote, "acceptHandshake hello")
+	if err != nil {
+		return hello{}, false
+	}
+	reason := checkCompatible(local, *remote)
+	err = n.writeLog(helloReply{reason == "", reason, local}, "acceptHandshake helloReply")
+	if err != nil || reason != "" {
+		return hello{}, false
+	}
+	if local.Authenticate {
+		key, err := keys.forSalt(local.AuthSalt)
+		if err != nil || !acceptAuth(n, key) {
+			return hello{}, false
+		}
+	}
+	return *remote, true
+}
@@ -0,0 +1,99 @@
+package network
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestCheckCompatible(t *testing.T) {
+	local := hello{ProtocolVersion: ProtocolVersion, MinProtocolVersion: minProtocolVersion}
+	tests := []struct {
+		remote     hello
+		compatible bool
+	}{
+		{local, true},
+		// an older peer without any of the capabilities added since the minimum
+		{hello{ProtocolVersion: minProtocolVersion, MinProtocolVersion: 1}, true},
+		{hello{ProtocolVersion: minProtocolVersion - 1, MinProtocolVersion: 1}, false},
+		{hello{ProtocolVersion: ProtocolVersion + 5, MinProtocolVersion: ProtocolVersion + 1}, false},
+		{hello{ProtocolVersion: ProtocolVersion, MinProtocolVersion: minProtocolVersion, Authenticate: true}, false},
+	}
+	for _, test := range tests {
+		assertEqual(t, test.compatible, checkCompatible(local, test.remote) == "")
+	}
+	secret := local
+	secret.Authenticate = true
+	assertEqual(t, "peer does not use a shared secret", checkCompatible(secret, local))
+}
+
+// runs the handshake of a dialing peer with hello dialer and a listening peer with hello listener
+func handshake(dialer, listener hello) (hello, error, hello, bool) {
+	client, server := newMemConnPair(NewMemNetwork(), "dialer", "listener")
+	accepted := make(chan bool)
+	var remote hello
+	go func() {
+		var ok bool
+		remote, ok = acceptHandshake(newConnWrapper(server), listener, nil)
+		server.Close()
+		accepted <- ok
+	}()
+	reply, err := dialHandshake(newConnWrapper(client), "listener", dialer, nil)
+	ok := <-accepted
+	return reply, err, remote, ok
+}
+
+func TestHandshake(t *testing.T) {
+	current := hello{ProtocolVersion: ProtocolVersion, MinProtocolVersion: minProtocolVersion,
+		Codec: CodecBinary, Topology: TopologyHub, Heartbeats: true, Busy: true, LeftExpiry: true}
+	old := hello{ProtocolVersion: minProtocolVersion, MinProtocolVersion: 1}
+
+	reply, err, remote, ok := handshake(current, old)
+	assertEqual(t, nil, err)
+	assertEqual(t, true, ok)
+	assertEqual(t, old, reply)
+	assertEqual(t, current, remote)
+
+	// the capabilities the old peer lacks are left out in either direction
+	reply, err, remote, ok = handshake(old, current)
+	assertEqual(t, nil, err)
+	assertEqual(t, true, ok)
+	assertEqual(t, false, reply.Heartbeats == remote.Heartbeats)
+}
+
+func TestIncompatiblePeer(t *testing.T) {
+	current := hello{ProtocolVersion: ProtocolVersion, MinProtocolVersion: minProtocolVersion}
+	tooOld := hello{ProtocolVersion: minProtocolVersion - 1, MinProtocolVersion: 1}
+	tooNew := hello{ProtocolVersion: ProtocolVersion + 1, MinProtocolVersion: ProtocolVersion + 1}
+
+	// the old peer accepts us, but we don't accept it
+	_, err, _, _ := handshake(current, tooOld)
+	incompatible, ok := err.(*IncompatiblePeerError)
+	assertEqual(t, true, ok)
+	assertEqual(t, "listener", incompatible.Addr)
+	assertEqual(t, checkCompatible(current, tooOld), incompatible.Reason)
+
+	// the new peer rejects us, the reason is worded from our side
+	_, err, _, accepted := handshake(current, tooNew)
+	assertEqual(t, false, accepted)
+	assertEqual(t, "network: peer at listener is incompatible: peer requires protocol version "+
+		strconv.Itoa(ProtocolVersion+1)+" or newer, this node uses version "+strconv.Itoa(ProtocolVersion), err.Error())
+}
+
+func TestConnectToIncompatiblePeer(t *testing.T) {
+	mn := NewMemNetwork()
+	a := newMemPeer(t, mn, "a")
+	listener, _ := mn.Transport("old").Listen("old")
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		n := newConnWrapper(conn)
+		n.readMessage("purpose")
+		acceptHandshake(n, hello{ProtocolVersion: 1, MinProtocolVersion: 1}, nil)
+		conn.Close()
+	}()
+	_, ok := a.nm.ConnectTo("old").(*IncompatiblePeerError)
+	assertEqual(t, true, ok)
+}
@@ -0,0 +1,173 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Every session of a node has a new id, the identity stays the same across sessions
+// and restarts so that peers recognize a node that reconnects. The session with the
+// highest incarnation supersedes the other sessions of its identity, which are removed
+// from the NetMeta instead of staying there as Left forever. The identity is the id of
+// a key that signs the identity and incarnation of every session, so that no one else
+// can supersede the sessions of a node. The incarnation is a counter kept with the key
+
+// Identity is the key a node is recognized by across sessions, with the number of sessions it started
+type Identity struct {
+	mutex       sync.Mutex
+	path        string // the file it's stored in, empty if it isn't
+	key         ed25519.PrivateKey
+	incarnation int64
+}
+
+// the content of an identity file
+type identityFile struct {
+	Key         []byte
+	Incarnation int64
+}
+
+// NewIdentity makes an identity that isn't stored anywhere
+func NewIdentity() *Identity {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err.Error())
+	}
+	return &Identity{key: key}
+}
+
+// LoadIdentity reads the identity stored in path, or stores a new one if path doesn't exist.
+// The file of an older version, which had no key, is replaced
+func LoadIdentity(path string) (*Identity, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var stored identityFile
+	if err == nil && json.Unmarshal(data, &stored) == nil && len(stored.Key) == ed25519.PrivateKeySize {
+		return &Identity{path: path, key: stored.Key, incarnation: stored.Incarnation}, nil
+	}
+	identity := NewIdentity()
+	identity.path = path
+	return identity, identity.save()
+}
+
+// the id of the key
+func (identity *Identity) String() string {
+	return siteOfKey(identity.key.Public().(ed25519.PublicKey))
+}
+
+// caller must hold the mutex. Written to a temporary file first so a crash
+// while saving doesn't lose the key
+func (identity *Identity) save() error {
+	if identity.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(identityFile{Key: identity.key, Incarnation: identity.incarnation})
+	if err != nil {
+		return err
+	}
+	tmp := identity.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, identity.path)
+}
+
+// the incarnation of a new session, stored before it's used so it keeps increasing
+// across restarts, whatever the clock says
+func (identity *Identity) nextIncarnation() (int64, error) {
+	identity.mutex.Lock()
+	defer identity.mutex.Unlock()
+	identity.incarnation++
+	return identity.incarnation, identity.save()
+}
+
+// sets the identity and incarnation of session id, signed with the key of identity
+func (meta *NodeMeta) signIdentity(id string, identity *Identity, incarnation int64) {
+	meta.Identity = identity.String()
+	meta.Incarnation = incarnation
+	meta.IdentityKey, meta.IdentitySignature = sign(identity.key, identityContent(id, meta.Identity, incarnation))
+}
+
+// whether session id proved that it's the incarnation of its identity
+func (meta NodeMeta) hasValidIdentity(id string) bool {
+	identity, ok := verify(meta.IdentityKey, meta.IdentitySignature, identityContent(id, meta.Identity, meta.Incarnation))
+	return ok && identity == meta.Identity
+}
+
+func identityContent(id, identity string, incarnation int64) []byte {
+	return signedContent("identity", id, identity, strconv.FormatInt(incarnation, 10))
+}
+
+// the meta identifying the session, kept in its quit message
+func (s *session) identityMeta() NodeMeta {
+	var meta NodeMeta
+	meta.signIdentity(s.id, s.manager.config.Identity, s.incarnation)
+	return meta
+}
+
+// tells everyone that session id at addr is gone. Nothing is sent when it's no longer known,
+// its meta was removed with a newer session and a quit without its identity would stay forever
+func (s *session) sendQuit(id, addr string) {
+	meta, ok := s.nodePool.findNodeMeta(id)
+	if !ok {
+		return
+	}
+	s.manager.msgChan <- newNetMetaUpdateMsg(s.id, newQuitNetMeta(id, addr, meta))
+}
+
+// whether session a is newer than session b of the same identity
+func newerSession(aId string, a NodeMeta, bId string, b NodeMeta) bool {
+	if a.Incarnation != b.Incarnation {
+		return a.Incarnation > b.Incarnation
+	}
+	return aId > bId
+}
+
+// whether a newer session of the identity of meta is known
+func (netMeta NetMeta) superseded(id string, meta NodeMeta) bool {
+	if meta.Identity == "" {
+		return false
+	}
+	for otherId, other := range netMeta {
+		if otherId != id && other.Identity == meta.Identity && newerSession(otherId, other, id, meta) {
+			return true
+		}
+	}
+	return false
+}
+
+// removes the sessions superseded by session id, returns them marked as left
+func (netMeta NetMeta) removeSuperseded(id string) NetMeta {
+	removed := newNetMeta()
+	meta, ok := netMeta[id]
+	if !ok || meta.Identity == "" {
+		return removed
+	}
+	for otherId, other := range netMeta {
+		if otherId != id && other.Identity == meta.Identity && newerSession(id, meta, otherId, other) {
+			other.leave(time.Now())
+			removed[otherId] = other
+			delete(netMeta, otherId)
+		}
+	}
+	return removed
+}
+
+// removes the changed sessions that a newer session supersedes, e.g. one whose identity
+// arrived after it was added, and marks them as left in delta
+func (netMeta NetMeta) removeSupersededIn(delta NetMeta) {
+	for id := range delta {
+		if meta, ok := netMeta[id]; ok && netMeta.superseded(id, meta) {
+			meta.leave(time.Now())
+			delta[id] = meta
+			delete(netMeta, id)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package network
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadIdentity(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "identity")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "identity.txt")
+	identity, err := LoadIdentity(path)
+	assertEqual(t, nil, err)
+	assertEqual(t, 36, len(identity.String()))
+	first, _ := identity.nextIncarnation()
+
+	// the incarnation keeps increasing after a restart
+	again, err := LoadIdentity(path)
+	assertEqual(t, nil, err)
+	assertEqual(t, identity.String(), again.String())
+	next, _ := again.nextIncarnation()
+	assertEqual(t, first+1, next)
+
+	// the file of an older version is replaced
+	ioutil.WriteFile(path, []byte("c1c9a4a6-0dd5-4bd4-9a3e-6d3c8a1cc1f0\n"), 0600)
+	replaced, err := LoadIdentity(path)
+	assertEqual(t, nil, err)
+	assertEqual(t, false, replaced.String() == identity.String())
+}
+
+// the meta of session id of identity
+func sessionMeta(id, addr string, identity *Identity, incarnation int64) NodeMeta {
+	meta := NodeMeta{Addr: addr}
+	meta.signIdentity(id, identity, incarnation)
+	return meta
+}
+
+func TestSupersededSessions(t *testing.T) {
+	x, y := NewIdentity(), NewIdentity()
+	s1, s2, t1 := sessionMeta("s1", "a", x, 1), sessionMeta("s2", "a", x, 2), sessionMeta("t1", "b", y, 1)
+	netMeta := newNetMeta()
+	netMeta.merge(NetMeta{"s1": s1, "t1": t1})
+
+	// a new session of x replaces s1
+	delta, changed := netMeta.merge(NetMeta{"s2": s2})
+	assertEqual(t, true, changed)
+	assertEqual(t, 2, len(delta))
+	assertEqual(t, true, delta["s1"].Left && delta["s1"].LeftAt != 0)
+	assertEqual(t, s2, delta["s2"])
+	assertEqual(t, NetMeta{"s2": s2, "t1": t1}, netMeta)
+
+	// peers that haven't heard of s2 yet can't bring s1 back
+	left := s1
+	left.Left = true
+	_, changed = netMeta.merge(NetMeta{"s1": left})
+	assertEqual(t, false, changed)
+	_, changed = netMeta.merge(NetMeta{"s0": sessionMeta("s0", "a", x, 0)})
+	assertEqual(t, false, changed)
+	assertEqual(t, 2, len(netMeta))
+
+	// nor can a quit that lost the identity once the identity reaches us
+	netMeta.merge(NetMeta{"s1": {Addr: "a", Left: true}})
+	left.LeftAt = 1
+	delta, changed = netMeta.merge(NetMeta{"s1": left})
+	assertEqual(t, true, changed)
+	assertEqual(t, NetMeta{"s1": left}, delta)
+	assertEqual(t, 2, len(netMeta))
+
+	// sessions without an identity are kept as left
+	netMeta.merge(NetMeta{"u1": {Addr: "c"}})
+	netMeta.merge(NetMeta{"u2": {Addr: "c"}, "u1": {Addr: "c", Left: true}})
+	assertEqual(t, 4, len(netMeta))
+	assertEqual(t, true, netMeta["u1"].Left)
+}
+
+func TestForgedIdentity(t *testing.T) {
+	x, mallory := NewIdentity(), NewIdentity()
+	netMeta := newNetMeta()
+	netMeta.merge(NetMeta{"s1": sessionMeta("s1", "a", x, 1)})
+
+	// claiming the identity of x without its key doesn't remove the session of x
+	forged := sessionMeta("m1", "m", mallory, 5)
+	forged.Identity = x.String()
+	delta, _ := netMeta.merge(NetMeta{"m1": forged})
+	assertEqual(t, false, netMeta["s1"].Left)
+	assertEqual(t, 1, len(delta))
+	assertEqual(t, "", netMeta["m1"].Identity)
+
+	// nor does replaying a signed session under another id
+	replayed := sessionMeta("s2", "a", x, 2)
+	netMeta.merge(NetMeta{"m2": replayed})
+	assertEqual(t, false, netMeta["s1"].Left)
+}
+
+func TestResumedSession(t *testing.T) {
+	x, mallory := NewIdentity(), NewIdentity()
+	netMeta := newNetMeta()
+	s1 := sessionMeta("s1", "a", x, 1)
+	left := s1
+	left.leave(time.Now())
+	netMeta.merge(NetMeta{"s1": left})
+
+	// the node reconnects as s1 under a newer incarnation
+	resumed := sessionMeta("s1", "a", x, 2)
+	_, changed := netMeta.merge(NetMeta{"s1": resumed})
+	assertEqual(t, true, changed)
+	assertEqual(t, resumed, netMeta["s1"])
+
+	// its quit from before doesn't make it leave again, nor can another identity take it over
+	_, changed = netMeta.merge(NetMeta{"s1": left})
+	assertEqual(t, false, changed)
+	_, changed = netMeta.merge(NetMeta{"s1": sessionMeta("s1", "m", mallory, 3)})
+	assertEqual(t, false, changed)
+	assertEqual(t, resumed, netMeta["s1"])
+
+	// also once it was forgotten
+	g := newGraveyard()
+	g.bury(NetMeta{"s1": left}, time.Now())
+	assertEqual(t, NetMeta{}, g.filter(NetMeta{"s1": left}, time.Now()))
+	assertEqual(t, NetMeta{}, g.filter(NetMeta{"s1": sessionMeta("s1", "m", mallory, 3)}, time.Now()))
+	assertEqual(t, NetMeta{"s1": resumed}, g.filter(NetMeta{"s1": resumed}, time.Now()))
+	assertEqual(t, 0, len(g))
+}
@@ -0,0 +1,157 @@
+package network
+
+import (
+	"time"
+)
+
+// A node that left stays in the NetMeta as Left for leftTTL after a peer first saw it
+// left, long enough for every peer to hear of it, and is then removed by every peer on
+// its own. Only the local clock is used for that, so a peer with a wrong clock can't make
+// the others drop a node early or keep it forever; the peers just remove it within a
+// little while of each other. The removed ids stay in a graveyard for graveyardTTL, so a
+// peer that was away and still has them can't bring them back, whether as left or as live
+// nodes, unless the node resumes the session under a newer incarnation. LeftAt, set by
+// the node marking it left and merged to the earliest, only buries entries as soon as
+// they arrive once it's older than any graveyard could still be
+
+const (
+	leftTTL         = 10 * time.Minute
+	graveyardTTL    = 24 * time.Hour
+	collectInterval = time.Minute
+)
+
+// the ids removed from the NetMeta by when they were removed
+type graveyard map[string]grave
+
+// a session resumed by its node under a newer incarnation comes back, see Reconnect
+type grave struct {
+	at          int64
+	identity    string
+	incarnation int64
+}
+
+func newGraveyard() graveyard {
+	return make(map[string]grave)
+}
+
+func newGrave(meta NodeMeta, now time.Time) grave {
+	return grave{now.UnixNano(), meta.Identity, meta.Incarnation}
+}
+
+// whether meta is the session buried in g resumed
+func (g grave) resumedBy(id string, meta NodeMeta) bool {
+	return !meta.Left && g.identity != "" && meta.Identity == g.identity && meta.Incarnation > g.incarnation &&
+		meta.hasValidIdentity(id)
+}
+
+// when the left nodes were first seen left, on the local clock
+type leftSince map[string]time.Time
+
+func newLeftSince() leftSince {
+	return make(map[string]time.Time)
+}
+
+func expired(at int64, ttl time.Duration, now time.Time) bool {
+	return at != 0 && now.Sub(time.Unix(0, at)) > ttl
+}
+
+// buries the left nodes of netMeta
+func (g graveyard) bury(netMeta NetMeta, now time.Time) {
+	for id, meta := range netMeta {
+		if meta.Left {
+			g[id] = newGrave(meta, now)
+		}
+	}
+}
+
+// notes the nodes of netMeta that are seen left for the first time
+func (since leftSince) observe(netMeta NetMeta, now time.Time) {
+	for id, meta := range netMeta {
+		if _, ok := since[id]; meta.Left && !ok {
+			since[id] = now
+		}
+	}
+}
+
+// the nodes of netMeta that aren't in current, e.g. superseded sessions
+func (netMeta NetMeta) removed(current NetMeta) NetMeta {
+	removed := newNetMeta()
+	for id, meta := range netMeta {
+		if _, ok := current[id]; !ok {
+			removed[id] = meta
+		}
+	}
+	return removed
+}
+
+// returns updates without the nodes that are buried or expired, burying the latter
+func (g graveyard) filter(updates NetMeta, now time.Time) NetMeta {
+	alive := newNetMeta()
+	for id, meta := range updates {
+		if buried, ok := g[id]; ok {
+			if !buried.resumedBy(id, meta) {
+				continue
+			}
+			delete(g, id)
+		}
+		if meta.Left && expired(meta.LeftAt, leftTTL+graveyardTTL, now) {
+			g[id] = newGrave(meta, now)
+			continue
+		}
+		alive[id] = meta
+	}
+	return alive
+}
+
+// moves the nodes of netMeta left for leftTTL to the graveyard and forgets the ones buried
+// long enough, returns whether netMeta changed
+func (netMeta NetMeta) collect(g graveyard, since leftSince, now time.Time) bool {
+	since.observe(netMeta, now)
+	changed := false
+	for id, seen := range since {
+		if meta, ok := netMeta[id]; !ok || !meta.Left {
+			delete(since, id)
+		} else if now.Sub(seen) > leftTTL {
+			g[id] = newGrave(meta, now)
+			delete(netMeta, id)
+			delete(since, id)
+			changed = true
+		}
+	}
+	for id, buried := range g {
+		if expired(buried.at, graveyardTTL, now) {
+			delete(g, id)
+		}
+	}
+	return changed
+}
+
+func (s *session) periodicallyCollect() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(collectInterval):
+		}
+		if s.nodePool.collect(time.Now()) {
+			go s.manager.NetMetaHandler(s.nodePool.getLatestNetMetaCopy())
+		}
+	}
+}
+
+// returns the updates received from peer id. A peer of an older version that doesn't
+// expire the nodes that left would bring them back once they're no longer buried, so
+// the nodes that left are only taken from it if they're known
+func (s *session) fromPeer(id string, updates NetMeta) NetMeta {
+	n, ok := s.nodePool.getNodeWithId(id)
+	if !ok || n.capabilities().LeftExpiry {
+		return updates
+	}
+	known := newNetMeta()
+	for id, meta := range updates {
+		if _, ok := s.nodePool.findNodeMeta(id); ok || !meta.Left {
+			known[id] = meta
+		}
+	}
+	return known
+}
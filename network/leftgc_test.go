@@ -0,0 +1,81 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEarliestLeftAtWins(t *testing.T) {
+	netMeta := newNetMeta()
+	netMeta.merge(NetMeta{"a": {Addr: "a"}})
+	netMeta.merge(NetMeta{"a": {Addr: "a", Left: true, LeftAt: 20}})
+	netMeta.merge(NetMeta{"a": {Addr: "a", Left: true, LeftAt: 10}})
+	_, changed := netMeta.merge(NetMeta{"a": {Addr: "a", Left: true, LeftAt: 30}})
+	assertEqual(t, false, changed)
+	assertEqual(t, NodeMeta{Addr: "a", Left: true, LeftAt: 10}, netMeta["a"])
+}
+
+func TestCollectLeft(t *testing.T) {
+	start := time.Now()
+	leftAt := start.UnixNano()
+	netMeta := newNetMeta()
+	g, since := newGraveyard(), newLeftSince()
+	netMeta.merge(g.filter(NetMeta{
+		"a": {Addr: "a"},
+		"b": {Addr: "b", Left: true, LeftAt: leftAt},
+	}, start))
+
+	assertEqual(t, false, netMeta.collect(g, since, start))
+	assertEqual(t, false, netMeta.collect(g, since, start.Add(leftTTL/2)))
+	assertEqual(t, 2, len(netMeta))
+	assertEqual(t, true, netMeta.collect(g, since, start.Add(leftTTL+time.Second)))
+	assertEqual(t, NetMeta{"a": {Addr: "a"}}, netMeta)
+	assertEqual(t, 0, len(since))
+
+	// a peer that was away can't bring b back, whether it knows it as left or not
+	now := start.Add(2 * leftTTL)
+	_, changed := netMeta.merge(g.filter(NetMeta{"b": {Addr: "b", Left: true, LeftAt: leftAt}}, now))
+	assertEqual(t, false, changed)
+	_, changed = netMeta.merge(g.filter(NetMeta{"b": {Addr: "b"}}, now))
+	assertEqual(t, false, changed)
+
+	// nor a node that left before any graveyard could still have it
+	ancient := start.Add(-leftTTL - graveyardTTL - time.Second).UnixNano()
+	_, changed = netMeta.merge(g.filter(NetMeta{"c": {Addr: "c", Left: true, LeftAt: ancient}}, now))
+	assertEqual(t, false, changed)
+	assertEqual(t, 2, len(g))
+
+	netMeta.collect(g, since, now.Add(graveyardTTL+time.Second))
+	assertEqual(t, 0, len(g))
+}
+
+func TestCollectLeftWithSkewedClock(t *testing.T) {
+	now := time.Now()
+	netMeta := newNetMeta()
+	g, since := newGraveyard(), newLeftSince()
+	// marked left by a peer whose clock is an hour behind or a day ahead
+	netMeta.merge(g.filter(NetMeta{
+		"behind": {Addr: "behind", Left: true, LeftAt: now.Add(-time.Hour).UnixNano()},
+		"ahead":  {Addr: "ahead", Left: true, LeftAt: now.Add(24 * time.Hour).UnixNano()},
+	}, now))
+	assertEqual(t, false, netMeta.collect(g, since, now))
+	assertEqual(t, 2, len(netMeta))
+
+	// both are removed leftTTL after they were seen left here
+	assertEqual(t, false, netMeta.collect(g, since, now.Add(leftTTL-time.Second)))
+	assertEqual(t, true, netMeta.collect(g, since, now.Add(leftTTL+time.Second)))
+	assertEqual(t, 0, len(netMeta))
+}
+
+func TestLeftFromPeerWithoutExpiry(t *testing.T) {
+	np := newNodePool(nil)
+	np.netMeta.merge(NetMeta{"a": {Addr: "a"}, "old": {Addr: "old"}, "new": {Addr: "new"}})
+	np.addOrGetNodeFromPool("old", np.getNodeMeta("old"), nil)
+	np.addOrGetNodeFromPool("new", np.getNodeMeta("new"), nil).peer.LeftExpiry = true
+	s := &session{nodePool: np}
+
+	updates := NetMeta{"a": {Addr: "a", Left: true}, "b": {Addr: "b", Left: true}, "c": {Addr: "c"}}
+	assertEqual(t, NetMeta{"a": {Addr: "a", Left: true}, "c": {Addr: "c"}}, s.fromPeer("old", updates))
+	assertEqual(t, updates, s.fromPeer("new", updates))
+	assertEqual(t, updates, s.fromPeer("", updates))
+}
@@ -0,0 +1,244 @@
+package network
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// Failure detection: every connected node is sent a heartbeat each HeartbeatInterval
+// and any message received from a node counts as a sign of life. How suspicious the
+// silence of a node is follows the phi-accrual failure detector (Hayashibara et al.):
+// from the intervals between the last messages of the node, phi is how unlikely it is
+// that the next one is still on its way. The node is suspect once phi reaches
+// phiThreshold, which for steady heartbeats is shortly after SuspectTimeout of silence
+// and later on a link whose delays vary. After UnreachableTimeout its connection is
+// closed and the node is unreachable until a new connection is established, which
+// catches peers frozen behind a half-open connection.
+// A node that knows other nodes still in the network but hasn't been connected to any
+// of them for UnreachableTimeout is partitioned, until it's connected to one again
+
+const (
+	defaultHeartbeatInterval  = time.Second
+	defaultSuspectTimeout     = 5 * time.Second
+	defaultUnreachableTimeout = 15 * time.Second
+	phiThreshold              = 8
+	// the number of intervals the expected arrival of the next message is estimated from
+	phiWindow = 100
+)
+
+var ErrInvalidTimeouts = errors.New("network: the heartbeat interval must be shorter than the suspect timeout, and that shorter than the unreachable timeout")
+
+// PeerStatus describes the liveness of a peer
+type PeerStatus struct {
+	State     string    // connected, suspect, unreachable or disconnected
+	LastHeard time.Time // zero if nothing was ever received from the peer
+	Dropped   uint64    // messages to the peer dropped since it didn't keep up, it pulls them instead
+}
+
+func (state NodeState) String() string {
+	switch state {
+	case nodeStateConnected:
+		return "connected"
+	case nodeStateSuspect:
+		return "suspect"
+	case nodeStateUnreachable:
+		return "unreachable"
+	case nodeStateLeft:
+		return "left"
+	default:
+		return "disconnected"
+	}
+}
+
+// the intervals between the last messages received from a node
+type arrivals struct {
+	last      time.Time
+	intervals []time.Duration
+}
+
+// starts over at now, expecting the next message after interval
+func (a *arrivals) reset(now time.Time, interval time.Duration) {
+	a.last = now
+	a.intervals = []time.Duration{interval}
+}
+
+func (a *arrivals) add(now time.Time) {
+	a.intervals = append(a.intervals, now.Sub(a.last))
+	if len(a.intervals) > phiWindow {
+		a.intervals = a.intervals[1:]
+	}
+	a.last = now
+}
+
+// phi is -log10 of the probability that the next message arrives later than now, taking
+// the intervals as normally distributed. The mean is stretched by pause so that a lost or
+// late heartbeat isn't suspicious yet, and the deviation is at least minStdDev
+func (a *arrivals) phi(now time.Time, pause, minStdDev time.Duration) float64 {
+	mean, variance := 0.0, 0.0
+	for _, interval := range a.intervals {
+		mean += float64(interval)
+	}
+	mean /= float64(len(a.intervals))
+	for _, interval := range a.intervals {
+		variance += (float64(interval) - mean) * (float64(interval) - mean)
+	}
+	stdDev := math.Max(math.Sqrt(variance/float64(len(a.intervals))), float64(minStdDev))
+	// logistic approximation of the normal distribution
+	y := (float64(now.Sub(a.last)) - mean - float64(pause)) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if y > 0 {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// phi of node n at now, caller must hold the stateMutex
+func (n *node) phi(now time.Time, config Config) float64 {
+	return n.arrivals.phi(now, config.SuspectTimeout-config.HeartbeatInterval, config.HeartbeatInterval/10)
+}
+
+// the connection to the node is open, though it may be suspect
+func (n *node) isConnected() bool {
+	n.stateMutex.Lock()
+	defer n.stateMutex.Unlock()
+	return n.state == nodeStateConnected || n.state == nodeStateSuspect
+}
+
+// no connection to the node is open, one is being established
+func (n *node) isDisconnected() bool {
+	n.stateMutex.Lock()
+	defer n.stateMutex.Unlock()
+	return n.state == nodeStateDisconnected || n.state == nodeStateUnreachable
+}
+
+func (n *node) isUnreachable() bool {
+	n.stateMutex.Lock()
+	defer n.stateMutex.Unlock()
+	return n.state == nodeStateUnreachable
+}
+
+// heard records a sign of life from the node, clearing any suspicion
+func (n *node) heard(now time.Time) {
+	n.stateMutex.Lock()
+	n.lastHeard = now
+	n.arrivals.add(now)
+	if n.state == nodeStateSuspect {
+		n.state = nodeStateConnected
+	}
+	n.stateMutex.Unlock()
+}
+
+// connectionLost marks the node as disconnected after its connection c failed, unless the
+// node has a newer connection already. An unreachable node stays unreachable until it's
+// connected again
+func (n *node) connectionLost(c *node) {
+	n.stateMutex.Lock()
+	if n.conn == c.conn && (n.state == nodeStateConnected || n.state == nodeStateSuspect) {
+		n.state = nodeStateDisconnected
+	}
+	n.stateMutex.Unlock()
+}
+
+// checks how long the node has been silent, returns false if it's unreachable. A peer
+// of an older version that doesn't send heartbeats is never suspected
+func (n *node) checkLiveness(now time.Time, config Config) bool {
+	n.stateMutex.Lock()
+	defer n.stateMutex.Unlock()
+	if n.state != nodeStateConnected && n.state != nodeStateSuspect {
+		return true
+	}
+	if !n.peer.Heartbeats {
+		return true
+	}
+	if now.Sub(n.lastHeard) > config.UnreachableTimeout {
+		n.state = nodeStateUnreachable
+		if n.conn != nil {
+			// the receive thread fails and reconnects
+			n.conn.Close()
+		}
+		return false
+	}
+	if n.phi(now, config) >= phiThreshold {
+		n.state = nodeStateSuspect
+	}
+	return true
+}
+
+func (n *node) capabilities() hello {
+	n.stateMutex.Lock()
+	defer n.stateMutex.Unlock()
+	return n.peer
+}
+
+func (n *node) status() PeerStatus {
+	var dropped uint64
+	if n.queue != nil {
+		dropped = n.queue.droppedMessages()
+	}
+	n.stateMutex.Lock()
+	defer n.stateMutex.Unlock()
+	return PeerStatus{n.state.String(), n.lastHeard, dropped}
+}
+
+func (s *session) monitorPeers() {
+	config := s.manager.config
+	var partition partition
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(config.HeartbeatInterval):
+		}
+		now := time.Now()
+		peers := len(s.nodePool.getConnectedNodes())
+		for _, n := range s.nodePool.getAllNodes() {
+			if n.checkLiveness(now, config) && n.isConnected() && n.capabilities().Heartbeats {
+				n.queue.beat(peers)
+			}
+		}
+		alone := peers == 0 && s.nodePool.hasOtherNodes(s.id)
+		if partitioned, changed := partition.update(alone, now, config.UnreachableTimeout); changed {
+			go s.manager.PartitionHandler(partitioned)
+		}
+	}
+}
+
+// whether a session is partitioned, see monitorPeers
+type partition struct {
+	aloneSince  time.Time // zero while connected to a peer
+	partitioned bool
+}
+
+// returns whether the session is partitioned and whether that changed
+func (p *partition) update(alone bool, now time.Time, timeout time.Duration) (bool, bool) {
+	if !alone {
+		p.aloneSince = time.Time{}
+	} else if p.aloneSince.IsZero() {
+		p.aloneSince = now
+	}
+	partitioned := alone && now.Sub(p.aloneSince) >= timeout
+	changed := partitioned != p.partitioned
+	p.partitioned = partitioned
+	return partitioned, changed
+}
+
+// SetPartitionHandler sets the function called with true when the node gets partitioned
+// from the network, and with false once it's connected to a peer again
+func (nm *NetworkManager) SetPartitionHandler(fn func(bool)) {
+	nm.PartitionHandler = fn
+}
+
+// GetPeerStatus returns the liveness of every known peer by id, leaving out the
+// peers this node doesn't keep a connection to, see star.go and sampling.go
+func (nm *NetworkManager) GetPeerStatus() map[string]PeerStatus {
+	result := make(map[string]PeerStatus)
+	for _, n := range nm.nodePool.getAllNodes() {
+		status := n.status()
+		if status.State == "disconnected" && !n.isActive() {
+			continue
+		}
+		result[n.id] = status
+	}
+	return result
+}
@@ -0,0 +1,133 @@
+package network
+
+import (
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPhi(t *testing.T) {
+	start := time.Now()
+	var steady, jittery arrivals
+	steady.reset(start, time.Second)
+	jittery.reset(start, time.Second)
+	for i := 1; i <= 20; i++ {
+		steady.add(start.Add(time.Duration(i) * time.Second))
+		// the same mean, but every other interval takes twice as long
+		jittery.add(start.Add(time.Duration(i)*time.Second + time.Duration(i%2)*500*time.Millisecond))
+	}
+	last := start.Add(20 * time.Second)
+	assertEqual(t, true, steady.phi(last.Add(time.Second), 0, 100*time.Millisecond) < 1)
+	assertEqual(t, true, steady.phi(last.Add(2*time.Second), 0, 100*time.Millisecond) > phiThreshold)
+	// the pause delays suspicion
+	assertEqual(t, true, steady.phi(last.Add(2*time.Second), time.Second, 100*time.Millisecond) < 1)
+	// a link whose delays vary is given more time
+	assertEqual(t, true, jittery.phi(last.Add(2*time.Second), 0, 100*time.Millisecond) < phiThreshold)
+}
+
+func TestCheckLiveness(t *testing.T) {
+	config := Config{
+		HeartbeatInterval:  100 * time.Millisecond,
+		SuspectTimeout:     time.Second,
+		UnreachableTimeout: 3 * time.Second,
+	}
+	local, remote := newMemConnPair(NewMemNetwork(), "a", "b")
+	n := &node{state: nodeStateDisconnected}
+	c := newConnWrapper(local)
+	c.peer.Heartbeats = true
+	assertEqual(t, true, n.attach(c, config.HeartbeatInterval))
+	start := n.lastHeard
+
+	assertEqual(t, true, n.checkLiveness(start.Add(500*time.Millisecond), config))
+	assertEqual(t, "connected", n.status().State)
+	assertEqual(t, true, n.checkLiveness(start.Add(1500*time.Millisecond), config))
+	assertEqual(t, "suspect", n.status().State)
+	assertEqual(t, true, n.isConnected())
+	n.heard(start.Add(1600 * time.Millisecond))
+	assertEqual(t, "connected", n.status().State)
+
+	assertEqual(t, false, n.checkLiveness(start.Add(5*time.Second), config))
+	assertEqual(t, "unreachable", n.status().State)
+	assertEqual(t, true, n.isDisconnected())
+	_, err := remote.Read(make([]byte, 1))
+	assertEqual(t, io.EOF, err)
+
+	// a peer that doesn't send heartbeats isn't expected to
+	old := &node{state: nodeStateDisconnected}
+	old.attach(newConnWrapper(local), config.HeartbeatInterval)
+	assertEqual(t, true, old.checkLiveness(old.lastHeard.Add(time.Minute), config))
+	assertEqual(t, "connected", old.status().State)
+}
+
+func TestMonitorPeers(t *testing.T) {
+	mn := NewMemNetwork()
+	a, b := newMemPeer(t, mn, "a"), newMemPeer(t, mn, "b")
+	assertEqual(t, nil, b.nm.ConnectTo("a"))
+	waitFor(t, "the connection", func() bool { return a.connectedIds() == idsOf(b) })
+
+	statusOfB := func() string { return a.nm.GetPeerStatus()[b.nm.GetCurrentId()].State }
+	mn.Freeze("b")
+	waitFor(t, "b to be suspected", func() bool { return statusOfB() == "suspect" })
+	waitFor(t, "b to be unreachable", func() bool { return statusOfB() == "unreachable" })
+	mn.Thaw("b")
+	waitFor(t, "b to recover", func() bool { return statusOfB() == "connected" })
+}
+
+func TestInvalidTimeouts(t *testing.T) {
+	mn := NewMemNetwork()
+	_, err := NewNetworkManager("a", "a", Config{
+		Transport:          mn.Transport("a"),
+		SuspectTimeout:     time.Second,
+		UnreachableTimeout: time.Second,
+	})
+	assertEqual(t, ErrInvalidTimeouts, err)
+}
+
+func TestPartition(t *testing.T) {
+	var p partition
+	now := time.Now()
+	timeout := time.Second
+	partitioned, changed := p.update(true, now, timeout)
+	assertEqual(t, false, partitioned || changed)
+	partitioned, changed = p.update(true, now.Add(timeout), timeout)
+	assertEqual(t, true, partitioned && changed)
+	partitioned, changed = p.update(true, now.Add(2*timeout), timeout)
+	assertEqual(t, true, partitioned && !changed)
+	partitioned, changed = p.update(false, now.Add(3*timeout), timeout)
+	assertEqual(t, true, !partitioned && changed)
+	// a brief loss of every peer isn't a partition
+	p.update(true, now.Add(4*timeout), timeout)
+	partitioned, changed = p.update(false, now.Add(4*timeout+timeout/2), timeout)
+	assertEqual(t, false, partitioned || changed)
+}
+
+func TestPartitionHandler(t *testing.T) {
+	mn := NewMemNetwork()
+	a, b := newMemPeer(t, mn, "a"), newMemPeer(t, mn, "b")
+	defer a.nm.Disconnect()
+	defer b.nm.Disconnect()
+	var mutex sync.Mutex
+	events := make([]bool, 0)
+	b.nm.SetPartitionHandler(func(partitioned bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, partitioned)
+	})
+	eventsAre := func(expected ...bool) func() bool {
+		return func() bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return reflect.DeepEqual(expected, events)
+		}
+	}
+	assertEqual(t, nil, b.nm.ConnectTo("a"))
+	waitFor(t, "the connection", func() bool {
+		return b.connectedIds() == idsOf(a)
+	})
+	mn.Partition("a", "b")
+	waitFor(t, "the partition", eventsAre(true))
+	mn.Heal("a", "b")
+	waitFor(t, "the reconnection", eventsAre(true, false))
+}
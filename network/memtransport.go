@@ -0,0 +1,394 @@
+package network
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// MemNetwork connects the transports it hands out in memory, so that several peers can run
+// in one process without sockets. Faults are injected by partitioning addresses from each
+// other, cutting their connections, freezing them, delaying every write and dropping some
+type MemNetwork struct {
+	mutex      sync.Mutex
+	listeners  map[string]*memListener
+	conns      map[*memConn]bool // the dialing side of every open connection
+	partitions map[memLink]bool
+	frozen     map[string]bool
+	latency    time.Duration
+	dropRate   float64
+}
+
+var (
+	ErrConnectionRefused = errors.New("memnet: connection refused")
+	ErrAddrInUse         = errors.New("memnet: address already in use")
+	errMemListenerClosed = errors.New("memnet: listener closed")
+	errMemDialTimeout    = memTimeoutError{}
+)
+
+type memTimeoutError struct{}
+
+func (memTimeoutError) Error() string   { return "memnet: i/o timeout" }
+func (memTimeoutError) Timeout() bool   { return true }
+func (memTimeoutError) Temporary() bool { return true }
+
+type memAddr string
+
+func (addr memAddr) Network() string {
+	return "mem"
+}
+
+func (addr memAddr) String() string {
+	return string(addr)
+}
+
+// unordered pair of addresses
+type memLink struct {
+	a, b string
+}
+
+func newMemLink(a, b string) memLink {
+	if b < a {
+		a, b = b, a
+	}
+	return memLink{a, b}
+}
+
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{
+		listeners:  make(map[string]*memListener),
+		conns:      make(map[*memConn]bool),
+		partitions: make(map[memLink]bool),
+		frozen:     make(map[string]bool),
+	}
+}
+
+// Transport returns a transport of the peer at addr, its connections come from addr
+func (mn *MemNetwork) Transport(addr string) Transport {
+	return &memTransport{network: mn, addr: addr}
+}
+
+// Partition cuts the connections between a and b and refuses new ones until Heal is called
+func (mn *MemNetwork) Partition(a, b string) {
+	mn.mutex.Lock()
+	mn.partitions[newMemLink(a, b)] = true
+	mn.mutex.Unlock()
+	mn.cut(func(link memLink) bool {
+		return link == newMemLink(a, b)
+	})
+}
+
+func (mn *MemNetwork) Heal(a, b string) {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+	delete(mn.partitions, newMemLink(a, b))
+}
+
+// Cut breaks every connection of addr, as if its network went down for a moment
+func (mn *MemNetwork) Cut(addr string) {
+	mn.cut(func(link memLink) bool {
+		return link.a == addr || link.b == addr
+	})
+}
+
+// Freeze silently discards everything addr writes until Thaw is called, as if its process
+// hung: its connections stay open but nothing arrives from it
+func (mn *MemNetwork) Freeze(addr string) {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+	mn.frozen[addr] = true
+}
+
+func (mn *MemNetwork) Thaw(addr string) {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+	delete(mn.frozen, addr)
+}
+
+// SetLatency delays everything written from now on by d
+func (mn *MemNetwork) SetLatency(d time.Duration) {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+	mn.latency = d
+}
+
+// SetDropRate drops every write with probability p from now on. A stream can't lose
+// data and go on, so the connection of a dropped write breaks as well
+func (mn *MemNetwork) SetDropRate(p float64) {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+	mn.dropRate = p
+}
+
+// returns the delay of a write from addr, whether it's dropped and whether it's discarded
+// without breaking the connection
+func (mn *MemNetwork) fate(addr string) (time.Duration, bool, bool) {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+	return mn.latency, mn.dropRate > 0 && rand.Float64() < mn.dropRate, mn.frozen[addr]
+}
+
+// breaks the matching connections
+func (mn *MemNetwork) cut(matches func(memLink) bool) {
+	mn.mutex.Lock()
+	conns := make([]*memConn, 0)
+	for conn := range mn.conns {
+		if matches(newMemLink(string(conn.local), string(conn.remote))) {
+			conns = append(conns, conn)
+		}
+	}
+	mn.mutex.Unlock()
+	for _, conn := range conns {
+		conn.reset()
+	}
+}
+
+func (mn *MemNetwork) forget(conn *memConn) {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+	delete(mn.conns, conn)
+	delete(mn.conns, conn.peer)
+}
+
+type memTransport struct {
+	network *MemNetwork
+	addr    string
+}
+
+func (t *memTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	mn := t.network
+	mn.mutex.Lock()
+	l, ok := mn.listeners[addr]
+	if !ok || mn.partitions[newMemLink(t.addr, addr)] {
+		mn.mutex.Unlock()
+		return nil, ErrConnectionRefused
+	}
+	client, server := newMemConnPair(mn, t.addr, addr)
+	mn.conns[client] = true
+	mn.mutex.Unlock()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		client.Close()
+		return nil, ErrConnectionRefused
+	case <-expired:
+		client.Close()
+		return nil, errMemDialTimeout
+	}
+}
+
+func (t *memTransport) Listen(addr string) (net.Listener, error) {
+	mn := t.network
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+	if _, ok := mn.listeners[addr]; ok {
+		return nil, ErrAddrInUse
+	}
+	l := &memListener{
+		network: mn,
+		addr:    addr,
+		conns:   make(chan *memConn),
+		done:    make(chan struct{}),
+	}
+	mn.listeners[addr] = l
+	return l, nil
+}
+
+type memListener struct {
+	network   *MemNetwork
+	addr      string
+	conns     chan *memConn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errMemListenerClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.network.mutex.Lock()
+		if l.network.listeners[l.addr] == l {
+			delete(l.network.listeners, l.addr)
+		}
+		l.network.mutex.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return memAddr(l.addr)
+}
+
+// one side of an in-memory connection
+type memConn struct {
+	network       *MemNetwork
+	local, remote memAddr
+	in, out       *memPipe
+	peer          *memConn
+}
+
+func newMemConnPair(mn *MemNetwork, from, to string) (*memConn, *memConn) {
+	up, down := newMemPipe(), newMemPipe()
+	client := &memConn{network: mn, local: memAddr(from), remote: memAddr(to), in: down, out: up}
+	server := &memConn{network: mn, local: memAddr(to), remote: memAddr(from), in: up, out: down}
+	client.peer, server.peer = server, client
+	return client, server
+}
+
+func (c *memConn) Read(b []byte) (int, error) {
+	return c.in.read(b)
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	latency, dropped, frozen := c.network.fate(string(c.local))
+	if frozen {
+		return len(b), nil
+	}
+	if dropped {
+		c.reset()
+		return len(b), nil
+	}
+	return c.out.write(b, time.Now().Add(latency))
+}
+
+// what was written is still delivered, like a TCP connection closed normally
+func (c *memConn) Close() error {
+	c.network.forget(c)
+	c.in.close(false)
+	c.out.close(false)
+	return nil
+}
+
+// breaks the connection, dropping what's still in flight
+func (c *memConn) reset() {
+	c.network.forget(c)
+	c.in.close(true)
+	c.out.close(true)
+}
+
+func (c *memConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+// writes never block
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// data written to a pipe and the time it can be read
+type memChunk struct {
+	data []byte
+	at   time.Time
+}
+
+// the bytes flowing in one direction of a connection
+type memPipe struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	chunks   []memChunk
+	closed   bool
+	deadline time.Time
+}
+
+func newMemPipe() *memPipe {
+	p := new(memPipe)
+	p.cond = sync.NewCond(&p.mutex)
+	return p
+}
+
+func (p *memPipe) read(b []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for {
+		now := time.Now()
+		if len(p.chunks) > 0 && !now.Before(p.chunks[0].at) {
+			n := copy(b, p.chunks[0].data)
+			if n == len(p.chunks[0].data) {
+				p.chunks = p.chunks[1:]
+			} else {
+				p.chunks[0].data = p.chunks[0].data[n:]
+			}
+			return n, nil
+		}
+		if len(p.chunks) == 0 && p.closed {
+			return 0, io.EOF
+		}
+		if !p.deadline.IsZero() && !now.Before(p.deadline) {
+			return 0, memTimeoutError{}
+		}
+		if len(p.chunks) > 0 {
+			p.wakeAt(p.chunks[0].at)
+		}
+		p.cond.Wait()
+	}
+}
+
+func (p *memPipe) write(b []byte, at time.Time) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+	p.chunks = append(p.chunks, memChunk{append([]byte(nil), b...), at})
+	p.cond.Broadcast()
+	return len(b), nil
+}
+
+func (p *memPipe) close(discard bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	if discard {
+		p.chunks = nil
+	}
+	p.cond.Broadcast()
+}
+
+func (p *memPipe) setDeadline(t time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.deadline = t
+	if !t.IsZero() {
+		p.wakeAt(t)
+	}
+	p.cond.Broadcast()
+}
+
+// wakes up the readers at t, caller must hold the mutex
+func (p *memPipe) wakeAt(t time.Time) {
+	time.AfterFunc(time.Until(t), func() {
+		p.mutex.Lock()
+		p.cond.Broadcast()
+		p.mutex.Unlock()
+	})
+}
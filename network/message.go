@@ -1,70 +1,72 @@
 package network
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"strconv"
+	"sync/atomic"
+)
 
 const (
-	MSG_TYPE_VERSION_CHECK   = "versionCheck"  // non-recursive
 	MSG_TYPE_NET_META_UPDATE = "netMetaUpdate" // recursive broadcast
-	MSG_TYPE_REMOTE_OP       = "remoteOp"      // (non) recursive broadcast Indicate by the Visited field
+	MSG_TYPE_REMOTE_OP       = "remoteOp"      // (non) recursive broadcast Indicate by the Id field
+	MSG_TYPE_TAG             = "tag"           // recursive broadcast
+	MSG_TYPE_ACK             = "ack"           // point to point, acknowledges messages up to Seq
+	MSG_TYPE_HEARTBEAT       = "heartbeat"     // point to point, see liveness.go
+	MSG_TYPE_IHAVE           = "ihave"         // point to point, see plumtree
+	MSG_TYPE_PRUNE           = "prune"
+	MSG_TYPE_GRAFT           = "graft"
+	MSG_TYPE_DIGEST          = "digest" // point to point, see antientropy.go
+	MSG_TYPE_SUMMARY         = "summary"
+	MSG_TYPE_RANGE_REQUEST   = "rangeRequest"
+	MSG_TYPE_PRESENCE        = "presence" // recursive broadcast, not retransmitted, see presence.go
 )
 
 // TODO: for convenience, we are passing json around with possibly
 // layers of mappings. This is inefficient. Should improve on this
 // if we have time
 
-type VisitedNodes map[string]struct{}
-
 // Message specifies the format of communication between nodes
 // after connection establishes
 type Message struct {
-	Type    string
-	Visited VisitedNodes
-	Msg     []byte
+	Type string
+	Id   string // set on messages broadcast to the whole network, unique
+	Msg  []byte
+	Seq  uint64 // sequence number on the link, see sendQueue
+	from string // node the message was received from, empty if created locally
+	// the payload converted per codec, shared by the copies sent to the peers, see withEncodings
+	encodings *encodings
 }
 
+var broadcastCounter uint64
+
+// NewBroadcastMessage creates a message to broadcast to the whole network
+// from the node with id
 func NewBroadcastMessage(id, msgType string, content []byte) Message {
 	return Message{
-		msgType,
-		map[string]struct{}{id: struct{}{}},
-		content,
+		Type: msgType,
+		Id:   id + "/" + strconv.FormatUint(atomic.AddUint64(&broadcastCounter, 1), 10),
+		Msg:  content,
 	}
 }
 
 func NewReplyMessage(msgType string, content []byte) Message {
 	return Message{
-		msgType,
-		nil,
-		content,
+		Type: msgType,
+		Msg:  content,
 	}
 }
 
-func newNetMetaUpdateMsg(id string, delta NetMeta) Message {
-	return NewBroadcastMessage(id, MSG_TYPE_NET_META_UPDATE, delta.toJson())
+func newAckMsg(seq uint64) Message {
+	return Message{Type: MSG_TYPE_ACK, Seq: seq}
 }
 
-func newSyncOrCheckMessage(msgType string, content []byte) Message {
-	return Message{
-		msgType,
-		nil,
-		content,
-	}
+// tells the peer how many peers this node is connected to, see sampling.go
+func newHeartbeatMsg(peers int) Message {
+	return Message{Type: MSG_TYPE_HEARTBEAT, Msg: []byte(strconv.Itoa(peers))}
 }
 
-type VersionCheckMsgContent struct {
-	Source        string
-	NetworkMeta   NetMeta
-	VersionVector []byte
-}
-
-func newVersionCheckMsgContentFromJson(contentJson []byte) (VersionCheckMsgContent, error) {
-	var versionCheckMsgContent VersionCheckMsgContent
-	err := json.Unmarshal(contentJson, &versionCheckMsgContent)
-	return versionCheckMsgContent, err
-}
-
-func (content VersionCheckMsgContent) toJson() []byte {
-	contentJson, _ := json.Marshal(content)
-	return contentJson
+func newNetMetaUpdateMsg(id string, delta NetMeta) Message {
+	return NewBroadcastMessage(id, MSG_TYPE_NET_META_UPDATE, delta.toJson())
 }
 
 func (msg *Message) toJson() []byte {
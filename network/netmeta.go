@@ -1,10 +1,39 @@
 package network
 
-import "encoding/json"
+import (
+	. "../common"
+	"encoding/json"
+	"time"
+)
 
 type NodeMeta struct {
 	Addr string
 	Left bool
+	// site id of the document edited on the node, set once it's known, with the public
+	// key of the site and its signature of the node id and site, see sign.go
+	Site          string `json:",omitempty"`
+	SiteKey       string `json:",omitempty"`
+	SiteSignature string `json:",omitempty"`
+	// role of the site with the public key and signature of the owner that assigned it, see roles.go
+	Role          string `json:",omitempty"`
+	RoleVersion   uint32 `json:",omitempty"`
+	RoleSigner    string `json:",omitempty"`
+	RoleSignature string `json:",omitempty"`
+	// TopologyMesh, TopologyStar or TopologyHub, see star.go
+	Topology string `json:",omitempty"`
+	// the same across the sessions of a node, the latest session supersedes the others, see identity.go
+	// with the public key of the identity and its signature of the session id, identity
+	// and incarnation
+	Identity          string `json:",omitempty"`
+	Incarnation       int64  `json:",omitempty"`
+	IdentityKey       string `json:",omitempty"`
+	IdentitySignature string `json:",omitempty"`
+	// when the node was marked as left, see leftgc.go
+	LeftAt int64 `json:",omitempty"`
+	// the profile of the user, see profile.go
+	Name    string `json:",omitempty"`
+	Color   string `json:",omitempty"`
+	Contact string `json:",omitempty"`
 }
 
 type NetMeta map[string]NodeMeta
@@ -13,42 +42,112 @@ func newNetMeta() NetMeta {
 	return make(map[string]NodeMeta)
 }
 
-func newQuitNetMeta(id, addr string) NetMeta {
+// meta is the last known meta of the node, so that the identity is kept
+func newQuitNetMeta(id, addr string, meta NodeMeta) NetMeta {
+	meta.Addr = addr
+	meta.leave(time.Now())
 	netMeta := newNetMeta()
-	netMeta[id] = NodeMeta{addr, true}
+	netMeta[id] = meta
 	return netMeta
 }
 
-func newJoinNetMeta(id, addr string) NetMeta {
-	netMeta := newNetMeta()
-	netMeta[id] = NodeMeta{addr, false}
-	return netMeta
+// marks the node as left at now unless it already left
+func (meta *NodeMeta) leave(now time.Time) {
+	meta.Left = true
+	if meta.LeftAt == 0 {
+		meta.LeftAt = now.UnixNano()
+	}
 }
 
-func newNetMetaFromJson(netMetaJson []byte) (NetMeta, error) {
+func newNetMetaFromSlice(data []byte) (NetMeta, error) {
 	var netMeta NetMeta
-	err := json.Unmarshal(netMetaJson, &netMeta)
+	err := decodePayload(data, &netMeta)
 	return netMeta, err
 }
 
-// return true if the update results in a change and false otherwise
-func (netMeta NetMeta) update(id string, newNodeMeta NodeMeta) bool {
-	if n, ok := netMeta[id]; !ok || (!n.Left && newNodeMeta.Left) {
-		netMeta[id] = newNodeMeta
-		return true
+// return true if the update results in a change and false otherwise. The site, role and
+// identity are only taken if they are signed, owners are the owners trusted besides the ones in netMeta
+func (netMeta NetMeta) update(id string, newNodeMeta NodeMeta, owners map[string]bool) bool {
+	n, ok := netMeta[id]
+	// the signature is only checked once the incarnations differ, most updates don't
+	if ok && n.Identity != "" && newNodeMeta.Identity == n.Identity && newNodeMeta.Incarnation != n.Incarnation &&
+		newNodeMeta.hasValidIdentity(id) {
+		if newNodeMeta.Incarnation > n.Incarnation {
+			// the session was resumed by its node, see Reconnect
+			ok = false
+		} else {
+			// from before it was resumed, it doesn't leave again
+			newNodeMeta.Left, newNodeMeta.LeftAt = false, 0
+		}
+	}
+	if !ok {
+		if newNodeMeta.hasValidIdentity(id) && netMeta.superseded(id, newNodeMeta) {
+			return false
+		}
+		n = newNodeMeta
+		n.Site, n.SiteKey, n.SiteSignature = "", "", ""
+		n.setProfile(Profile{})
+		n.setRoleGrant(RoleGrant{})
+		n.Identity, n.Incarnation, n.IdentityKey, n.IdentitySignature = "", 0, "", ""
+	}
+	merged := n
+	if newNodeMeta.Left {
+		merged.Left = true
+		// the earliest wins so every node expires it at the same time
+		if newNodeMeta.LeftAt != 0 && (merged.LeftAt == 0 || newNodeMeta.LeftAt < merged.LeftAt) {
+			merged.LeftAt = newNodeMeta.LeftAt
+		}
+	}
+	if merged.Site == "" && newNodeMeta.hasValidSite(id) {
+		merged.Site = newNodeMeta.Site
+		merged.SiteKey = newNodeMeta.SiteKey
+		merged.SiteSignature = newNodeMeta.SiteSignature
+		merged.setProfile(newNodeMeta.Profile())
+	}
+	if merged.Topology == "" {
+		merged.Topology = newNodeMeta.Topology
+	}
+	if merged.Identity == "" && newNodeMeta.hasValidIdentity(id) {
+		merged.Identity = newNodeMeta.Identity
+		merged.Incarnation = newNodeMeta.Incarnation
+		merged.IdentityKey = newNodeMeta.IdentityKey
+		merged.IdentitySignature = newNodeMeta.IdentitySignature
 	}
-	return false
+	grant := newNodeMeta.roleGrant()
+	if supersedesRole(grant, merged.roleGrant()) && netMeta.acceptsRole(merged.Site, grant, owners) {
+		merged.setRoleGrant(grant)
+	}
+	if ok && merged == n {
+		return false
+	}
+	netMeta[id] = merged
+	return true
 }
 
 // return the changes resulting from merge and whether changes occurred
 func (netMeta NetMeta) merge(netMeta2 NetMeta) (NetMeta, bool) {
+	return netMeta.mergeTrusting(netMeta2, nil)
+}
+
+// merge trusting owners to assign roles besides the owners in netMeta
+func (netMeta NetMeta) mergeTrusting(netMeta2 NetMeta, owners map[string]bool) (NetMeta, bool) {
 	delta := newNetMeta()
-	for id, node := range netMeta2 {
-		changed := netMeta.update(id, node)
-		if changed {
-			delta[id] = node
+	// until nothing changes, a role may be signed by an owner that's only added later on
+	for changed := true; changed; {
+		changed = false
+		for id, node := range netMeta2 {
+			if netMeta.update(id, node, owners) {
+				delta[id] = netMeta[id]
+				changed = true
+			}
+		}
+	}
+	for id := range delta.copy() {
+		for oldId, old := range netMeta.removeSuperseded(id) {
+			delta[oldId] = old
 		}
 	}
+	netMeta.removeSupersededIn(delta)
 	if len(delta) == 0 {
 		return nil, false
 	}
@@ -60,6 +159,13 @@ func (netMeta NetMeta) toJson() []byte {
 	return netMetaJson
 }
 
+func (netMeta NetMeta) encode(codecName string) []byte {
+	if codecName == CodecBinary {
+		return msgpackEncode(netMeta)
+	}
+	return netMeta.toJson()
+}
+
 func (netMeta NetMeta) toJsonPrettyPrint() []byte {
 	metaJson, _ := json.MarshalIndent(netMeta, "", "    ")
 	return metaJson
@@ -76,9 +182,15 @@ func (netMeta NetMeta) copy() NetMeta {
 type NetMetaList []NodeMetaListElem
 
 type NodeMetaListElem struct {
-	Id   string
-	Addr string
-	Left bool
+	Id       string
+	Addr     string
+	Left     bool
+	Site     string
+	Role     string
+	Topology string
+	Name     string
+	Color    string
+	Contact  string
 }
 
 func (slice NetMetaList) Len() int {
@@ -97,9 +209,15 @@ func (netMeta NetMeta) ToList() NetMetaList {
 	list := make(NetMetaList, 0, len(netMeta))
 	for id, node := range netMeta {
 		list = append(list, NodeMetaListElem{
-			Id:   id,
-			Addr: node.Addr,
-			Left: node.Left,
+			Id:       id,
+			Addr:     node.Addr,
+			Left:     node.Left,
+			Site:     node.Site,
+			Role:     node.Role,
+			Topology: node.Topology,
+			Name:     node.Name,
+			Color:    node.Color,
+			Contact:  node.Contact,
 		})
 	}
 	return list
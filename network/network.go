@@ -10,25 +10,82 @@
 package network
 
 import (
+	. "../common"
+	"crypto/ed25519"
+	"crypto/tls"
 	"errors"
 	"github.com/arcaneiceman/GoVector/govec"
-	"net"
+	"github.com/satori/go.uuid"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 type NetworkManager struct {
-	id         string
-	localAddr  string
-	publicAddr string
-	msgChan    chan Message
-	nodePool   *nodePool
-	session    *session
+	// the session and its id, kept when reconnecting, see currentSession
+	sessionMutex sync.RWMutex
+	id           string
+	session      *session
+	localAddr    string
+	publicAddr   string
+	msgChan      chan Message
+	nodePool     *nodePool
+	config       Config
+	auth         *authKeys  // of config.Secret, nil if the network is open
+	discovery    *discovery // nil unless config.Discovery is set
+	presence     *presence
 	// this is ugly and nt really good, maybe changed later once its working
 	RemoteOpHandler      func([]byte)
 	GetOpsReceiveVersion func() []byte
-	VersionCheckHandler  func([]byte) ([]byte, bool)
+	RangeRequestHandler  func([]byte) ([]byte, bool) // returns the operations in the requested ranges
+	SequenceHandler      func([]byte) ([]byte, bool) // of a hub, see star.go
+	TagHandler           func([]byte)
+	GetTags              func() []byte
+	NetMetaHandler       func(NetMeta) // called whenever the NetMeta changes
+	PresenceHandler      func()        // called whenever the presence of a peer changes
+	PartitionHandler     func(bool)    // called when the node gets partitioned and once it rejoins, see liveness.go
 	logger               *govec.GoLog
+	// key of the site and its role announced in the NetMeta of every session, see roles.go
+	localMutex sync.Mutex
+	siteKey    ed25519.PrivateKey
+	grant      RoleGrant
+	// the document edited on the node and its name, see discovery.go
+	docId   string
+	docName string
+}
+
+// Config holds the options of a NetworkManager
+type Config struct {
+	// preferred payload encoding, CodecBinary (default) or CodecJson
+	Codec string
+	// opens the connections, TCPTransport if nil
+	Transport Transport
+	// encrypts and authenticates all connections when set, see NewTLSConfig
+	TLS *tls.Config
+	// only peers knowing the same secret can join the network when set
+	Secret string
+	// failure detection, see liveness.go. Zero values are replaced by the defaults
+	HeartbeatInterval  time.Duration
+	SuspectTimeout     time.Duration
+	UnreachableTimeout time.Duration
+	// backoff between attempts to reconnect to a node, see backoff.go
+	ReconnectMinDelay time.Duration
+	ReconnectMaxDelay time.Duration
+	// stays the same across sessions so peers recognize the node, see LoadIdentity.
+	// A new one is made for the manager if nil
+	Identity *Identity
+	// shown to the other users, see profile.go. The color is picked from the identity if empty
+	Profile Profile
+	// TopologyMesh (default), TopologyStar to only connect to the hub or TopologyHub, see star.go
+	Topology string
+	// keep connections to at most this many peers instead of all of them, 0 is unlimited, see sampling.go
+	MaxPeers int
+	// address of a relay to accept connections through instead of listening, see relay.go
+	Relay string
+	// announce sessions on the local network and list those of others, see discovery.go
+	Discovery     bool
+	DiscoveryAddr string // multicast group, DefaultDiscoveryAddr if empty
 }
 
 var (
@@ -38,7 +95,61 @@ var (
 
 // NewNetworkManager initiate a new NetworkManager with listening
 // address addr to handle network operations
-func NewNetworkManager(localAddr, publicAddr string) (*NetworkManager, error) {
+func NewNetworkManager(localAddr, publicAddr string, config Config) (*NetworkManager, error) {
+	if config.Codec == "" {
+		config.Codec = CodecBinary
+	}
+	if config.Transport == nil {
+		config.Transport = TCPTransport
+	}
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if config.SuspectTimeout == 0 {
+		config.SuspectTimeout = defaultSuspectTimeout
+	}
+	if config.UnreachableTimeout == 0 {
+		config.UnreachableTimeout = defaultUnreachableTimeout
+	}
+	if config.HeartbeatInterval < 0 || config.HeartbeatInterval >= config.SuspectTimeout || config.SuspectTimeout >= config.UnreachableTimeout {
+		return nil, ErrInvalidTimeouts
+	}
+	if config.ReconnectMinDelay == 0 {
+		config.ReconnectMinDelay = defaultReconnectMinDelay
+	}
+	if config.ReconnectMaxDelay == 0 {
+		config.ReconnectMaxDelay = defaultReconnectMaxDelay
+	}
+	if config.ReconnectMinDelay < 0 || config.ReconnectMinDelay > config.ReconnectMaxDelay {
+		return nil, ErrInvalidReconnectDelays
+	}
+	if config.Topology == "" {
+		config.Topology = TopologyMesh
+	}
+	if config.Identity == nil {
+		config.Identity = NewIdentity()
+	}
+	if config.Profile.Color == "" {
+		config.Profile.Color = defaultColor(config.Identity.String())
+	}
+	if !IsProfileColor(config.Profile.Color) {
+		return nil, ErrInvalidColor
+	}
+	config.Profile = config.Profile.sanitized()
+	if config.MaxPeers > 0 && config.MaxPeers < minMaxPeers {
+		config.MaxPeers = minMaxPeers
+	}
+	if config.DiscoveryAddr == "" {
+		config.DiscoveryAddr = DefaultDiscoveryAddr
+	}
+	if config.Relay != "" {
+		// peers reach us through the relay under a name of our own
+		publicAddr = relayScheme + config.Relay + "/" + uuid.NewV1().String()
+	}
+	auth, err := newAuthKeys(config.Secret)
+	if err != nil {
+		return nil, err
+	}
 	os.Mkdir("govecLogTxt", os.ModeDir)
 	logger := govec.Initialize(localAddr, "govecLogTxt/"+strings.Replace(localAddr, ":", "_", 100))
 	manager := NetworkManager{
@@ -47,26 +158,55 @@ func NewNetworkManager(localAddr, publicAddr string) (*NetworkManager, error) {
 		msgChan:    make(chan Message, 30),
 		nodePool:   newNodePool(logger),
 		logger:     logger,
+		config:     config,
+		auth:       auth,
+		presence:   newPresence(),
 	}
-	err := startNewSessionOnNetworkManager(&manager)
+	err = startNewSessionOnNetworkManager(&manager)
 	if err != nil {
 		return nil, err
 	}
+	if config.Discovery {
+		err = manager.startDiscovery()
+		if err != nil {
+			manager.Disconnect()
+			return nil, err
+		}
+	}
 	// stubs
 	manager.SetRemoteOpHandler(func(msg []byte) {})
 	manager.SetGetOpsReceiveVersion(func() []byte {
 		return nil
 	})
-	manager.SetVersionCheckHandler(func(data []byte) ([]byte, bool) {
+	manager.SetRangeRequestHandler(func(data []byte) ([]byte, bool) {
+		return nil, false
+	})
+	manager.SetSequenceHandler(func(data []byte) ([]byte, bool) {
 		return nil, false
 	})
+	manager.SetTagHandler(func(data []byte) {})
+	manager.SetGetTags(func() []byte {
+		return nil
+	})
+	manager.SetNetMetaHandler(func(netMeta NetMeta) {})
+	manager.SetPresenceHandler(func() {})
+	manager.SetPartitionHandler(func(partitioned bool) {})
 	return &manager, nil
 }
 
 func (nm *NetworkManager) GetCurrentId() string {
+	nm.sessionMutex.RLock()
+	defer nm.sessionMutex.RUnlock()
 	return nm.id
 }
 
+// the session accepting and maintaining connections, nil while disconnected
+func (nm *NetworkManager) currentSession() *session {
+	nm.sessionMutex.RLock()
+	defer nm.sessionMutex.RUnlock()
+	return nm.session
+}
+
 // Notes on implementation of ConnectTo:
 // To simplify the flow and design, we do not try to establish connection
 // in the user command thread. Instead we put the load on the message handler
@@ -76,13 +216,13 @@ func (nm *NetworkManager) GetCurrentId() string {
 // whose listening address is remoteAddr
 func (nm *NetworkManager) ConnectTo(remoteAddr string) error {
 	// TODO: maybe make the errors more friendly as it is user facing
-	if nm.session == nil {
+	if nm.currentSession() == nil {
 		err := startNewSessionOnNetworkManager(nm)
 		if err != nil {
 			return err
 		}
 	}
-	conn, err := net.Dial("tcp", remoteAddr)
+	conn, err := nm.dial(remoteAddr)
 	if err != nil {
 		return err
 	}
@@ -93,14 +233,30 @@ func (nm *NetworkManager) ConnectTo(remoteAddr string) error {
 	if err != nil {
 		return err
 	}
+	_, err = dialHandshake(n, remoteAddr, nm.localHello(), nm.auth)
+	if err != nil {
+		return err
+	}
+	docId, err := n.readMessage("ConnectTo docId")
+	if err != nil {
+		return err
+	}
+	err = nm.joinDocument(docId)
+	if err != nil {
+		return err
+	}
 	incoming := new(NetMeta)
 	err = n.readLog(incoming, "ConnectTo incomingNetMeta")
 	if err != nil {
 		return err
 	}
 
-	defer func() { nm.msgChan <- newNetMetaUpdateMsg(nm.id, *incoming) }()
-	latestNetMeta := nm.nodePool.getLatestNetMeta()
+	nm.nodePool.trustOwners(*incoming)
+	defer func() { nm.msgChan <- newNetMetaUpdateMsg(nm.GetCurrentId(), *incoming) }()
+	if s := nm.currentSession(); s != nil {
+		nm.leaveOwnershipOnJoin(s)
+	}
+	latestNetMeta := nm.nodePool.getLatestNetMetaCopy()
 	err = n.writeLog(latestNetMeta, "ConnectTo latestNetMeta")
 	if err != nil {
 		return errors.New("Partially connected: unable to send message to " +
@@ -112,46 +268,59 @@ func (nm *NetworkManager) ConnectTo(remoteAddr string) error {
 
 // Disconnect disconnects from the rest of the network voluntarily
 func (nm *NetworkManager) Disconnect() error {
-	if nm.session == nil {
+	nm.sessionMutex.Lock()
+	s := nm.session
+	nm.session = nil
+	nm.sessionMutex.Unlock()
+	if s == nil {
 		return ErrAlreadyDisconnected
 	}
-	nm.session.end()
-	nm.session = nil
+	s.end()
 	nm.logger.LogLocalEvent("Disconnected======")
 	return nil
 }
 
-// Completely disconnect by throwing away all the NetMeta
+// Completely disconnect by throwing away all the NetMeta, the next session gets a new id
 func (nm *NetworkManager) CompleteDisconnect() {
 	nm.Disconnect()
 	nm.nodePool = newNodePool(nm.logger)
+	nm.sessionMutex.Lock()
+	nm.id = ""
+	nm.sessionMutex.Unlock()
 	startNewSessionOnNetworkManager(nm)
 }
 
-// Reconnect rejoins the network with new UUID.
+// Reconnect rejoins the network as the same session, under a new incarnation that
+// replaces its leave at the peers, see identity.go
 func (nm *NetworkManager) Reconnect() error {
 	nm.logger.LogLocalEvent("begin reconnect========")
-	if nm.session != nil {
+	if nm.currentSession() != nil {
 		return ErrAlreadyConnected
 	}
 	return startNewSessionOnNetworkManager(nm)
 }
 
+// IsConnected returns whether there's a session accepting and maintaining connections
+func (nm *NetworkManager) IsConnected() bool {
+	return nm.currentSession() != nil
+}
+
 // Broadcast msg asynchronously return whether the msg
 // if session has ended it will not broadcast
 func (nm *NetworkManager) Broadcast(msg Message) {
-	s := nm.session // this is necessary for thread safety and to avoid nil pointer dereference
+	s := nm.currentSession()
 	if s == nil || s.ended() {
 		return
 	}
 	nm.logger.LogLocalEvent("begin broadcast========")
 	s.nodePool.broadcast(msg)
+	s.noteActivity()
 }
 
 // Send msg to a node with specified id
 // if session has ended it will not send
 func (nm *NetworkManager) SendMessageToNodeWithId(msg Message, id string) {
-	s := nm.session // this is necessary for thread safety and to avoid nil pointer dereference
+	s := nm.currentSession()
 	if s == nil || s.ended() {
 		return
 	}
@@ -166,14 +335,28 @@ func (nm *NetworkManager) GetNetworkMetadata() NetMeta {
 	return nm.nodePool.getLatestNetMetaCopy()
 }
 
+// GetIncompatiblePeers returns the ids of peers that rejected our handshake (or we theirs)
+// with the reason why
+func (nm *NetworkManager) GetIncompatiblePeers() map[string]string {
+	return nm.nodePool.getIncompatible()
+}
+
 func (nm *NetworkManager) SetRemoteOpHandler(fn func([]byte)) {
 	nm.RemoteOpHandler = fn
 }
 
-func (nm *NetworkManager) SetVersionCheckHandler(fn func([]byte) ([]byte, bool)) {
-	nm.VersionCheckHandler = fn
+func (nm *NetworkManager) SetRangeRequestHandler(fn func([]byte) ([]byte, bool)) {
+	nm.RangeRequestHandler = fn
 }
 
 func (nm *NetworkManager) SetGetOpsReceiveVersion(fn func() []byte) {
 	nm.GetOpsReceiveVersion = fn
 }
+
+func (nm *NetworkManager) SetTagHandler(fn func([]byte)) {
+	nm.TagHandler = fn
+}
+
+func (nm *NetworkManager) SetGetTags(fn func() []byte) {
+	nm.GetTags = fn
+}
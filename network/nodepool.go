@@ -1,6 +1,7 @@
 package network
 
 import (
+	. "../common"
 	"../util"
 	"github.com/arcaneiceman/GoVector/govec"
 	"net"
@@ -16,26 +17,44 @@ const (
 	nodeStateConnected
 	nodeStateLeft
 	nodeStateSessionEnded
+	nodeStateSuspect     // connected but silent for too long, see liveness.go
+	nodeStateUnreachable // silent until the connection was closed, reconnecting
 )
 
-const chanBufferSize = 30
-
 type node struct {
 	stateMutex sync.Mutex
 	state      NodeState
 	id         string
 	addr       string
-	outChan    chan Message
+	queue      *sendQueue
 	conn       net.Conn
 	reader     *util.MessageReader
 	writer     *util.MessageWriter
-	interval   time.Duration // current interval to reconnect
-	logger     *govec.GoLog
+	interval   time.Duration // current interval to reconnect, see backoff.go
+	retry      chan struct{} // cuts the current backoff short
+	lastHeard  time.Time     // when the last message was received
+	arrivals   arrivals      // see liveness.go
+	// a connection to the node is wanted, see sampling.go
+	active    bool
+	activated time.Time
+	busyUntil time.Time // refused a connection, not sampled until then
+	peerCount int       // the number of peers of the node, see sampling.go
+	dialer    *session  // running the thread that connects to the node
+	logger    *govec.GoLog
+	codec     string // payload encoding agreed on for the connection
+	peer      hello  // the capabilities of the node on the connection, see hello.go
+	// reason why the node can't be connected to because of its protocol version
+	incompatible string
 }
 
 func (n *node) setState(state NodeState) bool {
 	n.stateMutex.Lock()
 	defer n.stateMutex.Unlock()
+	return n.transition(state)
+}
+
+// caller must hold the stateMutex
+func (n *node) transition(state NodeState) bool {
 	switch n.state {
 	case nodeStateLeft:
 		return state == nodeStateLeft
@@ -51,19 +70,45 @@ func (n *node) setState(state NodeState) bool {
 	}
 }
 
+// attach makes the connection of c the connection to the node, expecting a message
+// every heartbeat. Returns false if the node left or the session ended meanwhile
+func (n *node) attach(c *node, heartbeat time.Duration) bool {
+	n.stateMutex.Lock()
+	defer n.stateMutex.Unlock()
+	if !n.transition(nodeStateConnected) {
+		return false
+	}
+	n.conn, n.reader, n.writer, n.codec, n.peer = c.conn, c.reader, c.writer, c.codec, c.peer
+	now := time.Now()
+	n.lastHeard = now
+	n.arrivals.reset(now, heartbeat)
+	return true
+}
+
 type nodePool struct {
 	netMetaMutex sync.RWMutex
 	netMeta      NetMeta
+	graveyard    graveyard // see leftgc.go
+	leftSince    leftSince
 	poolMutex    sync.RWMutex
 	pool         map[string]*node
 	logger       *govec.GoLog
+	tree         *plumtree
+	sampleMutex  sync.Mutex // serializes reserve
+	lastEviction time.Time  // when admit last dropped a peer for another node
+	// the owners of the network that was joined, see roles.go
+	owners map[string]bool
 }
 
 func newNodePool(logger *govec.GoLog) *nodePool {
 	var np nodePool
 	np.netMeta = newNetMeta()
+	np.graveyard = newGraveyard()
+	np.leftSince = newLeftSince()
+	np.owners = make(map[string]bool)
 	np.pool = make(map[string]*node)
 	np.logger = logger
+	np.tree = newPlumtree(time.Now().UnixNano())
 	return &np
 }
 
@@ -75,10 +120,12 @@ func (np *nodePool) sendMessageToNodeWithId(msg Message, id string) bool {
 }
 
 func (np *nodePool) broadcast(msg Message) {
-	if msg.Visited == nil {
+	msg = msg.withEncodings()
+	if msg.Id == "" {
 		np.broadcastOnce(msg)
 	} else {
-		np.broadcastRecursive(msg)
+		np.syncTreePeers()
+		np.sendGossip(np.tree.broadcast(msg))
 	}
 }
 
@@ -89,39 +136,55 @@ func (np *nodePool) broadcastOnce(msg Message) {
 	}
 }
 
-func (np *nodePool) broadcastRecursive(msg Message) {
+// keeps the peers of the broadcast tree in sync with the connected nodes
+func (np *nodePool) syncTreePeers() {
 	connected := np.getConnectedNodes()
-	// copy visited nodes
-	original := map[string]struct{}{}
-	for id, _ := range msg.Visited {
-		original[id] = struct{}{}
+	peers := make([]string, len(connected))
+	for i, n := range connected {
+		peers[i] = n.id
 	}
-	// add connected nodes to visited
-	for _, n := range connected {
-		msg.Visited[n.id] = struct{}{}
-	}
-	for _, n := range connected {
-		if _, ok := original[n.id]; !ok {
-			successful := putMsgOnSendingQueueOfNode(msg, n)
-			if !successful {
-				delete(msg.Visited, n.id)
-			}
-		}
+	np.tree.syncPeers(peers)
+}
+
+func (np *nodePool) sendGossip(sends []gossipSend) {
+	for _, send := range sends {
+		np.sendMessageToNodeWithId(send.Msg, send.To)
 	}
 }
 
-// returns whether putting on the queue is successful
+// returns whether putting on the queue is successful. A node that doesn't keep up
+// misses messages, see sendQueue.push, and catches up through anti-entropy
 func putMsgOnSendingQueueOfNode(msg Message, n *node) bool {
-	// if the channel buffer is full we just drop it
-	// there's no point in sending way more than the node can handle
-	select {
-	case n.outChan <- msg:
-		return true
-	default: // dumps the msg if buffer is full
-		return false
+	return n.queue.push(msg)
+}
+
+// an incompatible node is never retried, unless it starts a new session
+func (np *nodePool) setIncompatible(id, reason string) {
+	if n, ok := np.getNodeWithId(id); ok {
+		n.stateMutex.Lock()
+		n.incompatible = reason
+		n.stateMutex.Unlock()
 	}
 }
 
+func (n *node) isIncompatible() bool {
+	n.stateMutex.Lock()
+	defer n.stateMutex.Unlock()
+	return n.incompatible != ""
+}
+
+func (np *nodePool) getIncompatible() map[string]string {
+	result := make(map[string]string)
+	for _, n := range np.getAllNodes() {
+		n.stateMutex.Lock()
+		if n.incompatible != "" {
+			result[n.id] = n.incompatible
+		}
+		n.stateMutex.Unlock()
+	}
+	return result
+}
+
 func (np *nodePool) has(id string) bool {
 	_, ok := np.netMeta[id]
 	return ok
@@ -129,10 +192,24 @@ func (np *nodePool) has(id string) bool {
 
 func (np *nodePool) handleNewSession(s *session) {
 	np.netMetaMutex.Lock()
-	np.netMeta[s.id] = NodeMeta{s.manager.publicAddr, false}
+	key, grant := s.manager.localSite()
+	meta := NodeMeta{
+		Addr:     s.manager.publicAddr,
+		Topology: s.manager.config.Topology,
+	}
+	meta.signIdentity(s.id, s.manager.config.Identity, s.incarnation)
+	meta.setLocalSite(s.id, key, grant, s.manager.config.Profile)
+	np.netMeta[s.id] = meta
+	// our previous sessions
+	superseded := np.netMeta.removeSuperseded(s.id)
+	np.graveyard.bury(superseded, time.Now())
 	np.netMetaMutex.Unlock()
+	for id := range superseded {
+		np.removeNodeFromPool(id)
+	}
 	np.poolMutex.RLock()
 	for _, n := range np.pool {
+		n.queue.reset()
 		n.stateMutex.Lock()
 		if n.state == nodeStateSessionEnded {
 			n.state = nodeStateDisconnected
@@ -145,7 +222,9 @@ func (np *nodePool) handleNewSession(s *session) {
 
 func (np *nodePool) handleEndSession(s *session) {
 	np.netMetaMutex.Lock()
-	np.netMeta[s.id] = NodeMeta{s.manager.publicAddr, true}
+	meta := np.netMeta[s.id]
+	meta.leave(time.Now())
+	np.netMeta[s.id] = meta
 	np.netMetaMutex.Unlock()
 	np.poolMutex.RLock()
 	for _, n := range np.pool {
@@ -154,12 +233,24 @@ func (np *nodePool) handleEndSession(s *session) {
 	np.poolMutex.RUnlock()
 }
 
+// whether the NetMeta has nodes besides id that didn't leave
+func (np *nodePool) hasOtherNodes(id string) bool {
+	np.netMetaMutex.RLock()
+	defer np.netMetaMutex.RUnlock()
+	for otherId, meta := range np.netMeta {
+		if otherId != id && !meta.Left {
+			return true
+		}
+	}
+	return false
+}
+
 func (np *nodePool) getConnectedNodes() []*node {
 	np.poolMutex.RLock()
 	defer np.poolMutex.RUnlock()
 	nodes := make([]*node, 0)
 	for _, n := range np.pool {
-		if n.state == nodeStateConnected {
+		if n.isConnected() {
 			nodes = append(nodes, n)
 		}
 	}
@@ -194,9 +285,7 @@ func (np *nodePool) removeNodeFromPool(id string) {
 	np.poolMutex.Lock()
 	if n, ok := np.pool[id]; ok {
 		n.setState(nodeStateLeft)
-		if n.conn != nil {
-			n.close()
-		}
+		n.close()
 		delete(np.pool, id)
 	}
 	np.poolMutex.Unlock()
@@ -207,11 +296,13 @@ func (np *nodePool) addOrGetNodeFromPool(id string, nodeMeta NodeMeta, logger *g
 	n, ok := np.pool[id]
 	if !ok {
 		n = &node{
-			id:      id,
-			addr:    nodeMeta.Addr,
-			outChan: make(chan Message, chanBufferSize),
-			state:   nodeStateDisconnected,
-			logger:  np.logger,
+			id:        id,
+			addr:      nodeMeta.Addr,
+			queue:     newSendQueue(),
+			retry:     make(chan struct{}, 1),
+			state:     nodeStateDisconnected,
+			peerCount: -1,
+			logger:    np.logger,
 		}
 		np.pool[id] = n
 	}
@@ -223,30 +314,77 @@ func (np *nodePool) addOrGetNodeFromPool(id string, nodeMeta NodeMeta, logger *g
 func (np *nodePool) applyReceivedUpdates(updates NetMeta) (nodeList []*node, delta NetMeta, changed bool) {
 	nodeList = make([]*node, 0)
 	np.netMetaMutex.Lock()
-	delta, changed = np.netMeta.merge(updates)
+	now := time.Now()
+	delta, changed = np.netMeta.mergeTrusting(np.graveyard.filter(updates, now), np.owners)
+	np.graveyard.bury(delta.removed(np.netMeta), now)
+	np.leftSince.observe(delta, now)
 	np.netMetaMutex.Unlock()
 	for id, n := range delta {
 		if n.Left {
 			np.removeNodeFromPool(id)
-		} else {
+		} else if _, ok := np.getNodeWithId(id); !ok {
+			// known nodes only changed their site or role
 			nodeList = append(nodeList, np.addOrGetNodeFromPool(id, n, np.logger))
 		}
 	}
 	return
 }
 
-func (np *nodePool) forceNodeQuit(n *node) {
+// removes the expired left nodes, returns whether any were removed
+func (np *nodePool) collect(now time.Time) bool {
+	np.netMetaMutex.Lock()
+	defer np.netMetaMutex.Unlock()
+	return np.netMeta.collect(np.graveyard, np.leftSince, now)
+}
 
+func (np *nodePool) getNodeMeta(id string) NodeMeta {
+	np.netMetaMutex.RLock()
+	defer np.netMetaMutex.RUnlock()
+	return np.netMeta[id]
 }
 
-//func (np *nodePool) sendMs
+// trusts the owners that assigned themselves their role in netMeta, received on joining
+func (np *nodePool) trustOwners(netMeta NetMeta) {
+	np.netMetaMutex.Lock()
+	defer np.netMetaMutex.Unlock()
+	for _, site := range selfAssignedOwners(netMeta) {
+		np.owners[site] = true
+	}
+}
+
+func (np *nodePool) siteGrant(site string) RoleGrant {
+	np.netMetaMutex.RLock()
+	defer np.netMetaMutex.RUnlock()
+	return np.netMeta.siteGrant(site)
+}
 
-func (np *nodePool) getLatestNetMeta() NetMeta {
+func (np *nodePool) findNodeMeta(id string) (NodeMeta, bool) {
 	np.netMetaMutex.RLock()
 	defer np.netMetaMutex.RUnlock()
-	return np.netMeta
+	meta, ok := np.netMeta[id]
+	return meta, ok
+}
+
+// changes the meta of node id with fn, returns the changed meta
+// or false if the node isn't known
+func (np *nodePool) updateNodeMeta(id string, fn func(*NodeMeta)) (NodeMeta, bool) {
+	np.netMetaMutex.Lock()
+	defer np.netMetaMutex.Unlock()
+	meta, ok := np.netMeta[id]
+	if !ok {
+		return meta, false
+	}
+	fn(&meta)
+	np.netMeta[id] = meta
+	return meta, true
+}
+
+func (np *nodePool) forceNodeQuit(n *node) {
+
 }
 
+//func (np *nodePool) sendMs
+
 func (np *nodePool) getLatestNetMetaJson() []byte {
 	np.netMetaMutex.RLock()
 	defer np.netMetaMutex.RUnlock()
@@ -1,19 +1,18 @@
 package network
 
 import (
-	"net"
 	"time"
 )
 
 func (s *session) initiateNewNode(n *node) {
-	if n.state != nodeStateDisconnected {
+	if !n.isDisconnected() || n.isIncompatible() || !s.linkedTo(n.id) {
 		return
 	}
-	if shouldConnect(s.manager.publicAddr, n.addr) {
-		go s.connectThread(n)
-	} else {
-		go s.pokeThread(n)
+	if !s.nodePool.reserve(n, s.manager.config.targetPeers()) {
+		// enough peers, the node stays a candidate for sampling
+		return
 	}
+	s.startDialing(n)
 }
 
 func shouldConnect(localAddr, remoteAddr string) bool {
@@ -27,33 +26,41 @@ func (s *session) pokeThread(n *node) {
 	// user-initiated connect is considered partial if we
 	// are not sure whether the other side has received our
 	// information but we have obtained theirs.
-	n.interval = 0
+	defer s.stopDialing(n)
+	n.resetBackoff()
 	for {
 		// We don't poke any more if node is connected or if
 		// a poke succeeded. The responsibility to connect is on
 		// the other node, and we will listen for requests to
 		// connect
-		if s.ended() || n.state != nodeStateDisconnected || s.poke(n.id, n.addr) {
+		if s.ended() || !n.isDisconnected() || !n.isActive() || s.poke(n.id, n.addr) {
 			return
 		}
-		n.interval += time.Second
-		time.Sleep(n.interval)
+		s.backoff(n)
 	}
 }
 
 // returns whether the poke succeeded
 func (s *session) poke(id, addr string) bool {
-	conn, err := net.Dial("tcp", addr)
+	conn, err := s.manager.dial(addr)
 	if err != nil {
 		return false
 	}
 	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.manager.config.UnreachableTimeout))
 	n := newConnWrapper(conn)
 	n.logger = s.manager.logger
 	err = n.writeMessage(dialingTypePoke, "poke dialingTypePoke")
 	if err != nil {
 		return false
 	}
+	_, err = dialHandshake(n, addr, s.localHello(), s.manager.auth)
+	if incompatible, ok := err.(*IncompatiblePeerError); ok {
+		s.nodePool.setIncompatible(id, incompatible.Reason)
+		return true
+	} else if err != nil {
+		return false
+	}
 	err = n.writeMessage(id, "poke id")
 	if err != nil {
 		return false
@@ -71,15 +78,26 @@ func (s *session) poke(id, addr string) bool {
 		if err != nil {
 			return false
 		}
+		// so the site and role are known without waiting for anti-entropy
+		err = n.writeLog(s.nodePool.getNodeMeta(s.id), "poke meta")
+		if err != nil {
+			return false
+		}
 		// TODO: not sure if the following is necessary when using tcp
 		// but it gives more guarantees
 		reply, err := n.readMessage("poke reply")
 		if err != nil {
 			return false
 		}
+		if reply == "busy" {
+			if busy, ok := s.nodePool.getNodeWithId(id); ok {
+				busy.drop(time.Now(), s.manager.config.busyBackoff())
+			}
+			return true
+		}
 		return reply == "done"
 	} else {
-		s.manager.msgChan <- newNetMetaUpdateMsg(s.id, newQuitNetMeta(id, addr))
+		s.sendQuit(id, addr)
 		return true
 	}
 }
@@ -87,83 +105,113 @@ func (s *session) poke(id, addr string) bool {
 func (s *session) connectThread(n *node) {
 	// We establish actual connection when our addr is greater
 	// than remote addr.
-	n.interval = 0
+	defer s.stopDialing(n)
+	n.resetBackoff()
 	for {
-		if s.ended() || n.state != nodeStateDisconnected || s.connect(n) {
+		if s.ended() || !n.isDisconnected() || !n.isActive() || s.connect(n) {
 			// connectThread stops when session ends
 			return
 		}
-		n.interval += time.Second
-		time.Sleep(n.interval)
+		s.backoff(n)
 	}
 }
 
 // returns whether connect succeeded
 func (s *session) connect(n *node) bool {
-	conn, err := net.Dial("tcp", n.addr)
+	conn, err := s.manager.dial(n.addr)
 	if err != nil {
 		return false
 	}
-	n.setConn(conn)
-	n.logger = s.manager.logger
-	defer func(err error, n *node) {
+	// a peer that accepts but never answers doesn't block reconnecting forever
+	conn.SetDeadline(time.Now().Add(s.manager.config.UnreachableTimeout))
+	c := newConnWrapper(conn)
+	c.logger = s.manager.logger
+	c.queue = n.queue
+	defer func(err error, c *node) {
 		if err != nil {
-			n.close()
+			c.close()
 		}
-	}(err, n)
-	err = n.writeMessage(dialingTypeConnect, "connect dialingTypeConnect")
+	}(err, c)
+	err = c.writeMessage(dialingTypeConnect, "connect dialingTypeConnect")
 	if err != nil {
 		return false
 	}
-	err = n.writeMessage(n.id, "connect n.id")
+	remote, err := dialHandshake(c, n.addr, s.localHello(), s.manager.auth)
+	if incompatible, ok := err.(*IncompatiblePeerError); ok {
+		c.close()
+		s.nodePool.setIncompatible(n.id, incompatible.Reason)
+		return true
+	} else if err != nil {
+		return false
+	}
+	c.codec = negotiateCodec(s.manager.config.Codec, remote.Codec)
+	c.peer = remote
+	err = c.writeMessage(n.id, "connect n.id")
 	if err != nil {
 		return false
 	}
-	match, err := n.readMessage("connect match")
+	match, err := c.readMessage("connect match")
 	if err != nil {
 		return false
 	}
 	if match == "true" {
-		err = n.writeMessage(s.id, "connect s.id")
+		err = c.writeMessage(s.id, "connect s.id")
 		if err != nil {
 			return false
 		}
-		err = n.writeMessage(s.manager.publicAddr, "connect s.addr")
+		err = c.writeMessage(s.manager.publicAddr, "connect s.addr")
 		if err != nil {
 			return false
 		}
-
-		hasMsg, msg := s.getLatestVersionCheckMsg()
-		if hasMsg {
-			err = n.sendMessage(msg, "connect LatestVersionCheckMsg")
+		if remote.Busy {
+			reply, err := c.readMessage("connect reply")
 			if err != nil {
 				return false
 			}
+			if reply == "busy" {
+				c.close()
+				n.drop(time.Now(), s.manager.config.busyBackoff())
+				return true
+			}
 		}
-		if n.setState(nodeStateConnected) {
-			go s.sendThread(getSendWrapperFromNode(n))
-			go s.receiveThread(n)
-		}
+		conn.SetDeadline(time.Time{})
+		s.startConnection(n, c)
 		return true
 	} else {
-		n.close()
-		s.manager.msgChan <- newNetMetaUpdateMsg(s.id, newQuitNetMeta(n.id, n.addr))
+		c.close()
+		s.sendQuit(n.id, n.addr)
 		return true
 	}
 }
 
-func (s *session) receiveThread(n *node) {
+// makes c the connection to n and starts sending and receiving on it
+func (s *session) startConnection(n *node, c *node) {
+	n.queue.resume(c.peer.Incarnation)
+	if !n.attach(c, s.manager.config.HeartbeatInterval) {
+		c.close()
+		return
+	}
+	go s.sendThread(c)
+	go s.receiveThread(n, c)
+	s.sendDigest(n)
+	s.noteActivity()
+}
+
+// receives the messages of n on its connection c
+func (s *session) receiveThread(n *node, c *node) {
 	for {
-		if n.state != nodeStateConnected {
-			n.close()
+		// the connection of an unreachable node is closed, so reading fails and reconnects
+		if !n.isConnected() && !n.isUnreachable() {
+			c.close()
 			return
 		}
-		msg, err, connOk := n.receiveMessage("receiveThread msg")
+		msg, err, connOk := c.receiveMessage("receiveThread msg")
 		if !connOk {
-			n.close()
-			n.setState(nodeStateDisconnected)
-			if shouldConnect(s.manager.publicAddr, n.addr) {
-				go s.connectThread(n)
+			c.close()
+			n.connectionLost(c)
+			if n.isActive() {
+				// the other side pokes, so a peer that dropped us answers busy
+				s.startDialing(n)
 			}
 			return
 		}
@@ -174,24 +222,49 @@ func (s *session) receiveThread(n *node) {
 			// stops receiving msg once session ends
 			return
 		}
+		n.heard(time.Now())
+		if msg.Type == MSG_TYPE_HEARTBEAT {
+			n.setPeerCount(msg)
+			continue
+		}
+		if msg.Type == MSG_TYPE_ACK {
+			n.queue.ack(msg.Seq)
+			continue
+		}
+		if !n.queue.receive(msg.Seq) {
+			continue
+		}
+		msg.from = n.id
 		s.manager.msgChan <- msg
 	}
 }
 
 func (s *session) sendThread(sendWrapper *node) {
-	for done := false; !done || len(sendWrapper.outChan) > 0; {
-		select {
-		case msg := <-sendWrapper.outChan:
-			err := sendWrapper.sendMessage(msg, "sendThread outChan msg")
-			if err != nil {
-				sendWrapper.close()
-				sendWrapper.outChan <- msg
-				return
-			}
-		case <-s.done:
-			done = true
+	queue := sendWrapper.queue
+	generation := queue.rewind()
+	for {
+		msg, ok := queue.next(generation, true, s.done)
+		if !ok {
+			break
+		}
+		err := sendWrapper.sendMessage(msg, "sendThread queue msg")
+		if err != nil {
+			// unacknowledged messages are sent again on the next connection
+			sendWrapper.close()
+			return
+		}
+	}
+	if !s.ended() {
+		// replaced by the send thread of a newer connection
+		return
+	}
+	for {
+		msg, ok := queue.next(generation, false, s.done)
+		if !ok {
+			break
 		}
+		sendWrapper.sendMessage(msg, "sendThread queue msg")
 	}
-	sendWrapper.sendMessage(newNetMetaUpdateMsg(s.id, newQuitNetMeta(s.id, s.manager.publicAddr)), "sendThread newNetMetaUpdateMsg")
+	sendWrapper.sendMessage(newNetMetaUpdateMsg(s.id, newQuitNetMeta(s.id, s.manager.publicAddr, s.identityMeta())), "sendThread newNetMetaUpdateMsg")
 	sendWrapper.close()
 }
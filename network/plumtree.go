@@ -0,0 +1,242 @@
+package network
+
+import (
+	"encoding/json"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Broadcast messages are disseminated along a spanning tree built with the plumtree
+// protocol (epidemic broadcast trees). Every broadcast message has a unique Id. Peers are
+// either eager, which receive the whole message, or lazy, which only receive the id in an
+// IHAVE. New peers start eager. Receiving a message twice means there's a cycle, so the
+// sender of the duplicate is made lazy and told with a PRUNE. When an IHAVE announces a
+// message that doesn't arrive through the tree in time, it's requested with a GRAFT,
+// which also makes the link eager again and so repairs the tree.
+//
+// plumtree only decides what to send, the session does the sending.
+
+const (
+	// lazy peers announced to per message, the mesh is full so announcing
+	// to all of them would cost more than the messages saved
+	lazyFanout = 3
+	// how long to wait for an announced message before grafting
+	graftTimeout = 500 * time.Millisecond
+	// received messages kept for answering grafts and detecting duplicates
+	maxCachedMessages = 5000
+)
+
+type gossipSend struct {
+	To  string
+	Msg Message
+}
+
+type missingMessage struct {
+	announcers []string
+	since      time.Time
+}
+
+type plumtree struct {
+	mutex      sync.Mutex
+	eager      map[string]bool
+	lazy       map[string]bool
+	cache      map[string]Message
+	cacheOrder []string
+	missing    map[string]*missingMessage
+	rand       *rand.Rand
+}
+
+func newPlumtree(seed int64) *plumtree {
+	return &plumtree{
+		eager:   make(map[string]bool),
+		lazy:    make(map[string]bool),
+		cache:   make(map[string]Message),
+		missing: make(map[string]*missingMessage),
+		rand:    rand.New(rand.NewSource(seed)),
+	}
+}
+
+// syncPeers makes the peers of the tree the connected nodes
+func (t *plumtree) syncPeers(peers []string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	connected := make(map[string]bool)
+	for _, peer := range peers {
+		connected[peer] = true
+		if !t.eager[peer] && !t.lazy[peer] {
+			t.eager[peer] = true
+		}
+	}
+	for peer := range t.eager {
+		if !connected[peer] {
+			delete(t.eager, peer)
+		}
+	}
+	for peer := range t.lazy {
+		if !connected[peer] {
+			delete(t.lazy, peer)
+		}
+	}
+}
+
+// broadcast starts disseminating a message created by this node
+func (t *plumtree) broadcast(msg Message) []gossipSend {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.remember(msg)
+	return t.forward(msg, "")
+}
+
+// receive handles a broadcast message from peer from, returns whether it's
+// the first time the message is received and should be delivered
+func (t *plumtree) receive(from string, msg Message) (bool, []gossipSend) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.cache[msg.Id]; ok {
+		if !t.eager[from] {
+			return false, nil
+		}
+		t.makeLazy(from)
+		return false, []gossipSend{{from, newGossipControlMsg(MSG_TYPE_PRUNE, nil)}}
+	}
+	t.remember(msg)
+	delete(t.missing, msg.Id)
+	t.makeEager(from)
+	return true, t.forward(msg, from)
+}
+
+func (t *plumtree) receivePrune(from string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.makeLazy(from)
+}
+
+func (t *plumtree) receiveIHave(from string, ids []string, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, id := range ids {
+		if _, ok := t.cache[id]; ok {
+			continue
+		}
+		missing, ok := t.missing[id]
+		if !ok {
+			missing = &missingMessage{since: now}
+			t.missing[id] = missing
+		}
+		missing.announcers = append(missing.announcers, from)
+	}
+}
+
+// receiveGraft makes from eager and sends it the requested messages
+func (t *plumtree) receiveGraft(from string, ids []string) []gossipSend {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.makeEager(from)
+	sends := make([]gossipSend, 0, len(ids))
+	for _, id := range ids {
+		if msg, ok := t.cache[id]; ok {
+			sends = append(sends, gossipSend{from, msg})
+		}
+	}
+	return sends
+}
+
+// graftMissing requests messages announced more than graftTimeout ago that haven't
+// arrived yet, each from one of the peers that announced it
+func (t *plumtree) graftMissing(now time.Time) []gossipSend {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	grafts := make(map[string][]string)
+	for id, missing := range t.missing {
+		if now.Sub(missing.since) < graftTimeout {
+			continue
+		}
+		// try the next announcer if this one doesn't answer either
+		var peer string
+		for len(missing.announcers) > 0 && peer == "" {
+			peer = missing.announcers[0]
+			missing.announcers = missing.announcers[1:]
+			if !t.eager[peer] && !t.lazy[peer] {
+				peer = ""
+			}
+		}
+		if peer == "" {
+			delete(t.missing, id)
+			continue
+		}
+		missing.since = now
+		grafts[peer] = append(grafts[peer], id)
+	}
+	sends := make([]gossipSend, 0, len(grafts))
+	for peer, ids := range grafts {
+		t.makeEager(peer)
+		sends = append(sends, gossipSend{peer, newGossipControlMsg(MSG_TYPE_GRAFT, ids)})
+	}
+	return sends
+}
+
+// caller must hold the mutex
+func (t *plumtree) forward(msg Message, from string) []gossipSend {
+	sends := make([]gossipSend, 0, len(t.eager)+lazyFanout)
+	for peer := range t.eager {
+		if peer != from {
+			sends = append(sends, gossipSend{peer, msg})
+		}
+	}
+	lazy := make([]string, 0, len(t.lazy))
+	for peer := range t.lazy {
+		if peer != from {
+			lazy = append(lazy, peer)
+		}
+	}
+	// sorted so the choice only depends on the random source
+	sort.Strings(lazy)
+	for i, j := range t.rand.Perm(len(lazy)) {
+		if i == lazyFanout {
+			break
+		}
+		sends = append(sends, gossipSend{lazy[j], newGossipControlMsg(MSG_TYPE_IHAVE, []string{msg.Id})})
+	}
+	return sends
+}
+
+// caller must hold the mutex
+func (t *plumtree) remember(msg Message) {
+	t.cache[msg.Id] = msg
+	t.cacheOrder = append(t.cacheOrder, msg.Id)
+	if len(t.cacheOrder) > maxCachedMessages {
+		delete(t.cache, t.cacheOrder[0])
+		t.cacheOrder = t.cacheOrder[1:]
+	}
+}
+
+// caller must hold the mutex
+func (t *plumtree) makeEager(peer string) {
+	if peer == "" || (!t.eager[peer] && !t.lazy[peer]) {
+		return
+	}
+	delete(t.lazy, peer)
+	t.eager[peer] = true
+}
+
+// caller must hold the mutex
+func (t *plumtree) makeLazy(peer string) {
+	if !t.eager[peer] {
+		return
+	}
+	delete(t.eager, peer)
+	t.lazy[peer] = true
+}
+
+func newGossipControlMsg(msgType string, ids []string) Message {
+	content, _ := json.Marshal(ids)
+	return Message{Type: msgType, Msg: content}
+}
+
+func gossipIdsFromSlice(data []byte) []string {
+	var ids []string
+	json.Unmarshal(data, &ids)
+	return ids
+}
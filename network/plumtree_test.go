@@ -0,0 +1,170 @@
+package network
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+type simSend struct {
+	from string
+	gossipSend
+}
+
+// simulates a full mesh of plumtree nodes delivering messages in random order
+type treeSim struct {
+	ids       []string
+	trees     map[string]*plumtree
+	queue     []simSend
+	rand      *rand.Rand
+	now       time.Time
+	delivered map[string]map[string]int // node -> message id -> times delivered
+	payloads  int
+	controls  int
+}
+
+func newTreeSim(n int) *treeSim {
+	sim := &treeSim{
+		trees:     make(map[string]*plumtree),
+		rand:      rand.New(rand.NewSource(1)),
+		now:       time.Unix(0, 0),
+		delivered: make(map[string]map[string]int),
+	}
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("n%02d", i)
+		sim.ids = append(sim.ids, id)
+		sim.trees[id] = newPlumtree(int64(i))
+		sim.delivered[id] = make(map[string]int)
+	}
+	for _, id := range sim.ids {
+		sim.trees[id].syncPeers(sim.others(id))
+	}
+	return sim
+}
+
+func (sim *treeSim) others(id string) []string {
+	others := make([]string, 0, len(sim.ids))
+	for _, other := range sim.ids {
+		if other != id {
+			others = append(others, other)
+		}
+	}
+	return others
+}
+
+func (sim *treeSim) send(from string, sends []gossipSend) {
+	for _, send := range sends {
+		if _, ok := sim.trees[send.To]; !ok {
+			continue
+		}
+		if send.Msg.Id != "" {
+			sim.payloads++
+		} else {
+			sim.controls++
+		}
+		sim.queue = append(sim.queue, simSend{from, send})
+	}
+}
+
+// broadcasts a message from origin and runs until every message and graft is handled
+func (sim *treeSim) broadcast(origin string) {
+	msg := NewBroadcastMessage(origin, MSG_TYPE_REMOTE_OP, []byte("op"))
+	sim.delivered[origin][msg.Id]++
+	sim.send(origin, sim.trees[origin].broadcast(msg))
+	for {
+		for len(sim.queue) > 0 {
+			i := sim.rand.Intn(len(sim.queue))
+			next := sim.queue[i]
+			sim.queue = append(sim.queue[:i], sim.queue[i+1:]...)
+			sim.deliver(next)
+		}
+		sim.now = sim.now.Add(graftTimeout)
+		for _, id := range sim.ids {
+			sim.send(id, sim.trees[id].graftMissing(sim.now))
+		}
+		if len(sim.queue) == 0 {
+			return
+		}
+	}
+}
+
+func (sim *treeSim) deliver(send simSend) {
+	tree, ok := sim.trees[send.To]
+	if !ok {
+		return
+	}
+	msg := send.Msg
+	switch msg.Type {
+	case MSG_TYPE_IHAVE:
+		tree.receiveIHave(send.from, gossipIdsFromSlice(msg.Msg), sim.now)
+	case MSG_TYPE_PRUNE:
+		tree.receivePrune(send.from)
+	case MSG_TYPE_GRAFT:
+		sim.send(send.To, tree.receiveGraft(send.from, gossipIdsFromSlice(msg.Msg)))
+	default:
+		deliver, sends := tree.receive(send.from, msg)
+		if deliver {
+			sim.delivered[send.To][msg.Id]++
+		}
+		sim.send(send.To, sends)
+	}
+}
+
+// every node delivered every message exactly once
+func (sim *treeSim) checkDelivered(t *testing.T, messages int) {
+	for _, id := range sim.ids {
+		if len(sim.delivered[id]) != messages {
+			t.Fatalf("%s delivered %d messages, expected %d", id, len(sim.delivered[id]), messages)
+		}
+		for msgId, times := range sim.delivered[id] {
+			if times != 1 {
+				t.Fatalf("%s delivered %s %d times", id, msgId, times)
+			}
+		}
+	}
+}
+
+func TestPlumtreeMessageCount(t *testing.T) {
+	for _, n := range []int{10, 25, 50} {
+		sim := newTreeSim(n)
+		sim.broadcast(sim.ids[0])
+		warmup := sim.payloads
+
+		const broadcasts = 20
+		sim.payloads = 0
+		sim.controls = 0
+		for i := 0; i < broadcasts; i++ {
+			sim.broadcast(sim.ids[sim.rand.Intn(n)])
+		}
+		sim.checkDelivered(t, broadcasts+1)
+
+		perBroadcast := float64(sim.payloads) / broadcasts
+		t.Logf("%d nodes: %d messages to build the tree, then %.1f messages and %.1f announcements per broadcast "+
+			"(flooding: %d messages)", n, warmup, perBroadcast, float64(sim.controls)/broadcasts, n*(n-1))
+		// once the tree is built every node receives a message once
+		if perBroadcast > float64(n-1)*1.1 {
+			t.Fatalf("%d nodes: %.1f messages per broadcast", n, perBroadcast)
+		}
+		if sim.controls > broadcasts*n*lazyFanout {
+			t.Fatalf("%d nodes: %d announcements", n, sim.controls)
+		}
+	}
+}
+
+func TestPlumtreeRepair(t *testing.T) {
+	sim := newTreeSim(20)
+	sim.broadcast(sim.ids[0])
+
+	// the node every other node receives from leaves
+	delete(sim.trees, sim.ids[0])
+	delete(sim.delivered, sim.ids[0])
+	sim.ids = sim.ids[1:]
+	for _, id := range sim.ids {
+		sim.trees[id].syncPeers(sim.others(id))
+	}
+	for i := 0; i < 10; i++ {
+		sim.broadcast(sim.ids[sim.rand.Intn(len(sim.ids))])
+	}
+	sim.checkDelivered(t, 11)
+}
@@ -0,0 +1,186 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Presence is ephemeral state every session shows the others, the cursor and selection of
+// its user. It's broadcast like any other message but not repaired by anti-entropy: only the
+// latest state of a session matters and the next one replaces it anyway. Changes are sent at
+// most every presenceMinInterval, and the state is repeated every presenceInterval so that
+// new peers learn it. Every state sent is numbered, so one that arrives late, e.g. through a
+// graft of the broadcast tree, doesn't replace a newer one. The state of a peer is dropped
+// when it leaves or wasn't heard of for presenceTTL, e.g. because it crashed. Presence is
+// signed with the key of the site of its session, see sign.go, so a relaying peer can't show
+// a cursor in the name of another. A session without a site only shows its presence to the
+// peers it's connected to
+
+const (
+	presenceMinInterval = 100 * time.Millisecond
+	presenceInterval    = 10 * time.Second
+	presenceTTL         = 3 * presenceInterval
+)
+
+type presence struct {
+	mutex  sync.Mutex
+	local  []byte // nil until set
+	sent   time.Time
+	seq    uint64 // of the last state sent
+	dirty  bool
+	remote map[string]remotePresence // by session id
+}
+
+type remotePresence struct {
+	data []byte
+	seq  uint64
+	at   time.Time
+}
+
+// the content of a presence message
+type presenceUpdate struct {
+	Seq       uint64
+	Data      []byte
+	Key       string `json:",omitempty"`
+	Signature string `json:",omitempty"`
+}
+
+func newPresence() *presence {
+	return &presence{remote: make(map[string]remotePresence)}
+}
+
+// SetPresence sets the presence of this node, it's sent to the peers shortly
+func (nm *NetworkManager) SetPresence(data []byte) {
+	p := nm.presence
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !bytes.Equal(p.local, data) {
+		p.local = data
+		p.dirty = true
+	}
+}
+
+// GetPresence returns the presence of every peer by session id
+func (nm *NetworkManager) GetPresence() map[string][]byte {
+	p := nm.presence
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	result := make(map[string][]byte)
+	for id, r := range p.remote {
+		result[id] = r.data
+	}
+	return result
+}
+
+// SetPresenceHandler sets the function called when the presence of a peer changes
+func (nm *NetworkManager) SetPresenceHandler(fn func()) {
+	nm.PresenceHandler = fn
+}
+
+// returns the presence to send at now, if any
+func (p *presence) due(now time.Time) (presenceUpdate, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.local == nil || (!p.dirty && now.Sub(p.sent) < presenceInterval) {
+		return presenceUpdate{}, false
+	}
+	p.dirty = false
+	p.sent = now
+	p.seq++
+	return presenceUpdate{Seq: p.seq, Data: p.local}, true
+}
+
+// returns whether the presence of id changed, an update older than the one
+// known is ignored
+func (p *presence) update(id string, update presenceUpdate, now time.Time) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	old, ok := p.remote[id]
+	if ok && update.Seq <= old.seq {
+		return false
+	}
+	p.remote[id] = remotePresence{update.Data, update.Seq, now}
+	return !ok || !bytes.Equal(old.data, update.Data)
+}
+
+// forgets the presence of the peers that left or weren't heard of since presenceTTL,
+// returns whether any was forgotten
+func (p *presence) expire(left func(id string) bool, now time.Time) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	changed := false
+	for id, r := range p.remote {
+		if left(id) || now.Sub(r.at) > presenceTTL {
+			delete(p.remote, id)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// forgets the presence of every peer and sends ours again in the next session
+func (p *presence) reset() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.remote = make(map[string]remotePresence)
+	p.dirty = true
+}
+
+func (s *session) periodicallySendPresence() {
+	p := s.manager.presence
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(presenceMinInterval):
+		}
+		now := time.Now()
+		if update, ok := p.due(now); ok {
+			if key, _ := s.manager.localSite(); key != nil {
+				update.Key, update.Signature = sign(key, update.signedContent(s.id))
+			}
+			content, _ := json.Marshal(update)
+			s.nodePool.broadcast(NewBroadcastMessage(s.id, MSG_TYPE_PRESENCE, content))
+		}
+		if p.expire(s.hasLeft, now) {
+			go s.manager.PresenceHandler()
+		}
+	}
+}
+
+func (s *session) handleIncomingPresence(msg Message) {
+	origin := broadcastOrigin(msg.Id)
+	var update presenceUpdate
+	if origin == s.id || s.hasLeft(origin) || json.Unmarshal(msg.Msg, &update) != nil {
+		return
+	}
+	if !s.presenceOfOrigin(origin, msg.from, update) {
+		return
+	}
+	if s.manager.presence.update(origin, update, time.Now()) {
+		go s.manager.PresenceHandler()
+	}
+}
+
+// whether update was made by the session origin and received from the node from
+func (s *session) presenceOfOrigin(origin, from string, update presenceUpdate) bool {
+	if update.Signature == "" {
+		return from == origin
+	}
+	meta, ok := s.nodePool.findNodeMeta(origin)
+	site, valid := verify(update.Key, update.Signature, update.signedContent(origin))
+	return ok && valid && meta.hasValidSite(origin) && site == meta.Site
+}
+
+func (update presenceUpdate) signedContent(id string) []byte {
+	return signedContent("presence", id, strconv.FormatUint(update.Seq, 10), string(update.Data))
+}
+
+// whether the node with id left, also if it was already removed from the NetMeta
+func (s *session) hasLeft(id string) bool {
+	meta, ok := s.nodePool.findNodeMeta(id)
+	return !ok || meta.Left
+}
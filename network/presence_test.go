@@ -0,0 +1,98 @@
+package network
+
+import (
+	. "../common"
+	"../documentmanager"
+	"testing"
+	"time"
+)
+
+func TestPresence(t *testing.T) {
+	mn := NewMemNetwork()
+	a := newMemPeer(t, mn, "a")
+	b := newMemPeer(t, mn, "b")
+	c := newMemPeer(t, mn, "c")
+	// presence relayed by b is signed with the key of the site of a
+	for _, p := range []*memPeer{a, b, c} {
+		key := documentmanager.NewSiteKey()
+		p.nm.SetLocalSite(key, NewRoleGrant(key, ROLE_EDITOR, 1))
+	}
+	assertEqual(t, nil, b.nm.ConnectTo("a"))
+	assertEqual(t, nil, c.nm.ConnectTo("b"))
+	waitFor(t, "c to connect to a", func() bool { return c.connectedIds() == idsOf(a, b) })
+
+	presenceOf := func(p, of *memPeer) string {
+		return string(p.nm.GetPresence()[of.nm.GetCurrentId()])
+	}
+	a.nm.SetPresence([]byte("line 1"))
+	waitFor(t, "the presence of a", func() bool { return presenceOf(b, a) == "line 1" && presenceOf(c, a) == "line 1" })
+	a.nm.SetPresence([]byte("line 2"))
+	waitFor(t, "the presence of a to change", func() bool { return presenceOf(c, a) == "line 2" })
+	assertEqual(t, 1, len(c.nm.GetPresence()))
+
+	a.nm.Disconnect()
+	waitFor(t, "the presence of a to expire", func() bool { return len(b.nm.GetPresence()) == 0 && len(c.nm.GetPresence()) == 0 })
+}
+
+func TestPresenceOfOrigin(t *testing.T) {
+	mn := NewMemNetwork()
+	a, b := newMemPeer(t, mn, "a"), newMemPeer(t, mn, "b")
+	key := documentmanager.NewSiteKey()
+	a.nm.SetLocalSite(key, NewRoleGrant(key, ROLE_EDITOR, 1))
+	assertEqual(t, nil, b.nm.ConnectTo("a"))
+	s := b.nm.currentSession()
+	origin := a.nm.GetCurrentId()
+	waitFor(t, "the site of a", func() bool {
+		meta, _ := s.nodePool.findNodeMeta(origin)
+		return meta.hasValidSite(origin)
+	})
+
+	// unsigned presence is only taken from its origin
+	update := presenceUpdate{Seq: 1, Data: []byte("line 1")}
+	assertEqual(t, true, s.presenceOfOrigin(origin, origin, update))
+	assertEqual(t, false, s.presenceOfOrigin(origin, "relay", update))
+
+	// signed presence from anyone, if signed by the site of the origin
+	update.Key, update.Signature = sign(key, update.signedContent(origin))
+	assertEqual(t, true, s.presenceOfOrigin(origin, "relay", update))
+	tampered := update
+	tampered.Data = []byte("line 2")
+	assertEqual(t, false, s.presenceOfOrigin(origin, "relay", tampered))
+	mallory := documentmanager.NewSiteKey()
+	forged := update
+	forged.Key, forged.Signature = sign(mallory, update.signedContent(origin))
+	assertEqual(t, false, s.presenceOfOrigin(origin, "relay", forged))
+}
+
+func TestPresenceExpires(t *testing.T) {
+	p := newPresence()
+	now := time.Now()
+	notLeft := func(id string) bool { return false }
+	assertEqual(t, true, p.update("a", presenceUpdate{Seq: 1, Data: []byte("x")}, now))
+	assertEqual(t, false, p.update("a", presenceUpdate{Seq: 2, Data: []byte("x")}, now))
+	assertEqual(t, false, p.expire(notLeft, now.Add(presenceTTL)))
+	assertEqual(t, true, p.expire(notLeft, now.Add(presenceTTL+time.Second)))
+	assertEqual(t, 0, len(p.remote))
+
+	// the local presence is repeated every presenceInterval
+	_, ok := p.due(now)
+	assertEqual(t, false, ok)
+	p.local, p.dirty = []byte("y"), true
+	_, ok = p.due(now)
+	assertEqual(t, true, ok)
+	_, ok = p.due(now.Add(presenceMinInterval))
+	assertEqual(t, false, ok)
+	update, ok := p.due(now.Add(presenceInterval))
+	assertEqual(t, true, ok)
+	assertEqual(t, uint64(2), update.Seq)
+}
+
+func TestPresenceIgnoresStaleUpdates(t *testing.T) {
+	p := newPresence()
+	now := time.Now()
+	assertEqual(t, true, p.update("a", presenceUpdate{Seq: 2, Data: []byte("new")}, now))
+	// arrives late, e.g. through a graft
+	assertEqual(t, false, p.update("a", presenceUpdate{Seq: 1, Data: []byte("old")}, now))
+	assertEqual(t, []byte("new"), p.remote["a"].data)
+	assertEqual(t, true, p.update("b", presenceUpdate{Seq: 1, Data: []byte("other session")}, now))
+}
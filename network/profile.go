@@ -0,0 +1,86 @@
+package network
+
+import (
+	"errors"
+	"hash/fnv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Profile tells the other users who is behind a node. It's advertised in the NodeMeta of
+// every session next to the site of the node and signed with it, so the operations of a
+// site can be attributed to a name. Profiles of other nodes that are too long, contain
+// control characters or an unknown color are ignored along with the site
+type Profile struct {
+	Name    string // display name, the address is shown if empty
+	Color   string // one of ProfileColors
+	Contact string // optional, e.g. an email address
+}
+
+// the colors a profile can have, the editor shows them in the terminal
+var ProfileColors = []string{"red", "green", "yellow", "blue", "magenta", "cyan"}
+
+const (
+	maxProfileNameLength    = 32
+	maxProfileContactLength = 64
+)
+
+var ErrInvalidColor = errors.New("network: unknown profile color")
+
+func IsProfileColor(color string) bool {
+	for _, c := range ProfileColors {
+		if c == color {
+			return true
+		}
+	}
+	return false
+}
+
+// the color of a node that didn't choose one, the same across its sessions
+func defaultColor(identity string) string {
+	h := fnv.New32a()
+	h.Write([]byte(identity))
+	return ProfileColors[h.Sum32()%uint32(len(ProfileColors))]
+}
+
+// the profile without control characters and cut to the maximum lengths
+func (profile Profile) sanitized() Profile {
+	profile.Name = sanitizeProfileField(profile.Name, maxProfileNameLength)
+	profile.Contact = sanitizeProfileField(profile.Contact, maxProfileContactLength)
+	return profile
+}
+
+func sanitizeProfileField(field string, max int) string {
+	field = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, field)
+	for len(field) > max {
+		_, size := utf8.DecodeLastRuneInString(field)
+		field = field[:len(field)-size]
+	}
+	return field
+}
+
+// whether a profile received from another node can be shown as it is
+func (profile Profile) valid() bool {
+	return utf8.ValidString(profile.Name) && utf8.ValidString(profile.Contact) &&
+		profile == profile.sanitized() && (profile.Color == "" || IsProfileColor(profile.Color))
+}
+
+func (meta NodeMeta) Profile() Profile {
+	return Profile{Name: meta.Name, Color: meta.Color, Contact: meta.Contact}
+}
+
+func (meta *NodeMeta) setProfile(profile Profile) {
+	meta.Name = profile.Name
+	meta.Color = profile.Color
+	meta.Contact = profile.Contact
+}
+
+func (node NodeMetaListElem) Profile() Profile {
+	return Profile{Name: node.Name, Color: node.Color, Contact: node.Contact}
+}
@@ -0,0 +1,81 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+
+	"../documentmanager"
+)
+
+func TestDefaultColor(t *testing.T) {
+	color := defaultColor("identity")
+	assertEqual(t, true, IsProfileColor(color))
+	assertEqual(t, color, defaultColor("identity"))
+	assertEqual(t, false, IsProfileColor("plaid"))
+}
+
+func profileMeta(id string, key ed25519.PrivateKey, profile Profile) NodeMeta {
+	meta := NodeMeta{Addr: id}
+	meta.setProfile(profile)
+	meta.signSite(id, key)
+	return meta
+}
+
+func TestProfileInNetMeta(t *testing.T) {
+	alice := Profile{Name: "alice", Color: "red", Contact: "alice@example.com"}
+	key := documentmanager.NewSiteKey()
+	netMeta := newNetMeta()
+	netMeta.merge(NetMeta{"a": {Addr: "a"}})
+
+	// the meta of a node that pokes us only has its address at first
+	delta, changed := netMeta.merge(NetMeta{"a": profileMeta("a", key, alice)})
+	assertEqual(t, true, changed)
+	assertEqual(t, alice, delta["a"].Profile())
+	assertEqual(t, alice, netMeta.ToList()[0].Profile())
+	assertEqual(t, siteOf(key), netMeta.ToList()[0].Site)
+}
+
+func TestUnsignedProfile(t *testing.T) {
+	alice := Profile{Name: "alice", Color: "red"}
+	key := documentmanager.NewSiteKey()
+
+	// a profile without a site is not shown
+	unsigned := NodeMeta{Addr: "a"}
+	unsigned.setProfile(alice)
+	netMeta := newNetMeta()
+	netMeta.merge(NetMeta{"a": unsigned})
+	assertEqual(t, Profile{}, netMeta.ToList()[0].Profile())
+
+	// neither is a site whose profile was changed after signing
+	spoofed := profileMeta("a", key, Profile{Name: "mallory"})
+	spoofed.setProfile(alice)
+	netMeta = newNetMeta()
+	netMeta.merge(NetMeta{"a": spoofed})
+	assertEqual(t, "", netMeta.ToList()[0].Site)
+	assertEqual(t, Profile{}, netMeta.ToList()[0].Profile())
+}
+
+func TestInvalidProfile(t *testing.T) {
+	key := documentmanager.NewSiteKey()
+	for _, profile := range []Profile{
+		{Name: "alice\x1b[2J"},
+		{Name: strings.Repeat("a", maxProfileNameLength+1)},
+		{Contact: strings.Repeat("a", maxProfileContactLength+1)},
+		{Name: "alice\xff"},
+		{Name: "alice", Color: "plaid"},
+	} {
+		netMeta := newNetMeta()
+		netMeta.merge(NetMeta{"a": profileMeta("a", key, profile)})
+		assertEqual(t, "", netMeta.ToList()[0].Site)
+		assertEqual(t, Profile{}, netMeta.ToList()[0].Profile())
+	}
+}
+
+func TestSanitizedProfile(t *testing.T) {
+	profile := Profile{Name: "al\nice" + strings.Repeat("é", maxProfileNameLength), Color: "red", Contact: "\x07alice"}.sanitized()
+	assertEqual(t, true, profile.valid())
+	assertEqual(t, true, strings.HasPrefix(profile.Name, "alice"))
+	assertEqual(t, maxProfileNameLength-1, len(profile.Name))
+	assertEqual(t, "alice", profile.Contact)
+}
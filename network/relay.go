@@ -0,0 +1,316 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Relay mode lets peers that can't accept connections, e.g. behind a NAT, take part in
+// the network. A relayed peer keeps a control connection open to the relay and is known
+// to the others by the address relay://<relay address>/<name>. A peer dialing such an
+// address asks the relay to connect it to name, the relay tells the relayed peer through
+// its control connection, which then opens a new connection to the relay that is joined
+// with the one of the dialing peer. Everything sent afterwards, from the hello handshake
+// to the Messages, is forwarded as is, so TLS and the shared secret work end to end and
+// the relay can't read or change what it forwards.
+//
+// The first peer to listen as a name claims it: the relay sends it a secret claim token,
+// and the name is only given to a peer listening with that token until relayClaimTimeout
+// after its control connection broke, so another peer can't take over its connections.
+//
+// Requests to the relay are single lines:
+//   LISTEN <name> [<claim>]  opens the control connection of name, answered with OK. The
+//                            relay then sends CLAIM <claim> if name wasn't claimed yet,
+//                            ACCEPT <token> for every peer dialing name, and PING lines
+//   CONNECT <name>           answered with OK once the relayed peer has picked up, then forwarded
+//   STREAM <token>           picks up the connection of token, forwarded right away
+// Errors are answered with ERR <reason> and the connection is closed
+
+const (
+	relayScheme = "relay://"
+	// a dialing peer is disconnected if the relayed peer doesn't pick up in time
+	relayPickupTimeout = 10 * time.Second
+	relayPingInterval  = 15 * time.Second
+	// a claimed name is kept this long for its peer to listen again
+	relayClaimTimeout  = 10 * time.Minute
+	maxRelayLineLength = 256
+)
+
+var (
+	ErrRelayProtocol    = errors.New("relay: malformed request")
+	ErrInvalidRelayAddr = errors.New("relay: address must be relay://<host:port>/<name>")
+)
+
+// RelayError is an error reported by the relay
+type RelayError struct {
+	Reason string
+}
+
+func (err *RelayError) Error() string {
+	return "relay: " + err.Reason
+}
+
+// Relay forwards connections between peers, see RunRelay
+type Relay struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	controls map[string]*relayControl // of every relayed peer by name
+	claims   map[string]*relayClaim   // of every claimed name
+	pending  map[string]net.Conn      // dialing connections waiting to be picked up by token
+}
+
+// the token a name was claimed with, released is set once its peer stopped listening
+type relayClaim struct {
+	token    string
+	released time.Time
+}
+
+// the control connection of a relayed peer, written to by several goroutines
+type relayControl struct {
+	conn  net.Conn
+	mutex sync.Mutex
+}
+
+func (control *relayControl) send(line string) error {
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	control.conn.SetWriteDeadline(time.Now().Add(relayPickupTimeout))
+	return writeLine(control.conn, line)
+}
+
+// RunRelay relays connections to peers registered at addr until the listener fails
+func RunRelay(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return ServeRelay(listener)
+}
+
+// ServeRelay relays connections to peers registered on listener until it fails
+func ServeRelay(listener net.Listener) error {
+	relay := &Relay{
+		listener: listener,
+		controls: make(map[string]*relayControl),
+		claims:   make(map[string]*relayClaim),
+		pending:  make(map[string]net.Conn),
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go relay.handle(conn)
+	}
+}
+
+func (relay *Relay) handle(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(relayPickupTimeout))
+	line, err := readLine(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	request, arg := splitLine(line)
+	if arg == "" {
+		rejectRelayRequest(conn, ErrRelayProtocol.Error())
+		return
+	}
+	switch request {
+	case "LISTEN":
+		relay.handleListen(conn, arg)
+	case "CONNECT":
+		relay.handleConnect(conn, arg)
+	case "STREAM":
+		relay.handleStream(conn, arg)
+	default:
+		rejectRelayRequest(conn, ErrRelayProtocol.Error())
+	}
+}
+
+func (relay *Relay) handleListen(conn net.Conn, arg string) {
+	name, token := splitLine(arg)
+	control := &relayControl{conn: conn}
+	relay.mutex.Lock()
+	claim, claimed := relay.claims[name]
+	if claimed && claim.token != token {
+		relay.mutex.Unlock()
+		rejectRelayRequest(conn, "name "+name+" is taken")
+		return
+	}
+	if !claimed {
+		claim = &relayClaim{token: newRelayToken()}
+		relay.claims[name] = claim
+	}
+	claim.released = time.Time{}
+	if old, ok := relay.controls[name]; ok {
+		// the peer reconnected before the relay noticed the old connection broke
+		old.conn.Close()
+	}
+	relay.controls[name] = control
+	relay.mutex.Unlock()
+	defer func() {
+		relay.mutex.Lock()
+		if relay.controls[name] == control {
+			delete(relay.controls, name)
+			claim.released = time.Now()
+		}
+		relay.mutex.Unlock()
+		conn.Close()
+		time.AfterFunc(relayClaimTimeout, func() { relay.expireClaim(name, claim) })
+	}()
+	if control.send("OK") != nil {
+		return
+	}
+	if !claimed && control.send("CLAIM "+claim.token) != nil {
+		return
+	}
+	closed := make(chan struct{})
+	// the peer never sends anything else, the reads only notice when it goes away
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-time.After(relayPingInterval):
+		}
+		if control.send("PING") != nil {
+			return
+		}
+	}
+}
+
+// forgets claim of name if its peer hasn't listened again for relayClaimTimeout
+func (relay *Relay) expireClaim(name string, claim *relayClaim) {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	if relay.claims[name] == claim && !claim.released.IsZero() && time.Since(claim.released) >= relayClaimTimeout {
+		delete(relay.claims, name)
+	}
+}
+
+func (relay *Relay) handleConnect(conn net.Conn, name string) {
+	relay.mutex.Lock()
+	control, ok := relay.controls[name]
+	relay.mutex.Unlock()
+	if !ok {
+		rejectRelayRequest(conn, "no peer "+name+" is connected to the relay")
+		return
+	}
+	token := newRelayToken()
+	relay.mutex.Lock()
+	relay.pending[token] = conn
+	relay.mutex.Unlock()
+	if control.send("ACCEPT "+token) != nil {
+		relay.takePending(token)
+		rejectRelayRequest(conn, "peer "+name+" is unreachable")
+		return
+	}
+	time.AfterFunc(relayPickupTimeout, func() {
+		if pending, ok := relay.takePending(token); ok {
+			rejectRelayRequest(pending, "peer "+name+" didn't answer")
+		}
+	})
+}
+
+func (relay *Relay) handleStream(conn net.Conn, token string) {
+	dialing, ok := relay.takePending(token)
+	if !ok {
+		rejectRelayRequest(conn, "unknown token")
+		return
+	}
+	if writeLine(dialing, "OK") != nil {
+		dialing.Close()
+		conn.Close()
+		return
+	}
+	go forward(dialing, conn)
+	forward(conn, dialing)
+}
+
+func (relay *Relay) takePending(token string) (net.Conn, bool) {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	conn, ok := relay.pending[token]
+	delete(relay.pending, token)
+	return conn, ok
+}
+
+// copies from src to dst until either side closes, then closes both
+func forward(dst, src net.Conn) {
+	io.Copy(dst, src)
+	dst.Close()
+	src.Close()
+}
+
+func rejectRelayRequest(conn net.Conn, reason string) {
+	writeLine(conn, "ERR "+reason)
+	conn.Close()
+}
+
+func newRelayToken() string {
+	token := make([]byte, 16)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+func splitLine(line string) (string, string) {
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) != 2 {
+		return fields[0], ""
+	}
+	return fields[0], fields[1]
+}
+
+// reads a line without reading past it, the rest of the connection is forwarded
+func readLine(conn net.Conn) (string, error) {
+	line := make([]byte, 0, 64)
+	b := make([]byte, 1)
+	for {
+		_, err := conn.Read(b)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		if len(line) >= maxRelayLineLength {
+			return "", ErrRelayProtocol
+		}
+		line = append(line, b[0])
+	}
+}
+
+func writeLine(conn net.Conn, line string) error {
+	_, err := conn.Write([]byte(line + "\n"))
+	return err
+}
+
+// parses relay://<relay address>/<name>
+func parseRelayAddr(addr string) (string, string, error) {
+	if !strings.HasPrefix(addr, relayScheme) {
+		return "", "", ErrInvalidRelayAddr
+	}
+	rest := addr[len(relayScheme):]
+	i := strings.LastIndex(rest, "/")
+	if i <= 0 || i == len(rest)-1 {
+		return "", "", ErrInvalidRelayAddr
+	}
+	return rest[:i], rest[i+1:], nil
+}
+
+// IsRelayedAddr returns whether addr is the address of a peer reached through a relay
+func IsRelayedAddr(addr string) bool {
+	return strings.HasPrefix(addr, relayScheme)
+}
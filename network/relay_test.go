@@ -0,0 +1,71 @@
+package network
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func startMemRelay(t *testing.T, mn *MemNetwork, addr string) net.Listener {
+	listener, err := mn.Transport(addr).Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ServeRelay(listener)
+	return listener
+}
+
+// sends request to the relay at addr, returns the connection and the first line of the answer
+func relayRequest(t *testing.T, mn *MemNetwork, addr, request string) (net.Conn, string) {
+	conn, err := mn.Transport("peer").Dial(addr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, nil, writeLine(conn, request))
+	line, _ := readLine(conn)
+	return conn, line
+}
+
+func TestRelayClaim(t *testing.T) {
+	mn := NewMemNetwork()
+	defer startMemRelay(t, mn, "relay").Close()
+	first, reply := relayRequest(t, mn, "relay", "LISTEN a")
+	assertEqual(t, "OK", reply)
+	claim, _ := readLine(first)
+	request, token := splitLine(claim)
+	assertEqual(t, "CLAIM", request)
+
+	// nobody else can listen as a
+	_, reply = relayRequest(t, mn, "relay", "LISTEN a")
+	assertEqual(t, "ERR name a is taken", reply)
+	_, reply = relayRequest(t, mn, "relay", "LISTEN a "+newRelayToken())
+	assertEqual(t, "ERR name a is taken", reply)
+
+	// but the peer itself can again, replacing its old control connection
+	second, reply := relayRequest(t, mn, "relay", "LISTEN a "+token)
+	assertEqual(t, "OK", reply)
+	_, err := readLine(first)
+	assertEqual(t, true, err != nil)
+	second.Close()
+}
+
+func TestRelayedConnectTo(t *testing.T) {
+	mn := NewMemNetwork()
+	defer startMemRelay(t, mn, "relay").Close()
+	a := newMemPeer(t, mn, "a")
+	config := memConfig(mn, "b")
+	config.Relay = "relay"
+	b := newMemPeerWithConfig(t, mn, "b", config)
+	relayed := b.nm.GetNetworkMetadata()[b.nm.GetCurrentId()].Addr
+	assertEqual(t, true, strings.HasPrefix(relayed, "relay://relay/"))
+
+	assertEqual(t, nil, a.nm.ConnectTo(relayed))
+	waitFor(t, "the relayed connection", func() bool {
+		return a.connectedIds() == idsOf(b) && b.connectedIds() == idsOf(a)
+	})
+	a.broadcast("1")
+	b.broadcast("2")
+	waitFor(t, "the broadcasts", func() bool {
+		return a.receivedPayloads() == "2" && b.receivedPayloads() == "1"
+	})
+}
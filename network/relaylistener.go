@@ -0,0 +1,208 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the client side of relay.go
+
+var errRelayListenerClosed = errors.New("relay: listener closed")
+
+// relayListener accepts the connections a relay forwards to a relayed peer. The control
+// connection is established again whenever it breaks, until the listener is closed
+type relayListener struct {
+	transport Transport
+	relayAddr string
+	name      string
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	mutex     sync.Mutex
+	control   net.Conn
+	claim     string // the token the relay gave for name, see relay.go
+}
+
+type relayNetAddr string
+
+func (addr relayNetAddr) Network() string {
+	return "relay"
+}
+
+func (addr relayNetAddr) String() string {
+	return string(addr)
+}
+
+// newRelayListener registers as name at the relay, addr is relay://<relay address>/<name>
+func newRelayListener(transport Transport, addr string) (*relayListener, error) {
+	relayAddr, name, err := parseRelayAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &relayListener{
+		transport: transport,
+		relayAddr: relayAddr,
+		name:      name,
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+	control, err := l.register()
+	if err != nil {
+		return nil, err
+	}
+	go l.serve(control)
+	return l, nil
+}
+
+func (l *relayListener) register() (net.Conn, error) {
+	conn, err := l.transport.Dial(l.relayAddr, relayPickupTimeout)
+	if err != nil {
+		return nil, err
+	}
+	l.mutex.Lock()
+	request := "LISTEN " + l.name
+	if l.claim != "" {
+		request += " " + l.claim
+	}
+	l.mutex.Unlock()
+	err = writeLine(conn, request)
+	if err == nil {
+		err = readRelayReply(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	select {
+	case <-l.done:
+		conn.Close()
+		return nil, errRelayListenerClosed
+	default:
+	}
+	l.control = conn
+	return conn, nil
+}
+
+func (l *relayListener) serve(control net.Conn) {
+	for {
+		l.readControl(control)
+		control.Close()
+		var interval time.Duration
+		for {
+			var delay time.Duration
+			interval, delay = nextBackoff(interval, Config{ReconnectMinDelay: time.Second, ReconnectMaxDelay: relayPingInterval})
+			select {
+			case <-l.done:
+				return
+			case <-time.After(delay):
+			}
+			var err error
+			control, err = l.register()
+			if err == errRelayListenerClosed {
+				return
+			} else if err == nil {
+				break
+			}
+		}
+	}
+}
+
+// handles requests of the relay until the control connection breaks
+func (l *relayListener) readControl(control net.Conn) {
+	for {
+		control.SetReadDeadline(time.Now().Add(3 * relayPingInterval))
+		line, err := readLine(control)
+		if err != nil {
+			return
+		}
+		switch request, token := splitLine(line); request {
+		case "ACCEPT":
+			go l.pickUp(token)
+		case "CLAIM":
+			l.mutex.Lock()
+			l.claim = token
+			l.mutex.Unlock()
+		}
+	}
+}
+
+func (l *relayListener) pickUp(token string) {
+	conn, err := l.transport.Dial(l.relayAddr, relayPickupTimeout)
+	if err != nil {
+		return
+	}
+	if writeLine(conn, "STREAM "+token) != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *relayListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errRelayListenerClosed
+	}
+}
+
+func (l *relayListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.mutex.Lock()
+		close(l.done)
+		if l.control != nil {
+			l.control.Close()
+		}
+		l.mutex.Unlock()
+	})
+	return nil
+}
+
+func (l *relayListener) Addr() net.Addr {
+	return relayNetAddr(relayScheme + l.relayAddr + "/" + l.name)
+}
+
+// dialRelay connects to the peer with the relayed address addr
+func dialRelay(transport Transport, addr string) (net.Conn, error) {
+	relayAddr, name, err := parseRelayAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := transport.Dial(relayAddr, relayPickupTimeout)
+	if err != nil {
+		return nil, err
+	}
+	err = writeLine(conn, "CONNECT "+name)
+	if err == nil {
+		err = readRelayReply(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// reads the OK or ERR answer to a request
+func readRelayReply(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(2 * relayPickupTimeout))
+	line, err := readLine(conn)
+	if err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	if line == "OK" {
+		return nil
+	}
+	return &RelayError{strings.TrimPrefix(line, "ERR ")}
+}
@@ -0,0 +1,247 @@
+package network
+
+import (
+	. "../common"
+	"crypto/ed25519"
+	"errors"
+	"strconv"
+)
+
+// Roles belong to the sites editing the document. Each node announces the site of its
+// document in its NetMeta together with the role of the site, signed by the owner that
+// assigned it. A role is only accepted if it's signed by an owner, or by the site itself
+// without raising the role it has, so a viewer can't promote itself. The owners of a
+// network are trusted as they are when joining it. A node that creates a document owns
+// it, a node that joins a network becomes an editor. The highest version wins, and of
+// two roles assigned concurrently with the same version the lower one, so a concurrent
+// demotion isn't lost
+
+var (
+	ErrNotOwner    = errors.New("network: only an owner can change roles")
+	ErrUnknownNode = errors.New("network: no node with that id")
+	ErrInvalidRole = errors.New("network: unknown role")
+	ErrNoSite      = errors.New("network: the node doesn't edit a document yet")
+)
+
+// NewRoleGrant assigns role to the site of key itself. Other nodes only accept it
+// if the site doesn't have a lower role, or it's the owner of a network they join
+func NewRoleGrant(key ed25519.PrivateKey, role string, version uint32) RoleGrant {
+	if key == nil {
+		return RoleGrant{Role: role, Version: version}
+	}
+	return signRole(key, siteOfKey(key.Public().(ed25519.PublicKey)), role, version)
+}
+
+func signRole(key ed25519.PrivateKey, site, role string, version uint32) RoleGrant {
+	signer, signature := sign(key, roleContent(site, role, version))
+	return RoleGrant{Role: role, Version: version, Signer: signer, Signature: signature}
+}
+
+func roleContent(site, role string, version uint32) []byte {
+	return signedContent("role", site, role, strconv.FormatUint(uint64(version), 10))
+}
+
+// returns the site that signed grant for site
+func roleSigner(site string, grant RoleGrant) (string, bool) {
+	return verify(grant.Signer, grant.Signature, roleContent(site, grant.Role, grant.Version))
+}
+
+func (meta NodeMeta) roleGrant() RoleGrant {
+	return RoleGrant{Role: meta.Role, Version: meta.RoleVersion, Signer: meta.RoleSigner, Signature: meta.RoleSignature}
+}
+
+func (meta *NodeMeta) setRoleGrant(grant RoleGrant) {
+	meta.Role = grant.Role
+	meta.RoleVersion = grant.Version
+	meta.RoleSigner = grant.Signer
+	meta.RoleSignature = grant.Signature
+}
+
+// an empty role is an editor
+func roleRank(role string) int {
+	switch role {
+	case ROLE_VIEWER:
+		return 0
+	case ROLE_OWNER:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// whether grant a replaces b, the signature breaks ties of equal roles
+// so every node ends up with the same one
+func supersedesRole(a, b RoleGrant) bool {
+	if a.Version != b.Version {
+		return a.Version > b.Version
+	}
+	if roleRank(a.Role) != roleRank(b.Role) {
+		return roleRank(a.Role) < roleRank(b.Role)
+	}
+	return a.Signature < b.Signature
+}
+
+// the latest role of site among its nodes
+func (netMeta NetMeta) siteGrant(site string) RoleGrant {
+	var grant RoleGrant
+	for _, meta := range netMeta {
+		if meta.Site == site && supersedesRole(meta.roleGrant(), grant) {
+			grant = meta.roleGrant()
+		}
+	}
+	return grant
+}
+
+// SiteRoles returns the role of every site in the network
+func (netMeta NetMeta) SiteRoles() map[string]string {
+	roles := make(map[string]string)
+	for _, meta := range netMeta {
+		if meta.Site != "" {
+			roles[meta.Site] = netMeta.siteGrant(meta.Site).Role
+		}
+	}
+	return roles
+}
+
+// whether grant may be the role of site: signed by an owner or one of the trusted
+// owners, or by site itself without raising its role
+func (netMeta NetMeta) acceptsRole(site string, grant RoleGrant, owners map[string]bool) bool {
+	if site == "" {
+		return false
+	}
+	signer, ok := roleSigner(site, grant)
+	if !ok {
+		return false
+	}
+	if owners[signer] || netMeta.siteGrant(signer).Role == ROLE_OWNER {
+		return true
+	}
+	return signer == site && roleRank(grant.Role) <= roleRank(netMeta.siteGrant(site).Role)
+}
+
+// the owners that assigned themselves their role in netMeta, the network being joined
+func selfAssignedOwners(netMeta NetMeta) []string {
+	owners := make([]string, 0)
+	for id, meta := range netMeta {
+		if meta.Role != ROLE_OWNER || !meta.hasValidSite(id) {
+			continue
+		}
+		if signer, ok := roleSigner(meta.Site, meta.roleGrant()); ok && signer == meta.Site {
+			owners = append(owners, meta.Site)
+		}
+	}
+	return owners
+}
+
+// SetLocalSite announces the site of key as the site of the document edited on this node,
+// with grant as its role
+func (nm *NetworkManager) SetLocalSite(key ed25519.PrivateKey, grant RoleGrant) {
+	nm.localMutex.Lock()
+	nm.siteKey = key
+	nm.grant = grant
+	nm.localMutex.Unlock()
+	s := nm.currentSession()
+	if s == nil {
+		return
+	}
+	meta, ok := s.nodePool.updateNodeMeta(s.id, func(meta *NodeMeta) {
+		meta.setLocalSite(s.id, key, grant, nm.config.Profile)
+	})
+	if ok {
+		nm.announceNodeMeta(s, s.id, meta)
+	}
+}
+
+// the profile is only advertised along with a site, which signs it
+func (meta *NodeMeta) setLocalSite(id string, key ed25519.PrivateKey, grant RoleGrant, profile Profile) {
+	if key != nil {
+		meta.setProfile(profile)
+		meta.signSite(id, key)
+	}
+	meta.setRoleGrant(grant)
+}
+
+// SetRole assigns role to the site of the node with id, only owners may do so
+func (nm *NetworkManager) SetRole(id, role string) error {
+	if role != ROLE_OWNER && role != ROLE_EDITOR && role != ROLE_VIEWER {
+		return ErrInvalidRole
+	}
+	key, grant := nm.localSite()
+	if key == nil || grant.Role != ROLE_OWNER {
+		return ErrNotOwner
+	}
+	s := nm.currentSession()
+	if s == nil {
+		return ErrAlreadyDisconnected
+	}
+	target, ok := s.nodePool.findNodeMeta(id)
+	if !ok {
+		return ErrUnknownNode
+	}
+	if target.Site == "" {
+		return ErrNoSite
+	}
+	newGrant := signRole(key, target.Site, role, s.nodePool.siteGrant(target.Site).Version+1)
+	meta, ok := s.nodePool.updateNodeMeta(id, func(meta *NodeMeta) {
+		meta.setRoleGrant(newGrant)
+	})
+	if !ok {
+		return ErrUnknownNode
+	}
+	if id == s.id {
+		nm.setLocalGrant(newGrant)
+	}
+	nm.announceNodeMeta(s, id, meta)
+	return nil
+}
+
+// LocalRole returns the role of this node
+func (nm *NetworkManager) LocalRole() string {
+	_, grant := nm.localSite()
+	if grant.Role == "" {
+		return ROLE_EDITOR
+	}
+	return grant.Role
+}
+
+// LocalRoleGrant returns the role of this node as assigned, to be kept with the document
+func (nm *NetworkManager) LocalRoleGrant() RoleGrant {
+	_, grant := nm.localSite()
+	return grant
+}
+
+func (nm *NetworkManager) SetNetMetaHandler(fn func(NetMeta)) {
+	nm.NetMetaHandler = fn
+}
+
+func (nm *NetworkManager) localSite() (ed25519.PrivateKey, RoleGrant) {
+	nm.localMutex.Lock()
+	defer nm.localMutex.Unlock()
+	return nm.siteKey, nm.grant
+}
+
+func (nm *NetworkManager) setLocalGrant(grant RoleGrant) {
+	nm.localMutex.Lock()
+	nm.grant = grant
+	nm.localMutex.Unlock()
+}
+
+// joining another network as its only node gives up ownership of the document
+func (nm *NetworkManager) leaveOwnershipOnJoin(s *session) {
+	for id, meta := range nm.nodePool.getLatestNetMetaCopy() {
+		if id != s.id && !meta.Left {
+			return
+		}
+	}
+	key, grant := nm.localSite()
+	if grant.Role == ROLE_OWNER {
+		nm.SetLocalSite(key, NewRoleGrant(key, ROLE_EDITOR, grant.Version+1))
+	}
+}
+
+func (nm *NetworkManager) announceNodeMeta(s *session, id string, meta NodeMeta) {
+	delta := newNetMeta()
+	delta[id] = meta
+	s.nodePool.broadcast(newNetMetaUpdateMsg(s.id, delta))
+	nm.NetMetaHandler(nm.GetNetworkMetadata())
+}
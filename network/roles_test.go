@@ -0,0 +1,90 @@
+package network
+
+import (
+	. "../common"
+	"../documentmanager"
+	"crypto/ed25519"
+	"testing"
+)
+
+// the meta of node id editing as the site of key with grant as its role
+func siteMeta(id string, key ed25519.PrivateKey, grant RoleGrant) NodeMeta {
+	meta := NodeMeta{Addr: id}
+	meta.setLocalSite(id, key, grant, Profile{})
+	return meta
+}
+
+func siteOf(key ed25519.PrivateKey) string {
+	return siteOfKey(key.Public().(ed25519.PublicKey))
+}
+
+func TestRoleGrants(t *testing.T) {
+	owner, viewer := documentmanager.NewSiteKey(), documentmanager.NewSiteKey()
+	netMeta := newNetMeta()
+	netMeta.mergeTrusting(NetMeta{"o": siteMeta("o", owner, NewRoleGrant(owner, ROLE_OWNER, 1))}, map[string]bool{siteOf(owner): true})
+	assertEqual(t, ROLE_OWNER, netMeta.SiteRoles()[siteOf(owner)])
+
+	// a self-assigned role isn't higher than an editor, and an owner demotes
+	netMeta.merge(NetMeta{"v": siteMeta("v", viewer, NewRoleGrant(viewer, ROLE_OWNER, 1))})
+	assertEqual(t, "", netMeta.SiteRoles()[siteOf(viewer)])
+	netMeta.merge(NetMeta{"v": siteMeta("v", viewer, signRole(owner, siteOf(viewer), ROLE_VIEWER, 1))})
+	assertEqual(t, ROLE_VIEWER, netMeta.SiteRoles()[siteOf(viewer)])
+
+	// the viewer can't promote itself with a higher version
+	_, changed := netMeta.merge(NetMeta{"v": siteMeta("v", viewer, NewRoleGrant(viewer, ROLE_EDITOR, 5))})
+	assertEqual(t, false, changed)
+	// nor in a new session
+	netMeta.merge(NetMeta{"v2": siteMeta("v2", viewer, NewRoleGrant(viewer, ROLE_OWNER, 5))})
+	assertEqual(t, ROLE_VIEWER, netMeta.SiteRoles()[siteOf(viewer)])
+	// nor by claiming the site of the owner
+	forged := siteMeta("v3", viewer, RoleGrant{})
+	forged.Site = siteOf(owner)
+	netMeta.merge(NetMeta{"v3": forged})
+	assertEqual(t, "", netMeta["v3"].Site)
+
+	// of two concurrent assignments the lower role wins, in either order
+	other := documentmanager.NewSiteKey()
+	netMeta.merge(NetMeta{"o2": siteMeta("o2", other, signRole(owner, siteOf(other), ROLE_OWNER, 1))})
+	promote := siteMeta("v", viewer, signRole(other, siteOf(viewer), ROLE_EDITOR, 2))
+	demote := siteMeta("v", viewer, signRole(owner, siteOf(viewer), ROLE_VIEWER, 2))
+	netMeta.merge(NetMeta{"v": demote})
+	netMeta.merge(NetMeta{"v": promote})
+	assertEqual(t, ROLE_VIEWER, netMeta.SiteRoles()[siteOf(viewer)])
+	assertEqual(t, true, supersedesRole(demote.roleGrant(), promote.roleGrant()))
+}
+
+func TestRolesOfJoinedNetwork(t *testing.T) {
+	owner, editor, mallory := documentmanager.NewSiteKey(), documentmanager.NewSiteKey(), documentmanager.NewSiteKey()
+	joined := NetMeta{
+		"o": siteMeta("o", owner, NewRoleGrant(owner, ROLE_OWNER, 1)),
+		// signed by the owner, whose meta may be merged after it
+		"e": siteMeta("e", editor, signRole(owner, siteOf(editor), ROLE_OWNER, 2)),
+	}
+	np := newNodePool(nil)
+	np.trustOwners(joined)
+	np.applyReceivedUpdates(joined)
+	assertEqual(t, ROLE_OWNER, np.siteGrant(siteOf(owner)).Role)
+	assertEqual(t, ROLE_OWNER, np.siteGrant(siteOf(editor)).Role)
+
+	// nodes joining later don't bring their own owners along
+	np.applyReceivedUpdates(NetMeta{"m": siteMeta("m", mallory, NewRoleGrant(mallory, ROLE_OWNER, 1))})
+	assertEqual(t, "", np.siteGrant(siteOf(mallory)).Role)
+}
+
+func TestSetRole(t *testing.T) {
+	mn := NewMemNetwork()
+	a, b := newMemPeer(t, mn, "a"), newMemPeer(t, mn, "b")
+	ownerKey, editorKey := documentmanager.NewSiteKey(), documentmanager.NewSiteKey()
+	a.nm.SetLocalSite(ownerKey, NewRoleGrant(ownerKey, ROLE_OWNER, 1))
+	b.nm.SetLocalSite(editorKey, NewRoleGrant(editorKey, ROLE_OWNER, 1))
+	assertEqual(t, nil, b.nm.ConnectTo("a"))
+	waitFor(t, "the connection", func() bool { return a.connectedIds() == idsOf(b) })
+	// b gave up ownership of its document on joining
+	assertEqual(t, ROLE_EDITOR, b.nm.LocalRole())
+	assertEqual(t, ErrNotOwner, b.nm.SetRole(a.nm.GetCurrentId(), ROLE_VIEWER))
+
+	assertEqual(t, nil, a.nm.SetRole(b.nm.GetCurrentId(), ROLE_VIEWER))
+	waitFor(t, "b to become a viewer", func() bool { return b.nm.LocalRole() == ROLE_VIEWER })
+	assertEqual(t, ROLE_VIEWER, b.nm.LocalRoleGrant().Role)
+	assertEqual(t, ROLE_VIEWER, b.nm.GetNetworkMetadata().SiteRoles()[siteOf(editorKey)])
+}
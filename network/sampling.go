@@ -0,0 +1,238 @@
+package network
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// Partial mesh: with Config.MaxPeers set, a node keeps connections to a random sample of
+// the nodes it knows instead of to all of them. A node dials random nodes until it wants
+// targetPeers of them and accepts connections up to MaxPeers. Every sampleInterval a
+// node drops the peers it couldn't connect to for UnreachableTimeout and now and then
+// swaps a random link for a new one, so the overlay stays a random graph: connected, with
+// a diameter of about log(n) hops. Broadcasts and anti-entropy reach every node along it.
+// A full node makes room for a node dialing it by dropping a random peer, at most once
+// every sampleInterval so links don't churn. Links are only dropped to peers that keep
+// targetPeers others, which every node tells its peers in its heartbeats, so no node is
+// cut off. A dropped node is refused for a while so it doesn't just reconnect, it's
+// answered busy and looks elsewhere
+
+const (
+	// in heartbeat intervals
+	sampleHeartbeats = 5
+	// a dropped node isn't sampled or accepted again for this many heartbeat intervals
+	busyHeartbeats = 30
+	// on average one link of a node is swapped every shuffleRounds sampleIntervals
+	shuffleRounds = 6
+	// fewer peers would easily split the overlay
+	minMaxPeers = 4
+)
+
+func (config Config) sampleInterval() time.Duration {
+	return sampleHeartbeats * config.HeartbeatInterval
+}
+
+func (config Config) busyBackoff() time.Duration {
+	return busyHeartbeats * config.HeartbeatInterval
+}
+
+// the number of peers a node dials on its own, the rest of MaxPeers is left
+// for the nodes dialing it. 0 is unlimited
+func (config Config) targetPeers() int {
+	return config.MaxPeers - config.MaxPeers/3
+}
+
+// the node is wanted: a connection to it is kept or being established
+func (n *node) isActive() bool {
+	n.stateMutex.Lock()
+	defer n.stateMutex.Unlock()
+	return n.active
+}
+
+// drop gives up on the node for backoff, closing the connection to it and
+// stopping a thread dialing it
+func (n *node) drop(now time.Time, backoff time.Duration) {
+	n.stateMutex.Lock()
+	n.active = false
+	n.busyUntil = now.Add(backoff)
+	if n.conn != nil {
+		n.conn.Close()
+	}
+	n.stateMutex.Unlock()
+	n.retryNow()
+}
+
+// wanted but not connected to since timeout
+func (n *node) stale(now time.Time, timeout time.Duration) bool {
+	n.stateMutex.Lock()
+	defer n.stateMutex.Unlock()
+	since := n.activated
+	if n.lastHeard.After(since) {
+		since = n.lastHeard
+	}
+	return n.active && (n.state == nodeStateDisconnected || n.state == nodeStateUnreachable) && now.Sub(since) > timeout
+}
+
+func (n *node) isCandidate(now time.Time) bool {
+	n.stateMutex.Lock()
+	defer n.stateMutex.Unlock()
+	return !n.active && n.state == nodeStateDisconnected && n.incompatible == "" && now.After(n.busyUntil)
+}
+
+// caller must hold the sampleMutex
+func (n *node) activate(now time.Time) {
+	n.stateMutex.Lock()
+	n.active = true
+	n.activated = now
+	n.stateMutex.Unlock()
+}
+
+// reserve makes n wanted unless more than max nodes would be, max 0 is unlimited.
+// Returns whether n is wanted
+func (np *nodePool) reserve(n *node, max int) bool {
+	np.sampleMutex.Lock()
+	defer np.sampleMutex.Unlock()
+	if n.isActive() {
+		return true
+	}
+	if max > 0 && len(np.getActiveNodes()) >= max {
+		return false
+	}
+	n.activate(time.Now())
+	return true
+}
+
+// admit makes n wanted when it asks for a connection. If there are MaxPeers already
+// a random peer that has enough others is dropped, unless one was dropped for another
+// node within the last sampleInterval. Refuses nodes dropped recently
+func (np *nodePool) admit(n *node, config Config) bool {
+	np.sampleMutex.Lock()
+	defer np.sampleMutex.Unlock()
+	if n.isActive() {
+		return true
+	}
+	now := time.Now()
+	n.stateMutex.Lock()
+	dropped := now.Before(n.busyUntil)
+	n.stateMutex.Unlock()
+	if dropped {
+		return false
+	}
+	if active := np.getActiveNodes(); config.MaxPeers > 0 && len(active) >= config.MaxPeers {
+		spare := spareNodes(active, config.targetPeers())
+		if len(spare) == 0 || now.Sub(np.lastEviction) < config.sampleInterval() {
+			return false
+		}
+		spare[rand.Intn(len(spare))].drop(now, config.busyBackoff())
+		np.lastEviction = now
+	}
+	n.activate(now)
+	return true
+}
+
+// the connected nodes that keep at least target other peers when the link to them is dropped
+func spareNodes(nodes []*node, target int) []*node {
+	spare := make([]*node, 0)
+	for _, n := range nodes {
+		n.stateMutex.Lock()
+		if (n.state == nodeStateConnected || n.state == nodeStateSuspect) && n.peerCount-1 >= target {
+			spare = append(spare, n)
+		}
+		n.stateMutex.Unlock()
+	}
+	return spare
+}
+
+// the number of peers the node said it's connected to in its heartbeat, -1 until it did
+func (n *node) setPeerCount(msg Message) {
+	count, err := strconv.Atoi(string(msg.Msg))
+	if err != nil {
+		count = -1
+	}
+	n.stateMutex.Lock()
+	n.peerCount = count
+	n.stateMutex.Unlock()
+}
+
+func (np *nodePool) getActiveNodes() []*node {
+	nodes := make([]*node, 0)
+	for _, n := range np.getAllNodes() {
+		if n.isActive() {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// starts the thread establishing the connection to n, unless one is already running
+// in this session
+func (s *session) startDialing(n *node) {
+	n.stateMutex.Lock()
+	if n.dialer == s {
+		n.stateMutex.Unlock()
+		n.retryNow()
+		return
+	}
+	n.dialer = s
+	n.stateMutex.Unlock()
+	if shouldConnect(s.manager.publicAddr, n.addr) {
+		go s.connectThread(n)
+	} else {
+		go s.pokeThread(n)
+	}
+}
+
+func (s *session) stopDialing(n *node) {
+	n.stateMutex.Lock()
+	if n.dialer == s {
+		n.dialer = nil
+	}
+	n.stateMutex.Unlock()
+}
+
+func (s *session) periodicallySample() {
+	if s.manager.config.MaxPeers == 0 {
+		return
+	}
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(s.manager.config.sampleInterval()):
+		}
+		s.sample(time.Now())
+	}
+}
+
+// drops the stale peers and dials random candidates until targetPeers are wanted
+func (s *session) sample(now time.Time) {
+	config := s.manager.config
+	candidates := make([]*node, 0)
+	for _, n := range s.nodePool.getAllNodes() {
+		if n.stale(now, config.UnreachableTimeout) {
+			n.drop(now, config.busyBackoff())
+		}
+		if n.isCandidate(now) && s.linkedTo(n.id) {
+			candidates = append(candidates, n)
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	connected := s.nodePool.getConnectedNodes()
+	if len(connected) >= config.targetPeers() && rand.Intn(shuffleRounds) == 0 {
+		if spare := spareNodes(connected, config.targetPeers()); len(spare) > 0 {
+			spare[rand.Intn(len(spare))].drop(now, config.busyBackoff())
+		}
+	}
+	for _, n := range candidates {
+		if !s.nodePool.reserve(n, config.targetPeers()) {
+			return
+		}
+		s.startDialing(n)
+	}
+}
@@ -0,0 +1,151 @@
+package network
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSpareNodes(t *testing.T) {
+	np := newNodePool(nil)
+	nodes := make([]*node, 0)
+	for i, count := range []int{-1, 2, 3, 4} {
+		n := np.addOrGetNodeFromPool(fmt.Sprint(i), NodeMeta{}, nil)
+		n.state = nodeStateConnected
+		n.peerCount = count
+		nodes = append(nodes, n)
+	}
+	// only the node that keeps 3 peers without us, unknown counts aren't spare
+	assertEqual(t, []*node{nodes[3]}, spareNodes(nodes, 3))
+}
+
+func TestAdmitWithoutSparePeers(t *testing.T) {
+	config := Config{MaxPeers: 4, HeartbeatInterval: time.Second}
+	np := newNodePool(nil)
+	for i := 0; i < 4; i++ {
+		n := np.addOrGetNodeFromPool(fmt.Sprint(i), NodeMeta{}, nil)
+		n.state = nodeStateConnected
+		n.peerCount = 2
+		np.admit(n, config)
+	}
+	// no peer may be dropped, the dialer is refused
+	dialer := np.addOrGetNodeFromPool("dialer", NodeMeta{}, nil)
+	assertEqual(t, false, np.admit(dialer, config))
+
+	np.pool["0"].peerCount = 4
+	assertEqual(t, true, np.admit(dialer, config))
+	assertEqual(t, false, np.pool["0"].isActive())
+	// and not another one right away
+	np.pool["1"].peerCount = 4
+	other := np.addOrGetNodeFromPool("other", NodeMeta{}, nil)
+	assertEqual(t, false, np.admit(other, config))
+	assertEqual(t, true, np.pool["1"].isActive())
+}
+
+// the ids of the peers reachable from the first one over the connections
+func reachable(peers []*memPeer) map[string]bool {
+	links := make(map[string][]string)
+	for _, p := range peers {
+		id := p.nm.GetCurrentId()
+		for _, other := range strings.Split(p.connectedIds(), ",") {
+			if other != "" {
+				links[id] = append(links[id], other)
+				links[other] = append(links[other], id)
+			}
+		}
+	}
+	seen := map[string]bool{peers[0].nm.GetCurrentId(): true}
+	queue := []string{peers[0].nm.GetCurrentId()}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, other := range links[id] {
+			if !seen[other] {
+				seen[other] = true
+				queue = append(queue, other)
+			}
+		}
+	}
+	return seen
+}
+
+// 30 peers are slow with the race detector on a single core,
+// the timeouts of the test are relaxed for it
+const overlayTimeout = 30 * time.Second
+
+func TestSampledOverlay(t *testing.T) {
+	mn := NewMemNetwork()
+	peers := make([]*memPeer, 0)
+	// like the tags of a document, anti-entropy repairs what the tree misses while links change
+	sets := make([]*tagSet, 0)
+	for i := 0; i < 30; i++ {
+		addr := fmt.Sprintf("peer%02d", i)
+		config := memConfig(mn, addr)
+		config.MaxPeers = 4
+		config.HeartbeatInterval = 100 * time.Millisecond
+		config.SuspectTimeout = time.Second
+		config.UnreachableTimeout = 2 * time.Second
+		p := newMemPeerWithConfig(t, mn, addr, config)
+		set := &tagSet{tags: make(map[string]bool)}
+		p.nm.SetGetTags(set.state)
+		p.nm.SetTagHandler(set.add)
+		peers, sets = append(peers, p), append(sets, set)
+		defer p.nm.Disconnect()
+		if i > 0 {
+			// the joined peer gives up on a join slower than UnreachableTimeout, as under -race
+			waitForWithin(t, addr+" joining", overlayTimeout, func() bool {
+				return p.nm.ConnectTo(peers[i/2].addr) == nil
+			})
+		}
+	}
+	// a dropped link may still show as connected for a moment
+	waitForWithin(t, "a connected overlay of at most 4 peers each", overlayTimeout, func() bool {
+		for _, p := range peers {
+			if len(strings.Split(p.connectedIds(), ",")) > 4 {
+				return false
+			}
+		}
+		return len(reachable(peers)) == len(peers)
+	})
+
+	all := make([]string, 0)
+	for i, p := range peers {
+		sets[i].add([]byte(p.addr))
+		p.broadcast(p.addr)
+		all = append(all, p.addr)
+	}
+	for i, p := range peers {
+		set := sets[i]
+		waitForWithin(t, "every broadcast at "+p.addr, overlayTimeout, func() bool { return string(set.state()) == strings.Join(all, ",") })
+	}
+}
+
+// comma separated tags, merged as received
+type tagSet struct {
+	mutex sync.Mutex
+	tags  map[string]bool
+}
+
+func (set *tagSet) add(tags []byte) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	for _, tag := range strings.Split(string(tags), ",") {
+		if tag != "" {
+			set.tags[tag] = true
+		}
+	}
+}
+
+func (set *tagSet) state() []byte {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	tags := make([]string, 0, len(set.tags))
+	for tag := range set.tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return []byte(strings.Join(tags, ","))
+}
@@ -0,0 +1,264 @@
+package network
+
+import (
+	"sync"
+)
+
+// Messages to a node are delivered reliably and in order across reconnects. Every message
+// queued for a node gets the next sequence number of the link, the receiver acknowledges
+// the highest number it has received and drops numbers it has already seen. Messages stay
+// queued until acknowledged and are sent again on the next connection to the node.
+// Acknowledgements, heartbeats and ephemeral messages, which are sent at most once on the
+// current connection and outdated by the next one anyway, have sequence number 0.
+// A node that resumes its session after its quit was lost starts its link over, which
+// the newer incarnation of the session in its hello tells.
+
+// beyond this many messages waiting for a node the oldest ones it can pull through
+// anti-entropy are dropped, instead of growing the queue without bound
+const maxQueuedMessages = 10000
+
+// ephemeral messages beyond this many waiting to be sent are dropped, oldest first
+const maxEphemeralMessages = 100
+
+// whether messages of msgType are ephemeral
+func ephemeral(msgType string) bool {
+	return msgType == MSG_TYPE_PRESENCE
+}
+
+// whether the content of messages of msgType is pulled again through anti-entropy if
+// they are lost, or they are repeated by its next round
+func recoverable(msgType string) bool {
+	switch msgType {
+	case MSG_TYPE_NET_META_UPDATE, MSG_TYPE_REMOTE_OP, MSG_TYPE_TAG,
+		MSG_TYPE_DIGEST, MSG_TYPE_SUMMARY, MSG_TYPE_RANGE_REQUEST:
+		return true
+	}
+	return false
+}
+
+type sendQueue struct {
+	mutex sync.Mutex
+	// signals the send thread, replaced and closed on every new generation
+	// so send threads of previous connections wake up and stop
+	wake chan struct{}
+	// not yet acknowledged, msgs[:sent] have been sent on the current connection
+	msgs    []Message
+	sent    int
+	nextSeq uint64
+	// increased on every new connection, stops the send thread of the previous one
+	generation int
+	// highest sequence number received from the node and the last one acknowledged
+	received uint64
+	ackSent  uint64
+	// a heartbeat is due, it's sent once and never queued
+	heartbeat bool
+	peers     int // the number of peers told in the heartbeat
+	// sent once on the current connection, never retransmitted
+	ephemeral []Message
+	// the highest incarnation of the session of the node, 0 until connected to one telling it
+	incarnation int64
+	// messages dropped since the node didn't keep up
+	dropped uint64
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{wake: make(chan struct{}, 1)}
+}
+
+// wakes up the send thread, caller must hold the mutex. The channel is
+// replaced and closed by newGeneration, so it's only used with the mutex held
+func (q *sendQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// caller must hold the mutex
+func (q *sendQueue) newGeneration() {
+	q.generation++
+	close(q.wake)
+	q.wake = make(chan struct{}, 1)
+}
+
+// push queues msg. If the node is too far behind the oldest recoverable message is
+// dropped to make room, returns false if there was none and msg was dropped instead
+func (q *sendQueue) push(msg Message) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if ephemeral(msg.Type) {
+		if len(q.ephemeral) >= maxEphemeralMessages {
+			q.ephemeral = q.ephemeral[1:]
+		}
+		q.ephemeral = append(q.ephemeral, msg)
+		q.signal()
+		return true
+	}
+	if len(q.msgs) >= maxQueuedMessages && !q.dropRecoverable() {
+		q.dropped++
+		return false
+	}
+	q.nextSeq++
+	msg.Seq = q.nextSeq
+	q.msgs = append(q.msgs, msg)
+	q.signal()
+	return true
+}
+
+// drops the oldest recoverable message, caller must hold the mutex. The sequence numbers
+// of the others stay, the node takes the gap for messages it has already received
+func (q *sendQueue) dropRecoverable() bool {
+	for i, msg := range q.msgs {
+		if recoverable(msg.Type) {
+			q.msgs = append(q.msgs[:i], q.msgs[i+1:]...)
+			if i < q.sent {
+				q.sent--
+			}
+			q.dropped++
+			return true
+		}
+	}
+	return false
+}
+
+// rewind starts a new connection: everything unacknowledged is sent again.
+// Returns the generation of the new send thread
+func (q *sendQueue) rewind() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.newGeneration()
+	q.sent = 0
+	q.ackSent = 0
+	q.heartbeat = false
+	q.ephemeral = nil
+	return q.generation
+}
+
+// reset forgets the state of the link, the node sees a new session of ours as a new node
+func (q *sendQueue) reset() {
+	q.mutex.Lock()
+	q.msgs = nil
+	q.sent = 0
+	q.nextSeq = 0
+	q.received = 0
+	q.ackSent = 0
+	q.ephemeral = nil
+	q.newGeneration()
+	q.mutex.Unlock()
+}
+
+// resume is called with the incarnation of the node on every connection to it. A newer
+// one resumed the session without our knowing that the previous one quit, the link
+// starts over as it did on the side of the node
+func (q *sendQueue) resume(incarnation int64) {
+	q.mutex.Lock()
+	resumed := q.incarnation != 0 && incarnation > q.incarnation
+	if incarnation > q.incarnation {
+		q.incarnation = incarnation
+	}
+	q.mutex.Unlock()
+	if resumed {
+		q.reset()
+	}
+}
+
+// next returns the next message to send on the connection of generation, waiting for
+// one if wait is set. Returns false once the generation is outdated or done is closed
+func (q *sendQueue) next(generation int, wait bool, done chan struct{}) (Message, bool) {
+	for {
+		q.mutex.Lock()
+		if generation != q.generation {
+			q.mutex.Unlock()
+			return Message{}, false
+		}
+		if q.received > q.ackSent {
+			q.ackSent = q.received
+			ack := newAckMsg(q.ackSent)
+			q.mutex.Unlock()
+			return ack, true
+		}
+		if q.heartbeat {
+			q.heartbeat = false
+			heartbeat := newHeartbeatMsg(q.peers)
+			q.mutex.Unlock()
+			return heartbeat, true
+		}
+		if len(q.ephemeral) > 0 {
+			msg := q.ephemeral[0]
+			q.ephemeral = q.ephemeral[1:]
+			q.mutex.Unlock()
+			return msg, true
+		}
+		if q.sent < len(q.msgs) {
+			msg := q.msgs[q.sent]
+			q.sent++
+			q.mutex.Unlock()
+			return msg, true
+		}
+		wake := q.wake
+		q.mutex.Unlock()
+		if !wait {
+			return Message{}, false
+		}
+		select {
+		case <-wake:
+		case <-done:
+			return Message{}, false
+		}
+	}
+}
+
+// ack drops the messages the node has received
+func (q *sendQueue) ack(seq uint64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	acked := 0
+	for acked < len(q.msgs) && q.msgs[acked].Seq <= seq {
+		acked++
+	}
+	q.msgs = q.msgs[acked:]
+	q.sent -= acked
+	if q.sent < 0 {
+		q.sent = 0
+	}
+}
+
+// receive records that a message with seq has arrived from the node,
+// returns false if it's a retransmission that was already delivered
+func (q *sendQueue) receive(seq uint64) bool {
+	if seq == 0 {
+		return true
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	duplicate := seq <= q.received
+	if duplicate {
+		// the acknowledgement may have been lost, send it again
+		q.ackSent = 0
+	} else {
+		q.received = seq
+	}
+	q.signal()
+	return !duplicate
+}
+
+// beat sends a heartbeat telling that this node has peers on the current connection
+func (q *sendQueue) beat(peers int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.heartbeat = true
+	q.peers = peers
+	q.signal()
+}
+
+func (q *sendQueue) len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.msgs)
+}
+
+func (q *sendQueue) droppedMessages() uint64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.dropped
+}
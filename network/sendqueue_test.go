@@ -0,0 +1,137 @@
+package network
+
+import (
+	"testing"
+)
+
+// the messages sent on the connection of generation until there's none left
+func drain(q *sendQueue, generation int) []Message {
+	msgs := make([]Message, 0)
+	for {
+		msg, ok := q.next(generation, false, nil)
+		if !ok {
+			return msgs
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+func seqs(msgs []Message) []uint64 {
+	result := make([]uint64, len(msgs))
+	for i, msg := range msgs {
+		result[i] = msg.Seq
+	}
+	return result
+}
+
+func TestSendQueueAckAndRewind(t *testing.T) {
+	q := newSendQueue()
+	generation := q.rewind()
+	for i := 0; i < 3; i++ {
+		assertEqual(t, true, q.push(Message{Type: MSG_TYPE_TAG}))
+	}
+	assertEqual(t, []uint64{1, 2, 3}, seqs(drain(q, generation)))
+
+	q.ack(2)
+	assertEqual(t, 1, q.len())
+	// a new connection sends everything unacknowledged again and stops the old send thread
+	newGeneration := q.rewind()
+	_, ok := q.next(generation, false, nil)
+	assertEqual(t, false, ok)
+	q.push(Message{Type: MSG_TYPE_TAG})
+	assertEqual(t, []uint64{3, 4}, seqs(drain(q, newGeneration)))
+	q.ack(4)
+	assertEqual(t, 0, q.len())
+}
+
+func TestSendQueueReceive(t *testing.T) {
+	q := newSendQueue()
+	generation := q.rewind()
+	assertEqual(t, true, q.receive(1))
+	assertEqual(t, true, q.receive(2))
+	msgs := drain(q, generation)
+	assertEqual(t, 1, len(msgs))
+	assertEqual(t, MSG_TYPE_ACK, msgs[0].Type)
+	assertEqual(t, uint64(2), msgs[0].Seq)
+
+	// a retransmission isn't delivered twice, but acknowledged again
+	assertEqual(t, false, q.receive(2))
+	msgs = drain(q, generation)
+	assertEqual(t, 1, len(msgs))
+	assertEqual(t, uint64(2), msgs[0].Seq)
+	// messages outside the queue are always delivered
+	assertEqual(t, true, q.receive(0))
+	assertEqual(t, true, q.receive(0))
+}
+
+func TestSendQueueOverflow(t *testing.T) {
+	q := newSendQueue()
+	q.push(Message{Type: MSG_TYPE_GRAFT})
+	for i := 1; i < maxQueuedMessages; i++ {
+		assertEqual(t, true, q.push(Message{Type: MSG_TYPE_TAG}))
+	}
+	generation := q.rewind()
+	q.next(generation, false, nil)
+	q.next(generation, false, nil)
+
+	// the oldest tag makes room, the graft stays
+	assertEqual(t, true, q.push(Message{Type: MSG_TYPE_TAG}))
+	assertEqual(t, maxQueuedMessages, q.len())
+	assertEqual(t, uint64(1), q.droppedMessages())
+	assertEqual(t, MSG_TYPE_GRAFT, q.msgs[0].Type)
+	assertEqual(t, uint64(3), q.msgs[1].Seq)
+	msg, _ := q.next(generation, false, nil)
+	assertEqual(t, uint64(3), msg.Seq)
+
+	// nothing left to drop
+	q = newSendQueue()
+	for i := 0; i < maxQueuedMessages; i++ {
+		q.push(Message{Type: MSG_TYPE_GRAFT})
+	}
+	assertEqual(t, false, q.push(Message{Type: MSG_TYPE_GRAFT}))
+	assertEqual(t, maxQueuedMessages, q.len())
+	assertEqual(t, uint64(1), q.droppedMessages())
+}
+
+func TestSendQueueEphemeral(t *testing.T) {
+	q := newSendQueue()
+	generation := q.rewind()
+	q.push(Message{Type: MSG_TYPE_PRESENCE, Msg: []byte("1")})
+	q.push(Message{Type: MSG_TYPE_TAG})
+	msgs := drain(q, generation)
+	assertEqual(t, 2, len(msgs))
+	assertEqual(t, []uint64{0, 1}, seqs(msgs))
+	assertEqual(t, 1, q.len())
+
+	// not sent again on the next connection
+	q.push(Message{Type: MSG_TYPE_PRESENCE, Msg: []byte("2")})
+	generation = q.rewind()
+	msgs = drain(q, generation)
+	assertEqual(t, 1, len(msgs))
+	assertEqual(t, MSG_TYPE_TAG, msgs[0].Type)
+
+	// only the latest are kept while the connection doesn't keep up
+	for i := 0; i < maxEphemeralMessages+10; i++ {
+		q.push(Message{Type: MSG_TYPE_PRESENCE, Msg: []byte{byte(i)}})
+	}
+	msgs = drain(q, generation)
+	assertEqual(t, maxEphemeralMessages, len(msgs))
+	assertEqual(t, []byte{10}, msgs[0].Msg)
+}
+
+func TestSendQueueResume(t *testing.T) {
+	q := newSendQueue()
+	q.resume(1)
+	for seq := uint64(1); seq <= 3; seq++ {
+		assertEqual(t, true, q.receive(seq))
+	}
+	// reconnecting to the same incarnation continues the link
+	q.resume(1)
+	assertEqual(t, false, q.receive(3))
+	// the node resumed its session after its quit was lost and numbers from 1 again
+	q.resume(2)
+	assertEqual(t, true, q.receive(1))
+	// an older incarnation doesn't go back
+	q.resume(1)
+	assertEqual(t, false, q.receive(1))
+}
@@ -6,39 +6,54 @@ import (
 	"time"
 )
 
-// how often to check if version on two nodes match
-const versionCheckInterval = 3 * time.Second
-
 type session struct {
-	id       string
-	listener *net.TCPListener
-	manager  *NetworkManager
-	done     chan struct{}
-	nodePool *nodePool
+	id           string
+	listener     net.Listener
+	manager      *NetworkManager
+	done         chan struct{}
+	nodePool     *nodePool
+	syncActivity chan struct{} // see noteActivity
+	incarnation  int64         // see identity.go
+	// local digest when a mismatch was last noted as activity, see handleIncomingDigest
+	mismatchedDigest digest
 }
 
 func startNewSessionOnNetworkManager(nm *NetworkManager) error {
-	lAddr, err := net.ResolveTCPAddr("tcp", nm.localAddr)
+	incarnation, err := nm.config.Identity.nextIncarnation()
 	if err != nil {
 		return err
 	}
-	listener, err := net.ListenTCP("tcp", lAddr)
+	listener, err := nm.listen()
 	if err != nil {
 		return err
 	}
+	// a session resumed after Disconnect keeps its id
+	id := nm.GetCurrentId()
+	if id == "" {
+		id = uuid.NewV1().String()
+	}
 	newSession := session{
-		id:       uuid.NewV1().String(),
-		listener: listener,
-		manager:  nm,
-		done:     make(chan struct{}),
-		nodePool: nm.nodePool,
+		id:           id,
+		listener:     listener,
+		manager:      nm,
+		done:         make(chan struct{}),
+		nodePool:     nm.nodePool,
+		syncActivity: make(chan struct{}, 1),
+		incarnation:  incarnation,
 	}
 	newSession.nodePool.handleNewSession(&newSession)
 	go newSession.listenForNewConn()
-	go newSession.periodicallyCheckVersion()
+	go newSession.periodicallySync()
 	go newSession.serveIncomingMessages()
+	go newSession.periodicallyRepairTree()
+	go newSession.monitorPeers()
+	go newSession.periodicallySample()
+	go newSession.periodicallyCollect()
+	go newSession.periodicallySendPresence()
+	nm.sessionMutex.Lock()
 	nm.id = newSession.id
 	nm.session = &newSession
+	nm.sessionMutex.Unlock()
 	return nil
 }
 
@@ -46,6 +61,8 @@ func (s *session) end() {
 	close(s.done)
 	s.listener.Close()
 	s.nodePool.handleEndSession(s)
+	s.manager.presence.reset()
+	go s.manager.PresenceHandler()
 }
 
 func (s *session) ended() bool {
@@ -61,13 +78,35 @@ func (s *session) serveIncomingMessages() {
 	for done := false; !done || len(s.manager.msgChan) > 0; {
 		select {
 		case msg := <-s.manager.msgChan:
+			if msg.Type == MSG_TYPE_REMOTE_OP && msg.from != "" && s.sequencesOperations() {
+				// forwarded once sequenced instead of along the broadcast tree
+				s.handleOperationsAtHub(msg)
+				continue
+			}
+			if msg.Id != "" && msg.from != "" && !s.receiveGossip(msg) {
+				continue
+			}
 			switch msg.Type {
 			case MSG_TYPE_NET_META_UPDATE:
 				s.handleIncomingNetMeta(msg)
 			case MSG_TYPE_REMOTE_OP:
 				s.handleIncomingRemoteOp(msg)
-			case MSG_TYPE_VERSION_CHECK:
-				s.handleIncomingVersionCheck(msg)
+			case MSG_TYPE_DIGEST:
+				s.handleIncomingDigest(msg)
+			case MSG_TYPE_SUMMARY:
+				s.handleIncomingSummary(msg)
+			case MSG_TYPE_RANGE_REQUEST:
+				s.handleIncomingRangeRequest(msg)
+			case MSG_TYPE_TAG:
+				s.handleIncomingTag(msg)
+			case MSG_TYPE_PRESENCE:
+				s.handleIncomingPresence(msg)
+			case MSG_TYPE_IHAVE:
+				s.nodePool.tree.receiveIHave(msg.from, gossipIdsFromSlice(msg.Msg), time.Now())
+			case MSG_TYPE_PRUNE:
+				s.nodePool.tree.receivePrune(msg.from)
+			case MSG_TYPE_GRAFT:
+				s.nodePool.sendGossip(s.nodePool.tree.receiveGraft(msg.from, gossipIdsFromSlice(msg.Msg)))
 			default:
 				// ignore and do nothing
 			}
@@ -78,15 +117,28 @@ func (s *session) serveIncomingMessages() {
 }
 
 func (s *session) handleIncomingNetMeta(msg Message) {
-	updates, err := newNetMetaFromJson(msg.Msg)
+	updates, err := newNetMetaFromSlice(msg.Msg)
 	if err != nil {
 		return
 	}
+	updates = s.fromPeer(msg.from, updates)
 	newNodes, deltaNetMeta, changed := s.nodePool.applyReceivedUpdates(updates)
 	if changed {
+		if meta, ok := deltaNetMeta[s.id]; ok && meta.RoleSigner != "" {
+			// an owner changed our role
+			s.manager.setLocalGrant(meta.roleGrant())
+		}
 		s.handleNewNodes(newNodes)
-		msg.Msg = deltaNetMeta.toJson()
-		s.nodePool.broadcast(msg)
+		for id, meta := range deltaNetMeta {
+			if !meta.Left {
+				s.nodePool.heardOf(id)
+			}
+		}
+		if msg.from == "" {
+			// updates received from peers are already forwarded along the broadcast tree
+			s.nodePool.broadcast(newNetMetaUpdateMsg(s.id, deltaNetMeta))
+		}
+		go s.manager.NetMetaHandler(s.nodePool.getLatestNetMetaCopy())
 	}
 }
 
@@ -94,23 +146,33 @@ func (s *session) handleIncomingRemoteOp(msg Message) {
 	if s.manager.RemoteOpHandler != nil {
 		go s.manager.RemoteOpHandler(msg.Msg)
 	}
-	if msg.Visited != nil { // we should only recursively broadcast in this case
-		s.nodePool.broadcast(msg)
+}
+
+func (s *session) handleIncomingTag(msg Message) {
+	if s.manager.TagHandler != nil {
+		go s.manager.TagHandler(msg.Msg)
 	}
 }
 
-func (s *session) handleIncomingVersionCheck(msg Message) {
-	content, err := newVersionCheckMsgContentFromJson(msg.Msg)
-	if err != nil {
-		return
+// passes a broadcast message received from a peer to the broadcast tree, returns
+// whether it should be handled, which is only the first time it's received
+func (s *session) receiveGossip(msg Message) bool {
+	s.nodePool.syncTreePeers()
+	deliver, sends := s.nodePool.tree.receive(msg.from, msg.withEncodings())
+	s.nodePool.sendGossip(sends)
+	if deliver {
+		s.noteActivity()
+		s.nodePool.heardOf(broadcastOrigin(msg.Id))
 	}
-	s.handleIncomingNetMeta(newNetMetaUpdateMsg(s.id, content.NetworkMeta))
-	syncInfo, shouldReply := s.manager.VersionCheckHandler(content.VersionVector)
-	if shouldReply {
-		toSend := NewReplyMessage(MSG_TYPE_REMOTE_OP, syncInfo)
-		go func() {
-			s.nodePool.sendMessageToNodeWithId(toSend, content.Source)
-		}()
+	return deliver
+}
+
+// requests messages that were announced but didn't arrive through the tree
+func (s *session) periodicallyRepairTree() {
+	for !s.ended() {
+		time.Sleep(graftTimeout / 2)
+		s.nodePool.syncTreePeers()
+		s.nodePool.sendGossip(s.nodePool.tree.graftMissing(time.Now()))
 	}
 }
 
@@ -134,31 +196,3 @@ func (s *session) handleNewNodes(nodes []*node) {
 		s.initiateNewNode(n)
 	}
 }
-
-func (s *session) periodicallyCheckVersion() {
-	for {
-		time.Sleep(versionCheckInterval)
-		hasMsg, msg := s.getLatestVersionCheckMsg()
-		if s.ended() {
-			return
-		}
-		if hasMsg {
-			s.nodePool.broadcast(msg)
-		}
-	}
-}
-
-func (s *session) getLatestVersionCheckMsg() (bool, Message) {
-	slice := s.manager.GetOpsReceiveVersion()
-	if slice != nil {
-		latestMeta := s.nodePool.getLatestNetMetaCopy()
-		versionCheckMsgContent := VersionCheckMsgContent{
-			s.id,
-			latestMeta,
-			slice,
-		}
-		content := versionCheckMsgContent.toJson()
-		return true, newSyncOrCheckMessage(MSG_TYPE_VERSION_CHECK, content)
-	}
-	return false, Message{}
-}
@@ -0,0 +1,72 @@
+package network
+
+import (
+	"../documentmanager"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/satori/go.uuid"
+)
+
+// What a node claims in the NetMeta about the site it edits as is signed with the key of
+// the site, see documentmanager/signature.go, so a node can't pass itself off as another
+// site. Keys and signatures are base64 encoded so that NodeMeta stays comparable
+
+func encodeKey(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// the site id of pubKey in the format of NodeMeta.Site
+func siteOfKey(pubKey ed25519.PublicKey) string {
+	id := documentmanager.SiteIdFromPublicKey(pubKey)
+	u, _ := uuid.FromBytes(id[:])
+	return u.String()
+}
+
+// signs content with key, returns the public key and the signature
+func sign(key ed25519.PrivateKey, content []byte) (string, string) {
+	return encodeKey(key.Public().(ed25519.PublicKey)), encodeKey(ed25519.Sign(key, content))
+}
+
+// verifies that signature is the signature of content by pubKey, returns the site of pubKey
+func verify(pubKey, signature string, content []byte) (string, bool) {
+	key, err := base64.StdEncoding.DecodeString(pubKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return "", false
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(key, content, sig) {
+		return "", false
+	}
+	return siteOfKey(key), true
+}
+
+// kind followed by the length prefixed fields, so that the content of different
+// claims or fields can't be mistaken for each other
+func signedContent(kind string, fields ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(kind)
+	for _, field := range fields {
+		binary.Write(&buf, binary.BigEndian, uint32(len(field)))
+		buf.WriteString(field)
+	}
+	return buf.Bytes()
+}
+
+// sets the site of the node id to the site of key, signed with it together with the
+// profile of the node, so nobody else can attribute the operations of the site to a name
+func (meta *NodeMeta) signSite(id string, key ed25519.PrivateKey) {
+	meta.Site = siteOfKey(key.Public().(ed25519.PublicKey))
+	meta.SiteKey, meta.SiteSignature = sign(key, meta.siteContent(id))
+}
+
+func (meta NodeMeta) siteContent(id string) []byte {
+	return signedContent("site", id, meta.Site, meta.Name, meta.Color, meta.Contact)
+}
+
+// whether the node id proved that it edits as its site, with a valid profile
+func (meta NodeMeta) hasValidSite(id string) bool {
+	site, ok := verify(meta.SiteKey, meta.SiteSignature, meta.siteContent(id))
+	return ok && site == meta.Site && meta.Profile().valid()
+}
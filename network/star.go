@@ -0,0 +1,60 @@
+package network
+
+// Star topology: instead of the full mesh, clients (TopologyStar) only keep a connection
+// to the hub (TopologyHub), which is connected to everyone. The hub is authoritative:
+// operations received from peers are handed to the SequenceHandler, which writes them to
+// the canonical log of the hub, and only the operations it returns are broadcast, by the
+// hub, in the order of that log. Everything else, NetMeta, tags and anti-entropy, works
+// as in the mesh, along the links that exist. Mesh nodes can join a star network, they
+// are linked to the hub and the other mesh nodes
+
+const (
+	TopologyMesh = "mesh"
+	TopologyStar = "star"
+	TopologyHub  = "hub"
+)
+
+// returns whether nodes with topologies a and b keep a connection to each other,
+// an empty topology is a mesh node that didn't announce one
+func linked(a, b string) bool {
+	if a == TopologyStar {
+		return b == TopologyHub
+	}
+	if b == TopologyStar {
+		return a == TopologyHub
+	}
+	return true
+}
+
+func (s *session) linkedTo(id string) bool {
+	return linked(s.manager.config.Topology, s.nodePool.getNodeMeta(id).Topology)
+}
+
+// whether operations from peers go through the SequenceHandler
+func (s *session) sequencesOperations() bool {
+	return s.manager.config.Topology == TopologyHub
+}
+
+// sequences the operations in msg and broadcasts the ones that made it into the canonical log
+func (s *session) handleOperationsAtHub(msg Message) {
+	if msg.Id != "" {
+		s.nodePool.heardOf(broadcastOrigin(msg.Id))
+	}
+	ops, ok := s.manager.SequenceHandler(msg.Msg)
+	if !ok {
+		return
+	}
+	s.nodePool.broadcast(NewBroadcastMessage(s.id, MSG_TYPE_REMOTE_OP, ops))
+	s.noteActivity()
+}
+
+// Topology returns the topology this node was started with
+func (nm *NetworkManager) Topology() string {
+	return nm.config.Topology
+}
+
+// SetSequenceHandler sets the handler of a hub, it's passed the operations received from
+// a peer and returns the ones written to the canonical log, encoded, or false if none were
+func (nm *NetworkManager) SetSequenceHandler(fn func([]byte) ([]byte, bool)) {
+	nm.SequenceHandler = fn
+}
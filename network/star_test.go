@@ -0,0 +1,107 @@
+package network
+
+import (
+	. "../common"
+	"../documentmanager"
+	"../version"
+	"sync"
+	"testing"
+)
+
+// a node of a star network editing a document, the hub sequences the operations of the clients
+type starPeer struct {
+	*memPeer
+	doc     *documentmanager.DocumentModel
+	mutex   sync.Mutex
+	offered int // operations passed to the SequenceHandler of a hub
+}
+
+func newStarPeer(t *testing.T, mn *MemNetwork, addr, topology string, site SiteId) *starPeer {
+	config := memConfig(mn, addr)
+	config.Topology = topology
+	p := &starPeer{memPeer: newMemPeerWithConfig(t, mn, addr, config)}
+	p.doc = documentmanager.NewDocumentModel(site, 80, func() {}, func(op documentmanager.RemoteOperation) {
+		p.nm.Broadcast(NewBroadcastMessage(p.nm.GetCurrentId(), MSG_TYPE_REMOTE_OP, documentmanager.RemoteOperationsToBinary([]documentmanager.RemoteOperation{op})))
+	})
+	p.doc.SetSigningKey(documentmanager.NewSiteKey())
+	p.nm.SetRemoteOpHandler(func(msg []byte) {
+		for _, op := range documentmanager.RemoteOperationsFromSlice(msg) {
+			p.doc.ApplyRemoteOperation(op)
+		}
+	})
+	p.nm.SetGetOpsReceiveVersion(func() []byte {
+		return p.doc.GetVersionVectorReceived().ToBinary()
+	})
+	p.nm.SetSequenceHandler(func(data []byte) ([]byte, bool) {
+		ops := documentmanager.RemoteOperationsFromSlice(data)
+		p.mutex.Lock()
+		p.offered += len(ops)
+		p.mutex.Unlock()
+		sequenced := p.doc.SequenceRemoteOperations(ops)
+		return documentmanager.RemoteOperationsToBinary(sequenced), len(sequenced) > 0
+	})
+	return p
+}
+
+func (p *starPeer) insert(str string) {
+	for i := 0; i < len(str); i++ {
+		p.doc.LocalInsert(str[i])
+	}
+}
+
+func (p *starPeer) text() string {
+	p.doc.RLock()
+	defer p.doc.RUnlock()
+	return p.doc.Buffer.ToString()
+}
+
+func (p *starPeer) offeredOperations() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.offered
+}
+
+func TestViewerOperationsNotForwarded(t *testing.T) {
+	mn := NewMemNetwork()
+	hub := newStarPeer(t, mn, "hub", TopologyHub, SiteId{1})
+	editor := newStarPeer(t, mn, "editor", TopologyStar, SiteId{2})
+	viewer := newStarPeer(t, mn, "viewer", TopologyStar, SiteId{3})
+	for _, p := range []*starPeer{hub, editor, viewer} {
+		defer p.nm.Disconnect()
+		p.doc.DocId = documentmanager.DocIdOfSite(hub.doc.OwnerId)
+	}
+	assertEqual(t, nil, editor.nm.ConnectTo("hub"))
+	assertEqual(t, nil, viewer.nm.ConnectTo("hub"))
+	waitFor(t, "the star", func() bool { return hub.connectedIds() == idsOf(editor.memPeer, viewer.memPeer) })
+	// the clients are only linked to the hub, not to each other
+	assertEqual(t, idsOf(hub.memPeer), editor.connectedIds())
+	assertEqual(t, idsOf(hub.memPeer), viewer.connectedIds())
+
+	assertEqual(t, nil, hub.doc.AssignRole(editor.doc.OwnerId, ROLE_EDITOR))
+	assertEqual(t, nil, hub.doc.AssignRole(viewer.doc.OwnerId, ROLE_VIEWER))
+	waitFor(t, "the roles at the clients", func() bool {
+		return !editor.doc.IsReadOnly() && viewer.doc.SiteRole(viewer.doc.OwnerId) == ROLE_VIEWER
+	})
+	// the edit of the viewer is refused at the source, nothing reaches the hub
+	viewer.insert("v")
+	assertEqual(t, uint32(0), viewer.doc.OpVersion)
+	assertEqual(t, "", viewer.text())
+	editor.insert("e")
+	for _, p := range []*starPeer{hub, editor, viewer} {
+		waitFor(t, "the edit of the editor at "+p.addr, func() bool { return p.text() == "e" })
+	}
+	assertEqual(t, 1, hub.offeredOperations())
+
+	// an edit racing the demotion of the editor was made while it could edit, all of them keep it
+	editor.insert("x")
+	assertEqual(t, nil, hub.doc.AssignRole(editor.doc.OwnerId, ROLE_VIEWER))
+	waitFor(t, "the replicas to converge", func() bool {
+		vector := hub.doc.GetVersionVectorReceived()
+		for _, p := range []*starPeer{hub, editor, viewer} {
+			if p.text() != "ex" || p.doc.GetVersionVectorReceived().Compare(vector) != version.EQUAL {
+				return false
+			}
+		}
+		return editor.doc.IsReadOnly()
+	})
+}
@@ -0,0 +1,265 @@
+package network
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// TLSOptions describes how peer connections are encrypted and how peers are authenticated.
+// Every peer presents a certificate and is accepted if it's signed by the CA or if its
+// fingerprint is pinned in the trust file
+type TLSOptions struct {
+	CertFile  string // a self-signed certificate is generated if CertFile and KeyFile don't exist
+	KeyFile   string
+	CAFile    string // PEM encoded certificates of trusted CAs
+	TrustFile string // one SHA-256 fingerprint of a trusted certificate per line, # starts a comment
+}
+
+var (
+	ErrNoTrustAnchor  = errors.New("tls: a CA file or a trust file is required to authenticate peers")
+	ErrNoCertificate  = errors.New("tls: peer did not present a certificate")
+	ErrUntrustedPeer  = errors.New("tls: peer certificate is neither signed by the CA nor pinned in the trust file")
+	ErrInvalidCAFile  = errors.New("tls: no certificates found in the CA file")
+	ErrMissingKeyFile = errors.New("tls: both a certificate and a key file are required")
+	ErrInvalidTrust   = errors.New("tls: the trust file contains something other than a SHA-256 fingerprint")
+)
+
+// dial opens a connection to addr, encrypted if the manager is configured with TLS.
+// Relayed addresses are dialed through their relay
+func (nm *NetworkManager) dial(addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if IsRelayedAddr(addr) {
+		conn, err = dialRelay(nm.config.Transport, addr)
+	} else {
+		conn, err = nm.config.Transport.Dial(addr, 0)
+	}
+	if err != nil || nm.config.TLS == nil {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, nm.config.TLS)
+	err = handshakeTLS(tlsConn, nm.config.UnreachableTimeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// handshakeTLS completes the handshake of conn, giving up after timeout so that a
+// peer that never finishes it doesn't hold on to the connection
+func handshakeTLS(conn *tls.Conn, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	err := conn.Handshake()
+	conn.SetDeadline(time.Time{})
+	return err
+}
+
+// listen accepts connections on the local address, or through the relay if the manager
+// uses one, encrypted if the manager is configured with TLS
+func (nm *NetworkManager) listen() (net.Listener, error) {
+	var listener net.Listener
+	var err error
+	if IsRelayedAddr(nm.publicAddr) {
+		listener, err = newRelayListener(nm.config.Transport, nm.publicAddr)
+	} else {
+		listener, err = nm.config.Transport.Listen(nm.localAddr)
+	}
+	if err != nil || nm.config.TLS == nil {
+		return listener, err
+	}
+	return tls.NewListener(listener, nm.config.TLS), nil
+}
+
+// TLSFingerprint returns the fingerprint of the certificate presented to peers,
+// or an empty string when TLS is disabled
+func (nm *NetworkManager) TLSFingerprint() string {
+	if nm.config.TLS == nil || len(nm.config.TLS.Certificates) == 0 {
+		return ""
+	}
+	return Fingerprint(nm.config.TLS.Certificates[0].Certificate[0])
+}
+
+// NewTLSConfig returns the configuration used for both accepting and dialing connections
+func NewTLSConfig(options TLSOptions) (*tls.Config, error) {
+	if options.CertFile == "" || options.KeyFile == "" {
+		return nil, ErrMissingKeyFile
+	}
+	if options.CAFile == "" && options.TrustFile == "" {
+		return nil, ErrNoTrustAnchor
+	}
+	if !fileExists(options.CertFile) && !fileExists(options.KeyFile) {
+		err := generateSelfSignedCert(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	var roots *x509.CertPool
+	if options.CAFile != "" {
+		pemCerts, err := ioutil.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pemCerts) {
+			return nil, ErrInvalidCAFile
+		}
+	}
+	pinned := make(map[string]bool)
+	if options.TrustFile != "" {
+		pinned, err = readTrustFile(options.TrustFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		// peers are addressed by ip and port, which certificates usually don't
+		// contain, so the standard verification is replaced by verifyPeer
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPeer(rawCerts, roots, pinned)
+		},
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+func verifyPeer(rawCerts [][]byte, roots *x509.CertPool, pinned map[string]bool) error {
+	if len(rawCerts) == 0 {
+		return ErrNoCertificate
+	}
+	if pinned[Fingerprint(rawCerts[0])] {
+		return nil
+	}
+	if roots != nil {
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err == nil {
+			return nil
+		}
+	}
+	return ErrUntrustedPeer
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a DER encoded certificate
+// in the form AB:CD:...
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hexSum := strings.ToUpper(hex.EncodeToString(sum[:]))
+	parts := make([]string, 0, len(sum))
+	for i := 0; i < len(hexSum); i += 2 {
+		parts = append(parts, hexSum[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
+
+// fingerprints may be written with or without colons and in any case
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.ToUpper(strings.Replace(strings.TrimSpace(fingerprint), ":", "", -1))
+	parts := make([]string, 0, len(fingerprint)/2)
+	for i := 0; i+1 < len(fingerprint); i += 2 {
+		parts = append(parts, fingerprint[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
+
+func isFingerprint(fingerprint string) bool {
+	sum, err := hex.DecodeString(strings.Replace(strings.TrimSpace(fingerprint), ":", "", -1))
+	return err == nil && len(sum) == sha256.Size
+}
+
+func readTrustFile(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	pinned := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if !isFingerprint(line) {
+			return nil, ErrInvalidTrust
+		}
+		pinned[normalizeFingerprint(line)] = true
+	}
+	return pinned, scanner.Err()
+}
+
+func generateSelfSignedCert(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "collaborative editor peer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(5 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,132 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a certificate for CommonName signed by parent, self-signed if parent is nil
+func newTestCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestFingerprint(t *testing.T) {
+	der := []byte("certificate")
+	sum := sha256.Sum256(der)
+	fingerprint := Fingerprint(der)
+	assertEqual(t, 32*3-1, len(fingerprint))
+	assertEqual(t, strings.ToUpper(hex.EncodeToString(sum[:])), strings.Replace(fingerprint, ":", "", -1))
+	// written without colons, in lower case or with spaces around it
+	assertEqual(t, fingerprint, normalizeFingerprint(hex.EncodeToString(sum[:])))
+	assertEqual(t, fingerprint, normalizeFingerprint("  "+strings.ToLower(fingerprint)+"\t"))
+}
+
+func TestReadTrustFile(t *testing.T) {
+	// the tests run in a temporary directory, see TestMain
+	a, b := Fingerprint([]byte("a")), Fingerprint([]byte("b"))
+	path := "trust_test"
+	ioutil.WriteFile(path, []byte("# peers\n"+a+" # alice\n\n"+strings.ToLower(strings.Replace(b, ":", "", -1))+"\n"), 0600)
+	pinned, err := readTrustFile(path)
+	assertEqual(t, nil, err)
+	assertEqual(t, map[string]bool{a: true, b: true}, pinned)
+
+	for _, malformed := range []string{"alice\n", a[:len(a)-3] + "\n", a + ":AB\n", strings.Replace(a, "A", "G", 1) + "0\n"} {
+		ioutil.WriteFile(path, []byte(malformed), 0600)
+		_, err = readTrustFile(path)
+		assertEqual(t, ErrInvalidTrust, err)
+	}
+	_, err = readTrustFile("missing")
+	assertEqual(t, true, err != nil)
+}
+
+func TestVerifyPeer(t *testing.T) {
+	ca, caKey := newTestCert(t, "ca", nil, nil)
+	signed, _ := newTestCert(t, "signed", ca, caKey)
+	self, _ := newTestCert(t, "self", nil, nil)
+	other, _ := newTestCert(t, "other", nil, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	pinned := map[string]bool{Fingerprint(self.Raw): true}
+
+	assertEqual(t, ErrNoCertificate, verifyPeer(nil, roots, pinned))
+	// pinned
+	assertEqual(t, nil, verifyPeer([][]byte{self.Raw}, nil, pinned))
+	assertEqual(t, ErrUntrustedPeer, verifyPeer([][]byte{other.Raw}, nil, pinned))
+	// signed by the CA
+	assertEqual(t, nil, verifyPeer([][]byte{signed.Raw}, roots, nil))
+	assertEqual(t, ErrUntrustedPeer, verifyPeer([][]byte{signed.Raw}, nil, pinned))
+	// self-signed and not pinned
+	assertEqual(t, ErrUntrustedPeer, verifyPeer([][]byte{other.Raw}, roots, pinned))
+	assertEqual(t, true, verifyPeer([][]byte{[]byte("garbage")}, roots, nil) != nil)
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	ioutil.WriteFile("trust_empty", nil, 0600)
+	tlsConfig, err := NewTLSConfig(TLSOptions{CertFile: "tls_test.crt", KeyFile: "tls_test.key", TrustFile: "trust_empty"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mn := NewMemNetwork()
+	config := memConfig(mn, "a")
+	config.TLS = tlsConfig
+	newMemPeerWithConfig(t, mn, "a", config)
+
+	// a peer that never starts the handshake is disconnected
+	conn, err := mn.Transport("b").Dial("a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan error)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		closed <- err
+	}()
+	select {
+	case err := <-closed:
+		assertEqual(t, true, err != nil)
+	case <-time.After(5 * config.UnreachableTimeout):
+		t.Fatal("the connection wasn't closed")
+	}
+
+	// nor is a peer that isn't trusted, not even itself
+	conn, err = mn.Transport("b").Dial("a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, true, tls.Client(conn, tlsConfig).Handshake() != nil)
+}
@@ -0,0 +1,28 @@
+package network
+
+import (
+	"net"
+	"time"
+)
+
+// Transport opens the connections between peers and to relays. TCPTransport is used
+// unless Config.Transport is set, tests use the in-memory transports of a MemNetwork
+type Transport interface {
+	// Dial connects to addr, giving up after timeout unless it's 0
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+	// Listen accepts the connections dialed to addr
+	Listen(addr string) (net.Listener, error)
+}
+
+type tcpTransport struct{}
+
+// TCPTransport connects peers over TCP
+var TCPTransport Transport = tcpTransport{}
+
+func (tcpTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
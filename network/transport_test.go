@@ -0,0 +1,254 @@
+package network
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func assertEqual(t *testing.T, exp, got interface{}) {
+	if !reflect.DeepEqual(exp, got) {
+		debug.PrintStack()
+		t.Fatalf("Expecting '%v' got '%v'\n", exp, got)
+	}
+}
+
+// the govec logs of the managers go to a temporary directory
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "network_test")
+	if err != nil {
+		panic(err)
+	}
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	code := m.Run()
+	os.Chdir(wd)
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+type memPeer struct {
+	nm       *NetworkManager
+	addr     string
+	mutex    sync.Mutex
+	received []string
+}
+
+// fast timeouts for the peers of the tests
+func memConfig(mn *MemNetwork, addr string) Config {
+	return Config{
+		Transport:          mn.Transport(addr),
+		HeartbeatInterval:  50 * time.Millisecond,
+		SuspectTimeout:     200 * time.Millisecond,
+		UnreachableTimeout: 500 * time.Millisecond,
+		ReconnectMinDelay:  50 * time.Millisecond,
+		ReconnectMaxDelay:  200 * time.Millisecond,
+	}
+}
+
+func newMemPeer(t *testing.T, mn *MemNetwork, addr string) *memPeer {
+	return newMemPeerWithConfig(t, mn, addr, memConfig(mn, addr))
+}
+
+func newMemPeerWithConfig(t *testing.T, mn *MemNetwork, addr string, config Config) *memPeer {
+	nm, err := NewNetworkManager(addr, addr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &memPeer{nm: nm, addr: addr}
+	nm.SetTagHandler(func(msg []byte) {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.received = append(p.received, string(msg))
+	})
+	return p
+}
+
+func (p *memPeer) broadcast(payload string) {
+	p.nm.Broadcast(NewBroadcastMessage(p.nm.GetCurrentId(), MSG_TYPE_TAG, []byte(payload)))
+}
+
+func (p *memPeer) receivedPayloads() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	received := append([]string(nil), p.received...)
+	sort.Strings(received)
+	return strings.Join(received, ",")
+}
+
+// ids of the peers p has a connection to
+func (p *memPeer) connectedIds() string {
+	ids := make([]string, 0)
+	for id, status := range p.nm.GetPeerStatus() {
+		if status.State == "connected" {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func idsOf(peers ...*memPeer) string {
+	ids := make([]string, 0)
+	for _, p := range peers {
+		ids = append(ids, p.nm.GetCurrentId())
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	waitForWithin(t, what, 5*time.Second, condition)
+}
+
+func waitForWithin(t *testing.T, what string, timeout time.Duration, condition func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMemTransport(t *testing.T) {
+	mn := NewMemNetwork()
+	transport := mn.Transport("a")
+	_, err := transport.Dial("b", 0)
+	assertEqual(t, ErrConnectionRefused, err)
+	l, err := mn.Transport("b").Listen("b")
+	assertEqual(t, nil, err)
+	_, err = transport.Listen("b")
+	assertEqual(t, ErrAddrInUse, err)
+
+	accepted := make(chan []byte)
+	go func() {
+		conn, _ := l.Accept()
+		buf := make([]byte, 5)
+		n, _ := conn.Read(buf)
+		accepted <- buf[:n]
+		conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		_, err := conn.Read(buf)
+		accepted <- []byte(err.Error())
+	}()
+	conn, err := transport.Dial("b", time.Second)
+	assertEqual(t, nil, err)
+	assertEqual(t, "b", conn.RemoteAddr().String())
+	conn.Write([]byte("hello"))
+	assertEqual(t, "hello", string(<-accepted))
+	assertEqual(t, "memnet: i/o timeout", string(<-accepted))
+
+	mn.Partition("a", "b")
+	_, err = conn.Write([]byte("x"))
+	assertEqual(t, true, err != nil)
+	_, err = transport.Dial("b", 0)
+	assertEqual(t, ErrConnectionRefused, err)
+	mn.Heal("a", "b")
+	l.Close()
+	_, err = transport.Dial("b", 0)
+	assertEqual(t, ErrConnectionRefused, err)
+}
+
+func TestMemConnectTo(t *testing.T) {
+	mn := NewMemNetwork()
+	a, b, c := newMemPeer(t, mn, "a"), newMemPeer(t, mn, "b"), newMemPeer(t, mn, "c")
+	assertEqual(t, nil, b.nm.ConnectTo("a"))
+	assertEqual(t, nil, c.nm.ConnectTo("b"))
+	// c learns about a from b and connects to it as well
+	waitFor(t, "a full mesh", func() bool {
+		return a.connectedIds() == idsOf(b, c) && b.connectedIds() == idsOf(a, c) && c.connectedIds() == idsOf(a, b)
+	})
+	a.broadcast("1")
+	c.broadcast("2")
+	waitFor(t, "the broadcasts", func() bool {
+		return a.receivedPayloads() == "2" && b.receivedPayloads() == "1,2" && c.receivedPayloads() == "1"
+	})
+	assertEqual(t, ErrConnectionRefused, c.nm.ConnectTo("d"))
+}
+
+func TestMemDisconnectReconnect(t *testing.T) {
+	mn := NewMemNetwork()
+	a, b := newMemPeer(t, mn, "a"), newMemPeer(t, mn, "b")
+	assertEqual(t, nil, b.nm.ConnectTo("a"))
+	waitFor(t, "the connection", func() bool {
+		return a.connectedIds() == idsOf(b)
+	})
+
+	oldId := b.nm.GetCurrentId()
+	assertEqual(t, nil, b.nm.Disconnect())
+	assertEqual(t, ErrAlreadyDisconnected, b.nm.Disconnect())
+	waitFor(t, "b to leave", func() bool {
+		return a.connectedIds() == ""
+	})
+	assertEqual(t, true, a.nm.GetNetworkMetadata()[oldId].Left)
+
+	// b resumes its session under a newer incarnation and finds a again
+	assertEqual(t, nil, b.nm.Reconnect())
+	assertEqual(t, ErrAlreadyConnected, b.nm.Reconnect())
+	assertEqual(t, oldId, b.nm.GetCurrentId())
+	waitFor(t, "b to rejoin", func() bool {
+		return a.connectedIds() == idsOf(b) && b.connectedIds() == idsOf(a)
+	})
+	waitFor(t, "b to be back", func() bool {
+		return !a.nm.GetNetworkMetadata()[oldId].Left
+	})
+	assertEqual(t, 2, len(a.nm.GetNetworkMetadata()))
+	b.broadcast("back")
+	waitFor(t, "the broadcast", func() bool {
+		return a.receivedPayloads() == "back"
+	})
+
+	// the quit of b is lost in a partition, a still expects the next message of the old link
+	for i := 0; i < 30; i++ {
+		b.broadcast("x")
+	}
+	waitFor(t, "the broadcasts", func() bool {
+		return len(a.receivedPayloads()) == len("back")+30*len(",x")
+	})
+	mn.Partition("a", "b")
+	assertEqual(t, nil, b.nm.Disconnect())
+	mn.Heal("a", "b")
+	assertEqual(t, nil, b.nm.Reconnect())
+	waitFor(t, "b to rejoin", func() bool {
+		return a.connectedIds() == idsOf(b) && b.connectedIds() == idsOf(a)
+	})
+	b.broadcast("y")
+	waitFor(t, "the broadcast of the resumed session", func() bool {
+		return strings.HasSuffix(a.receivedPayloads(), ",y")
+	})
+}
+
+func TestMemPartition(t *testing.T) {
+	mn := NewMemNetwork()
+	a, b, c := newMemPeer(t, mn, "a"), newMemPeer(t, mn, "b"), newMemPeer(t, mn, "c")
+	assertEqual(t, nil, b.nm.ConnectTo("a"))
+	assertEqual(t, nil, c.nm.ConnectTo("a"))
+	waitFor(t, "a full mesh", func() bool {
+		return a.connectedIds() == idsOf(b, c) && b.connectedIds() == idsOf(a, c)
+	})
+
+	mn.Partition("a", "b")
+	waitFor(t, "the partition to be noticed", func() bool {
+		return a.connectedIds() == idsOf(c) && b.connectedIds() == idsOf(c)
+	})
+	// c still forwards between the two sides
+	a.broadcast("1")
+	waitFor(t, "the broadcast", func() bool {
+		return b.receivedPayloads() == "1"
+	})
+
+	mn.Heal("a", "b")
+	waitFor(t, "a and b to reconnect", func() bool {
+		return a.connectedIds() == idsOf(b, c) && b.connectedIds() == idsOf(a, c)
+	})
+	mn.Cut("c")
+	waitFor(t, "c to reconnect", func() bool {
+		return c.connectedIds() == idsOf(a, b)
+	})
+}
@@ -160,15 +160,6 @@ func nextNonEmptyAtom(i int, atoms []Atom) int {
 	return i
 }
 
-func nextNonEmptyOrUninitializedAtom(i int, atoms []Atom) int {
-	for i = i + 1; i < len(atoms); i++ {
-		if atoms[i].Size != 0 || atoms[i].State == UNINITIALIZED {
-			return i
-		}
-	}
-	return i
-}
-
 func findNodePos(pos int, acc int, nodes []*DocNode) (int, *DocNode) {
 	i, node := nextNonEmptyNode(-1, nodes)
 	for i < len(nodes) {
@@ -194,28 +185,27 @@ func findAtomPos(pos int, acc int, atoms []Atom) (int, int) {
 }
 
 // finds the next node to keep traverse down the tree to find pos, OR find the node and atom
-// where we can immediately insert atom if possible
+// where we can immediately insert atom if possible. An uninitialized atom of our own node can
+// take the insert if it's right at pos, i.e. before the atom containing pos. Taking a later one,
+// as was done before, put the insert after a node of another site in between. This only
+// decides which operation a local insert becomes, every replica applies an operation as it is,
+// so replicas still placing inserts the old way converge with this one, only their own inserts
+// may land right of where they were typed
 func findAtomForInsertHelper(pos int, acc int, nodeId NodeId, node *DocNode, atoms []Atom) (byte, int, int) {
-	i := nextNonEmptyAtom(-1, atoms)
 	potentialInsert := EqualSiteIdInNodeId(nodeId, node.NodeId)
-	for i < len(atoms) {
-		if potentialInsert && acc == pos {
-			if canDoInsert(node, i, nodeId) {
+	for i := 0; i < len(atoms); i++ {
+		if atoms[i].Size == 0 {
+			if potentialInsert && acc == pos && canDoInsert(node, i, nodeId) {
 				return INSERT, acc, i
-			} else {
-				k := nextNonEmptyOrUninitializedAtom(i, atoms)
-				if k < len(atoms) && canDoInsert(node, k, nodeId) {
-					return INSERT, acc, k
-				}
 			}
+			continue
 		}
 		if acc+atoms[i].Size > pos {
 			return NO_OPERATION, acc, i
 		}
 		acc += atoms[i].Size
-		i = nextNonEmptyAtom(i, atoms)
 	}
-	return NO_OPERATION, acc, i
+	return NO_OPERATION, acc, len(atoms)
 }
 
 // traverse the tree until it finds a place to insert (either a new node or reuse an applicable node)
@@ -306,3 +296,38 @@ func DeletePos(doc *Document, pos int) Operation {
 	doc.Delete(op)
 	return op
 }
+
+// AtomPosition returns the position of an atom in the document. For a deleted atom it is the
+// position the atom would be at if it was still alive. ok is false if the atom doesn't exist
+func (doc *Document) AtomPosition(id NodeId, n uint16) (pos int, ok bool) {
+	node, exists := doc.Nodes[id]
+	if !exists || int(n) >= len(node.Atoms) || node.Atoms[n].State == UNINITIALIZED {
+		return 0, false
+	}
+	atom := node.Atoms[n]
+	leftSize := atom.Size
+	if atom.State == ALIVE {
+		leftSize--
+	}
+	return calcPosHelper(doc, node, int(n)) + leftSize, true
+}
+
+// AtomBefore returns the alive atom right before pos, which a position can be anchored to so
+// that it stays after the same character while the document changes. ok is false at the start
+func (doc *Document) AtomBefore(pos int) (id NodeId, n uint16, ok bool) {
+	if pos <= 0 || pos > doc.Size {
+		return id, 0, false
+	}
+	node, i := posToIdForDel(doc.Doc, pos-1)
+	return node.NodeId, uint16(i), true
+}
+
+// PositionAfter returns the position right after an atom, for a deleted atom it is where the atom
+// would be. ok is false if the atom doesn't exist
+func (doc *Document) PositionAfter(id NodeId, n uint16) (pos int, ok bool) {
+	node, exists := doc.Nodes[id]
+	if !exists || int(n) >= len(node.Atoms) || node.Atoms[n].State == UNINITIALIZED {
+		return 0, false
+	}
+	return calcPosHelper(doc, node, int(n)) + node.Atoms[n].Size, true
+}
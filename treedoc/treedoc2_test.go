@@ -390,3 +390,85 @@ func TestInsertPosOpReturn(t *testing.T) {
 //	assertEqual(t, MAX_ATOMS_PER_NODE+1, d.Size)
 //	assertEqual(t, 1, DocHeight(d))
 //}
+
+func TestAtomPosition(t *testing.T) {
+	d := NewTestDoc()
+	assertEqual(t, "cfadeghb", DocToString(d))
+	pos, ok := d.AtomPosition(A_ID0, 0)
+	assertEqual(t, true, ok)
+	assertEqual(t, 2, pos)
+	pos, _ = d.AtomPosition(D_ID0, 0)
+	assertEqual(t, 4, pos)
+	pos, _ = d.AtomPosition(B_ID0, 0)
+	assertEqual(t, 7, pos)
+
+	d.ApplyOperation(Operation{Type: DELETE, Id: D_ID0, N: 0})
+	assertEqual(t, "cfadghb", DocToString(d))
+	pos, ok = d.AtomPosition(D_ID0, 0)
+	assertEqual(t, true, ok)
+	assertEqual(t, 4, pos)
+
+	_, ok = d.AtomPosition(B_ID1, 0)
+	assertEqual(t, false, ok)
+}
+
+// a node of another site left of an uninitialized atom of our own node, the insert
+// in front of the node must not reuse that atom
+func TestInsertPosBeforeForeignNode(t *testing.T) {
+	d := newForeignNodeDoc()
+	assertEqual(t, "ip", DocToString(d))
+	op := InsertPos(d, B_ID1, 0, 'a')
+	assertEqual(t, "aip", DocToString(d))
+	assertEqual(t, Operation{Type: INSERT_NEW, Atom: 'a', ParentId: B_ID1, ParentN: 0, Id: B_ID1, N: 0}, op)
+}
+
+// "ip" with a deleted node of site a between p and the next uninitialized atom of p's node
+func newForeignNodeDoc() *Document {
+	d := NewDocument()
+	InsertPos(d, B_ID0, 0, 'p')
+	InsertPos(d, B_ID1, 0, 'i')
+	d.ApplyOperation(Operation{Type: INSERT_NEW, Atom: 'b', ParentId: B_ID0, ParentN: 1, Id: A_ID0, N: 0})
+	d.ApplyOperation(Operation{Type: DELETE, Id: A_ID0, N: 0})
+	return d
+}
+
+// the placement only decides which operation a local insert becomes, replicas apply the
+// operations as they are, so an insert placed as before the fix converges with one placed now
+func TestInsertPlacementConverges(t *testing.T) {
+	// at 0, placed on the later own atom as before, which put it after p
+	before := Operation{Type: INSERT, Atom: 'a', Id: B_ID0, N: 1}
+	// at 0 by another site, placed as now
+	now := Operation{Type: INSERT_NEW, Atom: 'x', ParentId: B_ID1, ParentN: 0, Id: C_ID0, N: 0}
+	d1, d2 := newForeignNodeDoc(), newForeignNodeDoc()
+	d1.ApplyOperation(before)
+	d1.ApplyOperation(now)
+	d2.ApplyOperation(now)
+	d2.ApplyOperation(before)
+	assertEqual(t, "xipa", DocToString(d1))
+	assertEqual(t, DocToString(d1), DocToString(d2))
+}
+
+func TestAtomBefore(t *testing.T) {
+	d := NewTestDoc()
+	_, _, ok := d.AtomBefore(0)
+	assertEqual(t, false, ok)
+	for pos := 1; pos <= d.Size; pos++ {
+		id, n, ok := d.AtomBefore(pos)
+		assertEqual(t, true, ok)
+		after, _ := d.PositionAfter(id, n)
+		assertEqual(t, pos, after)
+	}
+
+	// an anchor stays after its character when text is inserted before it
+	id, n, _ := d.AtomBefore(5)
+	assertEqual(t, "cfade", DocToString(d)[:5])
+	InsertPos(d, B_ID1, 0, 'x')
+	pos, _ := d.PositionAfter(id, n)
+	assertEqual(t, 6, pos)
+
+	// and stays where its character was once deleted
+	d.ApplyOperation(Operation{Type: DELETE, Id: id, N: n})
+	assertEqual(t, "xcfadghb", DocToString(d))
+	pos, _ = d.PositionAfter(id, n)
+	assertEqual(t, 5, pos)
+}
@@ -0,0 +1,66 @@
+package version
+
+import (
+	. "../common"
+	"encoding/binary"
+	"errors"
+)
+
+var ErrMalformedBinary = errors.New("version: malformed binary vector")
+
+// binary format: number of entries followed by each 16 byte site id, in order, and its version, all as uvarints
+
+func (vector VersionVector) AppendBinary(buf []byte) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(vector)))
+	buf = append(buf, tmp[:n]...)
+	// sorted so equal vectors encode to the same bytes
+	for _, k := range vector.sortedSites() {
+		buf = append(buf, k[:]...)
+		n = binary.PutUvarint(tmp[:], uint64(vector[k]))
+		buf = append(buf, tmp[:n]...)
+	}
+	return buf
+}
+
+// ReadBinary reads a vector written by AppendBinary and returns the number of bytes read
+func ReadBinary(data []byte) (VersionVector, int, error) {
+	count, i := binary.Uvarint(data)
+	if i <= 0 {
+		return nil, 0, ErrMalformedBinary
+	}
+	vector := NewVector()
+	for ; count > 0; count-- {
+		if len(data) < i+16 {
+			return nil, 0, ErrMalformedBinary
+		}
+		var id SiteId
+		copy(id[:], data[i:i+16])
+		i += 16
+		v, n := binary.Uvarint(data[i:])
+		if n <= 0 {
+			return nil, 0, ErrMalformedBinary
+		}
+		i += n
+		vector[id] = uint32(v)
+	}
+	return vector, i, nil
+}
+
+func (vector VersionVector) ToBinary() []byte {
+	return vector.AppendBinary([]byte{BINARY_PAYLOAD_MAGIC})
+}
+
+// FromSlice decodes a vector in either json or binary format
+func FromSlice(data []byte) (VersionVector, error) {
+	if len(data) > 0 && data[0] == BINARY_PAYLOAD_MAGIC {
+		vector, _, err := ReadBinary(data[1:])
+		return vector, err
+	}
+	err, vector := UnmarshalJSON(data)
+	return vector, err
+}
+
+func IsBinary(data []byte) bool {
+	return len(data) > 0 && data[0] == BINARY_PAYLOAD_MAGIC
+}
@@ -0,0 +1,113 @@
+package version
+
+import (
+	. "../common"
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+)
+
+// Range is the operations of Site with versions in (From, To]
+type Range struct {
+	Site SiteId
+	From uint32
+	To   uint32
+}
+
+// MissingRanges returns the ranges of operations counted in other but not in vector
+func (vector VersionVector) MissingRanges(other VersionVector) []Range {
+	ranges := make([]Range, 0)
+	for _, id := range other.sortedSites() {
+		if other[id] > vector[id] {
+			ranges = append(ranges, Range{id, vector[id], other[id]})
+		}
+	}
+	return ranges
+}
+
+// ContainsOperation returns whether the operation with version of site is in one of the ranges
+func ContainsOperation(ranges []Range, site SiteId, version uint32) bool {
+	for _, r := range ranges {
+		if r.Site == site && r.From < version && version <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+// Hash returns a digest of the vector that is equal on every site with the same vector
+func (vector VersionVector) Hash() uint64 {
+	h := fnv.New64a()
+	var tmp [binary.MaxVarintLen64]byte
+	for _, id := range vector.sortedSites() {
+		if vector[id] == 0 {
+			continue
+		}
+		h.Write(id[:])
+		n := binary.PutUvarint(tmp[:], uint64(vector[id]))
+		h.Write(tmp[:n])
+	}
+	return h.Sum64()
+}
+
+func (vector VersionVector) sortedSites() []SiteId {
+	ids := make([]SiteId, 0, len(vector))
+	for id := range vector {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+	return ids
+}
+
+// binary format: number of ranges followed by each 16 byte site id, From and To, all as uvarints
+
+func RangesToBinary(ranges []Range) []byte {
+	buf := []byte{BINARY_PAYLOAD_MAGIC}
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(ranges)))
+	buf = append(buf, tmp[:n]...)
+	for _, r := range ranges {
+		buf = append(buf, r.Site[:]...)
+		n = binary.PutUvarint(tmp[:], uint64(r.From))
+		buf = append(buf, tmp[:n]...)
+		n = binary.PutUvarint(tmp[:], uint64(r.To))
+		buf = append(buf, tmp[:n]...)
+	}
+	return buf
+}
+
+func RangesFromSlice(data []byte) ([]Range, error) {
+	if !IsBinary(data) {
+		return nil, ErrMalformedBinary
+	}
+	count, i := binary.Uvarint(data[1:])
+	if i <= 0 {
+		return nil, ErrMalformedBinary
+	}
+	i++
+	ranges := make([]Range, 0)
+	for ; count > 0; count-- {
+		if len(data) < i+16 {
+			return nil, ErrMalformedBinary
+		}
+		var r Range
+		copy(r.Site[:], data[i:i+16])
+		i += 16
+		from, n := binary.Uvarint(data[i:])
+		if n <= 0 {
+			return nil, ErrMalformedBinary
+		}
+		i += n
+		to, n := binary.Uvarint(data[i:])
+		if n <= 0 {
+			return nil, ErrMalformedBinary
+		}
+		i += n
+		r.From, r.To = uint32(from), uint32(to)
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
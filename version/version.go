@@ -2,6 +2,7 @@ package version
 
 import (
 	. "../common"
+	"encoding/hex"
 	"encoding/json"
 	"github.com/satori/go.uuid"
 )
@@ -97,12 +98,13 @@ func (vector VersionVector) DecrementTo(id SiteId, i uint32) {
 	}
 }
 
+// site ids are written in hex, as raw bytes they aren't valid json strings
 type VersionVectorJson map[string]uint32
 
 func (version VersionVector) ToJsonable() VersionVectorJson {
 	newVector := make(VersionVectorJson)
 	for k, v := range version {
-		newVector[k.ToString()] = v
+		newVector[hex.EncodeToString(k[:])] = v
 	}
 	return newVector
 }
@@ -110,11 +112,21 @@ func (version VersionVector) ToJsonable() VersionVectorJson {
 func FromVersionVectorJson(json VersionVectorJson) VersionVector {
 	newVector := make(VersionVector)
 	for k, v := range json {
-		newVector[StringToSiteId(k)] = v
+		newVector[siteIdFromJsonKey(k)] = v
 	}
 	return newVector
 }
 
+// older recovery files have the raw site id
+func siteIdFromJsonKey(key string) SiteId {
+	var id SiteId
+	if b, err := hex.DecodeString(key); err == nil && len(b) == len(id) {
+		copy(id[:], b)
+		return id
+	}
+	return StringToSiteId(key)
+}
+
 func (version VersionVector) MarshalJSON() []byte {
 	newVector := version.ToJsonable()
 	b, _ := json.Marshal(newVector)
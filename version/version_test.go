@@ -113,3 +113,79 @@ func TestCompare(t *testing.T) {
 	assertEqual(t, CONFLICT, v1.Compare(v2))
 	assertEqual(t, CONFLICT, v2.Compare(v1))
 }
+
+func TestBinary(t *testing.T) {
+	v := NewVector()
+	v.IncrementTo(A_ID, 5)
+	v.IncrementTo(B_ID, 300)
+	v.IncrementTo(C_ID, 1)
+	b := v.ToBinary()
+	assertEqual(t, true, IsBinary(b))
+	assertEqual(t, 1+1+3*16+1+2+1, len(b))
+	decoded, err := FromSlice(b)
+	assertEqual(t, nil, err)
+	assertEqual(t, v, decoded)
+	for i := 0; i < 10; i++ {
+		assertEqual(t, string(b), string(decoded.ToBinary()))
+	}
+
+	decoded, err = FromSlice(v.MarshalJSON())
+	assertEqual(t, nil, err)
+	assertEqual(t, v, decoded)
+
+	_, err = FromSlice(b[:10])
+	assertEqual(t, ErrMalformedBinary, err)
+}
+
+func TestJsonKeys(t *testing.T) {
+	// site ids that aren't utf-8 survive json
+	var id SiteId
+	id[0] = 0xff
+	v := NewVector()
+	v.IncrementTo(id, 2)
+	decoded, err := FromSlice(v.MarshalJSON())
+	assertEqual(t, nil, err)
+	assertEqual(t, v, decoded)
+
+	// older files keyed by the raw site id
+	legacy := FromVersionVectorJson(VersionVectorJson{"aaaaaaaaaaaaaaaa": 3})
+	assertEqual(t, uint32(3), legacy.Get(A_ID))
+}
+
+func TestMissingRanges(t *testing.T) {
+	v1 := NewVector()
+	v1.IncrementTo(A_ID, 5)
+	v1.IncrementTo(B_ID, 2)
+	v2 := NewVector()
+	v2.IncrementTo(A_ID, 3)
+	v2.IncrementTo(B_ID, 4)
+	v2.IncrementTo(C_ID, 1)
+
+	assertEqual(t, []Range{{B_ID, 2, 4}, {C_ID, 0, 1}}, v1.MissingRanges(v2))
+	assertEqual(t, []Range{{A_ID, 3, 5}}, v2.MissingRanges(v1))
+	assertEqual(t, []Range{}, v1.MissingRanges(v1.Copy()))
+	assertEqual(t, true, ContainsOperation(v1.MissingRanges(v2), B_ID, 3))
+	assertEqual(t, false, ContainsOperation(v1.MissingRanges(v2), B_ID, 2))
+}
+
+func TestRangesBinary(t *testing.T) {
+	ranges := []Range{{A_ID, 3, 5}, {C_ID, 0, 300}}
+	decoded, err := RangesFromSlice(RangesToBinary(ranges))
+	assertEqual(t, nil, err)
+	assertEqual(t, ranges, decoded)
+	_, err = RangesFromSlice(RangesToBinary(ranges)[:20])
+	assertEqual(t, ErrMalformedBinary, err)
+}
+
+func TestHash(t *testing.T) {
+	v1 := NewVector()
+	v1.IncrementTo(A_ID, 5)
+	v1.IncrementTo(B_ID, 2)
+	v2 := NewVector()
+	v2.IncrementTo(B_ID, 2)
+	v2.IncrementTo(A_ID, 5)
+	v2[C_ID] = 0
+	assertEqual(t, v1.Hash(), v2.Hash())
+	v2.Increment(C_ID)
+	assertEqual(t, false, v1.Hash() == v2.Hash())
+}